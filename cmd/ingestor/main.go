@@ -1,47 +1,186 @@
 package main
 
 import (
+	"context"
 	"flag"
-	"fmt"
 	"goriok/pulses/cmd/stubs"
 	"goriok/pulses/internal/app/ingestor"
 	"goriok/pulses/internal/broker/fsbroker"
+	"goriok/pulses/internal/broker/membroker"
+	"goriok/pulses/internal/config"
+	"goriok/pulses/internal/logging"
+	"goriok/pulses/internal/tracing"
 	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
 )
 
 func main() {
-	var cfg ingestor.Config
+	printConfig := flag.Bool("print-config", false, "Print the effective configuration as YAML and exit")
+	conf, err := config.Load(flag.CommandLine, os.Args[1:])
+	if *printConfig {
+		if err := conf.Write(os.Stdout); err != nil {
+			log.Fatalf("config failed: %v", err)
+		}
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *printConfig {
+		return
+	}
+
+	if err := logging.Configure(conf.Log); err != nil {
+		log.Fatalf("logging failed: %v", err)
+	}
+
+	shutdownTracing, err := tracing.Setup(context.Background(), conf.Tracing)
+	if err != nil {
+		log.Fatalf("tracing failed: %v", err)
+	}
+	defer shutdownTracing(context.Background())
+
+	cfg, err := conf.Ingestor()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if conf.Broker.Embedded {
+		runEmbedded(conf, cfg)
+		return
+	}
+
+	// Clean before the broker opens the topic logs, which would otherwise
+	// keep pointing at the removed files.
+	if cfg.EnableStubs && cfg.StubClean {
+		if err := stubs.CleanTopics(cfg.DataDir); err != nil {
+			log.Fatalf("stubs failed: %v", err)
+		}
+	}
+
+	broker := fsbroker.NewBrokerWithConfig(conf.BrokerConfig())
+	errs := make(chan error, 1)
+	go func() { errs <- broker.Start() }()
+	select {
+	case <-broker.Ready():
+	case err := <-errs:
+		log.Fatalf("broker failed: %v", err)
+	}
+
+	prometheus.MustRegister(broker.Collector())
+
+	// The broker may have picked its port.
+	cfg.BrokerHost = broker.Host()
 
-	flag.IntVar(&cfg.BrokerPort, "port", 9000, "Broker port")
-	flag.StringVar(&cfg.SourceTopic, "source-topic", "source.pulses", "Source Topic")
-	flag.BoolVar(&cfg.EnableStubs, "stub", false, "Enable stubs")
-	flag.IntVar(&cfg.StubTenants, "stub-tenants", 10, "Number of tenants")
-	flag.IntVar(&cfg.StubSKUs, "stub-skus", 50, "Number of SKUs")
-	flag.BoolVar(&cfg.StubClean, "stub-clean", false, "Clean all topics")
-	flag.Parse()
+	app := ingestor.NewWithOptions(cfg, conf.ConnectorOptions())
+	defer app.Stop()
+	serveHTTP(conf.HTTP.Addr, app)
+	reloadOnChange(conf, app)
 
-	broker := fsbroker.NewBroker(cfg.BrokerPort)
-	go broker.Start()
-	time.Sleep(1 * time.Second)
+	if cfg.EnableStubs {
+		go stubs.WriteRandomTenantPulses(
+			broker.Host(),
+			cfg.SourceTopic,
+			cfg.StubTenants,
+			cfg.StubSKUs,
+		)
+	}
+	if err := app.Start(); err != nil {
+		log.Fatalf("app failed: %v", err)
+	}
+}
 
-	app := ingestor.New(cfg)
+// runEmbedded runs the ingestor on an in-process broker, with no TCP
+// listener and nothing written to disk.
+func runEmbedded(conf config.Config, cfg ingestor.Config) {
+	broker := membroker.NewBroker()
+	defer broker.Close()
+
+	app := ingestor.NewWithConnectors(cfg, broker.NewSourceConnector(), broker.NewSinkConnector())
+	if cfg.CatalogTopic != "" {
+		app.SetCatalogConnector(broker.NewSourceConnector(), broker.EndOffset)
+	}
 	defer app.Stop()
+	serveHTTP(conf.HTTP.Addr, app)
+	reloadOnChange(conf, app)
 
 	if cfg.EnableStubs {
-		go func() {
-			if cfg.StubClean {
-				stubs.CleanTopics()
-			}
-			stubs.WriteRandomTenantPulses(
-				"localhost:"+fmt.Sprint(cfg.BrokerPort),
-				cfg.SourceTopic,
-				cfg.StubTenants,
-				cfg.StubSKUs,
-			)
-		}()
+		go stubs.WriteRandomTenantPulsesTo(
+			broker.NewSinkConnector(),
+			cfg.SourceTopic,
+			cfg.StubTenants,
+			cfg.StubSKUs,
+		)
 	}
 	if err := app.Start(); err != nil {
 		log.Fatalf("app failed: %v", err)
 	}
 }
+
+// configWatchInterval is how often the configuration file is checked for
+// changes.
+const configWatchInterval = 2 * time.Second
+
+// reloadOnChange applies, in the background, the reloadable settings of the
+// configuration whenever its file changes or the process receives SIGHUP,
+// once the app is ready. A SIGHUP received earlier is applied then.
+func reloadOnChange(conf config.Config, app *ingestor.App) {
+	reloader := config.NewReloader(flag.CommandLine, os.Args[1:], conf, func(next config.Config) error {
+		// Everything that may fail is checked before anything is applied,
+		// so that a failed reload leaves the running settings untouched.
+		routes, err := next.Routes()
+		if err != nil {
+			return err
+		}
+		if err := logging.Validate(next.Log); err != nil {
+			return err
+		}
+		// The window can only fail to apply before the app is ready, so it
+		// goes first of the changes.
+		if err := app.SetWindow(next.Aggregation.Window); err != nil {
+			return err
+		}
+		if err := logging.Configure(next.Log); err != nil {
+			return err
+		}
+		app.SetRoutes(routes)
+		return nil
+	})
+
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	go func() {
+		<-app.Ready()
+		go reloader.Watch(configWatchInterval, nil)
+		for range hangups {
+			reloader.Reload()
+		}
+	}()
+}
+
+// serveHTTP serves, in the background, the metrics of the default
+// Prometheus registry on /metrics and the health of the app on /healthz and
+// /readyz.
+func serveHTTP(addr string, app *ingestor.App) {
+	if addr == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	health := app.HealthHandler()
+	mux.Handle("/healthz", health)
+	mux.Handle("/readyz", health)
+	go func() {
+		logrus.Infof("ingestor: serving metrics and health checks on %s", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			logrus.Errorf("ingestor: HTTP server failed: %v", err)
+		}
+	}()
+}
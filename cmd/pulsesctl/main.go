@@ -0,0 +1,292 @@
+// Command pulsesctl administers the topics and consumer groups of a running
+// fsbroker.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"goriok/pulses/internal/broker/fsbroker"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+const usage = `Usage: pulsesctl [global flags] <command> [flags] [args]
+
+Global flags:
+  -broker <host:port>             broker address (default localhost:9000)
+  -json                           print results as JSON
+  -tls-ca <file>                  connect over TLS, trusting the CAs in file
+  -tls-cert <file> -tls-key <file>
+                                  client certificate for mutual TLS
+  -token <token>                  authenticate with a token
+
+Commands:
+  topics                          list topics with their size and offsets
+  describe <topic>                show a topic, its subscribers and consumer groups
+  create [flags] <topic>          create a topic
+      -fsync never|always|interval
+      -queue-size <n>
+      -overflow block|drop-oldest|disconnect
+  delete <topic>                  delete a topic and the offsets committed for it
+  truncate <topic>                drop every message of a topic, keeping its offsets
+  reset-offset [flags] <group> <topic>
+                                  set the offset a consumer group reads a topic from
+      -to earliest|latest|<offset>
+`
+
+func main() {
+	broker := flag.String("broker", "localhost:9000", "Broker address")
+	asJSON := flag.Bool("json", false, "Print results as JSON")
+	tlsCA := flag.String("tls-ca", "", "CA file to verify the broker with, enables TLS")
+	tlsCert := flag.String("tls-cert", "", "Client certificate file for mutual TLS")
+	tlsKey := flag.String("tls-key", "", "Client key file for mutual TLS")
+	token := flag.String("token", "", "Authentication token")
+	flag.Usage = func() { fmt.Fprint(flag.CommandLine.Output(), usage) }
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	opts := fsbroker.DefaultConnectorOptions()
+	opts.Token = *token
+	if *tlsCA != "" || *tlsCert != "" {
+		cfg, err := fsbroker.LoadClientTLS(*tlsCA, *tlsCert, *tlsKey)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "pulsesctl: %v\n", err)
+			os.Exit(1)
+		}
+		opts.TLS = cfg
+	}
+
+	client := fsbroker.NewAdminClientWithOptions(*broker, opts)
+	defer client.Close()
+
+	cli := &cli{client: client, json: *asJSON}
+	if err := cli.run(flag.Arg(0), flag.Args()[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "pulsesctl: %v\n", err)
+		client.Close()
+		os.Exit(1)
+	}
+}
+
+type cli struct {
+	client *fsbroker.AdminClient
+	json   bool
+}
+
+func (c *cli) run(command string, args []string) error {
+	switch command {
+	case "topics":
+		return c.topics(args)
+	case "describe":
+		return c.describe(args)
+	case "create":
+		return c.create(args)
+	case "delete":
+		return c.delete(args)
+	case "truncate":
+		return c.truncate(args)
+	case "reset-offset":
+		return c.resetOffset(args)
+	default:
+		return fmt.Errorf("unknown command %q, see pulsesctl -h", command)
+	}
+}
+
+func (c *cli) topics(args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("usage: pulsesctl topics")
+	}
+
+	topics, err := c.client.Topics()
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return printJSON(topics)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TOPIC\tSIZE\tSTART\tEND\tSUBSCRIBERS")
+	for _, topic := range topics {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\n", topic.Name, topic.Size, topic.StartOffset, topic.EndOffset, len(topic.Subscribers))
+	}
+	return w.Flush()
+}
+
+func (c *cli) describe(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: pulsesctl describe <topic>")
+	}
+
+	topic, err := c.client.DescribeTopic(args[0])
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return printJSON(topic)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Topic:\t%s\n", topic.Name)
+	fmt.Fprintf(w, "Size:\t%d bytes\n", topic.Size)
+	fmt.Fprintf(w, "Offsets:\t%d - %d (%d messages)\n", topic.StartOffset, topic.EndOffset, topic.EndOffset-topic.StartOffset)
+	fmt.Fprintf(w, "Config:\t%s\n", formatConfig(topic.Config))
+	w.Flush()
+
+	if len(topic.Subscribers) > 0 {
+		fmt.Println()
+		w = tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "SUBSCRIBER\tGROUP\tLAG\tDELIVERED\tDROPPED")
+		for _, sub := range topic.Subscribers {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\n", sub.ID, orDash(sub.Group), sub.Lag, sub.Delivered, sub.Dropped)
+		}
+		w.Flush()
+	}
+
+	if len(topic.Groups) > 0 {
+		fmt.Println()
+		groups := make([]string, 0, len(topic.Groups))
+		for group := range topic.Groups {
+			groups = append(groups, group)
+		}
+		sort.Strings(groups)
+
+		w = tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "GROUP\tOFFSET\tLAG")
+		for _, group := range groups {
+			offset := topic.Groups[group]
+			fmt.Fprintf(w, "%s\t%d\t%d\n", group, offset, topic.EndOffset-max(offset, topic.StartOffset))
+		}
+		w.Flush()
+	}
+	return nil
+}
+
+func (c *cli) create(args []string) error {
+	flags := flag.NewFlagSet("create", flag.ContinueOnError)
+	fsync := flags.String("fsync", "", "Fsync policy: never, always or interval (default: broker setting)")
+	queueSize := flags.Int("queue-size", 0, "Subscriber queue size (default: broker setting)")
+	overflow := flags.String("overflow", "", "Overflow policy: block, drop-oldest or disconnect (default: broker setting)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: pulsesctl create [flags] <topic>")
+	}
+
+	cfg := fsbroker.TopicConfig{QueueSize: *queueSize}
+	if *fsync != "" {
+		policy, err := fsbroker.ParseFsyncPolicy(*fsync)
+		if err != nil {
+			return err
+		}
+		cfg.Fsync = &policy
+	}
+	if *overflow != "" {
+		policy, err := fsbroker.ParseOverflowPolicy(*overflow)
+		if err != nil {
+			return err
+		}
+		cfg.Overflow = &policy
+	}
+
+	if err := c.client.CreateTopic(flags.Arg(0), cfg); err != nil {
+		return err
+	}
+	fmt.Printf("created topic %s\n", flags.Arg(0))
+	return nil
+}
+
+func (c *cli) delete(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: pulsesctl delete <topic>")
+	}
+
+	if err := c.client.DeleteTopic(args[0]); err != nil {
+		return err
+	}
+	fmt.Printf("deleted topic %s\n", args[0])
+	return nil
+}
+
+func (c *cli) truncate(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: pulsesctl truncate <topic>")
+	}
+
+	if err := c.client.TruncateTopic(args[0]); err != nil {
+		return err
+	}
+	fmt.Printf("truncated topic %s\n", args[0])
+	return nil
+}
+
+func (c *cli) resetOffset(args []string) error {
+	flags := flag.NewFlagSet("reset-offset", flag.ContinueOnError)
+	to := flags.String("to", "earliest", "Where to reset to: earliest, latest or an offset")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 2 {
+		return fmt.Errorf("usage: pulsesctl reset-offset [-to earliest|latest|<offset>] <group> <topic>")
+	}
+
+	var offset int64
+	switch *to {
+	case "earliest":
+		offset = 0
+	case "latest":
+		offset = -1
+	default:
+		var err error
+		offset, err = strconv.ParseInt(*to, 10, 64)
+		if err != nil || offset < 0 {
+			return fmt.Errorf("invalid offset %q", *to)
+		}
+	}
+
+	group, topic := flags.Arg(0), flags.Arg(1)
+	offset, err := c.client.ResetGroupOffset(group, topic, offset)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("group %s reads topic %s from offset %d\n", group, topic, offset)
+	return nil
+}
+
+func formatConfig(cfg fsbroker.TopicConfig) string {
+	var settings []string
+	if cfg.Fsync != nil {
+		settings = append(settings, "fsync="+cfg.Fsync.String())
+	}
+	if cfg.QueueSize > 0 {
+		settings = append(settings, "queue-size="+strconv.Itoa(cfg.QueueSize))
+	}
+	if cfg.Overflow != nil {
+		settings = append(settings, "overflow="+cfg.Overflow.String())
+	}
+	if len(settings) == 0 {
+		return "broker defaults"
+	}
+	return strings.Join(settings, " ")
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func printJSON(v any) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
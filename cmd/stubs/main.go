@@ -1,36 +1,53 @@
 package stubs
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"goriok/pulses/internal/broker"
 	"goriok/pulses/internal/broker/fsbroker"
 	"goriok/pulses/internal/models"
+	"goriok/pulses/internal/tracing"
 	"math/rand"
 	"os"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
-const (
-	DATA_DIR = ".data"
-)
+const tracerName = "goriok/pulses/cmd/stubs"
 
 type SKU struct {
 	Id      string
 	UseUnit string
 }
 
+// SinkConnector writes the generated pulses.
+type SinkConnector interface {
+	Connect(topic string) error
+	WriteMessage(msg broker.Message) error
+}
+
 func WriteRandomTenantPulses(brokerHost string, sourceTopic string, tenantsAmount int, skuAmount int) error {
-	err := setupStub()
-	if err != nil {
-		return err
-	}
+	// The source topic is what gets billed, so every pulse waits for fsync.
+	sinkConnector := fsbroker.NewSinkConnectorWithOptions(brokerHost, fsbroker.ConnectorOptions{
+		Durability: fsbroker.DurabilityFsynced,
+	})
+	defer sinkConnector.Close()
+
+	return WriteRandomTenantPulsesTo(sinkConnector, sourceTopic, tenantsAmount, skuAmount)
+}
 
-	sinkConnector := fsbroker.NewSinkConnector(brokerHost)
+// WriteRandomTenantPulsesTo writes random pulses to the source topic through
+// the given connector, such as one of an in-process broker, until a pulse
+// fails to encode. Each pulse is keyed by its tenant and starts a trace with
+// a stubs.produce span, whose context goes along with it.
+func WriteRandomTenantPulsesTo(sinkConnector SinkConnector, sourceTopic string, tenantsAmount int, skuAmount int) error {
 	sinkConnector.Connect(sourceTopic)
-	defer sinkConnector.Close()
 
 	tenants := generateRandomTenants(tenantsAmount)
 	skus := generateRandomSKU(skuAmount)
@@ -51,33 +68,40 @@ func WriteRandomTenantPulses(brokerHost string, sourceTopic string, tenantsAmoun
 		if err != nil {
 			return err
 		}
-		sinkConnector.Write(sourceTopic, msg)
+		writePulse(sinkConnector, sourceTopic, pulse, msg)
 	}
 }
 
-func setupStub() error {
-	_, err := os.ReadDir(DATA_DIR)
-	if err != nil && !os.IsNotExist(err) {
-		logrus.Fatalf("failed to read .data folder: %v", err)
-	}
-
-	if os.IsNotExist(err) {
-		err = os.MkdirAll(DATA_DIR, os.ModePerm)
-		if err != nil {
-			return err
-		}
-		logrus.Infof(".data folder created successfully")
+func writePulse(sinkConnector SinkConnector, sourceTopic string, pulse *models.Pulse, msg []byte) {
+	ctx, span := otel.Tracer(tracerName).Start(context.Background(), "stubs.produce",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			attribute.String("messaging.destination.name", sourceTopic),
+			attribute.String("pulses.tenant_id", pulse.TenantID),
+		))
+	defer span.End()
+
+	err := sinkConnector.WriteMessage(broker.Message{
+		Topic:     sourceTopic,
+		Key:       []byte(pulse.TenantID),
+		Value:     msg,
+		Headers:   tracing.Inject(ctx, nil),
+		Timestamp: time.Now(),
+	})
+	if err != nil {
+		span.RecordError(err)
+		logrus.Errorf("stubs: failed to write pulse: %v", err)
 	}
-
-	return nil
 }
 
-func CleanTopics() {
-	err := os.RemoveAll(".data")
-	if err != nil {
-		logrus.Fatalf("failed to clean .data folder: %v", err)
+// CleanTopics removes every topic stored in dataDir, the data directory of
+// the broker.
+func CleanTopics(dataDir string) error {
+	if err := os.RemoveAll(dataDir); err != nil {
+		return fmt.Errorf("failed to clean %s folder: %w", dataDir, err)
 	}
-	logrus.Infof(".data folder cleaned successfully")
+	logrus.Infof("%s folder cleaned successfully", dataDir)
+	return nil
 }
 
 func generateRandomSKU(amount int) []*SKU {
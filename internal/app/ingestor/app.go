@@ -7,33 +7,78 @@
 package ingestor
 
 import (
+	"errors"
 	"fmt"
+	"goriok/pulses/internal/broker"
 	"goriok/pulses/internal/broker/fsbroker"
+	"goriok/pulses/internal/logging"
 	"goriok/pulses/internal/stream"
+	"goriok/pulses/internal/stream/catalog"
+	"goriok/pulses/internal/stream/enrichers"
+	"goriok/pulses/internal/stream/topics"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+var ingestorLog = logging.For("ingestor")
+
 type Pipeline interface {
 	Start(opts *stream.Options) error
+	LastMessage() time.Time
+	LastFlush() time.Time
+	SetWindow(window time.Duration) error
+	SetRoutes(routes *topics.Routes)
+	Ready() <-chan struct{}
 }
 
 type SourceConnector interface {
-	Read(topic string, handler func(topic string, message []byte)) error
+	Read(topic string, handler broker.Handler) error
 	Close()
 }
 
 type SinkConnector interface {
 	Connect(topic string) error
-	Write(topic string, message []byte) error
+	WriteMessage(msg broker.Message) error
 	Close()
 }
 
+// EndOffsetFunc returns the offset the next message written to a topic
+// gets.
+type EndOffsetFunc func(topic string) (int64, error)
+
 type Config struct {
-	BrokerPort  int
+	// BrokerHost is the address of the TCP broker, as host:port.
+	BrokerHost  string
+	DataDir     string
 	SourceTopic string
-	EnableStubs bool
-	StubTenants int
-	StubSKUs    int
-	StubClean   bool
+	// Window is how often aggregates are flushed, engines.DefaultWindow if
+	// zero.
+	Window time.Duration
+	// Routes names the grouped and aggregated topics, topics.DefaultRoutes
+	// if nil.
+	Routes *topics.Routes
+	// DisableGrouped only writes aggregates.
+	DisableGrouped bool
+	// GroupedEnrichers and AggregatedEnrichers add reference data to grouped
+	// pulses and aggregates.
+	GroupedEnrichers    []enrichers.Enricher
+	AggregatedEnrichers []enrichers.Enricher
+	// Catalog, if set, annotates pulses with the product family and
+	// canonical unit of their SKU, and sends the pulses of unknown SKUs to
+	// QuarantineTopic. It is kept up to date by reloading CatalogFile every
+	// CatalogRefresh, if positive, and by following CatalogTopic, if set,
+	// which is read up to its end before pulses are.
+	Catalog         *catalog.Catalog
+	CatalogFile     string
+	CatalogRefresh  time.Duration
+	CatalogTopic    string
+	QuarantineTopic string
+	EnableStubs     bool
+	StubTenants     int
+	StubSKUs        int
+	StubClean       bool
+	Health          HealthConfig
 }
 
 type App struct {
@@ -41,24 +86,125 @@ type App struct {
 	sinkConnector   SinkConnector
 	sourceConnector SourceConnector
 	pipeline        Pipeline
+
+	// catalogConnector follows the catalog topic, if any, and catalogEnd
+	// tells where it ends.
+	catalogConnector SourceConnector
+	catalogEnd       EndOffsetFunc
+	stop             chan struct{}
+	stopOnce         sync.Once
+
+	// brokerHost is the address of the TCP broker, empty for an in-process
+	// broker, sourceState the state of the source connection to it and
+	// connections the last state of the connection of every topic.
+	brokerHost    string
+	sourceState   atomic.Int32
+	connectionsMu sync.Mutex
+	connections   map[string]connectionState
+	started       time.Time
 }
 
+// New creates the ingestor app. Its connectors reconnect to the broker on
+// their own, so a broker restart does not require restarting the ingestor.
 func New(cfg Config) *App {
-	host := "localhost:" + fmt.Sprint(cfg.BrokerPort)
+	opts := fsbroker.DefaultConnectorOptions()
+	opts.Reconnect = fsbroker.DefaultReconnectPolicy()
+	return NewWithOptions(cfg, opts)
+}
+
+// NewWithOptions creates the ingestor app with connectors configured by
+// opts. OnStateChange is replaced by the app, which tracks the state of its
+// source connection for readiness checks.
+func NewWithOptions(cfg Config, opts fsbroker.ConnectorOptions) *App {
+	host := cfg.BrokerHost
+	app := &App{
+		cfg:        cfg,
+		pipeline:   stream.NewPipeline(),
+		brokerHost: host,
+		started:    time.Now(),
+		stop:       make(chan struct{}),
+	}
+	app.sourceState.Store(int32(fsbroker.StateConnecting))
+
+	if cfg.Catalog != nil && cfg.CatalogTopic != "" {
+		// The catalog topic is read whole by every ingestor.
+		catalogOpts := opts
+		catalogOpts.Group = ""
+		catalogOpts.OnStateChange = nil
+		app.catalogConnector = fsbroker.NewSourceConnectorWithOptions(host, catalogOpts)
+		app.catalogEnd = endOffsetOf(fsbroker.NewAdminClientWithOptions(host, opts))
+	}
+
+	opts.OnStateChange = app.trackState
 
-	return &App{
+	app.sourceConnector = fsbroker.NewSourceConnectorWithOptions(host, opts)
+	app.sinkConnector = fsbroker.NewSinkConnectorWithOptions(host, opts)
+	return app
+}
+
+// NewWithConnectors creates the ingestor app on the given connectors, such
+// as those of an in-process membroker.Broker. BrokerHost is not used, and
+// the source connector is deemed connected.
+func NewWithConnectors(cfg Config, source SourceConnector, sink SinkConnector) *App {
+	app := &App{
 		cfg:             cfg,
-		sinkConnector:   fsbroker.NewSinkConnector(host),
-		sourceConnector: fsbroker.NewSourceConnector(host),
+		sinkConnector:   sink,
+		sourceConnector: source,
 		pipeline:        stream.NewPipeline(),
+		started:         time.Now(),
+		stop:            make(chan struct{}),
+	}
+	app.sourceState.Store(int32(fsbroker.StateConnected))
+	return app
+}
+
+// SetCatalogConnector sets the connector following the catalog topic of an
+// app created by NewWithConnectors, which has none, and the function telling
+// where the topic ends. With no such function the catalog is not waited for.
+// It must be called before Start.
+func (a *App) SetCatalogConnector(source SourceConnector, endOffset EndOffsetFunc) {
+	a.catalogConnector = source
+	a.catalogEnd = endOffset
+}
+
+// endOffsetOf returns the end offset of topics as described by admin. A
+// topic that does not exist yet is empty, as in membroker.Broker.EndOffset,
+// and one whose messages were all dropped ends where it starts.
+func endOffsetOf(admin *fsbroker.AdminClient) EndOffsetFunc {
+	return func(topic string) (int64, error) {
+		info, err := admin.DescribeTopic(topic)
+		var brokerErr *fsbroker.BrokerError
+		if errors.As(err, &brokerErr) && brokerErr.Code == fsbroker.ErrCodeNotFound {
+			return 0, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		if info.StartOffset >= info.EndOffset {
+			return 0, nil
+		}
+		return info.EndOffset, nil
 	}
 }
 
+// Start reads the catalog topic, if any, up to its end and then starts
+// processing pulses. It returns once the pipeline stops, or fails to start.
 func (a *App) Start() error {
+	if err := a.startCatalog(); err != nil {
+		return err
+	}
+
 	err := a.pipeline.Start(&stream.Options{
-		SourceTopic:     a.cfg.SourceTopic,
-		SourceConnector: a.sourceConnector,
-		SinkConnector:   a.sinkConnector,
+		SourceTopic:         a.cfg.SourceTopic,
+		SourceConnector:     a.sourceConnector,
+		SinkConnector:       a.sinkConnector,
+		Window:              a.cfg.Window,
+		Routes:              a.cfg.Routes,
+		DisableGrouped:      a.cfg.DisableGrouped,
+		GroupedEnrichers:    a.cfg.GroupedEnrichers,
+		AggregatedEnrichers: a.cfg.AggregatedEnrichers,
+		Catalog:             a.cfg.Catalog,
+		QuarantineTopic:     a.cfg.QuarantineTopic,
 	})
 	if err != nil {
 		return err
@@ -67,7 +213,80 @@ func (a *App) Start() error {
 	return nil
 }
 
+// startCatalog keeps the catalog up to date in the background, until the app
+// stops. It returns once the catalog topic, if any, has been read up to
+// where it ended, so that pulses of the SKUs it holds are not quarantined.
+func (a *App) startCatalog() error {
+	c, topic := a.cfg.Catalog, a.cfg.CatalogTopic
+	if c == nil {
+		return nil
+	}
+	if a.cfg.CatalogFile != "" && a.cfg.CatalogRefresh > 0 {
+		go c.WatchFile(a.cfg.CatalogFile, a.cfg.CatalogRefresh, a.stop)
+	}
+	if topic == "" || a.catalogConnector == nil {
+		return nil
+	}
+
+	var end int64
+	if a.catalogEnd != nil {
+		var err error
+		if end, err = a.catalogEnd(topic); err != nil {
+			return fmt.Errorf("ingestor: failed to describe catalog topic %s: %w", topic, err)
+		}
+	}
+
+	caughtUp := make(chan struct{})
+	stopped := make(chan error, 1)
+	go func() {
+		err := c.Follow(a.catalogConnector, topic, end, func() { close(caughtUp) })
+		if err != nil {
+			ingestorLog.Errorf("ingestor: stopped following catalog topic %s: %v", topic, err)
+		}
+		stopped <- err
+	}()
+
+	select {
+	case <-caughtUp:
+	case err := <-stopped:
+		select {
+		case <-caughtUp:
+		default:
+			if err == nil {
+				err = errors.New("connector closed")
+			}
+			return fmt.Errorf("ingestor: failed to read catalog topic %s: %w", topic, err)
+		}
+	}
+	ingestorLog.Infof("ingestor: read catalog topic %s up to offset %d, %d SKUs", topic, end, c.Len())
+	return nil
+}
+
+// Ready returns a channel closed once the app has started, as Start goes on
+// to process pulses until it fails. Its settings can be changed from then on.
+func (a *App) Ready() <-chan struct{} {
+	return a.pipeline.Ready()
+}
+
+// SetWindow changes the aggregation window of the running app, from the
+// next window on.
+func (a *App) SetWindow(window time.Duration) error {
+	return a.pipeline.SetWindow(window)
+}
+
+// SetRoutes changes the topics the running app writes grouped pulses and
+// aggregates to.
+func (a *App) SetRoutes(routes *topics.Routes) {
+	a.pipeline.SetRoutes(routes)
+}
+
 func (a *App) Stop() {
 	a.sourceConnector.Close()
 	a.sinkConnector.Close()
+	if a.catalogConnector != nil {
+		a.catalogConnector.Close()
+	}
+	if a.stop != nil {
+		a.stopOnce.Do(func() { close(a.stop) })
+	}
 }
@@ -2,8 +2,13 @@ package ingestor
 
 import (
 	"errors"
+	"goriok/pulses/internal/broker"
+	"goriok/pulses/internal/broker/membroker"
 	"goriok/pulses/internal/stream"
+	"goriok/pulses/internal/stream/catalog"
+	"goriok/pulses/internal/stream/topics"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
@@ -19,11 +24,35 @@ func (m *MockPipeline) Start(opts *stream.Options) error {
 	return args.Error(0)
 }
 
+func (m *MockPipeline) LastMessage() time.Time {
+	args := m.Called()
+	return args.Get(0).(time.Time)
+}
+
+func (m *MockPipeline) LastFlush() time.Time {
+	args := m.Called()
+	return args.Get(0).(time.Time)
+}
+
+func (m *MockPipeline) SetWindow(window time.Duration) error {
+	args := m.Called(window)
+	return args.Error(0)
+}
+
+func (m *MockPipeline) SetRoutes(routes *topics.Routes) {
+	m.Called(routes)
+}
+
+func (m *MockPipeline) Ready() <-chan struct{} {
+	args := m.Called()
+	return args.Get(0).(chan struct{})
+}
+
 type MockSourceConnector struct {
 	mock.Mock
 }
 
-func (m *MockSourceConnector) Read(topic string, handler func(topic string, message []byte)) error {
+func (m *MockSourceConnector) Read(topic string, handler broker.Handler) error {
 	args := m.Called(topic, handler)
 	return args.Error(0)
 }
@@ -41,8 +70,8 @@ func (m *MockSinkConnector) Connect(topic string) error {
 	return args.Error(0)
 }
 
-func (m *MockSinkConnector) Write(topic string, message []byte) error {
-	args := m.Called(topic, message)
+func (m *MockSinkConnector) WriteMessage(msg broker.Message) error {
+	args := m.Called(msg)
 	return args.Error(0)
 }
 
@@ -56,9 +85,14 @@ func TestApp_Start_Success(t *testing.T) {
 	mockSource := new(MockSourceConnector)
 	mockSink := new(MockSinkConnector)
 
+	routes := topics.DefaultRoutes()
 	cfg := Config{
-		BrokerPort:  1234,
+		BrokerHost:  "localhost:1234",
 		SourceTopic: "test-topic",
+		Window:      time.Minute,
+		Routes:      routes,
+		// Aggregates only.
+		DisableGrouped: true,
 	}
 
 	app := &App{
@@ -70,6 +104,9 @@ func TestApp_Start_Success(t *testing.T) {
 
 	mockPipeline.On("Start", mock.MatchedBy(func(opts *stream.Options) bool {
 		return opts.SourceTopic == "test-topic" &&
+			opts.Window == time.Minute &&
+			opts.Routes == routes &&
+			opts.DisableGrouped &&
 			opts.SourceConnector == mockSource &&
 			opts.SinkConnector == mockSink
 	})).Return(nil)
@@ -86,7 +123,7 @@ func TestApp_Start_Failure(t *testing.T) {
 	mockSink := new(MockSinkConnector)
 
 	cfg := Config{
-		BrokerPort:  1234,
+		BrokerHost:  "localhost:1234",
 		SourceTopic: "fail-topic",
 	}
 
@@ -111,7 +148,7 @@ func TestApp_Stop(t *testing.T) {
 	mockSink := new(MockSinkConnector)
 
 	cfg := Config{
-		BrokerPort:  1234,
+		BrokerHost:  "localhost:1234",
 		SourceTopic: "test-topic",
 	}
 
@@ -130,3 +167,138 @@ func TestApp_Stop(t *testing.T) {
 	mockSource.AssertCalled(t, "Close")
 	mockSink.AssertCalled(t, "Close")
 }
+
+// Test App.Start reads the catalog topic up to its end before starting the
+// pipeline, and App.Stop stops following it
+func TestApp_Catalog(t *testing.T) {
+	mockPipeline := new(MockPipeline)
+	mockSource := new(MockSourceConnector)
+	mockSink := new(MockSinkConnector)
+	mockCatalogSource := new(MockSourceConnector)
+	cat := catalog.New()
+
+	app := NewWithConnectors(Config{
+		SourceTopic:     "test-topic",
+		Catalog:         cat,
+		CatalogTopic:    "catalog.skus",
+		QuarantineTopic: "quarantine.test",
+	}, mockSource, mockSink)
+	app.pipeline = mockPipeline
+	app.SetCatalogConnector(mockCatalogSource, func(topic string) (int64, error) {
+		assert.Equal(t, "catalog.skus", topic)
+		return 2, nil
+	})
+
+	mockCatalogSource.On("Read", "catalog.skus", mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+		handler := args.Get(1).(broker.Handler)
+		handler(broker.Message{Key: []byte("vm-small"), Value: []byte(`{"family": "compute"}`), Offset: 0})
+		time.Sleep(20 * time.Millisecond)
+		handler(broker.Message{Key: []byte("db-large"), Value: []byte(`{"family": "database"}`), Offset: 1})
+	})
+	mockPipeline.On("Start", mock.MatchedBy(func(opts *stream.Options) bool {
+		_, ok := cat.Lookup("db-large")
+		return ok && opts.Catalog == cat && opts.QuarantineTopic == "quarantine.test"
+	})).Return(nil)
+
+	assert.NoError(t, app.Start())
+	mockPipeline.AssertExpectations(t)
+
+	mockSource.On("Close").Return()
+	mockSink.On("Close").Return()
+	mockCatalogSource.On("Close").Return()
+	app.Stop()
+	app.Stop()
+	mockCatalogSource.AssertCalled(t, "Close")
+}
+
+// Test App.Start fails, without starting the pipeline, when the end of the
+// catalog topic is unknown
+func TestApp_Catalog_DescribeFailure(t *testing.T) {
+	mockPipeline := new(MockPipeline)
+	app := NewWithConnectors(Config{Catalog: catalog.New(), CatalogTopic: "catalog.skus"}, nil, nil)
+	app.pipeline = mockPipeline
+	app.SetCatalogConnector(new(MockSourceConnector), func(string) (int64, error) {
+		return 0, errors.New("broker unreachable")
+	})
+
+	assert.ErrorContains(t, app.Start(), "broker unreachable")
+	mockPipeline.AssertNotCalled(t, "Start", mock.Anything)
+}
+
+// slowSource starts reading late, like a catalog connector still dialing a
+// broker when the pulses are already there.
+type slowSource struct {
+	SourceConnector
+	delay time.Duration
+}
+
+func (s slowSource) Read(topic string, handler broker.Handler) error {
+	time.Sleep(s.delay)
+	return s.SourceConnector.Read(topic, handler)
+}
+
+// Test a pulse read by App.Start is not quarantined when the catalog entry
+// of its SKU is already in the catalog topic, however late it is read
+func TestApp_CatalogBeforePulses(t *testing.T) {
+	b := membroker.NewBroker()
+	defer b.Close()
+
+	sink := b.NewSinkConnector()
+	assert.NoError(t, sink.WriteMessage(broker.Message{
+		Topic: "catalog.skus",
+		Key:   []byte("vm-small"),
+		Value: []byte(`{"family": "compute", "unit": "hours"}`),
+	}))
+	assert.NoError(t, sink.Write("source.pulses", []byte(`{"tenant_id": "acme", "product_sku": "vm-small", "use_unity": "hours", "used_ammount": 1}`)))
+
+	app := NewWithConnectors(Config{
+		SourceTopic:  "source.pulses",
+		Catalog:      catalog.New(),
+		CatalogTopic: "catalog.skus",
+	}, b.NewSourceConnector(), b.NewSinkConnector())
+	app.SetCatalogConnector(slowSource{b.NewSourceConnector(), 50 * time.Millisecond}, b.EndOffset)
+	go app.Start()
+	defer app.Stop()
+
+	assert.Eventually(t, func() bool {
+		return len(b.Messages("tenants.acme.grouped.pulses")) == 1
+	}, time.Second, 5*time.Millisecond)
+	assert.Empty(t, b.Messages(stream.DefaultQuarantineTopic))
+}
+
+// Test App.SetWindow forwards the window to the pipeline
+func TestApp_SetWindow(t *testing.T) {
+	mockPipeline := new(MockPipeline)
+	app := &App{pipeline: mockPipeline}
+
+	mockPipeline.On("SetWindow", time.Minute).Return(nil).Once()
+	mockPipeline.On("SetWindow", time.Hour).Return(errors.New("not started")).Once()
+
+	assert.NoError(t, app.SetWindow(time.Minute))
+	assert.EqualError(t, app.SetWindow(time.Hour), "not started")
+	mockPipeline.AssertExpectations(t)
+}
+
+// Test App.SetRoutes forwards the routes to the pipeline
+func TestApp_SetRoutes(t *testing.T) {
+	mockPipeline := new(MockPipeline)
+	app := &App{pipeline: mockPipeline}
+	routes := topics.DefaultRoutes()
+
+	mockPipeline.On("SetRoutes", routes).Once()
+
+	app.SetRoutes(routes)
+	mockPipeline.AssertExpectations(t)
+}
+
+// Test App.Ready is the readiness of the pipeline
+func TestApp_Ready(t *testing.T) {
+	mockPipeline := new(MockPipeline)
+	app := &App{pipeline: mockPipeline}
+	ready := make(chan struct{})
+
+	mockPipeline.On("Ready").Return(ready)
+
+	assert.Equal(t, (<-chan struct{})(ready), app.Ready())
+	mockPipeline.AssertExpectations(t)
+}
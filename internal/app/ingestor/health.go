@@ -0,0 +1,208 @@
+package ingestor
+
+import (
+	"encoding/json"
+	"fmt"
+	"goriok/pulses/internal/broker/fsbroker"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// HealthConfig sets the thresholds of the health checks. A zero duration
+// disables the check it bounds.
+type HealthConfig struct {
+	// MaxFlushAge is how long the aggregator may go without a successful
+	// flush before the ingestor is reported unhealthy, and should be
+	// restarted.
+	MaxFlushAge time.Duration `yaml:"max_flush_age"`
+	// MaxMessageAge is how long the ingestor may go without reading a pulse
+	// before it is reported not ready. Sources may be idle for a while, so
+	// it is disabled by default.
+	MaxMessageAge time.Duration `yaml:"max_message_age"`
+}
+
+// DefaultHealthConfig allows the aggregator, which flushes every few
+// seconds, to miss a few flushes and the source to be idle.
+func DefaultHealthConfig() HealthConfig {
+	return HealthConfig{
+		MaxFlushAge: 30 * time.Second,
+	}
+}
+
+// HealthCheck is the outcome of a single check.
+type HealthCheck struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// HealthReport is the outcome of the checks run for a probe. Status is "ok"
+// when every check passed, "failing" otherwise.
+type HealthReport struct {
+	Status string        `json:"status"`
+	Checks []HealthCheck `json:"checks"`
+}
+
+// OK reports whether every check passed.
+func (r HealthReport) OK() bool {
+	return r.Status == "ok"
+}
+
+func newHealthReport(checks ...HealthCheck) HealthReport {
+	report := HealthReport{Status: "ok", Checks: checks}
+	for _, check := range checks {
+		if !check.OK {
+			report.Status = "failing"
+		}
+	}
+	return report
+}
+
+// Liveness reports whether the ingestor is working at all: its aggregator
+// keeps flushing.
+func (a *App) Liveness() HealthReport {
+	return newHealthReport(a.checkFlush())
+}
+
+// Readiness reports whether the ingestor is consuming: on top of Liveness,
+// the connectors are connected to the broker, the source connector among
+// them, and a pulse was read recently enough.
+func (a *App) Readiness() HealthReport {
+	return newHealthReport(a.checkFlush(), a.checkBroker(), a.checkSource(), a.checkMessages())
+}
+
+// HealthHandler serves Liveness on /healthz and Readiness on /readyz as
+// JSON, with status 503 when a check fails.
+func (a *App) HealthHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealthReport(w, a.Liveness())
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealthReport(w, a.Readiness())
+	})
+	return mux
+}
+
+func writeHealthReport(w http.ResponseWriter, report HealthReport) {
+	w.Header().Set("Content-Type", "application/json")
+	if !report.OK() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+// connectionState is the last state reported for the connection of a topic,
+// with the error that caused a disconnection.
+type connectionState struct {
+	state fsbroker.ConnectionState
+	err   error
+}
+
+// trackState records the state of the connections to the broker, as
+// reported to ConnectorOptions.OnStateChange.
+func (a *App) trackState(topic string, state fsbroker.ConnectionState, err error) {
+	if topic == a.cfg.SourceTopic {
+		a.sourceState.Store(int32(state))
+	}
+
+	a.connectionsMu.Lock()
+	defer a.connectionsMu.Unlock()
+	if a.connections == nil {
+		a.connections = make(map[string]connectionState)
+	}
+	a.connections[topic] = connectionState{state: state, err: err}
+}
+
+func (a *App) checkFlush() HealthCheck {
+	check := HealthCheck{Name: "aggregator", OK: true}
+
+	last := a.pipeline.LastFlush()
+	if last.IsZero() {
+		check.Detail = "not started"
+		return check
+	}
+
+	age := time.Since(last).Round(time.Millisecond)
+	check.Detail = fmt.Sprintf("last flush %s ago", age)
+	if limit := a.cfg.Health.MaxFlushAge; limit > 0 && age > limit {
+		check.OK = false
+		check.Detail += fmt.Sprintf(", more than %s", limit)
+	}
+	return check
+}
+
+// checkBroker reports the connections the connectors keep to the broker,
+// rather than dialing it: a connection of its own would neither speak TLS
+// nor authenticate. Connections being dialed again, or lost, fail the check.
+func (a *App) checkBroker() HealthCheck {
+	check := HealthCheck{Name: "broker", OK: true}
+	if a.brokerHost == "" {
+		check.Detail = "in process"
+		return check
+	}
+
+	a.connectionsMu.Lock()
+	defer a.connectionsMu.Unlock()
+
+	if len(a.connections) == 0 {
+		check.OK = false
+		check.Detail = "not connected to " + a.brokerHost
+		return check
+	}
+
+	var down []string
+	for topic, conn := range a.connections {
+		if conn.state == fsbroker.StateConnecting || conn.state == fsbroker.StateDisconnected {
+			down = append(down, topic)
+		}
+	}
+	if len(down) == 0 {
+		check.Detail = a.brokerHost
+		return check
+	}
+
+	// Multiplexed connections carry every topic and report none.
+	slices.Sort(down)
+	conn, name := a.connections[down[0]], fmt.Sprintf("topic %q", down[0])
+	if down[0] == "" {
+		name = "multiplexed connection"
+	}
+	check.OK = false
+	check.Detail = fmt.Sprintf("%s: %s %s", a.brokerHost, name, conn.state)
+	if conn.err != nil {
+		check.Detail += ": " + conn.err.Error()
+	}
+	if len(down) > 1 {
+		check.Detail += fmt.Sprintf(", and %d more", len(down)-1)
+	}
+	return check
+}
+
+func (a *App) checkSource() HealthCheck {
+	state := fsbroker.ConnectionState(a.sourceState.Load())
+	return HealthCheck{
+		Name:   "source",
+		OK:     state == fsbroker.StateConnected,
+		Detail: fmt.Sprintf("%s %s", a.cfg.SourceTopic, state),
+	}
+}
+
+func (a *App) checkMessages() HealthCheck {
+	check := HealthCheck{Name: "messages", OK: true}
+
+	// Before the first pulse, the wait counts from the start of the app.
+	last, format := a.pipeline.LastMessage(), "last pulse %s ago"
+	if last.IsZero() {
+		last, format = a.started, "no pulse read in %s"
+	}
+
+	age := time.Since(last).Round(time.Millisecond)
+	check.Detail = fmt.Sprintf(format, age)
+	if limit := a.cfg.Health.MaxMessageAge; limit > 0 && age > limit {
+		check.OK = false
+		check.Detail += fmt.Sprintf(", more than %s", limit)
+	}
+	return check
+}
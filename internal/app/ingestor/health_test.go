@@ -0,0 +1,126 @@
+package ingestor
+
+import (
+	"encoding/json"
+	"errors"
+	"goriok/pulses/internal/broker/fsbroker"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newHealthTestApp returns an app on a mock pipeline that last read a pulse
+// and flushed at the given times, with its source connected to a broker.
+func newHealthTestApp(t *testing.T, lastMessage, lastFlush time.Time) *App {
+	pipeline := new(MockPipeline)
+	pipeline.On("LastMessage").Return(lastMessage)
+	pipeline.On("LastFlush").Return(lastFlush)
+
+	app := &App{
+		cfg: Config{
+			SourceTopic: "source.pulses",
+			Health:      HealthConfig{MaxFlushAge: time.Minute, MaxMessageAge: time.Minute},
+		},
+		pipeline:   pipeline,
+		brokerHost: "localhost:9000",
+		started:    time.Now(),
+	}
+	app.trackState("source.pulses", fsbroker.StateConnected, nil)
+	return app
+}
+
+func checksByName(report HealthReport) map[string]HealthCheck {
+	checks := make(map[string]HealthCheck)
+	for _, check := range report.Checks {
+		checks[check.Name] = check
+	}
+	return checks
+}
+
+func TestApp_Health_OK(t *testing.T) {
+	app := newHealthTestApp(t, time.Now(), time.Now())
+
+	assert.True(t, app.Liveness().OK())
+	report := app.Readiness()
+	assert.True(t, report.OK(), "%+v", report)
+	assert.Len(t, report.Checks, 4)
+}
+
+func TestApp_Health_StaleFlush(t *testing.T) {
+	app := newHealthTestApp(t, time.Now(), time.Now().Add(-2*time.Minute))
+
+	assert.False(t, app.Liveness().OK())
+	assert.False(t, app.Readiness().OK())
+
+	// Disabled thresholds never fail.
+	app.cfg.Health.MaxFlushAge = 0
+	assert.True(t, app.Liveness().OK())
+}
+
+func TestApp_Readiness(t *testing.T) {
+	app := newHealthTestApp(t, time.Now().Add(-2*time.Minute), time.Now())
+	checks := checksByName(app.Readiness())
+	assert.False(t, checks["messages"].OK)
+	assert.True(t, app.Liveness().OK(), "an idle source does not make the app unhealthy")
+
+	// Before the first pulse, the wait counts from the start of the app.
+	app = newHealthTestApp(t, time.Time{}, time.Now())
+	assert.True(t, checksByName(app.Readiness())["messages"].OK)
+	app.started = time.Now().Add(-2 * time.Minute)
+	assert.False(t, checksByName(app.Readiness())["messages"].OK)
+
+	app = newHealthTestApp(t, time.Now(), time.Now())
+	app.trackState("tenants.a.grouped.pulses", fsbroker.StateDisconnected, nil)
+	assert.True(t, checksByName(app.Readiness())["source"].OK, "sink topics do not affect the source")
+	app.trackState("source.pulses", fsbroker.StateDisconnected, nil)
+	assert.False(t, checksByName(app.Readiness())["source"].OK)
+
+	app = newHealthTestApp(t, time.Now(), time.Now())
+	app.brokerHost = ""
+	assert.True(t, checksByName(app.Readiness())["broker"].OK, "in-process brokers are always reachable")
+}
+
+func TestApp_Readiness_BrokerConnections(t *testing.T) {
+	app := newHealthTestApp(t, time.Now(), time.Now())
+	app.trackState("tenants.a.grouped.pulses", fsbroker.StateConnected, nil)
+	app.trackState("tenants.b.grouped.pulses", fsbroker.StateClosed, nil)
+	assert.True(t, checksByName(app.Readiness())["broker"].OK, "idle sink connections may be closed")
+
+	app.trackState("tenants.a.grouped.pulses", fsbroker.StateDisconnected, errors.New("connection reset"))
+	app.trackState("tenants.b.grouped.pulses", fsbroker.StateConnecting, nil)
+	check := checksByName(app.Readiness())["broker"]
+	assert.False(t, check.OK)
+	assert.Equal(t, `localhost:9000: topic "tenants.a.grouped.pulses" disconnected: connection reset, and 1 more`, check.Detail)
+	assert.True(t, checksByName(app.Readiness())["source"].OK, "sink topics do not affect the source")
+
+	app.trackState("tenants.a.grouped.pulses", fsbroker.StateConnected, nil)
+	app.trackState("tenants.b.grouped.pulses", fsbroker.StateConnected, nil)
+	assert.True(t, checksByName(app.Readiness())["broker"].OK)
+
+	// Until a connector connects, nothing is known about the broker.
+	app = newHealthTestApp(t, time.Now(), time.Now())
+	app.connections = nil
+	assert.False(t, checksByName(app.Readiness())["broker"].OK)
+}
+
+func TestApp_HealthHandler(t *testing.T) {
+	app := newHealthTestApp(t, time.Now().Add(-2*time.Minute), time.Now())
+	handler := app.HealthHandler()
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+
+	var report HealthReport
+	assert.NoError(t, json.NewDecoder(rec.Body).Decode(&report))
+	assert.Equal(t, "failing", report.Status)
+	assert.False(t, checksByName(report)["messages"].OK)
+}
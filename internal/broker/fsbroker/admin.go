@@ -0,0 +1,342 @@
+package fsbroker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+)
+
+var (
+	// ErrTopicNotFound is returned by admin operations on a topic that does
+	// not exist.
+	ErrTopicNotFound = errors.New("topic not found")
+	// ErrTopicExists is returned when creating a topic that already exists.
+	ErrTopicExists = errors.New("topic already exists")
+)
+
+// TopicInfo describes a topic. Offsets run from StartOffset, the first
+// message still stored, to EndOffset, the offset the next message will get.
+// Groups holds the offset committed by each consumer group reading the topic.
+type TopicInfo struct {
+	Name        string            `json:"name"`
+	Size        int64             `json:"size"`
+	StartOffset int64             `json:"start_offset"`
+	EndOffset   int64             `json:"end_offset"`
+	Config      TopicConfig       `json:"config"`
+	Subscribers []SubscriberStats `json:"subscribers,omitempty"`
+	Groups      map[string]int64  `json:"groups,omitempty"`
+}
+
+// Topics describes every topic of the broker, sorted by name.
+func (b *Broker) Topics() ([]TopicInfo, error) {
+	if err := b.ensureDataDir(); err != nil {
+		return nil, err
+	}
+
+	names, err := b.existingTopics()
+	if err != nil {
+		return nil, err
+	}
+	slices.Sort(names)
+
+	topics := make([]TopicInfo, 0, len(names))
+	for _, name := range names {
+		info, err := b.DescribeTopic(name)
+		if errors.Is(err, ErrTopicNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		topics = append(topics, info)
+	}
+	return topics, nil
+}
+
+// DescribeTopic returns the size, offsets, config, subscribers and consumer
+// group offsets of a topic.
+func (b *Broker) DescribeTopic(topic string) (TopicInfo, error) {
+	if err := b.checkTopic(topic); err != nil {
+		return TopicInfo{}, err
+	}
+
+	log, err := b.topicLog(topic)
+	if err != nil {
+		return TopicInfo{}, err
+	}
+	groups, err := b.groups.topic(topic)
+	if err != nil {
+		return TopicInfo{}, err
+	}
+
+	size, count, _ := log.head()
+	return TopicInfo{
+		Name:        topic,
+		Size:        size,
+		StartOffset: log.first(),
+		EndOffset:   count,
+		Config:      log.config,
+		Subscribers: b.SubscriberStats(topic),
+		Groups:      groups,
+	}, nil
+}
+
+// CreateTopic creates an empty topic with the given config. Topics are also
+// created implicitly, with the broker defaults, when first used.
+func (b *Broker) CreateTopic(topic string, cfg TopicConfig) error {
+	b.adminMu.Lock()
+	defer b.adminMu.Unlock()
+
+	if err := validateTopic(topic); err != nil {
+		return err
+	}
+	if b.topicExists(topic) {
+		return fmt.Errorf("%w: %s", ErrTopicExists, topic)
+	}
+	if err := b.ensureDataDir(); err != nil {
+		return err
+	}
+	if err := saveTopicMeta(b.dataDir, topic, topicMeta{Config: cfg}); err != nil {
+		return err
+	}
+
+	_, err := b.topicLog(topic)
+	brokerLog.Infof("broker: created topic %s", topic)
+	return err
+}
+
+// DeleteTopic removes a topic along with the offsets committed for it.
+// Its subscribers are disconnected; sink connectors writing to it create it
+// again on their next write.
+func (b *Broker) DeleteTopic(topic string) error {
+	b.adminMu.Lock()
+	defer b.adminMu.Unlock()
+
+	if err := b.checkTopic(topic); err != nil {
+		return err
+	}
+
+	// Held until the file is gone, so that the topic is not opened again in
+	// between.
+	b.mu.Lock()
+	if log, ok := b.topics[topic]; ok {
+		delete(b.topics, topic)
+		log.close()
+	}
+	err := os.Remove(b.topicPath(topic))
+	b.mu.Unlock()
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	if err := removeTopicMeta(b.dataDir, topic); err != nil {
+		return err
+	}
+	b.metrics.dropTopic(topic)
+	brokerLog.Infof("broker: deleted topic %s", topic)
+	return b.groups.dropTopic(topic)
+}
+
+// TruncateTopic drops every message of a topic. Offsets carry on where they
+// were, so consumers resuming from an earlier offset start with the next
+// message written to the topic. Its subscribers are disconnected.
+func (b *Broker) TruncateTopic(topic string) error {
+	b.adminMu.Lock()
+	defer b.adminMu.Unlock()
+
+	if err := b.checkTopic(topic); err != nil {
+		return err
+	}
+
+	log, err := b.topicLog(topic)
+	if err != nil {
+		return err
+	}
+	meta, err := loadTopicMeta(b.dataDir, topic)
+	if err != nil {
+		return err
+	}
+	if meta.Start, err = log.truncate(); err != nil {
+		return err
+	}
+
+	brokerLog.Infof("broker: truncated topic %s at offset %d", topic, meta.Start)
+	return saveTopicMeta(b.dataDir, topic, meta)
+}
+
+// ResetGroupOffset sets the offset a consumer group reads the topic from
+// next. Negative offsets and offsets past the end of the topic point at its
+// end, offsets before its start at its start. The group must have no member
+// subscribed to the topic.
+func (b *Broker) ResetGroupOffset(group, topic string, offset int64) (int64, error) {
+	b.adminMu.Lock()
+	defer b.adminMu.Unlock()
+
+	if err := validateGroup(group); err != nil {
+		return 0, err
+	}
+	if err := b.checkTopic(topic); err != nil {
+		return 0, err
+	}
+
+	b.mu.Lock()
+	for _, sub := range b.sourceConnectors[topic] {
+		if sub.group == group {
+			b.mu.Unlock()
+			return 0, fmt.Errorf("%w: %s on topic %s", ErrGroupActive, group, topic)
+		}
+	}
+	b.mu.Unlock()
+
+	log, err := b.topicLog(topic)
+	if err != nil {
+		return 0, err
+	}
+	_, count, _ := log.head()
+	if offset < 0 || offset > count {
+		offset = count
+	}
+	offset = max(offset, log.first())
+
+	brokerLog.Infof("broker: reset offset of group %s on topic %s to %d", group, topic, offset)
+	return offset, b.groups.commit(group, topic, offset)
+}
+
+// checkTopic makes sure topic names an existing topic.
+func (b *Broker) checkTopic(topic string) error {
+	if err := validateTopic(topic); err != nil {
+		return err
+	}
+	if !b.topicExists(topic) {
+		return fmt.Errorf("%w: %s", ErrTopicNotFound, topic)
+	}
+	return nil
+}
+
+// topicExists reports whether the topic is open or stored on disk.
+func (b *Broker) topicExists(topic string) bool {
+	b.mu.Lock()
+	_, ok := b.topics[topic]
+	b.mu.Unlock()
+	if ok {
+		return true
+	}
+
+	info, err := os.Stat(b.topicPath(topic))
+	return err == nil && info.Mode().IsRegular()
+}
+
+// Admin operations, sent as the op of an admin request.
+const (
+	adminTopics      = "topics"
+	adminDescribe    = "describe"
+	adminCreate      = "create"
+	adminDelete      = "delete"
+	adminTruncate    = "truncate"
+	adminResetOffset = "reset-offset"
+)
+
+// adminRequest is the payload of an admin frame sent by an admin client.
+type adminRequest struct {
+	Op     string      `json:"op"`
+	Topic  string      `json:"topic,omitempty"`
+	Group  string      `json:"group,omitempty"`
+	Offset int64       `json:"offset,omitempty"`
+	Config TopicConfig `json:"config"`
+}
+
+// adminResponse is the payload of the admin frame answering a successful
+// request.
+type adminResponse struct {
+	Topics []TopicInfo `json:"topics,omitempty"`
+	Offset int64       `json:"offset,omitempty"`
+}
+
+// handleAdmin answers the admin requests of a client, one at a time, until
+// it disconnects. Principal must have AccessAdmin on the topics involved;
+// listing topics leaves out the others.
+func (b *Broker) handleAdmin(codec *binaryCodec, principal string) {
+	for {
+		f, err := readFrame(codec.reader)
+		if err != nil {
+			return
+		}
+
+		var req adminRequest
+		if f.Type != frameAdmin || json.Unmarshal(f.Payload, &req) != nil {
+			codec.writeError(ErrCodeBadRequest, "expected admin frame")
+			return
+		}
+
+		resp, err := b.admin(req, principal)
+		if err != nil {
+			brokerLog.Errorf("broker: admin %s failed: %v", req.Op, err)
+			if codec.writeError(requestErrorCode(err), err.Error()) != nil {
+				return
+			}
+			continue
+		}
+
+		payload, err := json.Marshal(resp)
+		if err != nil {
+			return
+		}
+		if writeFrame(codec.conn, frameAdmin, payload) != nil {
+			return
+		}
+	}
+}
+
+func (b *Broker) admin(req adminRequest, principal string) (adminResponse, error) {
+	var resp adminResponse
+	var err error
+
+	if req.Op != adminTopics && !b.security.authorize(principal, req.Topic, AccessAdmin) {
+		return resp, fmt.Errorf("%w: %s may not administer topic %q", errForbidden, principal, req.Topic)
+	}
+
+	switch req.Op {
+	case adminTopics:
+		var topics []TopicInfo
+		topics, err = b.Topics()
+		for _, info := range topics {
+			if b.security.authorize(principal, info.Name, AccessAdmin) {
+				resp.Topics = append(resp.Topics, info)
+			}
+		}
+	case adminDescribe:
+		var info TopicInfo
+		info, err = b.DescribeTopic(req.Topic)
+		resp.Topics = []TopicInfo{info}
+	case adminCreate:
+		err = b.CreateTopic(req.Topic, req.Config)
+	case adminDelete:
+		err = b.DeleteTopic(req.Topic)
+	case adminTruncate:
+		err = b.TruncateTopic(req.Topic)
+	case adminResetOffset:
+		resp.Offset, err = b.ResetGroupOffset(req.Group, req.Topic, req.Offset)
+	default:
+		err = fmt.Errorf("%w: unknown admin operation %q", errInvalidRequest, req.Op)
+	}
+	return resp, err
+}
+
+// requestErrorCode returns the code of the error frame answering a request
+// that failed with err.
+func requestErrorCode(err error) ErrorCode {
+	switch {
+	case errors.Is(err, errInvalidRequest):
+		return ErrCodeBadRequest
+	case errors.Is(err, ErrTopicNotFound):
+		return ErrCodeNotFound
+	case errors.Is(err, ErrTopicExists), errors.Is(err, ErrGroupActive):
+		return ErrCodeConflict
+	case errors.Is(err, errForbidden):
+		return ErrCodeForbidden
+	default:
+		return ErrCodeStorage
+	}
+}
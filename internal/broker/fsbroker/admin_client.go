@@ -0,0 +1,151 @@
+package fsbroker
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// AdminClient manages the topics and consumer groups of a broker over the
+// binary protocol. Failed operations return a *BrokerError, with
+// ErrCodeNotFound for unknown topics and ErrCodeConflict for topics that
+// already exist or groups that are in use.
+//
+// The connection is dialed on first use and again after it fails. An
+// AdminClient is safe for concurrent use; operations run one at a time.
+type AdminClient struct {
+	broker string
+	opts   ConnectorOptions
+	mu     sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func NewAdminClient(broker string) *AdminClient {
+	return NewAdminClientWithOptions(broker, DefaultConnectorOptions())
+}
+
+// NewAdminClientWithOptions creates an admin client using the TLS config and
+// token of the given options. It always speaks the binary protocol.
+func NewAdminClientWithOptions(broker string, opts ConnectorOptions) *AdminClient {
+	opts.Protocol = ProtocolBinary
+	return &AdminClient{broker: broker, opts: opts}
+}
+
+// Topics describes every topic of the broker, sorted by name.
+func (a *AdminClient) Topics() ([]TopicInfo, error) {
+	resp, err := a.do(adminRequest{Op: adminTopics})
+	return resp.Topics, err
+}
+
+// DescribeTopic returns the size, offsets, config, subscribers and consumer
+// group offsets of a topic.
+func (a *AdminClient) DescribeTopic(topic string) (TopicInfo, error) {
+	resp, err := a.do(adminRequest{Op: adminDescribe, Topic: topic})
+	if err != nil {
+		return TopicInfo{}, err
+	}
+	if len(resp.Topics) != 1 {
+		return TopicInfo{}, fmt.Errorf("admin-client: expected 1 topic, got %d", len(resp.Topics))
+	}
+	return resp.Topics[0], nil
+}
+
+// CreateTopic creates an empty topic with the given config.
+func (a *AdminClient) CreateTopic(topic string, cfg TopicConfig) error {
+	_, err := a.do(adminRequest{Op: adminCreate, Topic: topic, Config: cfg})
+	return err
+}
+
+// DeleteTopic removes a topic along with the offsets committed for it.
+func (a *AdminClient) DeleteTopic(topic string) error {
+	_, err := a.do(adminRequest{Op: adminDelete, Topic: topic})
+	return err
+}
+
+// TruncateTopic drops every message of a topic, keeping its offsets.
+func (a *AdminClient) TruncateTopic(topic string) error {
+	_, err := a.do(adminRequest{Op: adminTruncate, Topic: topic})
+	return err
+}
+
+// ResetGroupOffset sets the offset a consumer group reads the topic from
+// next, a negative offset meaning the end of the topic, and returns the
+// offset set once clamped to the topic.
+func (a *AdminClient) ResetGroupOffset(group, topic string, offset int64) (int64, error) {
+	resp, err := a.do(adminRequest{Op: adminResetOffset, Group: group, Topic: topic, Offset: offset})
+	return resp.Offset, err
+}
+
+// Close closes the connection to the broker.
+func (a *AdminClient) Close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.dropLocked()
+}
+
+// do sends a request and waits for its answer. A connection that fails is
+// dropped, and the next request dials again.
+func (a *AdminClient) do(req adminRequest) (adminResponse, error) {
+	var resp adminResponse
+
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return resp, err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.conn == nil {
+		if err := a.dialLocked(); err != nil {
+			return resp, err
+		}
+	}
+
+	if err := writeFrame(a.conn, frameAdmin, payload); err != nil {
+		a.dropLocked()
+		return resp, err
+	}
+	reply, err := readFrame(a.reader)
+	if err != nil {
+		a.dropLocked()
+		return resp, err
+	}
+
+	switch reply.Type {
+	case frameAdmin:
+		return resp, json.Unmarshal(reply.Payload, &resp)
+	case frameError:
+		return resp, decodeError(reply.Payload)
+	default:
+		a.dropLocked()
+		return resp, fmt.Errorf("admin-client: unexpected %s frame", reply.Type)
+	}
+}
+
+func (a *AdminClient) dialLocked() error {
+	conn, err := dial(a.broker, a.opts)
+	if err != nil {
+		return err
+	}
+	reader, err := handshake(conn, a.opts, roleAdmin, "", nil)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	a.conn = conn
+	a.reader = reader
+	return nil
+}
+
+func (a *AdminClient) dropLocked() {
+	if a.conn != nil {
+		a.conn.Close()
+	}
+	a.conn = nil
+	a.reader = nil
+}
@@ -0,0 +1,168 @@
+package fsbroker
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestAdmin(t *testing.T, b *Broker) *AdminClient {
+	admin := NewAdminClient(b.Host())
+	t.Cleanup(admin.Close)
+	return admin
+}
+
+func assertBrokerError(t *testing.T, err error, code ErrorCode) {
+	var brokerErr *BrokerError
+	if assert.True(t, errors.As(err, &brokerErr), "expected broker error, got %v", err) {
+		assert.Equal(t, code, brokerErr.Code)
+	}
+}
+
+func TestAdminClient_CreateAndDescribeTopic(t *testing.T) {
+	topic := "test." + uuid.New().String() + ".admin"
+	b := startTestBroker(t, DefaultSubscriberConfig())
+	admin := newTestAdmin(t, b)
+
+	fsync := FsyncAlways
+	overflow := OverflowDropOldest
+	assert.NoError(t, admin.CreateTopic(topic, TopicConfig{Fsync: &fsync, QueueSize: 8, Overflow: &overflow}))
+	assertBrokerError(t, admin.CreateTopic(topic, TopicConfig{}), ErrCodeConflict)
+
+	sink := NewSinkConnector(b.Host())
+	defer sink.Close()
+	assert.NoError(t, sink.Connect(topic))
+	assert.NoError(t, sink.Write(topic, []byte("one")))
+	assert.NoError(t, sink.Write(topic, []byte("two")))
+
+	info, err := admin.DescribeTopic(topic)
+	assert.NoError(t, err)
+	assert.Equal(t, topic, info.Name)
+	assert.Equal(t, int64(8), info.Size)
+	assert.Equal(t, int64(0), info.StartOffset)
+	assert.Equal(t, int64(2), info.EndOffset)
+	assert.Equal(t, FsyncAlways, *info.Config.Fsync)
+	assert.Equal(t, 8, info.Config.QueueSize)
+	assert.Equal(t, OverflowDropOldest, *info.Config.Overflow)
+
+	topics, err := admin.Topics()
+	assert.NoError(t, err)
+	var names []string
+	for _, info := range topics {
+		names = append(names, info.Name)
+	}
+	assert.Contains(t, names, topic)
+
+	// The config survives a restart.
+	b = restartTestBroker(t, b)
+	info, err = newTestAdmin(t, b).DescribeTopic(topic)
+	assert.NoError(t, err)
+	assert.Equal(t, FsyncAlways, *info.Config.Fsync)
+}
+
+func TestAdminClient_DescribeUnknownTopic(t *testing.T) {
+	topic := "test." + uuid.New().String() + ".unknown"
+	b := startTestBroker(t, DefaultSubscriberConfig())
+	admin := newTestAdmin(t, b)
+
+	_, err := admin.DescribeTopic(topic)
+	assertBrokerError(t, err, ErrCodeNotFound)
+	assertBrokerError(t, admin.DeleteTopic(topic), ErrCodeNotFound)
+	assertBrokerError(t, admin.TruncateTopic("test.*.pattern"), ErrCodeBadRequest)
+
+	_, err = os.Stat(b.topicPath(topic))
+	assert.True(t, os.IsNotExist(err), "describing a topic must not create it")
+}
+
+func TestAdminClient_DescribeShowsSubscribers(t *testing.T) {
+	topic := "test." + uuid.New().String() + ".subscribers"
+	b := startTestBroker(t, DefaultSubscriberConfig())
+	admin := newTestAdmin(t, b)
+	assert.NoError(t, admin.CreateTopic(topic, TopicConfig{}))
+
+	source := NewSourceConnectorWithOptions(b.Host(), ConnectorOptions{Protocol: ProtocolBinary, Group: "test-" + uuid.New().String()})
+	readPattern(t, source, topic)
+
+	assert.Eventually(t, func() bool {
+		info, err := admin.DescribeTopic(topic)
+		return err == nil && len(info.Subscribers) == 1 && info.Subscribers[0].Group != ""
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestAdminClient_TruncateTopic(t *testing.T) {
+	topic := "test." + uuid.New().String() + ".truncate"
+	b := startTestBroker(t, DefaultSubscriberConfig())
+	admin := newTestAdmin(t, b)
+
+	sink := NewSinkConnector(b.Host())
+	defer sink.Close()
+	assert.NoError(t, sink.Connect(topic))
+	for _, msg := range []string{"one", "two", "three"} {
+		_, err := sink.Produce(topic, []byte(msg))
+		assert.NoError(t, err)
+	}
+
+	assert.NoError(t, admin.TruncateTopic(topic))
+
+	offset, err := sink.Produce(topic, []byte("four"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), offset)
+
+	info, err := admin.DescribeTopic(topic)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), info.StartOffset)
+	assert.Equal(t, int64(4), info.EndOffset)
+	assert.Equal(t, int64(5), info.Size)
+
+	// A new subscriber only sees what was written after the truncation, and
+	// offsets carry on across a restart.
+	received := readPattern(t, NewSourceConnector(b.Host()), topic)
+	assert.Equal(t, []patternMessage{{topic, "four"}}, receivePattern(t, received, 1))
+
+	b = restartTestBroker(t, b)
+	info, err = newTestAdmin(t, b).DescribeTopic(topic)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), info.StartOffset)
+	assert.Equal(t, int64(4), info.EndOffset)
+}
+
+func TestAdminClient_DeleteTopic(t *testing.T) {
+	topic := "test." + uuid.New().String() + ".delete"
+	other := "test." + uuid.New().String() + ".kept"
+	b := startTestBroker(t, DefaultSubscriberConfig())
+	admin := newTestAdmin(t, b)
+
+	sink := NewSinkConnector(b.Host())
+	defer sink.Close()
+	assert.NoError(t, sink.Connect(topic))
+	assert.NoError(t, sink.Connect(other))
+	assert.NoError(t, sink.Write(topic, []byte("gone")))
+	assert.NoError(t, sink.Write(other, []byte("kept")))
+
+	source := NewSourceConnectorWithOptions(b.Host(), ConnectorOptions{Protocol: ProtocolBinary})
+	received := readPattern(t, source, topic)
+	receivePattern(t, received, 1)
+
+	assert.NoError(t, admin.DeleteTopic(topic))
+
+	_, err := os.Stat(b.topicPath(topic))
+	assert.True(t, os.IsNotExist(err))
+	_, err = admin.DescribeTopic(topic)
+	assertBrokerError(t, err, ErrCodeNotFound)
+	assert.Eventually(t, func() bool {
+		return len(b.SubscriberStats(topic)) == 0
+	}, 2*time.Second, 10*time.Millisecond)
+
+	info, err := admin.DescribeTopic(other)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), info.EndOffset)
+
+	// Writing to a deleted topic creates it again from scratch.
+	offset, err := sink.Produce(topic, []byte("again"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), offset)
+}
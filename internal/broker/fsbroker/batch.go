@@ -0,0 +1,152 @@
+package fsbroker
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// batch is a group of messages for one topic sent as a single produce
+// request. done is closed once the broker answered, after which offset holds
+// the offset of the first message and err the outcome for the whole batch.
+type batch struct {
+	messages [][]byte
+	done     chan struct{}
+	offset   int64
+	err      error
+}
+
+// batcher collects writes for one topic into batches, which are handed to
+// send one at a time, in order, by a dedicated goroutine. Writers block on
+// their batch only if they wait for an ack.
+//
+// A batch is released as soon as the sender is idle, so a lone writer never
+// waits for linger. While a request is in flight, writes accumulate until the
+// batch holds size messages, its first message has waited for linger, or the
+// sender becomes idle again.
+type batcher struct {
+	size     int
+	linger   time.Duration
+	send     func(*batch)
+	ready    chan *batch
+	inflight atomic.Int32
+
+	mu      sync.Mutex
+	pending *batch
+	last    *batch
+	timer   *time.Timer
+	closed  bool
+}
+
+func newBatcher(size int, linger time.Duration, send func(*batch)) *batcher {
+	b := &batcher{
+		size:   size,
+		linger: linger,
+		send:   send,
+		ready:  make(chan *batch, 16),
+	}
+	go b.run()
+	return b
+}
+
+func (b *batcher) run() {
+	for next := range b.ready {
+		b.send(next)
+
+		// Nothing else is queued once the count drops to zero, so release
+		// whatever accumulated meanwhile. If the lock is busy, its holder is
+		// either releasing already or will see the idle sender.
+		if b.inflight.Add(-1) == 0 && b.mu.TryLock() {
+			if !b.closed {
+				b.release()
+			}
+			b.mu.Unlock()
+		}
+	}
+}
+
+// add appends a message to the pending batch and returns the batch with the
+// index of the message within it. It returns a nil batch if the batcher is
+// closed.
+func (b *batcher) add(message []byte) (*batch, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return nil, 0
+	}
+
+	if b.pending == nil {
+		b.pending = &batch{done: make(chan struct{})}
+		if b.linger > 0 {
+			pending := b.pending
+			b.timer = time.AfterFunc(b.linger, func() { b.flushBatch(pending) })
+		}
+	}
+
+	current := b.pending
+	index := len(current.messages)
+	current.messages = append(current.messages, message)
+
+	if len(current.messages) >= b.size || b.linger <= 0 || b.inflight.Load() == 0 {
+		b.release()
+	}
+	return current, index
+}
+
+// flush releases the pending batch, if any, and returns the last batch handed
+// to the sender. Since batches are sent in order, once it is done every
+// earlier write is done too.
+func (b *batcher) flush() *batch {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.release()
+	return b.last
+}
+
+// close flushes the pending batch and stops the sender once every batch has
+// been sent.
+func (b *batcher) close() *batch {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return b.last
+	}
+	b.release()
+	b.closed = true
+	close(b.ready)
+	return b.last
+}
+
+// flushBatch releases the given batch if it is still the pending one. It is
+// called by the linger timer, which may fire after the batch was already
+// released for being full.
+func (b *batcher) flushBatch(target *batch) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.pending == target {
+		b.release()
+	}
+}
+
+// release hands the pending batch to the sender so that new writes start a
+// fresh one. It must be called with b.mu held, which keeps batches in the
+// order they were filled.
+func (b *batcher) release() {
+	current := b.pending
+	if current == nil {
+		return
+	}
+
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	b.pending = nil
+	b.last = current
+	b.inflight.Add(1)
+	b.ready <- current
+}
@@ -0,0 +1,133 @@
+package fsbroker
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingSender collects the batches handed to it and acknowledges them
+// with consecutive offsets.
+type recordingSender struct {
+	mu      sync.Mutex
+	batches [][]string
+	next    int64
+}
+
+func (r *recordingSender) send(b *batch) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	messages := make([]string, 0, len(b.messages))
+	for _, msg := range b.messages {
+		messages = append(messages, string(msg))
+	}
+	r.batches = append(r.batches, messages)
+
+	b.offset = r.next
+	r.next += int64(len(b.messages))
+	close(b.done)
+}
+
+func (r *recordingSender) sent() [][]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([][]string(nil), r.batches...)
+}
+
+// busyBatcher returns a batcher whose sender is stuck on a first batch until
+// the returned function is called, so that later writes accumulate.
+func busyBatcher(t *testing.T, size int, linger time.Duration, sender *recordingSender) (*batcher, func()) {
+	unblock := make(chan struct{})
+	first := true
+	b := newBatcher(size, linger, func(next *batch) {
+		if first {
+			first = false
+			<-unblock
+		}
+		sender.send(next)
+	})
+
+	b.add([]byte("first"))
+	return b, sync.OnceFunc(func() { close(unblock) })
+}
+
+func TestBatcher_SendsRightAwayWhenIdle(t *testing.T) {
+	sender := &recordingSender{}
+	b := newBatcher(100, time.Hour, sender.send)
+	defer b.close()
+
+	current, _ := b.add([]byte("one"))
+	<-current.done
+	assert.Equal(t, [][]string{{"one"}}, sender.sent())
+}
+
+func TestBatcher_SendsWhenFull(t *testing.T) {
+	sender := &recordingSender{}
+	b, unblock := busyBatcher(t, 2, time.Hour, sender)
+	defer b.close()
+	defer unblock()
+
+	first, i := b.add([]byte("one"))
+	assert.Equal(t, 0, i)
+	second, j := b.add([]byte("two"))
+	assert.Equal(t, 1, j)
+	assert.Same(t, first, second)
+
+	unblock()
+	<-first.done
+	assert.Equal(t, [][]string{{"first"}, {"one", "two"}}, sender.sent())
+	assert.Equal(t, int64(1), first.offset)
+}
+
+func TestBatcher_SendsAfterLinger(t *testing.T) {
+	sender := &recordingSender{}
+	b, unblock := busyBatcher(t, 100, 20*time.Millisecond, sender)
+	defer b.close()
+	defer unblock()
+
+	pending, _ := b.add([]byte("one"))
+	time.Sleep(50 * time.Millisecond)
+	unblock()
+
+	<-pending.done
+	assert.Equal(t, [][]string{{"first"}, {"one"}}, sender.sent())
+}
+
+func TestBatcher_SendsAccumulatedWhenSenderIdles(t *testing.T) {
+	sender := &recordingSender{}
+	b, unblock := busyBatcher(t, 100, time.Hour, sender)
+	defer b.close()
+
+	b.add([]byte("one"))
+	pending, _ := b.add([]byte("two"))
+	unblock()
+
+	select {
+	case <-pending.done:
+	case <-time.After(time.Second):
+		t.Fatal("expected accumulated batch to be sent once the sender is idle")
+	}
+	assert.Equal(t, [][]string{{"first"}, {"one", "two"}}, sender.sent())
+}
+
+func TestBatcher_FlushKeepsOrder(t *testing.T) {
+	sender := &recordingSender{}
+	b, unblock := busyBatcher(t, 2, time.Hour, sender)
+
+	for _, msg := range []string{"one", "two", "three"} {
+		b.add([]byte(msg))
+	}
+	last := b.flush()
+	unblock()
+	<-last.done
+
+	assert.Equal(t, [][]string{{"first"}, {"one", "two"}, {"three"}}, sender.sent())
+	assert.Equal(t, int64(3), last.offset)
+
+	b.close()
+	current, _ := b.add([]byte("late"))
+	assert.Nil(t, current)
+}
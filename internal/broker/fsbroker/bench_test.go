@@ -0,0 +1,68 @@
+package fsbroker
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// BenchmarkSinkConnector_Produce measures fsynced produce throughput with and
+// without batching. A single writer matches the stub generator; 100
+// concurrent writers stand in for 100x that rate.
+func BenchmarkSinkConnector_Produce(b *testing.B) {
+	modes := []struct {
+		name string
+		opts ConnectorOptions
+	}{
+		{"unbatched", ConnectorOptions{Durability: DurabilityFsynced}},
+		{"batched", ConnectorOptions{Durability: DurabilityFsynced, BatchSize: 128, Linger: time.Millisecond}},
+	}
+
+	for _, writers := range []int{1, 100} {
+		for _, mode := range modes {
+			b.Run(fmt.Sprintf("writers=%d/%s", writers, mode.name), func(b *testing.B) {
+				benchmarkProduce(b, writers, mode.opts)
+			})
+		}
+	}
+}
+
+func benchmarkProduce(b *testing.B, writers int, opts ConnectorOptions) {
+	topic := "bench." + uuid.New().String()
+	broker := startTestBroker(b, DefaultSubscriberConfig())
+
+	sink := NewSinkConnectorWithOptions(broker.Host(), opts)
+	defer sink.Close()
+	if err := sink.Connect(topic); err != nil {
+		b.Fatal(err)
+	}
+
+	msg := []byte(`{"tenant_id":"tenant","product_sku":"sku","used_ammount":42.5,"use_unity":"GB"}`)
+
+	b.ResetTimer()
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		n := b.N / writers
+		if w < b.N%writers {
+			n++
+		}
+
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			for i := 0; i < n; i++ {
+				if err := sink.Write(topic, msg); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		}(n)
+	}
+	wg.Wait()
+	b.StopTimer()
+
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "msgs/s")
+}
@@ -1,74 +1,216 @@
 // Package fsbroker implements a lightweight, filesystem-backed message broker
 // for local development and testing. It simulates publish/subscribe behavior
-// using TCP connections and disk-based topic storage in the `.data` directory.
+// using TCP connections and disk-based topic storage in a data directory,
+// `.data` by default.
 package fsbroker
 
 import (
 	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"goriok/pulses/internal/logging"
 	"net"
 	"os"
-	"strings"
+	"path/filepath"
 	"sync"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
 const (
+	// DATA_DIR is the default data directory, relative to the working
+	// directory.
 	DATA_DIR = ".data"
+	// DefaultListenAddr is the default address the broker listens on.
+	DefaultListenAddr = "localhost:9000"
 )
 
+// brokerLog is the logger of the broker itself, as opposed to its clients.
+var brokerLog = logging.For("broker")
+
+// BrokerConfig configures a broker created with NewBrokerWithConfig.
+//
+// ListenAddr is the TCP address the broker listens on; with port 0 the
+// broker picks a free port, which Host returns once Ready. DataDir holds the
+// topic files, their metadata and the consumer group offsets; it is created
+// on first use.
+//
+// Topics sets the config of topics that were not created with one, from the
+// first entry matching the topic. Fields left unset by both fall back to
+// Storage and Subscriber.
+type BrokerConfig struct {
+	ListenAddr string
+	DataDir    string
+	Storage    StorageConfig
+	Subscriber SubscriberConfig
+	Security   SecurityConfig
+	Topics     []TopicDefaults
+}
+
+// TopicDefaults is the config of the topics matching Topic, a topic name or
+// a pattern as in ACLRule.
+type TopicDefaults struct {
+	Topic  string
+	Config TopicConfig
+}
+
+// DefaultBrokerConfig listens on DefaultListenAddr and stores topics in
+// DATA_DIR, with the default storage and subscriber configs.
+func DefaultBrokerConfig() BrokerConfig {
+	return BrokerConfig{
+		ListenAddr: DefaultListenAddr,
+		DataDir:    DATA_DIR,
+		Storage:    DefaultStorageConfig(),
+		Subscriber: DefaultSubscriberConfig(),
+	}
+}
+
 // Broker is a local TCP server that simulates a pub/sub broker.
-// It stores messages per topic as files in the .data directory,
+// It stores messages per topic as files in its data directory,
 // and manages connected source and sink connectors.
+//
+// Every source connector is served by its own goroutine reading the topic
+// file, so a slow or stuck consumer only affects itself (or the producers of
+// its topic, under OverflowBlock).
 type Broker struct {
-	sourceConnectors map[string][]*net.Conn
-	newMessage       chan struct {
-		Topic   string
-		Message string
-	}
-	mu       sync.Mutex
-	host     string
-	listener *net.Listener
+	sourceConnectors map[string][]*subscriber
+	topics           map[string]*topicLog
+	conns            map[net.Conn]struct{}
+	patterns         map[*patternSubscription]struct{}
+	groups           *groupStore
+	subscriberCfg    SubscriberConfig
+	storageCfg       StorageConfig
+	security         SecurityConfig
+	topicDefaults    []TopicDefaults
+	dataDir          string
+	metrics          brokerMetrics
+	mu               sync.Mutex
+	adminMu          sync.Mutex
+	host             string
+	listener         *net.Listener
+	ready            chan struct{}
+	readyOnce        sync.Once
 }
 
+// NewBroker creates a broker listening on localhost:port, with the defaults
+// of DefaultBrokerConfig otherwise.
 func NewBroker(port int) *Broker {
-	host := fmt.Sprintf("localhost:%d", port)
+	cfg := DefaultBrokerConfig()
+	cfg.ListenAddr = fmt.Sprintf("localhost:%d", port)
+	return NewBrokerWithConfig(cfg)
+}
+
+// NewBrokerWithConfig creates a broker with the given config. An empty
+// DataDir stands for DATA_DIR.
+func NewBrokerWithConfig(cfg BrokerConfig) *Broker {
+	if cfg.DataDir == "" {
+		cfg.DataDir = DATA_DIR
+	}
 
 	return &Broker{
-		sourceConnectors: make(map[string][]*net.Conn),
-		newMessage: make(chan struct {
-			Topic   string
-			Message string
-		}),
-		host: host,
+		sourceConnectors: make(map[string][]*subscriber),
+		topics:           make(map[string]*topicLog),
+		conns:            make(map[net.Conn]struct{}),
+		patterns:         make(map[*patternSubscription]struct{}),
+		groups:           &groupStore{dir: cfg.DataDir},
+		subscriberCfg:    cfg.Subscriber,
+		storageCfg:       cfg.Storage,
+		security:         cfg.Security,
+		topicDefaults:    cfg.Topics,
+		dataDir:          cfg.DataDir,
+		metrics:          newBrokerMetrics(),
+		host:             cfg.ListenAddr,
+		ready:            make(chan struct{}),
 	}
 }
 
+// WithSubscriberConfig sets the queue size and overflow policy applied to
+// source connectors that subscribe from now on.
+func (b *Broker) WithSubscriberConfig(cfg SubscriberConfig) *Broker {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.subscriberCfg = cfg
+	return b
+}
+
+// WithStorageConfig sets the fsync policy applied to topic files, unless
+// their TopicConfig sets one.
+func (b *Broker) WithStorageConfig(cfg StorageConfig) *Broker {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.storageCfg = cfg
+	return b
+}
+
+// WithSecurityConfig sets how clients are authenticated and what they are
+// allowed to do. It must be called before Start.
+func (b *Broker) WithSecurityConfig(cfg SecurityConfig) *Broker {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.security = cfg
+	return b
+}
+
 func (b *Broker) On() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
 	return b.listener != nil
 }
 
+// Ready returns a channel closed once the broker listens for connections.
+// It stays open if Start fails.
+func (b *Broker) Ready() <-chan struct{} {
+	return b.ready
+}
+
 // Start begins accepting TCP connections from clients.
 // It listens for both sink and source connectors and handles broadcasting.
 func (b *Broker) Start() error {
-	listener, err := net.Listen("tcp", b.host)
+	listener, err := net.Listen("tcp", b.Host())
 	if err != nil {
-		logrus.Errorf("broker: Error starting server => %v\n", err)
+		brokerLog.Errorf("broker: Error starting server => %v\n", err)
 		return err
 	}
+	if b.security.TLS != nil {
+		listener = tls.NewListener(listener, b.security.TLS)
+	}
+	defer listener.Close()
 
+	// The actual address, in case the configured port was 0.
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	b.mu.Lock()
 	b.listener = &listener
-	defer listener.Close()
+	if host, _, err := net.SplitHostPort(b.host); err == nil {
+		b.host = net.JoinHostPort(host, port)
+	}
+	b.mu.Unlock()
+	b.readyOnce.Do(func() { close(b.ready) })
 
-	logrus.Infof("broker: listening on %s", b.host)
+	brokerLog.Infof("broker: listening on %s", b.Host())
 
-	go b.broadcastMessages()
+	// Topics may be created with FsyncInterval whatever the broker default.
+	interval := b.storageCfg.FsyncInterval
+	if interval <= 0 {
+		interval = DefaultStorageConfig().FsyncInterval
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go b.syncPeriodically(interval, done)
 
 	for {
 		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
 		if err != nil {
-			logrus.Errorf("broker: Error accepting connection => %v", err)
+			brokerLog.Errorf("broker: Error accepting connection => %v", err)
 			continue
 		}
 
@@ -76,119 +218,546 @@ func (b *Broker) Start() error {
 	}
 }
 
+// Stop closes the listener and every client connection, so that connectors
+// notice the broker going away, and closes the topic files.
 func (b *Broker) Stop() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
 	if b.listener != nil {
 		(*b.listener).Close()
+		b.listener = nil
+	}
+
+	for conn := range b.conns {
+		conn.Close()
+	}
+
+	for topic, log := range b.topics {
+		log.close()
+		delete(b.topics, topic)
 	}
 }
 
+// Host returns the address clients connect to, which carries the port
+// picked by the broker once it is Ready.
 func (b *Broker) Host() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
 	return b.host
 }
 
+// DataDir returns the directory the broker stores topics in.
+func (b *Broker) DataDir() string {
+	return b.dataDir
+}
+
 // handleConnection receives the initial greeting from a connector to determine
-// whether it is a sink or source, and delegates to the appropriate handler.
+// which protocol it speaks and whether it is a sink or source, and delegates
+// to the appropriate handler.
 func (b *Broker) handleConnection(conn *net.Conn) {
-	defer (*conn).Close()
+	b.mu.Lock()
+	b.conns[*conn] = struct{}{}
+	b.mu.Unlock()
+
+	defer func() {
+		b.mu.Lock()
+		delete(b.conns, *conn)
+		b.mu.Unlock()
+		(*conn).Close()
+	}()
+
+	// Clients that do not identify themselves in time are dropped, so that
+	// unauthenticated connections can not pile up.
+	(*conn).SetDeadline(time.Now().Add(b.security.handshakeTimeout()))
+	if tlsConn, ok := (*conn).(*tls.Conn); ok {
+		if err := tlsConn.Handshake(); err != nil {
+			brokerLog.Warnf("broker: TLS handshake with %s failed: %v", tlsConn.RemoteAddr(), err)
+			return
+		}
+	}
 
 	reader := bufio.NewReader(*conn)
-	greeting, _ := reader.ReadString('\n')
-	greeting = greeting[:len(greeting)-1]
-
-	data := strings.Split(greeting, "_")
-	if data[0] == "sink-connector" {
-		logrus.Debugf("broker: sink-connector connected on topic %s", data[1])
-		b.handleSinkConnector(reader, data[1])
-	} else if data[0] == "source-connector" {
-		logrus.Debugf("broker: source-connector connected on topic %s", data[1])
-		b.handleSourceConnector(conn, data[1])
+	magic, err := reader.Peek(len(protocolMagic))
+	if err != nil {
+		brokerLog.Debugf("broker: connection closed before greeting: %v", err)
+		return
+	}
+
+	if string(magic) == protocolMagic {
+		b.handleBinaryConnection(*conn, reader)
+		return
+	}
+
+	greeting, err := reader.ReadString('\n')
+	if err != nil {
+		brokerLog.Debugf("broker: connection closed before greeting: %v", err)
+		return
+	}
+	(*conn).SetDeadline(time.Time{})
+
+	// The text protocol can not report errors, so rejected clients are
+	// just disconnected.
+	codec := &textCodec{reader: reader, conn: *conn}
+	clientType, topic, _ := parseTextGreeting(greeting)
+	if err := validateTopic(topic); err != nil {
+		brokerLog.Warnf("broker: rejected %s: %v", (*conn).RemoteAddr(), err)
+		return
+	}
+
+	principal, err := b.security.authenticate(*conn, "")
+	if err != nil {
+		brokerLog.Warnf("broker: rejected %s: %v", (*conn).RemoteAddr(), err)
+		return
+	}
+	access := AccessConsume
+	if clientType == textSinkGreeting {
+		access = AccessProduce
+	}
+	if !b.security.authorize(principal, topic, access) {
+		brokerLog.Warnf("broker: %s may not access topic %s as %s", principal, topic, clientType)
+		return
+	}
+
+	if clientType == textSinkGreeting {
+		brokerLog.Debugf("broker: sink-connector connected on topic %s", topic)
+		b.handleSinkConnector(codec, topic, DurabilityNone)
+	} else if clientType == textSourceGreeting {
+		brokerLog.Debugf("broker: source-connector connected on topic %s", topic)
+		b.handleSourceConnector(*conn, codec, topic, 0, "")
 	} else {
-		logrus.Errorf("broker: Unknown client type: %s", data[0])
+		brokerLog.Errorf("broker: Unknown client type: %s", clientType)
 	}
 }
 
-// handleSinkConnector reads messages from a sink connector and appends them to disk.
-// It then broadcasts the message to all connected source connectors for that topic.
-func (b *Broker) handleSinkConnector(reader *bufio.Reader, topic string) {
-	data := fmt.Sprintf("%s/%s", DATA_DIR, topic)
-	if err := ensureDataDirExists(); err != nil {
-		logrus.Fatalf("broker: failed to ensure .data exists: %v", err)
+// handleBinaryConnection negotiates the protocol version and reads the hello
+// frame of a binary protocol client.
+func (b *Broker) handleBinaryConnection(conn net.Conn, reader *bufio.Reader) {
+	codec := &binaryCodec{reader: reader, conn: conn}
+
+	if _, err := reader.Discard(len(protocolMagic)); err != nil {
+		return
+	}
+	version, err := reader.ReadByte()
+	if err != nil {
+		return
+	}
+	if version < minProtocolVersion {
+		codec.writeError(ErrCodeUnsupportedVersion, fmt.Sprintf("protocol version %d is not supported", version))
 		return
 	}
+	codec.version = min(int(version), protocolVersion)
 
-	file, err := os.OpenFile(data, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	f, err := readFrame(reader)
 	if err != nil {
-		logrus.Fatalf("broker: invalid topic: %v", err)
+		brokerLog.Debugf("broker: connection closed before hello: %v", err)
+		return
+	}
+
+	var req hello
+	if f.Type != frameHello || json.Unmarshal(f.Payload, &req) != nil {
+		codec.writeError(ErrCodeBadRequest, "expected hello frame")
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	reply, err := json.Marshal(hello{Version: codec.version})
+	if err != nil {
+		return
+	}
+
+	principal, err := b.security.authenticate(conn, req.Token)
+	if err != nil {
+		brokerLog.Warnf("broker: rejected %s: %v", conn.RemoteAddr(), err)
+		codec.writeError(ErrCodeUnauthorized, err.Error())
+		return
+	}
+	if err := validateHelloTopic(req); err != nil {
+		brokerLog.Warnf("broker: rejected %s: %v", conn.RemoteAddr(), err)
+		codec.writeError(ErrCodeBadRequest, err.Error())
+		return
+	}
+	if !b.authorizeHello(principal, req) {
+		brokerLog.Warnf("broker: %s may not access topic %s as %s", principal, req.Topic, req.Role)
+		codec.writeError(ErrCodeForbidden, fmt.Sprintf("%s may not access topic %q as %s", principal, req.Topic, req.Role))
+		return
+	}
+
+	if req.Group != "" {
+		if err := validateGroup(req.Group); err != nil {
+			codec.writeError(ErrCodeBadRequest, err.Error())
+			return
+		}
+	}
+
+	switch req.Role {
+	case roleSink:
+		if err := writeFrame(conn, frameHello, reply); err != nil {
+			return
+		}
+		brokerLog.Debugf("broker: sink-connector connected on topic %s", req.Topic)
+		b.handleSinkConnector(codec, req.Topic, req.Durability)
+	case roleProducer:
+		if err := writeFrame(conn, frameHello, reply); err != nil {
+			return
+		}
+		brokerLog.Debugf("broker: multiplexed sink-connector connected")
+		b.handleProducer(codec, req.Durability, principal)
+	case roleAdmin:
+		if err := writeFrame(conn, frameHello, reply); err != nil {
+			return
+		}
+		brokerLog.Debugf("broker: admin client connected")
+		b.handleAdmin(codec, principal)
+	case roleSource:
+		if err := writeFrame(conn, frameHello, reply); err != nil {
+			return
+		}
+		if isPattern(req.Topic) {
+			brokerLog.Debugf("broker: source-connector connected on topic pattern %s", req.Topic)
+			b.handlePatternSubscription(conn, codec, req.Topic, req.Offsets, req.Group, principal)
+			return
+		}
+		brokerLog.Debugf("broker: source-connector connected on topic %s from offset %d", req.Topic, req.Offset)
+		b.handleSourceConnector(conn, codec, req.Topic, req.Offset, req.Group)
+	default:
+		brokerLog.Errorf("broker: Unknown client role: %s", req.Role)
+		codec.writeError(ErrCodeBadRequest, fmt.Sprintf("unknown role %q", req.Role))
+	}
+}
+
+// authorizeHello checks the access a client asks for in its hello. Producers
+// and admin clients are checked per request, and pattern subscriptions per
+// matching topic, instead.
+func (b *Broker) authorizeHello(principal string, req hello) bool {
+	switch {
+	case req.Role == roleSink:
+		return b.security.authorize(principal, req.Topic, AccessProduce)
+	case req.Role == roleSource && !isPattern(req.Topic):
+		return b.security.authorize(principal, req.Topic, AccessConsume)
+	default:
+		return true
+	}
+}
+
+// validateHelloTopic checks the topic a sink or source connector connects
+// to. Only source connectors may name a topic pattern.
+func validateHelloTopic(req hello) error {
+	switch {
+	case req.Role == roleSource && isPattern(req.Topic):
+		return validateTopicName(req.Topic)
+	case req.Role == roleSink, req.Role == roleSource:
+		return validateTopic(req.Topic)
+	default:
+		return nil
+	}
+}
+
+// handleSinkConnector reads messages from a sink connector and appends them to disk.
+// Source connectors subscribed to the topic pick them up from the topic log.
+//
+// Unless the connector asked for DurabilityNone, every message is answered
+// with an ack carrying its offset once the requested durability is reached,
+// or with an error frame if it could not be stored.
+//
+// The topic log is looked up for every request, so that writes to a topic
+// deleted in the meantime create it again.
+func (b *Broker) handleSinkConnector(codec codec, topic string, durability Durability) {
+	if _, err := b.openTopic(codec, topic); err != nil {
 		return
 	}
-	defer file.Close()
 
 	for {
-		message, err := reader.ReadString('\n')
+		messages, err := codec.readMessages()
 		if err != nil {
-			logrus.Errorf("broker: Error reading message: %v", err)
+			brokerLog.Errorf("broker: Error reading message: %v", err)
 			return
 		}
 
-		_, err = file.WriteString(message)
+		log, err := b.topicLog(topic)
 		if err != nil {
-			logrus.Errorf("broker: Error writing message: %v", err)
+			brokerLog.Errorf("broker: Error opening topic %s: %v", topic, err)
 			return
 		}
 
-		logrus.Infof("broker: [APPEND] %s <= %s", topic, message)
-		b.newMessage <- struct {
-			Topic   string
-			Message string
-		}{Topic: topic, Message: message}
+		if err := b.appendAndAck(codec, log, topic, messages, durability); err != nil {
+			brokerLog.Errorf("broker: Error acknowledging message: %v", err)
+			return
+		}
 	}
 }
 
-// handleSourceConnector registers a source connector to a topic and replays existing messages.
-// It will remain open indefinitely, receiving messages via broadcast.
-func (b *Broker) handleSourceConnector(conn *net.Conn, topic string) {
-	b.mu.Lock()
-	b.sourceConnectors[topic] = append(b.sourceConnectors[topic], conn)
-	b.mu.Unlock()
-
-	if err := ensureDataDirExists(); err != nil {
-		logrus.Fatalf("broker: failed to ensure .data exists: %v", err)
+// handleProducer reads produce requests for any topic from a multiplexed
+// connection. Requests are handled one at a time, so they are answered in
+// the order they were sent. Requests to topics the principal may not produce
+// to are answered with an error.
+func (b *Broker) handleProducer(codec *binaryCodec, durability Durability, principal string) {
+	if err := b.ensureDataDir(); err != nil {
+		brokerLog.Errorf("broker: failed to create data dir %s: %v", b.dataDir, err)
+		codec.writeError(ErrCodeStorage, err.Error())
 		return
 	}
 
-	data := fmt.Sprintf("%s/%s", DATA_DIR, topic)
-	file, err := os.OpenFile(data, os.O_APPEND|os.O_CREATE|os.O_RDONLY, 0777)
+	for {
+		topic, messages, err := codec.readProduceTo()
+		if err != nil {
+			brokerLog.Errorf("broker: Error reading message: %v", err)
+			return
+		}
+
+		if !b.security.authorize(principal, topic, AccessProduce) {
+			brokerLog.Warnf("broker: %s may not produce to topic %s", principal, topic)
+			if durability != DurabilityNone {
+				codec.writeError(ErrCodeForbidden, fmt.Sprintf("%s may not produce to topic %q", principal, topic))
+			}
+			continue
+		}
+
+		log, err := b.topicLog(topic)
+		if err != nil {
+			brokerLog.Errorf("broker: failed to open topic %q: %v", topic, err)
+			if durability != DurabilityNone {
+				codec.writeError(requestErrorCode(err), err.Error())
+			}
+			continue
+		}
+
+		if err := b.appendAndAck(codec, log, topic, messages, durability); err != nil {
+			brokerLog.Errorf("broker: Error acknowledging message: %v", err)
+			return
+		}
+	}
+}
+
+// appendAndAck stores messages in the topic log and, unless the client asked
+// for DurabilityNone, answers with an ack carrying the offset of the first
+// one once the requested durability is reached, or with an error frame if
+// they could not be stored. It only fails if the client can not be answered.
+func (b *Broker) appendAndAck(codec codec, log *topicLog, topic string, messages []string, durability Durability) error {
+	offset, size, err := log.appendBatch(messages)
+	if err == nil && (durability == DurabilityFsynced || log.config.fsync(b.storageCfg) == FsyncAlways) {
+		err = log.syncTo(size)
+	}
 	if err != nil {
-		logrus.Fatalf("broker: invalid topic: %v", err)
+		brokerLog.Sampledf(logrus.ErrorLevel, "broker: Error writing message: %v", err)
+		if durability != DurabilityNone {
+			return codec.writeError(ErrCodeStorage, err.Error())
+		}
+		return nil
 	}
 
-	defer file.Close()
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		_, err := fmt.Fprintf(*conn, "%s\n", scanner.Text())
-		if err != nil {
-			logrus.Errorf("broker: error writing message to source-connector: %v", err)
+	b.metrics.appended(topic, messages)
+	if brokerLog.Logger.IsLevelEnabled(logrus.DebugLevel) {
+		for _, message := range messages {
+			brokerLog.Sampledf(logrus.DebugLevel, "broker: [APPEND] %s <= %s", topic, logging.Payload([]byte(message)))
+		}
+	}
+	if durability != DurabilityNone {
+		return codec.writeAck(offset)
+	}
+	return nil
+}
+
+// handleSourceConnector registers a source connector to a topic and serves it
+// every message of the topic, from the one stored at offset onwards. Clients
+// resuming after a reconnection use offset to skip what they already got.
+// The subscriber is unregistered and its goroutines released as soon as the
+// client disconnects, a write fails or a heartbeat goes unanswered.
+//
+// Members of a consumer group start from the group's committed offset
+// instead, and the commits they send are recorded for the group.
+func (b *Broker) handleSourceConnector(conn net.Conn, codec codec, topic string, offset int64, group string) {
+	log, err := b.openTopic(codec, topic)
+	if err != nil {
+		return
+	}
+
+	if group != "" {
+		if offset, err = b.groups.offset(group, topic); err != nil {
+			brokerLog.Errorf("broker: failed to read offset of group %s on topic %s: %v", group, topic, err)
 			return
 		}
 	}
 
-	select {}
+	b.mu.Lock()
+	sub := newSubscriber(conn, codec, topic, log, log.config.subscriber(b.subscriberCfg))
+	sub.from = offset
+	sub.group = group
+	b.sourceConnectors[topic] = append(b.sourceConnectors[topic], sub)
+	b.mu.Unlock()
+	log.subscribe(sub)
+	defer b.unsubscribe(sub)
+
+	if binary, ok := codec.(*binaryCodec); ok {
+		sub.watched = true
+		go func() {
+			b.readCommits(binary.reader, group)
+			sub.close()
+		}()
+	}
+
+	if err := sub.run(); err != nil {
+		brokerLog.Errorf("broker: error writing message to source-connector: %v", err)
+	}
 }
 
-// broadcastMessages delivers new messages to all source connectors subscribed to the topic.
-func (b *Broker) broadcastMessages() {
-	for msg := range b.newMessage {
+// syncPeriodically syncs every open topic log with the FsyncInterval policy
+// until done is closed.
+func (b *Broker) syncPeriodically(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
 		b.mu.Lock()
-		for _, conn := range b.sourceConnectors[msg.Topic] {
-			_, err := fmt.Fprintf(*conn, "%s", msg.Message)
-			if err != nil {
-				logrus.Errorf("broker: Error writing message to consumer: %v", err)
+		logs := make([]*topicLog, 0, len(b.topics))
+		for _, log := range b.topics {
+			if log.config.fsync(b.storageCfg) == FsyncInterval {
+				logs = append(logs, log)
 			}
 		}
 		b.mu.Unlock()
+
+		for _, log := range logs {
+			if err := log.sync(); err != nil {
+				brokerLog.Errorf("broker: Error syncing %s: %v", log.path, err)
+			}
+		}
+	}
+}
+
+// openTopic returns the log backing the topic a connector connected to,
+// creating the data directory if needed. Failures are reported to the
+// client, which the caller should then disconnect.
+func (b *Broker) openTopic(codec codec, topic string) (*topicLog, error) {
+	err := b.ensureDataDir()
+	if err != nil {
+		brokerLog.Errorf("broker: failed to create data dir %s: %v", b.dataDir, err)
+		codec.writeError(ErrCodeStorage, err.Error())
+		return nil, err
+	}
+
+	log, err := b.topicLog(topic)
+	if err != nil {
+		brokerLog.Errorf("broker: failed to open topic %q: %v", topic, err)
+		codec.writeError(requestErrorCode(err), err.Error())
+		return nil, err
+	}
+	return log, nil
+}
+
+// topicLog returns the log backing the topic, opening it on first use, at
+// which point subscriptions to matching patterns pick it up.
+func (b *Broker) topicLog(topic string) (*topicLog, error) {
+	if err := validateTopic(topic); err != nil {
+		return nil, err
+	}
+
+	b.mu.Lock()
+	if log, ok := b.topics[topic]; ok {
+		b.mu.Unlock()
+		return log, nil
+	}
+
+	meta, err := loadTopicMeta(b.dataDir, topic)
+	if err != nil {
+		b.mu.Unlock()
+		return nil, err
+	}
+	log, err := openTopicLog(b.topicPath(topic), meta.Start)
+	if err != nil {
+		b.mu.Unlock()
+		return nil, err
+	}
+	log.config = meta.Config.inherit(b.topicDefaultsFor(topic))
+	b.topics[topic] = log
+
+	var matching []*patternSubscription
+	for sub := range b.patterns {
+		if matchTopic(sub.pattern, topic) {
+			matching = append(matching, sub)
+		}
 	}
+	b.mu.Unlock()
+
+	// Subscribed before the caller appends anything, so pattern subscribers
+	// get a new topic from its first message.
+	for _, sub := range matching {
+		b.subscribePattern(sub, topic, log)
+	}
+	return log, nil
+}
+
+// unsubscribe closes a source connector and removes it from its topic.
+func (b *Broker) unsubscribe(sub *subscriber) {
+	sub.close()
+	sub.log.unsubscribe(sub)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	subs := b.sourceConnectors[sub.topic]
+	for i, s := range subs {
+		if s == sub {
+			b.sourceConnectors[sub.topic] = append(subs[:i:i], subs[i+1:]...)
+			break
+		}
+	}
+	if len(b.sourceConnectors[sub.topic]) == 0 {
+		delete(b.sourceConnectors, sub.topic)
+	}
+}
+
+// Subscribers returns the IDs (remote addresses) of the live source
+// connectors, keyed by topic.
+func (b *Broker) Subscribers() map[string][]string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	subscribers := make(map[string][]string, len(b.sourceConnectors))
+	for topic, subs := range b.sourceConnectors {
+		for _, sub := range subs {
+			subscribers[topic] = append(subscribers[topic], sub.id)
+		}
+	}
+	return subscribers
+}
+
+// SubscriberStats reports lag and delivery counters for every source
+// connector currently subscribed to the topic.
+func (b *Broker) SubscriberStats(topic string) []SubscriberStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	stats := make([]SubscriberStats, 0, len(b.sourceConnectors[topic]))
+	for _, sub := range b.sourceConnectors[topic] {
+		stats = append(stats, sub.stats())
+	}
+	return stats
+}
+
+// topicDefaultsFor returns the config of the first TopicDefaults matching
+// the topic.
+func (b *Broker) topicDefaultsFor(topic string) TopicConfig {
+	for _, defaults := range b.topicDefaults {
+		if matchACLTopic(defaults.Topic, topic) {
+			return defaults.Config
+		}
+	}
+	return TopicConfig{}
+}
+
+// topicPath returns the path of the file storing the topic.
+func (b *Broker) topicPath(topic string) string {
+	return filepath.Join(b.dataDir, topic)
 }
 
-func ensureDataDirExists() error {
-	return os.MkdirAll(DATA_DIR, os.ModePerm)
+func (b *Broker) ensureDataDir() error {
+	return os.MkdirAll(b.dataDir, os.ModePerm)
 }
@@ -1,8 +1,21 @@
 package fsbroker
 
 import (
+	"fmt"
+	"goriok/pulses/internal/broker"
+	"goriok/pulses/internal/logging"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -11,3 +24,451 @@ func TestBroker_HostAndOn(t *testing.T) {
 	assert.False(t, b.On())
 	assert.Contains(t, b.Host(), "localhost:12345")
 }
+
+func TestBroker_NotOnAfterStop(t *testing.T) {
+	b := startTestBroker(t, DefaultSubscriberConfig())
+	assert.True(t, b.On())
+
+	b.Stop()
+	assert.False(t, b.On())
+}
+
+func TestBroker_ListenAddrAndDataDir(t *testing.T) {
+	topic := "test." + uuid.New().String() + ".config"
+	cfg := DefaultBrokerConfig()
+	cfg.ListenAddr = "127.0.0.1:0"
+	cfg.DataDir = filepath.Join(t.TempDir(), "nested", "data")
+	b := runTestBroker(t, NewBrokerWithConfig(cfg))
+	assert.True(t, b.On())
+
+	host, port, err := net.SplitHostPort(b.Host())
+	assert.NoError(t, err)
+	assert.Equal(t, "127.0.0.1", host)
+	assert.NotEqual(t, "0", port, "Host must carry the port picked by the broker")
+
+	sink := NewSinkConnectorWithOptions(b.Host(), ConnectorOptions{Durability: DurabilityWritten})
+	defer sink.Close()
+	assert.NoError(t, sink.Connect(topic))
+	assert.NoError(t, sink.Write(topic, []byte("stored")))
+
+	stored, err := os.ReadFile(filepath.Join(cfg.DataDir, topic))
+	assert.NoError(t, err)
+	assert.Equal(t, "stored\n", string(stored))
+	_, err = os.Stat(filepath.Join(DATA_DIR, topic))
+	assert.True(t, os.IsNotExist(err), "nothing must be written to the default data dir")
+}
+
+func TestBroker_TopicDefaults(t *testing.T) {
+	always, dropOldest := FsyncAlways, OverflowDropOldest
+	cfg := testBrokerConfig(t)
+	cfg.Topics = []TopicDefaults{
+		{Topic: "tenants.*.grouped.pulses", Config: TopicConfig{QueueSize: 8}},
+		{Topic: "tenants.>", Config: TopicConfig{Fsync: &always, QueueSize: 16, Overflow: &dropOldest}},
+	}
+	b := NewBrokerWithConfig(cfg)
+
+	log, err := b.topicLog("tenants.a.grouped.pulses")
+	assert.NoError(t, err)
+	assert.Equal(t, TopicConfig{QueueSize: 8}, log.config)
+
+	log, err = b.topicLog("tenants.a.aggregated.pulses")
+	assert.NoError(t, err)
+	assert.Equal(t, FsyncAlways, log.config.fsync(b.storageCfg))
+	subCfg := log.config.subscriber(b.subscriberCfg)
+	assert.Equal(t, 16, subCfg.QueueSize)
+	assert.Equal(t, OverflowDropOldest, subCfg.Overflow)
+
+	log, err = b.topicLog("source.pulses")
+	assert.NoError(t, err)
+	assert.Equal(t, TopicConfig{}, log.config)
+
+	// Settings a topic was created with win over the defaults.
+	never := FsyncNever
+	assert.NoError(t, b.CreateTopic("tenants.b.aggregated.pulses", TopicConfig{Fsync: &never}))
+	log, err = b.topicLog("tenants.b.aggregated.pulses")
+	assert.NoError(t, err)
+	assert.Equal(t, TopicConfig{Fsync: &never, QueueSize: 16, Overflow: &dropOldest}, log.config)
+	b.Stop()
+}
+
+// startTestBroker runs a broker on an ephemeral port, storing its topics in a
+// temporary directory.
+func startTestBroker(t testing.TB, cfg SubscriberConfig) *Broker {
+	brokerCfg := testBrokerConfig(t)
+	brokerCfg.Subscriber = cfg
+	return runTestBroker(t, NewBrokerWithConfig(brokerCfg))
+}
+
+// testBrokerConfig returns the default config, with an ephemeral port and a
+// temporary data directory.
+func testBrokerConfig(t testing.TB) BrokerConfig {
+	cfg := DefaultBrokerConfig()
+	cfg.ListenAddr = "localhost:0"
+	cfg.DataDir = t.TempDir()
+	return cfg
+}
+
+// runTestBroker starts a configured broker and stops it once the test
+// finishes.
+func runTestBroker(t testing.TB, b *Broker) *Broker {
+	serveTestBroker(t, b)
+	t.Cleanup(b.Stop)
+	return b
+}
+
+// restartTestBroker stops b and starts a new broker on the same address and
+// data directory, as after a broker restart.
+func restartTestBroker(t testing.TB, b *Broker) *Broker {
+	b.Stop()
+
+	restarted := NewBrokerWithConfig(BrokerConfig{
+		ListenAddr: b.Host(),
+		DataDir:    b.DataDir(),
+		Storage:    b.storageCfg,
+		Subscriber: b.subscriberCfg,
+		Security:   b.security,
+		Topics:     b.topicDefaults,
+	})
+	serveTestBroker(t, restarted)
+	t.Cleanup(restarted.Stop)
+	return restarted
+}
+
+// serveTestBroker starts b and waits until it accepts connections.
+func serveTestBroker(t testing.TB, b *Broker) {
+	errs := make(chan error, 1)
+	go func() { errs <- b.Start() }()
+
+	select {
+	case <-b.Ready():
+	case err := <-errs:
+		t.Fatalf("broker failed to start: %v", err)
+	case <-time.After(time.Second):
+		t.Fatal("broker did not become ready")
+	}
+}
+
+func TestBroker_SlowConsumerDoesNotStallOtherTopics(t *testing.T) {
+	slowTopic := "test." + uuid.New().String() + ".slow"
+	fastTopic := "test." + uuid.New().String() + ".fast"
+	b := startTestBroker(t, SubscriberConfig{QueueSize: 4, Overflow: OverflowDropOldest})
+
+	// A consumer that subscribes and never reads.
+	slow, err := net.Dial("tcp", b.Host())
+	assert.NoError(t, err)
+	defer slow.Close()
+	fmt.Fprintf(slow, "source-connector_%s\n", slowTopic)
+
+	received := make(chan []byte, 1)
+	fast := NewSourceConnector(b.Host())
+	go fast.Read(fastTopic, broker.BytesHandler(func(_ string, msg []byte) {
+		received <- msg
+	}))
+
+	sink := NewSinkConnector(b.Host())
+	defer sink.Close()
+	assert.NoError(t, sink.Connect(slowTopic))
+	assert.NoError(t, sink.Connect(fastTopic))
+
+	payload := strings.Repeat("x", 64*1024)
+	go func() {
+		for i := 0; i < 256; i++ {
+			sink.Write(slowTopic, []byte(payload))
+		}
+	}()
+
+	assert.Eventually(t, func() bool {
+		stats := b.SubscriberStats(slowTopic)
+		return len(stats) == 1 && stats[0].Dropped > 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	assert.NoError(t, sink.Write(fastTopic, []byte("hello")))
+	select {
+	case msg := <-received:
+		assert.Equal(t, "hello", string(msg))
+	case <-time.After(2 * time.Second):
+		t.Fatal("fast topic consumer was stalled by slow consumer")
+	}
+}
+
+func TestBroker_SlowConsumerBlocksProducersOfItsTopic(t *testing.T) {
+	slowTopic := "test." + uuid.New().String() + ".slow"
+	fastTopic := "test." + uuid.New().String() + ".fast"
+	b := startTestBroker(t, SubscriberConfig{QueueSize: 4, Overflow: OverflowBlock})
+
+	// A consumer that subscribes and never reads.
+	slow, err := net.Dial("tcp", b.Host())
+	assert.NoError(t, err)
+	defer slow.Close()
+	fmt.Fprintf(slow, "source-connector_%s\n", slowTopic)
+	assert.Eventually(t, func() bool {
+		return len(b.SubscriberStats(slowTopic)) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	received := make(chan []byte, 1)
+	fast := NewSourceConnector(b.Host())
+	defer fast.Close()
+	go fast.Read(fastTopic, broker.BytesHandler(func(_ string, msg []byte) {
+		received <- msg
+	}))
+
+	slowSink := NewSinkConnector(b.Host())
+	defer slowSink.Close()
+	assert.NoError(t, slowSink.Connect(slowTopic))
+
+	var written atomic.Int64
+	payload := strings.Repeat("x", 64*1024)
+	go func() {
+		for i := 0; i < 256; i++ {
+			if slowSink.Write(slowTopic, []byte(payload)) != nil {
+				return
+			}
+			written.Add(1)
+		}
+	}()
+
+	// Once the socket buffers are full, the producer waits for the consumer.
+	assert.Eventually(t, func() bool {
+		before := written.Load()
+		time.Sleep(50 * time.Millisecond)
+		return written.Load() == before && before < 256
+	}, 5*time.Second, 10*time.Millisecond)
+	stats := b.SubscriberStats(slowTopic)
+	assert.Greater(t, stats[0].Lag, int64(0))
+	assert.Zero(t, stats[0].Dropped)
+
+	fastSink := NewSinkConnector(b.Host())
+	defer fastSink.Close()
+	assert.NoError(t, fastSink.Connect(fastTopic))
+	assert.NoError(t, fastSink.Write(fastTopic, []byte("hello")))
+	select {
+	case msg := <-received:
+		assert.Equal(t, "hello", string(msg))
+	case <-time.After(2 * time.Second):
+		t.Fatal("fast topic consumer was stalled by slow consumer")
+	}
+}
+
+func TestBroker_UnregistersDisconnectedSubscribers(t *testing.T) {
+	topic := "test." + uuid.New().String() + ".gone"
+	b := startTestBroker(t, DefaultSubscriberConfig())
+
+	conn, err := net.Dial("tcp", b.Host())
+	assert.NoError(t, err)
+	fmt.Fprintf(conn, "source-connector_%s\n", topic)
+
+	assert.Eventually(t, func() bool {
+		return len(b.Subscribers()[topic]) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	conn.Close()
+
+	assert.Eventually(t, func() bool {
+		_, ok := b.Subscribers()[topic]
+		return !ok
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestBroker_GapFreeHandoffUnderConcurrency(t *testing.T) {
+	const (
+		producers   = 4
+		perProducer = 250
+		subscribers = 6
+	)
+
+	topic := "test." + uuid.New().String() + ".stress"
+	b := startTestBroker(t, DefaultSubscriberConfig())
+
+	var wg sync.WaitGroup
+	received := make([][]string, subscribers)
+	var mu sync.Mutex
+	total := producers * perProducer
+
+	subscribe := func(i int) {
+		source := NewSourceConnector(b.Host())
+		done := make(chan struct{})
+		go source.Read(topic, broker.BytesHandler(func(_ string, msg []byte) {
+			mu.Lock()
+			received[i] = append(received[i], string(msg))
+			n := len(received[i])
+			mu.Unlock()
+			if n == total {
+				close(done)
+			}
+		}))
+		t.Cleanup(func() { source.Close() })
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			select {
+			case <-done:
+			case <-time.After(10 * time.Second):
+			}
+		}()
+	}
+
+	var producing sync.WaitGroup
+	for p := 0; p < producers; p++ {
+		producing.Add(1)
+		go func(p int) {
+			defer producing.Done()
+			sink := NewSinkConnector(b.Host())
+			defer sink.Close()
+			assert.NoError(t, sink.Connect(topic))
+			for i := 0; i < perProducer; i++ {
+				sink.Write(topic, []byte(fmt.Sprintf("producer-%d-%d", p, i)))
+			}
+		}(p)
+	}
+
+	// Subscribers join at different points while producers are writing.
+	for i := 0; i < subscribers; i++ {
+		subscribe(i)
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	producing.Wait()
+	wg.Wait()
+
+	stored, err := os.ReadFile(b.topicPath(topic))
+	assert.NoError(t, err)
+	expected := strings.Split(string(stored), "\n")
+	expected = expected[:len(expected)-1]
+	assert.Len(t, expected, total)
+
+	mu.Lock()
+	defer mu.Unlock()
+	for i := range received {
+		assert.Equal(t, expected, received[i], "subscriber %d", i)
+	}
+}
+
+func TestBroker_BinaryProtocolTopicWithUnderscore(t *testing.T) {
+	topic := "test_" + uuid.New().String() + "_underscored"
+	b := startTestBroker(t, DefaultSubscriberConfig())
+
+	sink := NewSinkConnector(b.Host())
+	defer sink.Close()
+	assert.NoError(t, sink.Connect(topic))
+	assert.NoError(t, sink.Write(topic, []byte(`{"a":1}`)))
+
+	received := make(chan string, 1)
+	source := NewSourceConnector(b.Host())
+	go source.Read(topic, broker.BytesHandler(func(got string, msg []byte) {
+		assert.Equal(t, topic, got)
+		received <- string(msg)
+	}))
+
+	select {
+	case msg := <-received:
+		assert.Equal(t, `{"a":1}`, msg)
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for message")
+	}
+
+	stored, err := os.ReadFile(b.topicPath(topic))
+	assert.NoError(t, err)
+	assert.Equal(t, "{\"a\":1}\n", string(stored))
+}
+
+func TestBroker_TextAndBinaryClientsInteroperate(t *testing.T) {
+	topic := "test." + uuid.New().String() + ".compat"
+	b := startTestBroker(t, DefaultSubscriberConfig())
+
+	textOpts := ConnectorOptions{Protocol: ProtocolText}
+	textSink := NewSinkConnectorWithOptions(b.Host(), textOpts)
+	defer textSink.Close()
+	assert.NoError(t, textSink.Connect(topic))
+	assert.NoError(t, textSink.Write(topic, []byte("from-text")))
+
+	binarySink := NewSinkConnector(b.Host())
+	defer binarySink.Close()
+	assert.NoError(t, binarySink.Connect(topic))
+	assert.NoError(t, binarySink.Write(topic, []byte("from-binary")))
+
+	textReceived := make(chan string, 2)
+	go NewSourceConnectorWithOptions(b.Host(), textOpts).Read(topic, broker.BytesHandler(func(_ string, msg []byte) {
+		textReceived <- string(msg)
+	}))
+
+	binaryReceived := make(chan string, 2)
+	go NewSourceConnector(b.Host()).Read(topic, broker.BytesHandler(func(_ string, msg []byte) {
+		binaryReceived <- string(msg)
+	}))
+
+	var text, binary []string
+	timeout := time.After(2 * time.Second)
+	for len(text) < 2 || len(binary) < 2 {
+		select {
+		case msg := <-textReceived:
+			text = append(text, msg)
+		case msg := <-binaryReceived:
+			binary = append(binary, msg)
+		case <-timeout:
+			t.Fatalf("timeout: text=%v binary=%v", text, binary)
+		}
+	}
+
+	assert.ElementsMatch(t, []string{"from-text\n", "from-binary\n"}, text)
+	assert.ElementsMatch(t, []string{"from-text", "from-binary"}, binary)
+}
+
+func TestBroker_FsyncInterval(t *testing.T) {
+	topic := "test." + uuid.New().String() + ".interval"
+
+	cfg := testBrokerConfig(t)
+	cfg.Storage = StorageConfig{Fsync: FsyncInterval, FsyncInterval: 10 * time.Millisecond}
+	b := runTestBroker(t, NewBrokerWithConfig(cfg))
+
+	sink := NewSinkConnectorWithOptions(b.Host(), ConnectorOptions{Durability: DurabilityWritten})
+	defer sink.Close()
+	assert.NoError(t, sink.Connect(topic))
+	assert.NoError(t, sink.Write(topic, []byte("one")))
+
+	log, err := b.topicLog(topic)
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		size, _, _ := log.head()
+		return log.synced.Load() == size
+	}, time.Second, 10*time.Millisecond)
+}
+
+// lockedBuffer is a log output the test reads while the broker writes to it.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf strings.Builder
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestBroker_AppendLogRedactsPayloads(t *testing.T) {
+	var out lockedBuffer
+	cfg := logging.DefaultConfig()
+	cfg.Levels = map[string]logrus.Level{"broker": logrus.DebugLevel}
+	cfg.SampleInterval = 0
+	cfg.Output = &out
+	assert.NoError(t, logging.Configure(cfg))
+	defer logging.Configure(logging.DefaultConfig())
+
+	topic := "test." + uuid.New().String() + ".redacted"
+	b := startTestBroker(t, DefaultSubscriberConfig())
+	sink := NewSinkConnector(b.Host())
+	defer sink.Close()
+	assert.NoError(t, sink.Connect(topic))
+	assert.NoError(t, sink.Write(topic, []byte(`{"tenant_id":"secret"}`)))
+
+	logged := out.String()
+	assert.Regexp(t, `\[APPEND\] `+regexp.QuoteMeta(topic)+` <= <redacted \d+ bytes>`, logged)
+	assert.NotContains(t, logged, "secret")
+}
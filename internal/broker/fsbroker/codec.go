@@ -0,0 +1,195 @@
+package fsbroker
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+)
+
+// codec is the broker side of a connection, hiding which protocol the client
+// negotiated. Messages are passed around as topic log entries, newline
+// terminated, as they are stored in the topic log.
+type codec interface {
+	// readMessages returns the next message, or batch of messages, produced
+	// by a sink connector.
+	readMessages() ([]string, error)
+	// writeMessage delivers a message stored at offset to a source connector.
+	writeMessage(offset int64, message string) error
+	writeHeartbeat() error
+	// writeAck confirms to a sink connector that its message was stored at
+	// offset, if the protocol allows it.
+	writeAck(offset int64) error
+	// writeError reports a failed request to the client, if the protocol
+	// allows it.
+	writeError(code ErrorCode, message string) error
+}
+
+// errUndeliverable is returned by codecs for messages their protocol can not
+// carry. Subscribers skip them.
+var errUndeliverable = errors.New("message can not be carried by the protocol")
+
+// textCodec speaks the newline-delimited text protocol, which carries bare
+// message values without metadata, and only values that fit on one line.
+type textCodec struct {
+	reader *bufio.Reader
+	conn   net.Conn
+}
+
+func (c *textCodec) readMessages() ([]string, error) {
+	message, err := c.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	return []string{escapeEntry(strings.TrimSuffix(message, "\n")) + "\n"}, nil
+}
+
+// writeMessage writes the value of the message as a line. A value that
+// reads as a heartbeat, or spans several lines, is not written.
+func (c *textCodec) writeMessage(_ int64, message string) error {
+	value := stripEntry(strings.TrimSuffix(message, "\n"))
+	if strings.Contains(value, "\n") {
+		return fmt.Errorf("%w: value spans several lines", errUndeliverable)
+	}
+	line := value + "\n"
+	if line == heartbeat {
+		return fmt.Errorf("%w: value is a text protocol heartbeat", errUndeliverable)
+	}
+	_, err := io.WriteString(c.conn, line)
+	return err
+}
+
+func (c *textCodec) writeHeartbeat() error {
+	_, err := io.WriteString(c.conn, heartbeat)
+	return err
+}
+
+func (c *textCodec) writeAck(int64) error {
+	return nil
+}
+
+func (c *textCodec) writeError(ErrorCode, string) error {
+	return nil
+}
+
+// binaryCodec speaks the length-prefixed frame protocol, in the version
+// negotiated with the client.
+type binaryCodec struct {
+	reader  *bufio.Reader
+	conn    net.Conn
+	version int
+}
+
+func (c *binaryCodec) readMessages() ([]string, error) {
+	for {
+		f, err := readFrame(c.reader)
+		if err != nil {
+			return nil, err
+		}
+
+		var payloads [][]byte
+		switch f.Type {
+		case frameProduce:
+			payloads = [][]byte{f.Payload}
+		case frameProduceBatch:
+			payloads, err = decodeBatch(f.Payload)
+			if err != nil {
+				c.writeError(ErrCodeBadRequest, err.Error())
+				continue
+			}
+		case frameHeartbeat:
+			continue
+		default:
+			c.writeError(ErrCodeBadRequest, fmt.Sprintf("unexpected %s frame", f.Type))
+			continue
+		}
+
+		messages, err := c.entriesOf(payloads)
+		if err != nil {
+			c.writeError(ErrCodeInvalidMessage, err.Error())
+			continue
+		}
+		return messages, nil
+	}
+}
+
+// readProduceTo returns the next topic and batch of messages produced over
+// a multiplexed connection. Malformed or invalid requests are answered with
+// an error frame and skipped.
+func (c *binaryCodec) readProduceTo() (string, []string, error) {
+	for {
+		f, err := readFrame(c.reader)
+		if err != nil {
+			return "", nil, err
+		}
+
+		switch f.Type {
+		case frameProduceTo:
+		case frameHeartbeat:
+			continue
+		default:
+			c.writeError(ErrCodeBadRequest, fmt.Sprintf("unexpected %s frame", f.Type))
+			continue
+		}
+
+		topic, payloads, err := decodeProduceTo(f.Payload)
+		if err != nil {
+			c.writeError(ErrCodeBadRequest, err.Error())
+			continue
+		}
+		messages, err := c.entriesOf(payloads)
+		if err != nil {
+			c.writeError(ErrCodeInvalidMessage, err.Error())
+			continue
+		}
+		return topic, messages, nil
+	}
+}
+
+// entriesOf turns produced payloads into newline terminated log entries.
+// Before version 2, payloads are bare values and escaped like any other.
+// From version 2 on, they are entries already, and the whole batch is
+// rejected if any contains a newline or malformed metadata.
+func (c *binaryCodec) entriesOf(payloads [][]byte) ([]string, error) {
+	messages := make([]string, 0, len(payloads))
+	for _, payload := range payloads {
+		message := string(payload)
+		if c.version < 2 {
+			message = escapeEntry(message)
+		} else if strings.Contains(message, "\n") {
+			return nil, errors.New("message must not contain newlines")
+		} else if _, err := decodeEntry(payload); err != nil {
+			return nil, err
+		}
+		messages = append(messages, message+"\n")
+	}
+	return messages, nil
+}
+
+// deliverable returns what to deliver of a topic log entry: the entry itself
+// from version 2 on, its bare value before.
+func (c *binaryCodec) deliverable(message string) []byte {
+	message = strings.TrimSuffix(message, "\n")
+	if c.version < 2 {
+		message = stripEntry(message)
+	}
+	return []byte(message)
+}
+
+func (c *binaryCodec) writeMessage(offset int64, message string) error {
+	return writeFrame(c.conn, frameDeliver, encodeDeliver(offset, c.deliverable(message)))
+}
+
+func (c *binaryCodec) writeHeartbeat() error {
+	return writeFrame(c.conn, frameHeartbeat, nil)
+}
+
+func (c *binaryCodec) writeAck(offset int64) error {
+	return writeFrame(c.conn, frameAck, encodeAck(offset))
+}
+
+func (c *binaryCodec) writeError(code ErrorCode, message string) error {
+	return writeFrame(c.conn, frameError, encodeError(code, message))
+}
@@ -0,0 +1,125 @@
+package fsbroker
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBinaryCodec_RejectsEmbeddedNewlines(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	codec := &binaryCodec{reader: bufio.NewReader(server), conn: server, version: protocolVersion}
+
+	errs := make(chan *BrokerError, 1)
+	go func() {
+		writeFrame(client, frameProduce, []byte("first\nsecond"))
+		f, _ := readFrame(client)
+		errs <- decodeError(f.Payload)
+		writeFrame(client, frameProduce, []byte("valid"))
+	}()
+
+	messages, err := codec.readMessages()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"valid\n"}, messages)
+	assert.Equal(t, ErrCodeInvalidMessage, (<-errs).Code)
+}
+
+func TestBinaryCodec_WriteMessage(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	codec := &binaryCodec{reader: bufio.NewReader(server), conn: server}
+	go codec.writeMessage(7, "payload\n")
+
+	f, err := readFrame(client)
+	assert.NoError(t, err)
+	assert.Equal(t, frameDeliver, f.Type)
+
+	offset, message, err := decodeDeliver(f.Payload)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(7), offset)
+	assert.Equal(t, "payload", string(message))
+}
+
+func TestBinaryCodec_ReadBatch(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	codec := &binaryCodec{reader: bufio.NewReader(server), conn: server}
+	go writeFrame(client, frameProduceBatch, encodeBatch([][]byte{[]byte("one"), []byte("two")}))
+
+	messages, err := codec.readMessages()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"one\n", "two\n"}, messages)
+}
+
+func TestBinaryCodec_Version1(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	codec := &binaryCodec{reader: bufio.NewReader(server), conn: server, version: 1}
+	go writeFrame(client, frameProduce, []byte("\x1eraw"))
+
+	messages, err := codec.readMessages()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"\x1e{}\x1e\x1eraw\n"}, messages, "version 1 messages are escaped")
+
+	go codec.writeMessage(3, "\x1e{\"headers\":{\"k\":\"v\"}}\x1epayload\n")
+	f, err := readFrame(client)
+	assert.NoError(t, err)
+	_, message, err := decodeDeliver(f.Payload)
+	assert.NoError(t, err)
+	assert.Equal(t, "payload", string(message), "version 1 clients do not receive metadata")
+}
+
+func TestBinaryCodec_Version1_EscapesNewlines(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	codec := &binaryCodec{reader: bufio.NewReader(server), conn: server, version: 1}
+	go writeFrame(client, frameProduce, []byte("first\nsecond"))
+
+	messages, err := codec.readMessages()
+	assert.NoError(t, err)
+	if assert.Len(t, messages, 1) {
+		assert.Equal(t, 1, strings.Count(messages[0], "\n"), "entries stay on a single line")
+	}
+
+	go codec.writeMessage(0, messages[0])
+	f, err := readFrame(client)
+	assert.NoError(t, err)
+	_, message, err := decodeDeliver(f.Payload)
+	assert.NoError(t, err)
+	assert.Equal(t, "first\nsecond", string(message))
+}
+
+func TestBinaryCodec_RejectsMalformedMetadata(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	codec := &binaryCodec{reader: bufio.NewReader(server), conn: server, version: protocolVersion}
+
+	errs := make(chan *BrokerError, 1)
+	go func() {
+		writeFrame(client, frameProduce, []byte("\x1enot json\x1epayload"))
+		f, _ := readFrame(client)
+		errs <- decodeError(f.Payload)
+		writeFrame(client, frameProduce, []byte("\x1e{\"headers\":{\"k\":\"v\"}}\x1epayload"))
+	}()
+
+	messages, err := codec.readMessages()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"\x1e{\"headers\":{\"k\":\"v\"}}\x1epayload\n"}, messages)
+	assert.Equal(t, ErrCodeInvalidMessage, (<-errs).Code)
+}
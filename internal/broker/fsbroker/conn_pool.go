@@ -0,0 +1,401 @@
+package fsbroker
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// defaultIdleTimeout is used when ConnectorOptions.IdleTimeout is not set.
+const defaultIdleTimeout = 5 * time.Minute
+
+var errSinkClosed = errors.New("sink-connector: sink-connector closed")
+
+// connPool holds the connections of a sink connector, one per topic. The
+// pool lock only guards the set of topics; each topic has its own lock, held
+// while dialing and for the whole of a produce request, so that writers to
+// different topics never wait on each other.
+//
+// Connections unused for the idle timeout are closed in the background and
+// dialed again on the next write.
+type connPool struct {
+	broker      string
+	opts        ConnectorOptions
+	idleTimeout time.Duration
+
+	mu        sync.Mutex
+	topics    map[string]*topicConn
+	reaper    sync.Once
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// topicConn is the connection to one topic, along with the messages buffered
+// for it while reconnecting. All fields are guarded by mu. conn is also
+// guarded by connMu, so that it can be closed while a request holds mu.
+type topicConn struct {
+	pool  *connPool
+	topic string
+
+	mu           sync.Mutex
+	connMu       sync.Mutex
+	conn         net.Conn
+	reader       *bufio.Reader
+	lastUsed     time.Time
+	buffer       [][]byte
+	reconnecting bool
+}
+
+func newConnPool(broker string, opts ConnectorOptions) *connPool {
+	idleTimeout := opts.IdleTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = defaultIdleTimeout
+	}
+
+	return &connPool{
+		broker:      broker,
+		opts:        opts,
+		idleTimeout: idleTimeout,
+		topics:      make(map[string]*topicConn),
+		closed:      make(chan struct{}),
+	}
+}
+
+// get returns the connection of a topic, or nil if the topic was never
+// connected.
+func (p *connPool) get(topic string) *topicConn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.topics[topic]
+}
+
+// all returns every topic connection of the pool.
+func (p *connPool) all() []*topicConn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	conns := make([]*topicConn, 0, len(p.topics))
+	for _, t := range p.topics {
+		conns = append(conns, t)
+	}
+	return conns
+}
+
+// connect makes sure the topic has a connection. With reconnection enabled,
+// a failed dial is retried in the background and connect succeeds right
+// away, so that writes are buffered meanwhile.
+func (p *connPool) connect(topic string) error {
+	if p.isClosed() {
+		return errSinkClosed
+	}
+
+	p.mu.Lock()
+	t, ok := p.topics[topic]
+	if !ok {
+		t = &topicConn{pool: p, topic: topic}
+		p.topics[topic] = t
+	}
+	p.mu.Unlock()
+	p.reaper.Do(func() { go p.evictIdle() })
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.conn != nil || t.reconnecting {
+		return nil
+	}
+
+	err := t.dialLocked()
+	if err != nil && p.opts.Reconnect.Enabled && retryable(err) {
+		connectorLog.Warnf("sink-connector: failed to connect to broker %s for topic %s, retrying: %v", p.broker, topic, err)
+		p.opts.notify(topic, StateDisconnected, err)
+		t.startReconnectLocked()
+		return nil
+	}
+	return err
+}
+
+// produce sends messages to the topic as a single request.
+func (p *connPool) produce(topic string, messages [][]byte) (int64, error) {
+	t := p.get(topic)
+	if t == nil {
+		return -1, fmt.Errorf("sink-connector: sink-connector not connected")
+	}
+	if p.isClosed() {
+		return -1, errSinkClosed
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.produceLocked(messages)
+}
+
+func (p *connPool) isClosed() bool {
+	select {
+	case <-p.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// evictIdle periodically closes connections unused for the idle timeout,
+// until the pool is closed. Topics busy with a request are left alone.
+func (p *connPool) evictIdle() {
+	ticker := time.NewTicker(p.idleTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.closed:
+			return
+		case now := <-ticker.C:
+			for _, t := range p.all() {
+				if !t.mu.TryLock() {
+					continue
+				}
+				if t.conn != nil && now.Sub(t.lastUsed) >= p.idleTimeout {
+					connectorLog.Debugf("sink-connector: closing idle connection for topic %s", t.topic)
+					t.dropLocked()
+				}
+				t.mu.Unlock()
+			}
+		}
+	}
+}
+
+// close closes every connection and stops background work. Requests in
+// flight fail, and messages still buffered for reconnection are lost.
+func (p *connPool) close() {
+	p.closeOnce.Do(func() { close(p.closed) })
+
+	conns := p.all()
+	for _, t := range conns {
+		t.interrupt()
+	}
+	for _, t := range conns {
+		t.mu.Lock()
+		if t.conn != nil {
+			t.dropLocked()
+			p.opts.notify(t.topic, StateClosed, nil)
+		}
+		if len(t.buffer) > 0 {
+			connectorLog.Warnf("sink-connector: closed with %d undelivered messages for topic %s", len(t.buffer), t.topic)
+			t.buffer = nil
+		}
+		t.mu.Unlock()
+	}
+}
+
+// produceLocked sends messages as a single request, dialing first if the
+// connection was closed for being idle or dead. If the connection turns out
+// to be dead it is dropped and, with reconnection enabled, the messages are
+// buffered for the next connection instead.
+func (t *topicConn) produceLocked(messages [][]byte) (int64, error) {
+	opts := t.pool.opts
+
+	if t.reconnecting {
+		return -1, t.bufferLocked(messages)
+	}
+
+	var err error
+	if t.conn == nil {
+		err = t.dialLocked()
+	}
+
+	if err == nil {
+		var offset int64
+		offset, err = t.sendLocked(messages)
+		var brokerErr *BrokerError
+		if err == nil || errors.As(err, &brokerErr) {
+			return offset, err
+		}
+
+		connectorLog.Errorf("sink-connector: lost connection to broker %s for topic %s: %v", t.pool.broker, t.topic, err)
+		t.dropLocked()
+	}
+
+	opts.notify(t.topic, StateDisconnected, err)
+	if !opts.Reconnect.Enabled || !retryable(err) {
+		return -1, err
+	}
+
+	t.startReconnectLocked()
+	return -1, t.bufferLocked(messages)
+}
+
+// sendLocked writes messages over the connection and waits for the broker's
+// answer.
+func (t *topicConn) sendLocked(messages [][]byte) (int64, error) {
+	if t.pool.opts.Protocol == ProtocolText {
+		for _, msg := range messages {
+			if _, err := fmt.Fprintf(t.conn, "%s\n", msg); err != nil {
+				return -1, err
+			}
+		}
+		t.lastUsed = time.Now()
+		return -1, nil
+	}
+
+	var err error
+	if len(messages) == 1 {
+		err = writeFrame(t.conn, frameProduce, messages[0])
+	} else {
+		err = writeFrame(t.conn, frameProduceBatch, encodeBatch(messages))
+	}
+	if err != nil {
+		return -1, err
+	}
+
+	offset, err := t.readAckLocked()
+	t.lastUsed = time.Now()
+	return offset, err
+}
+
+// readAckLocked waits for the broker's answer to a produce request, unless
+// the connector does not ask for acknowledgements.
+func (t *topicConn) readAckLocked() (int64, error) {
+	if t.pool.opts.Durability == DurabilityNone {
+		return -1, nil
+	}
+
+	reply, err := readFrame(t.reader)
+	if err != nil {
+		return -1, err
+	}
+	switch reply.Type {
+	case frameAck:
+		return decodeAck(reply.Payload)
+	case frameError:
+		return -1, decodeError(reply.Payload)
+	default:
+		return -1, fmt.Errorf("sink-connector: unexpected %s frame", reply.Type)
+	}
+}
+
+func (t *topicConn) dialLocked() error {
+	opts := t.pool.opts
+	opts.notify(t.topic, StateConnecting, nil)
+
+	conn, err := dial(t.pool.broker, opts)
+	if err != nil {
+		return err
+	}
+	reader, err := handshake(conn, opts, roleSink, t.topic, nil)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	t.connMu.Lock()
+	t.conn = conn
+	t.connMu.Unlock()
+	t.reader = reader
+	t.lastUsed = time.Now()
+
+	connectorLog.Infof("sink-connector: connected to broker %s for topic %s", t.pool.broker, t.topic)
+	opts.notify(t.topic, StateConnected, nil)
+	return nil
+}
+
+func (t *topicConn) dropLocked() {
+	t.connMu.Lock()
+	defer t.connMu.Unlock()
+
+	if t.conn != nil {
+		t.conn.Close()
+	}
+	t.conn = nil
+	t.reader = nil
+}
+
+// interrupt closes the connection without waiting for the request in flight,
+// which then fails.
+func (t *topicConn) interrupt() {
+	t.connMu.Lock()
+	defer t.connMu.Unlock()
+
+	if t.conn != nil {
+		t.conn.Close()
+	}
+}
+
+// bufferLocked keeps messages until the topic is reconnected.
+func (t *topicConn) bufferLocked(messages [][]byte) error {
+	if len(t.buffer)+len(messages) > t.pool.opts.Reconnect.BufferSize {
+		return ErrBufferFull
+	}
+	t.buffer = append(t.buffer, messages...)
+	return nil
+}
+
+func (t *topicConn) startReconnectLocked() {
+	if t.reconnecting {
+		return
+	}
+	t.reconnecting = true
+	go t.reconnect()
+}
+
+// reconnect dials the broker with backoff until it succeeds, then sends the
+// buffered messages ahead of any new write. When it gives up, the buffered
+// messages are dropped and the next write starts over.
+func (t *topicConn) reconnect() {
+	policy := t.pool.opts.Reconnect
+
+	for attempt := 0; ; attempt++ {
+		if !policy.sleep(attempt, t.pool.closed) {
+			t.mu.Lock()
+			t.reconnecting = false
+			t.mu.Unlock()
+			return
+		}
+
+		t.mu.Lock()
+		err := t.dialLocked()
+		if err == nil {
+			err = t.flushBufferLocked()
+		}
+		if err == nil {
+			t.reconnecting = false
+			t.mu.Unlock()
+			return
+		}
+
+		connectorLog.Warnf("sink-connector: reconnecting to broker %s for topic %s: %v", t.pool.broker, t.topic, err)
+		t.pool.opts.notify(t.topic, StateDisconnected, err)
+
+		giveUp := !retryable(err) || policy.exhausted(attempt+1)
+		if giveUp {
+			connectorLog.Errorf("sink-connector: giving up on topic %s after %d attempts, dropping %d buffered messages", t.topic, attempt+1, len(t.buffer))
+			t.buffer = nil
+			t.reconnecting = false
+		}
+		t.mu.Unlock()
+
+		if giveUp {
+			return
+		}
+	}
+}
+
+// flushBufferLocked sends the buffered messages as a single request. On
+// failure the connection is dropped and the messages are kept.
+func (t *topicConn) flushBufferLocked() error {
+	if len(t.buffer) == 0 {
+		return nil
+	}
+
+	if _, err := t.sendLocked(t.buffer); err != nil {
+		t.dropLocked()
+		return err
+	}
+
+	connectorLog.Infof("sink-connector: sent %d buffered messages to topic %s", len(t.buffer), t.topic)
+	t.buffer = nil
+	return nil
+}
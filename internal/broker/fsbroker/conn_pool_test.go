@@ -0,0 +1,168 @@
+package fsbroker
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSinkConnector_ConcurrentTopics(t *testing.T) {
+	const (
+		topics  = 20
+		writers = 4
+		writes  = 25
+	)
+
+	for _, multiplex := range []bool{false, true} {
+		t.Run(fmt.Sprintf("multiplex=%t", multiplex), func(t *testing.T) {
+			names := make([]string, topics)
+			for i := range names {
+				names[i] = "test." + uuid.New().String() + ".pool"
+			}
+			b := startTestBroker(t, DefaultSubscriberConfig())
+
+			opts := DefaultConnectorOptions()
+			opts.Multiplex = multiplex
+			sink := NewSinkConnectorWithOptions(b.Host(), opts)
+			defer sink.Close()
+
+			var wg sync.WaitGroup
+			for _, topic := range names {
+				for w := 0; w < writers; w++ {
+					wg.Add(1)
+					go func(topic string, w int) {
+						defer wg.Done()
+						for i := 0; i < writes; i++ {
+							assert.NoError(t, sink.Connect(topic))
+							assert.NoError(t, sink.Write(topic, []byte(fmt.Sprintf("writer-%d-%d", w, i))))
+						}
+					}(topic, w)
+				}
+			}
+			wg.Wait()
+
+			for _, topic := range names {
+				stored, err := os.ReadFile(b.topicPath(topic))
+				assert.NoError(t, err)
+				assert.Len(t, strings.Split(strings.TrimSuffix(string(stored), "\n"), "\n"), writers*writes, topic)
+			}
+		})
+	}
+}
+
+func TestSinkConnector_EvictsIdleConnections(t *testing.T) {
+	topic := "test." + uuid.New().String() + ".idle"
+	b := startTestBroker(t, DefaultSubscriberConfig())
+
+	opts := DefaultConnectorOptions()
+	opts.IdleTimeout = 20 * time.Millisecond
+	sink := NewSinkConnectorWithOptions(b.Host(), opts)
+	defer sink.Close()
+
+	assert.NoError(t, sink.Connect(topic))
+	assert.NoError(t, sink.Write(topic, []byte("one")))
+
+	assert.Eventually(t, func() bool {
+		conn := sink.conns.(*connPool).get(topic)
+		conn.mu.Lock()
+		defer conn.mu.Unlock()
+		return conn.conn == nil
+	}, time.Second, 5*time.Millisecond)
+
+	assert.NoError(t, sink.Write(topic, []byte("two")))
+
+	stored, err := os.ReadFile(b.topicPath(topic))
+	assert.NoError(t, err)
+	assert.Equal(t, "one\ntwo\n", string(stored))
+}
+
+func TestSinkConnector_SlowTopicDoesNotBlockOthers(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer ln.Close()
+
+	// The fake broker acknowledges every write except on the stuck topic.
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+
+				reader := bufio.NewReader(conn)
+				reader.Discard(len(protocolMagic) + 1)
+				f, err := readFrame(reader)
+				if err != nil {
+					return
+				}
+				var req hello
+				json.Unmarshal(f.Payload, &req)
+				writeFrame(conn, frameHello, []byte(fmt.Sprintf(`{"version":%d}`, protocolVersion)))
+
+				for offset := int64(0); ; offset++ {
+					if _, err := readFrame(reader); err != nil {
+						return
+					}
+					if req.Topic != "stuck.topic" {
+						writeFrame(conn, frameAck, encodeAck(offset))
+					}
+				}
+			}()
+		}
+	}()
+
+	sink := NewSinkConnectorWithOptions(ln.Addr().String(), ConnectorOptions{Durability: DurabilityWritten})
+	defer sink.Close()
+	assert.NoError(t, sink.Connect("stuck.topic"))
+	assert.NoError(t, sink.Connect("fast.topic"))
+
+	go sink.Write("stuck.topic", []byte("never acknowledged"))
+	time.Sleep(20 * time.Millisecond)
+
+	done := make(chan error)
+	go func() {
+		done <- sink.Write("fast.topic", []byte("one"))
+	}()
+
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("write to fast.topic blocked by stuck.topic")
+	}
+}
+
+func TestSinkConnector_CloseWhileWriting(t *testing.T) {
+	topic := "test." + uuid.New().String() + ".closing"
+	b := startTestBroker(t, DefaultSubscriberConfig())
+
+	sink := NewSinkConnector(b.Host())
+	assert.NoError(t, sink.Connect(topic))
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for sink.Write(topic, []byte("message")) == nil {
+			}
+		}()
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	sink.Close()
+	wg.Wait()
+
+	assert.Error(t, sink.Connect(topic))
+}
@@ -0,0 +1,111 @@
+package fsbroker
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"goriok/pulses/internal/broker"
+	"time"
+)
+
+// entryMarker opens and closes the metadata of a topic log entry.
+//
+// An entry is stored as the message value itself when the message has no
+// key, headers or timestamp. Otherwise it is an envelope: entryMarker, the
+// metadata as a JSON object, entryMarker again and then the value. JSON
+// escapes newlines and control characters, the marker included, so entries
+// stay on a single line and the first marker after the opening one always
+// closes the metadata. Values without metadata that start with the marker
+// are wrapped in an envelope with no metadata, so that they are not
+// mistaken for one, and values containing newlines are moved into the
+// metadata, so that they do not break the entry over several lines.
+const entryMarker = '\x1e'
+
+var errMalformedEntry = errors.New("malformed message metadata")
+
+// entryMetadata is the JSON object of an envelope. The timestamp is in Unix
+// nanoseconds. Value holds values containing newlines, which then do not
+// follow the envelope.
+type entryMetadata struct {
+	Key       []byte            `json:"key,omitempty"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	Timestamp int64             `json:"ts,omitempty"`
+	Value     []byte            `json:"value,omitempty"`
+}
+
+// encodeEntry returns the topic log entry of a message. Its topic and
+// offset are not part of it.
+func encodeEntry(msg broker.Message) ([]byte, error) {
+	meta := entryMetadata{Key: msg.Key, Headers: msg.Headers}
+	if !msg.Timestamp.IsZero() {
+		meta.Timestamp = msg.Timestamp.UnixNano()
+	}
+
+	value := msg.Value
+	if bytes.IndexByte(value, '\n') >= 0 {
+		meta.Value, value = value, nil
+	}
+
+	bare := len(meta.Key) == 0 && len(meta.Headers) == 0 && meta.Timestamp == 0 && meta.Value == nil
+	if bare && (len(value) == 0 || value[0] != entryMarker) {
+		return value, nil
+	}
+
+	encoded, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := make([]byte, 0, len(encoded)+len(value)+2)
+	entry = append(entry, entryMarker)
+	entry = append(entry, encoded...)
+	entry = append(entry, entryMarker)
+	return append(entry, value...), nil
+}
+
+// decodeEntry returns the message stored as a topic log entry, without its
+// topic and offset.
+func decodeEntry(entry []byte) (broker.Message, error) {
+	if len(entry) == 0 || entry[0] != entryMarker {
+		return broker.Message{Value: entry}, nil
+	}
+
+	end := bytes.IndexByte(entry[1:], entryMarker)
+	if end < 0 {
+		return broker.Message{}, errMalformedEntry
+	}
+
+	var meta entryMetadata
+	if err := json.Unmarshal(entry[1:end+1], &meta); err != nil {
+		return broker.Message{}, errMalformedEntry
+	}
+
+	msg := broker.Message{Key: meta.Key, Headers: meta.Headers, Value: entry[end+2:]}
+	if meta.Value != nil {
+		if len(msg.Value) != 0 {
+			return broker.Message{}, errMalformedEntry
+		}
+		msg.Value = meta.Value
+	}
+	if meta.Timestamp != 0 {
+		msg.Timestamp = time.Unix(0, meta.Timestamp)
+	}
+	return msg, nil
+}
+
+// escapeEntry turns a value produced by a client unaware of metadata into a
+// topic log entry.
+func escapeEntry(value string) string {
+	entry, _ := encodeEntry(broker.Message{Value: []byte(value)})
+	return string(entry)
+}
+
+// stripEntry returns the value of a topic log entry, for clients unaware of
+// metadata. Malformed entries are returned as is.
+func stripEntry(entry string) string {
+	msg, err := decodeEntry([]byte(entry))
+	if err != nil {
+		return entry
+	}
+	return string(msg.Value)
+}
@@ -0,0 +1,158 @@
+package fsbroker
+
+import (
+	"goriok/pulses/internal/broker"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEntry_RoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  broker.Message
+		bare bool
+	}{
+		{name: "value only", msg: broker.Message{Value: []byte(`{"a":1}`)}, bare: true},
+		{name: "empty value", msg: broker.Message{Value: []byte{}}, bare: true},
+		{name: "headers", msg: broker.Message{
+			Value:   []byte(`{"a":1}`),
+			Headers: map[string]string{"traceparent": "00-abc-def-01", "x": "line\nbreak\x1e"},
+		}},
+		{name: "key and timestamp", msg: broker.Message{
+			Value:     []byte(`{"a":1}`),
+			Key:       []byte("tenant\n\x1e"),
+			Timestamp: time.Unix(1700000000, 42),
+		}},
+		{name: "leading marker", msg: broker.Message{Value: []byte("\x1eraw")}},
+		{name: "embedded newlines", msg: broker.Message{Value: []byte("first\nsecond\n")}},
+		{name: "embedded newlines and key", msg: broker.Message{Value: []byte("first\nsecond"), Key: []byte("tenant")}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entry, err := encodeEntry(tt.msg)
+			assert.NoError(t, err)
+			assert.NotContains(t, string(entry), "\n")
+			if tt.bare {
+				assert.Equal(t, tt.msg.Value, entry)
+			}
+
+			msg, err := decodeEntry(entry)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.msg.Value, msg.Value)
+			assert.Equal(t, tt.msg.Headers, msg.Headers)
+			assert.Equal(t, tt.msg.Key, msg.Key)
+			assert.True(t, tt.msg.Timestamp.Equal(msg.Timestamp), "timestamp %v", msg.Timestamp)
+			assert.Equal(t, string(tt.msg.Value), stripEntry(string(entry)))
+		})
+	}
+}
+
+func TestDecodeEntry_Malformed(t *testing.T) {
+	for _, entry := range []string{"\x1e{\"ts\":1}", "\x1enot json\x1evalue", "\x1e[1]\x1evalue", "\x1e{\"value\":\"YQ==\"}\x1evalue"} {
+		_, err := decodeEntry([]byte(entry))
+		assert.ErrorIs(t, err, errMalformedEntry, "%q", entry)
+		assert.Equal(t, entry, stripEntry(entry))
+	}
+}
+
+func TestBroker_MessageMetadata(t *testing.T) {
+	topic := "test." + uuid.New().String() + ".metadata"
+	b := startTestBroker(t, DefaultSubscriberConfig())
+
+	sink := NewSinkConnector(b.Host())
+	defer sink.Close()
+	assert.NoError(t, sink.Connect(topic))
+	written := broker.Message{
+		Topic:     topic,
+		Key:       []byte("tenant-a"),
+		Value:     []byte("traced"),
+		Headers:   map[string]string{"traceparent": "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"},
+		Timestamp: time.Unix(1700000000, 0),
+	}
+	assert.NoError(t, sink.WriteMessage(written))
+	assert.NoError(t, sink.Write(topic, []byte("bare")))
+
+	// Text clients neither send nor receive metadata, and their values are
+	// never mistaken for entries with metadata.
+	textOpts := ConnectorOptions{Protocol: ProtocolText}
+	textSink := NewSinkConnectorWithOptions(b.Host(), textOpts)
+	defer textSink.Close()
+	assert.NoError(t, textSink.Connect(topic))
+	assert.NoError(t, textSink.WriteMessage(broker.Message{Topic: topic, Key: []byte("dropped"), Value: []byte("\x1efrom-text")}))
+
+	binaryReceived := make(chan broker.Message, 3)
+	go NewSourceConnector(b.Host()).Read(topic, func(msg broker.Message) {
+		binaryReceived <- msg
+	})
+	textReceived := make(chan broker.Message, 3)
+	go NewSourceConnectorWithOptions(b.Host(), textOpts).Read(topic, func(msg broker.Message) {
+		textReceived <- msg
+	})
+
+	var binary, text []broker.Message
+	timeout := time.After(2 * time.Second)
+	for len(binary) < 3 || len(text) < 3 {
+		select {
+		case msg := <-binaryReceived:
+			binary = append(binary, msg)
+		case msg := <-textReceived:
+			text = append(text, msg)
+		case <-timeout:
+			t.Fatalf("timeout: binary=%v text=%v", binary, text)
+		}
+	}
+
+	assert.Equal(t, topic, binary[0].Topic)
+	assert.Equal(t, written.Key, binary[0].Key)
+	assert.Equal(t, written.Headers, binary[0].Headers)
+	assert.True(t, written.Timestamp.Equal(binary[0].Timestamp))
+	for i, value := range []string{"traced", "bare", "\x1efrom-text"} {
+		assert.Equal(t, value, string(binary[i].Value))
+		assert.Equal(t, int64(i), binary[i].Offset)
+		assert.Equal(t, value+"\n", string(text[i].Value))
+		assert.Equal(t, int64(i), text[i].Offset)
+		assert.Nil(t, text[i].Key)
+	}
+	assert.Nil(t, binary[1].Headers)
+	assert.True(t, binary[1].Timestamp.IsZero())
+}
+
+func TestBroker_TextSubscriberSkipsMultilineValues(t *testing.T) {
+	topic := "test." + uuid.New().String() + ".multiline"
+	b := startTestBroker(t, DefaultSubscriberConfig())
+
+	sink := NewSinkConnector(b.Host())
+	defer sink.Close()
+	assert.NoError(t, sink.Connect(topic))
+	for _, value := range []string{"first\nsecond", "third\nfourth\n", "last"} {
+		assert.NoError(t, sink.Write(topic, []byte(value)))
+	}
+
+	source := NewSourceConnectorWithOptions(b.Host(), ConnectorOptions{Protocol: ProtocolText})
+	defer source.Close()
+	received := make(chan broker.Message, 3)
+	go source.Read(topic, func(msg broker.Message) {
+		received <- msg
+	})
+
+	select {
+	case msg := <-received:
+		assert.Equal(t, "last\n", string(msg.Value))
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for the single line value")
+	}
+	select {
+	case msg := <-received:
+		t.Fatalf("unexpected message %q", msg.Value)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	assert.Eventually(t, func() bool {
+		stats := b.SubscriberStats(topic)
+		return len(stats) == 1 && stats[0].Skipped == 2 && stats[0].Delivered == 1
+	}, time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,172 @@
+package fsbroker
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// groupsDir holds, inside the data directory, one file per consumer group with the
+// offset committed for each topic the group reads.
+const groupsDir = ".groups"
+
+// ErrGroupActive is returned when resetting the offset of a consumer group
+// that still has a source connector subscribed to the topic.
+var ErrGroupActive = errors.New("consumer group has active members")
+
+// groupStore persists the offsets committed by consumer groups. Source
+// connectors in a group start from the group's offset instead of their own,
+// so that a restarted consumer carries on where the previous one stopped.
+type groupStore struct {
+	dir string
+	mu  sync.Mutex
+}
+
+func (g *groupStore) path(group string) string {
+	return filepath.Join(g.dir, groupsDir, group+".json")
+}
+
+// offset returns the offset committed by the group for the topic, 0 if none.
+func (g *groupStore) offset(group, topic string) (int64, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	offsets, err := g.loadLocked(group)
+	return offsets[topic], err
+}
+
+// commit records offset as the next message the group reads from the topic.
+func (g *groupStore) commit(group, topic string, offset int64) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	offsets, err := g.loadLocked(group)
+	if err != nil {
+		return err
+	}
+	if offsets[topic] == offset {
+		return nil
+	}
+	offsets[topic] = offset
+	return g.saveLocked(group, offsets)
+}
+
+// topic returns the offset committed for the topic by every group.
+func (g *groupStore) topic(topic string) (map[string]int64, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	groups, err := g.listLocked()
+	if err != nil {
+		return nil, err
+	}
+
+	committed := make(map[string]int64)
+	for _, group := range groups {
+		offsets, err := g.loadLocked(group)
+		if err != nil {
+			return nil, err
+		}
+		if offset, ok := offsets[topic]; ok {
+			committed[group] = offset
+		}
+	}
+	return committed, nil
+}
+
+// dropTopic forgets the offsets committed for a deleted topic.
+func (g *groupStore) dropTopic(topic string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	groups, err := g.listLocked()
+	if err != nil {
+		return err
+	}
+
+	for _, group := range groups {
+		offsets, err := g.loadLocked(group)
+		if err != nil {
+			return err
+		}
+		if _, ok := offsets[topic]; !ok {
+			continue
+		}
+		delete(offsets, topic)
+		if err := g.saveLocked(group, offsets); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (g *groupStore) listLocked() ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(g.dir, groupsDir))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var groups []string
+	for _, entry := range entries {
+		if group, ok := strings.CutSuffix(entry.Name(), ".json"); ok && entry.Type().IsRegular() {
+			groups = append(groups, group)
+		}
+	}
+	return groups, nil
+}
+
+func (g *groupStore) loadLocked(group string) (map[string]int64, error) {
+	offsets := make(map[string]int64)
+
+	data, err := os.ReadFile(g.path(group))
+	if errors.Is(err, os.ErrNotExist) {
+		return offsets, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return offsets, json.Unmarshal(data, &offsets)
+}
+
+func (g *groupStore) saveLocked(group string, offsets map[string]int64) error {
+	data, err := json.Marshal(offsets)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(g.path(group), data)
+}
+
+// readCommits reads the frames a binary source connector sends after its
+// hello, which are only commit frames, until the connection fails. Commits
+// are recorded for the group, and ignored for clients outside of any.
+func (b *Broker) readCommits(reader *bufio.Reader, group string) {
+	for {
+		f, err := readFrame(reader)
+		if err != nil {
+			return
+		}
+		if f.Type != frameCommit {
+			brokerLog.Errorf("broker: unexpected %s frame from source-connector", f.Type)
+			return
+		}
+
+		topic, offset, err := decodeCommit(f.Payload)
+		if err != nil {
+			brokerLog.Errorf("broker: %v", err)
+			return
+		}
+		if group == "" {
+			continue
+		}
+		if err := b.groups.commit(group, topic, offset); err != nil {
+			brokerLog.Errorf("broker: failed to commit offset %d of group %s on topic %s: %v", offset, group, topic, err)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package fsbroker
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestGroup returns a unique consumer group name.
+func newTestGroup(t *testing.T) string {
+	return "test-" + uuid.New().String()
+}
+
+func newGroupSource(b *Broker, group string) *SourceConnector {
+	return NewSourceConnectorWithOptions(b.Host(), ConnectorOptions{Protocol: ProtocolBinary, Group: group})
+}
+
+// waitForCommit waits until the group committed offset for the topic.
+func waitForCommit(t *testing.T, b *Broker, group, topic string, offset int64) {
+	assert.Eventually(t, func() bool {
+		committed, err := b.groups.offset(group, topic)
+		return err == nil && committed == offset
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestSourceConnector_GroupResumesFromCommittedOffset(t *testing.T) {
+	topic := "test." + uuid.New().String() + ".group"
+	b := startTestBroker(t, DefaultSubscriberConfig())
+	group := newTestGroup(t)
+
+	sink := NewSinkConnector(b.Host())
+	defer sink.Close()
+	assert.NoError(t, sink.Connect(topic))
+	assert.NoError(t, sink.Write(topic, []byte("one")))
+	assert.NoError(t, sink.Write(topic, []byte("two")))
+
+	first := newGroupSource(b, group)
+	received := readPattern(t, first, topic)
+	receivePattern(t, received, 2)
+	waitForCommit(t, b, group, topic, 2)
+	first.Close()
+
+	assert.NoError(t, sink.Write(topic, []byte("three")))
+
+	// A new member of the group, as after a consumer restart, carries on
+	// where the previous one stopped; one outside of it starts over.
+	received = readPattern(t, newGroupSource(b, group), topic)
+	assert.Equal(t, []patternMessage{{topic, "three"}}, receivePattern(t, received, 1))
+
+	received = readPattern(t, NewSourceConnector(b.Host()), topic)
+	assert.Len(t, receivePattern(t, received, 3), 3)
+}
+
+func TestSourceConnector_GroupWithPattern(t *testing.T) {
+	prefix := "test" + strings.ReplaceAll(uuid.New().String(), "-", "")
+	a, c := prefix+".a.grouped", prefix+".c.grouped"
+	b := startTestBroker(t, DefaultSubscriberConfig())
+	group := newTestGroup(t)
+
+	sink := NewSinkConnector(b.Host())
+	defer sink.Close()
+	assert.NoError(t, sink.Connect(a))
+	assert.NoError(t, sink.Write(a, []byte("a1")))
+
+	first := newGroupSource(b, group)
+	receivePattern(t, readPattern(t, first, prefix+".*.grouped"), 1)
+	waitForCommit(t, b, group, a, 1)
+	first.Close()
+
+	assert.NoError(t, sink.Connect(c))
+	assert.NoError(t, sink.Write(a, []byte("a2")))
+	assert.NoError(t, sink.Write(c, []byte("c1")))
+
+	received := readPattern(t, newGroupSource(b, group), prefix+".*.grouped")
+	assert.ElementsMatch(t, []patternMessage{{a, "a2"}, {c, "c1"}}, receivePattern(t, received, 2))
+}
+
+func TestAdminClient_ResetGroupOffset(t *testing.T) {
+	topic := "test." + uuid.New().String() + ".reset"
+	b := startTestBroker(t, DefaultSubscriberConfig())
+	admin := newTestAdmin(t, b)
+	group := newTestGroup(t)
+
+	sink := NewSinkConnector(b.Host())
+	defer sink.Close()
+	assert.NoError(t, sink.Connect(topic))
+	for _, msg := range []string{"one", "two", "three"} {
+		assert.NoError(t, sink.Write(topic, []byte(msg)))
+	}
+
+	source := newGroupSource(b, group)
+	receivePattern(t, readPattern(t, source, topic), 3)
+	waitForCommit(t, b, group, topic, 3)
+
+	_, err := admin.ResetGroupOffset(group, topic, 0)
+	assertBrokerError(t, err, ErrCodeConflict)
+
+	source.Close()
+	assert.Eventually(t, func() bool {
+		return len(b.SubscriberStats(topic)) == 0
+	}, 2*time.Second, 10*time.Millisecond)
+
+	offset, err := admin.ResetGroupOffset(group, topic, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), offset)
+
+	info, err := admin.DescribeTopic(topic)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int64{group: 1}, info.Groups)
+
+	received := readPattern(t, newGroupSource(b, group), topic)
+	assert.Equal(t, []patternMessage{{topic, "two"}, {topic, "three"}}, receivePattern(t, received, 2))
+
+	_, err = admin.ResetGroupOffset("../escape", topic, 0)
+	assertBrokerError(t, err, ErrCodeBadRequest)
+}
+
+func TestAdminClient_ResetGroupOffsetClampsToTopic(t *testing.T) {
+	topic := "test." + uuid.New().String() + ".clamp"
+	b := startTestBroker(t, DefaultSubscriberConfig())
+	admin := newTestAdmin(t, b)
+	group := newTestGroup(t)
+
+	sink := NewSinkConnector(b.Host())
+	defer sink.Close()
+	assert.NoError(t, sink.Connect(topic))
+	assert.NoError(t, sink.Write(topic, []byte("one")))
+	assert.NoError(t, sink.Write(topic, []byte("two")))
+
+	offset, err := admin.ResetGroupOffset(group, topic, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), offset)
+
+	assert.NoError(t, admin.TruncateTopic(topic))
+	assert.NoError(t, sink.Write(topic, []byte("three")))
+
+	offset, err = admin.ResetGroupOffset(group, topic, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), offset)
+
+	offset, err = admin.ResetGroupOffset(group, topic, 100)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), offset)
+}
@@ -0,0 +1,99 @@
+package fsbroker
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	subscriberLagDesc = prometheus.NewDesc(
+		"pulses_broker_subscriber_lag",
+		"Messages of the topic not yet delivered to its slowest subscriber, per consumer group.",
+		[]string{"topic", "group"}, nil,
+	)
+	subscribersDesc = prometheus.NewDesc(
+		"pulses_broker_subscribers",
+		"Source connectors subscribed to the topic.",
+		[]string{"topic"}, nil,
+	)
+)
+
+// brokerMetrics counts what a broker appends to its topics.
+type brokerMetrics struct {
+	appendedMessages *prometheus.CounterVec
+	appendedBytes    *prometheus.CounterVec
+}
+
+func newBrokerMetrics() brokerMetrics {
+	return brokerMetrics{
+		appendedMessages: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "pulses",
+			Subsystem: "broker",
+			Name:      "appended_messages_total",
+			Help:      "Messages appended to the topic.",
+		}, []string{"topic"}),
+		appendedBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "pulses",
+			Subsystem: "broker",
+			Name:      "appended_bytes_total",
+			Help:      "Bytes appended to the topic file.",
+		}, []string{"topic"}),
+	}
+}
+
+func (m brokerMetrics) appended(topic string, messages []string) {
+	bytes := 0
+	for _, message := range messages {
+		bytes += len(message)
+	}
+	m.appendedMessages.WithLabelValues(topic).Add(float64(len(messages)))
+	m.appendedBytes.WithLabelValues(topic).Add(float64(bytes))
+}
+
+func (m brokerMetrics) dropTopic(topic string) {
+	m.appendedMessages.DeleteLabelValues(topic)
+	m.appendedBytes.DeleteLabelValues(topic)
+}
+
+// Collector returns a Prometheus collector exporting the per-topic append
+// counters of the broker and the lag of its subscribers. It is not
+// registered anywhere; register it on the registry served over HTTP.
+func (b *Broker) Collector() prometheus.Collector {
+	return brokerCollector{b}
+}
+
+type brokerCollector struct {
+	b *Broker
+}
+
+func (c brokerCollector) Describe(ch chan<- *prometheus.Desc) {
+	c.b.metrics.appendedMessages.Describe(ch)
+	c.b.metrics.appendedBytes.Describe(ch)
+	ch <- subscriberLagDesc
+	ch <- subscribersDesc
+}
+
+func (c brokerCollector) Collect(ch chan<- prometheus.Metric) {
+	c.b.metrics.appendedMessages.Collect(ch)
+	c.b.metrics.appendedBytes.Collect(ch)
+
+	type topicGroup struct{ topic, group string }
+	lag := make(map[topicGroup]int64)
+	subscribers := make(map[string]int)
+
+	c.b.mu.Lock()
+	for topic, subs := range c.b.sourceConnectors {
+		subscribers[topic] = len(subs)
+		for _, sub := range subs {
+			key := topicGroup{topic, sub.group}
+			lag[key] = max(lag[key], sub.stats().Lag)
+		}
+	}
+	c.b.mu.Unlock()
+
+	for key, value := range lag {
+		ch <- prometheus.MustNewConstMetric(subscriberLagDesc, prometheus.GaugeValue, float64(value), key.topic, key.group)
+	}
+	for topic, value := range subscribers {
+		ch <- prometheus.MustNewConstMetric(subscribersDesc, prometheus.GaugeValue, float64(value), topic)
+	}
+}
@@ -0,0 +1,56 @@
+package fsbroker
+
+import (
+	"goriok/pulses/internal/broker"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBroker_Collector(t *testing.T) {
+	topic := "test." + uuid.New().String() + ".metrics"
+	b := startTestBroker(t, DefaultSubscriberConfig())
+	registry := prometheus.NewPedanticRegistry()
+	assert.NoError(t, registry.Register(b.Collector()))
+
+	sink := NewSinkConnectorWithOptions(b.Host(), ConnectorOptions{Protocol: ProtocolBinary, Durability: DurabilityWritten})
+	defer sink.Close()
+	assert.NoError(t, sink.Connect(topic))
+	assert.NoError(t, sink.Write(topic, []byte("one")))
+	assert.NoError(t, sink.Write(topic, []byte("two")))
+
+	assert.Equal(t, 2.0, testutil.ToFloat64(b.metrics.appendedMessages.WithLabelValues(topic)))
+	assert.Equal(t, 8.0, testutil.ToFloat64(b.metrics.appendedBytes.WithLabelValues(topic)))
+
+	// A subscriber stuck in its handler lags behind the messages written
+	// after the ones it holds.
+	block := make(chan struct{})
+	defer close(block)
+	source := NewSourceConnector(b.Host())
+	defer source.Close()
+	go source.Read(topic, broker.BytesHandler(func(string, []byte) { <-block }))
+	assert.Eventually(t, func() bool { return len(b.SubscriberStats(topic)) == 1 }, time.Second, 10*time.Millisecond)
+
+	expected := `
+# HELP pulses_broker_subscribers Source connectors subscribed to the topic.
+# TYPE pulses_broker_subscribers gauge
+pulses_broker_subscribers{topic="` + topic + `"} 1
+`
+	assert.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(expected), "pulses_broker_subscribers"))
+	count, err := testutil.GatherAndCount(registry, "pulses_broker_subscriber_lag")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	admin := newTestAdmin(t, b)
+	source.Close()
+	assert.Eventually(t, func() bool { return len(b.SubscriberStats(topic)) == 0 }, time.Second, 10*time.Millisecond)
+	assert.NoError(t, admin.DeleteTopic(topic))
+	count, err = testutil.GatherAndCount(registry, "pulses_broker_appended_messages_total")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count, "deleted topics must not be reported")
+}
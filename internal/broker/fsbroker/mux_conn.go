@@ -0,0 +1,443 @@
+package fsbroker
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// producer sends the produce requests of a sink connector, either over one
+// connection per topic or over a single multiplexed one.
+type producer interface {
+	connect(topic string) error
+	produce(topic string, messages [][]byte) (int64, error)
+	close()
+}
+
+// muxConn is a single connection to the broker carrying produce requests for
+// any topic. Requests are pipelined: they are written as they come, and since
+// the broker answers them in order, a reader goroutine hands every answer to
+// the oldest request still waiting for one.
+//
+// Writes are serialized by writeMu and done without holding mu, which guards
+// the connection state and the requests in flight. A request joins inflight
+// before it is written, so the reader never waits for a writer stalled on a
+// full socket buffer: the broker would in turn stall writing answers nobody
+// reads, and stop reading requests.
+//
+// As with connPool, an idle connection is closed in the background and a
+// dead one is dialed again on the next write or, with reconnection enabled,
+// in the background while writes are buffered.
+type muxConn struct {
+	broker      string
+	opts        ConnectorOptions
+	idleTimeout time.Duration
+
+	writeMu sync.Mutex
+
+	mu           sync.Mutex
+	conn         net.Conn
+	lastUsed     time.Time
+	inflight     []*muxRequest
+	buffer       []*muxRequest
+	buffered     map[string]int
+	reconnecting bool
+
+	reaper    sync.Once
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// muxRequest is a produce request sent over a muxConn. done is closed once
+// the broker answered, after which offset and err hold the outcome.
+type muxRequest struct {
+	topic    string
+	messages [][]byte
+	payload  []byte
+	done     chan struct{}
+	offset   int64
+	err      error
+}
+
+func newMuxConn(broker string, opts ConnectorOptions) *muxConn {
+	idleTimeout := opts.IdleTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = defaultIdleTimeout
+	}
+
+	return &muxConn{
+		broker:      broker,
+		opts:        opts,
+		idleTimeout: idleTimeout,
+		buffered:    make(map[string]int),
+		closed:      make(chan struct{}),
+	}
+}
+
+// connect makes sure the shared connection is up. The topic only matters to
+// the broker once something is produced to it.
+func (m *muxConn) connect(string) error {
+	if m.isClosed() {
+		return errSinkClosed
+	}
+	m.reaper.Do(func() { go m.evictIdle() })
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.conn != nil || m.reconnecting {
+		return nil
+	}
+
+	err := m.dialLocked()
+	if err != nil && m.opts.Reconnect.Enabled && retryable(err) {
+		connectorLog.Warnf("sink-connector: failed to connect to broker %s, retrying: %v", m.broker, err)
+		m.opts.notify("", StateDisconnected, err)
+		m.startReconnectLocked()
+		return nil
+	}
+	return err
+}
+
+// produce sends messages to the topic as a single request and waits for the
+// broker's answer, unless the connector does not ask for acknowledgements.
+func (m *muxConn) produce(topic string, messages [][]byte) (int64, error) {
+	if m.isClosed() {
+		return -1, errSinkClosed
+	}
+
+	payload, err := encodeProduceTo(topic, messages)
+	if err != nil {
+		return -1, err
+	}
+	req := &muxRequest{topic: topic, messages: messages, payload: payload, done: make(chan struct{}), offset: -1}
+
+	m.writeMu.Lock()
+	m.mu.Lock()
+	conn, err := m.queueLocked(req)
+	m.mu.Unlock()
+	if conn != nil {
+		m.write(conn, req)
+	}
+	m.writeMu.Unlock()
+	if conn == nil {
+		return -1, err
+	}
+
+	<-req.done
+	return req.offset, req.err
+}
+
+// queueLocked returns the connection to write req to, dialing first if
+// needed, and queues req for an answer unless the connector does not ask for
+// acknowledgements. No connection is returned if req can not be written;
+// with reconnection enabled, it is buffered instead.
+func (m *muxConn) queueLocked(req *muxRequest) (net.Conn, error) {
+	if m.reconnecting {
+		return nil, m.bufferLocked(req)
+	}
+
+	if m.conn == nil {
+		err := m.dialLocked()
+		if err != nil {
+			m.opts.notify("", StateDisconnected, err)
+			if !m.opts.Reconnect.Enabled || !retryable(err) {
+				return nil, err
+			}
+			m.startReconnectLocked()
+			return nil, m.bufferLocked(req)
+		}
+	}
+
+	m.lastUsed = time.Now()
+	if m.opts.Durability != DurabilityNone {
+		m.inflight = append(m.inflight, req)
+	}
+	return m.conn, nil
+}
+
+// write writes a request queued by queueLocked to conn. It must be called
+// with writeMu held, and without mu. If the write fails, the connection is
+// dropped, which fails or buffers the requests in flight, req included.
+func (m *muxConn) write(conn net.Conn, req *muxRequest) error {
+	err := writeFrame(conn, frameProduceTo, req.payload)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err == nil {
+		m.lastUsed = time.Now()
+		if m.opts.Durability == DurabilityNone {
+			close(req.done)
+		}
+		return nil
+	}
+
+	if m.conn == conn {
+		connectorLog.Errorf("sink-connector: lost connection to broker %s: %v", m.broker, err)
+		m.failLocked(err)
+	}
+	if m.opts.Durability == DurabilityNone {
+		// Not in flight, so failLocked left it alone.
+		if m.opts.Reconnect.Enabled && !m.isClosed() {
+			req.err = m.bufferLocked(req)
+		} else {
+			req.err = err
+		}
+		close(req.done)
+	}
+	return err
+}
+
+// readAnswers hands the broker's answers on conn to the requests waiting for
+// them, until the connection fails.
+func (m *muxConn) readAnswers(conn net.Conn, reader *bufio.Reader) {
+	for {
+		f, err := readFrame(reader)
+
+		m.mu.Lock()
+		if m.conn != conn {
+			m.mu.Unlock()
+			return
+		}
+		if err == nil && len(m.inflight) == 0 {
+			err = fmt.Errorf("sink-connector: unexpected %s frame", f.Type)
+		}
+		if err != nil {
+			if !m.isClosed() {
+				connectorLog.Errorf("sink-connector: lost connection to broker %s: %v", m.broker, err)
+			}
+			m.failLocked(err)
+			m.mu.Unlock()
+			return
+		}
+
+		req := m.inflight[0]
+		m.inflight = m.inflight[1:]
+		m.mu.Unlock()
+
+		switch f.Type {
+		case frameAck:
+			req.offset, req.err = decodeAck(f.Payload)
+		case frameError:
+			req.err = decodeError(f.Payload)
+		default:
+			req.err = fmt.Errorf("sink-connector: unexpected %s frame", f.Type)
+		}
+		close(req.done)
+	}
+}
+
+// failLocked drops the connection after err. Requests still waiting for an
+// answer are buffered for the next connection when reconnection is enabled,
+// and fail with err otherwise.
+func (m *muxConn) failLocked(err error) {
+	m.dropLocked()
+	m.opts.notify("", StateDisconnected, err)
+
+	inflight := m.inflight
+	m.inflight = nil
+
+	reconnect := m.opts.Reconnect.Enabled && !m.isClosed()
+	if reconnect {
+		m.startReconnectLocked()
+	}
+	for _, req := range inflight {
+		if reconnect {
+			req.err = m.bufferLocked(req)
+		} else {
+			req.err = err
+		}
+		close(req.done)
+	}
+}
+
+func (m *muxConn) dialLocked() error {
+	m.opts.notify("", StateConnecting, nil)
+
+	conn, err := dial(m.broker, m.opts)
+	if err != nil {
+		return err
+	}
+	reader, err := handshake(conn, m.opts, roleProducer, "", nil)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	m.conn = conn
+	m.lastUsed = time.Now()
+	go m.readAnswers(conn, reader)
+
+	connectorLog.Infof("sink-connector: connected to broker %s", m.broker)
+	m.opts.notify("", StateConnected, nil)
+	return nil
+}
+
+func (m *muxConn) dropLocked() {
+	if m.conn != nil {
+		m.conn.Close()
+	}
+	m.conn = nil
+}
+
+// bufferLocked keeps a request until the connection is back, up to
+// BufferSize messages per topic.
+func (m *muxConn) bufferLocked(req *muxRequest) error {
+	if m.buffered[req.topic]+len(req.messages) > m.opts.Reconnect.BufferSize {
+		return ErrBufferFull
+	}
+	m.buffered[req.topic] += len(req.messages)
+	m.buffer = append(m.buffer, &muxRequest{
+		topic:    req.topic,
+		messages: req.messages,
+		payload:  req.payload,
+		done:     make(chan struct{}),
+		offset:   -1,
+	})
+	return nil
+}
+
+func (m *muxConn) startReconnectLocked() {
+	if m.reconnecting {
+		return
+	}
+	m.reconnecting = true
+	go m.reconnect()
+}
+
+// reconnect dials the broker with backoff until it succeeds, then sends the
+// buffered requests ahead of any new write. Nobody waits for their answers;
+// if the connection fails again they are buffered again.
+func (m *muxConn) reconnect() {
+	policy := m.opts.Reconnect
+
+	for attempt := 0; ; attempt++ {
+		if !policy.sleep(attempt, m.closed) {
+			m.mu.Lock()
+			m.reconnecting = false
+			m.mu.Unlock()
+			return
+		}
+
+		// New writes wait for the buffered ones, and are not buffered
+		// again once the connection is back.
+		m.writeMu.Lock()
+		err := m.redial()
+		m.mu.Lock()
+		m.writeMu.Unlock()
+		if err == nil {
+			m.reconnecting = false
+			m.mu.Unlock()
+			return
+		}
+
+		connectorLog.Warnf("sink-connector: reconnecting to broker %s: %v", m.broker, err)
+		m.opts.notify("", StateDisconnected, err)
+
+		giveUp := !retryable(err) || policy.exhausted(attempt+1)
+		if giveUp {
+			connectorLog.Errorf("sink-connector: giving up after %d attempts, dropping %d buffered requests", attempt+1, len(m.buffer))
+			m.buffer = nil
+			clear(m.buffered)
+			m.reconnecting = false
+		}
+		m.mu.Unlock()
+
+		if giveUp {
+			return
+		}
+	}
+}
+
+// redial dials the broker and writes the buffered requests in order. It
+// must be called with writeMu held, and without mu. On failure the requests
+// not yet answered are buffered again.
+func (m *muxConn) redial() error {
+	m.mu.Lock()
+	if err := m.dialLocked(); err != nil {
+		m.mu.Unlock()
+		return err
+	}
+	conn, pending := m.conn, m.buffer
+	m.buffer = nil
+	clear(m.buffered)
+	if m.opts.Durability != DurabilityNone {
+		m.inflight = append(m.inflight, pending...)
+	}
+	m.mu.Unlock()
+
+	for i, req := range pending {
+		if err := m.write(conn, req); err != nil {
+			if m.opts.Durability == DurabilityNone {
+				m.mu.Lock()
+				for _, rest := range pending[i+1:] {
+					m.bufferLocked(rest)
+				}
+				m.mu.Unlock()
+			}
+			return err
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.conn != conn {
+		return errors.New("sink-connector: lost connection while sending buffered requests")
+	}
+	if len(pending) > 0 {
+		connectorLog.Infof("sink-connector: sent %d buffered requests", len(pending))
+	}
+	return nil
+}
+
+func (m *muxConn) isClosed() bool {
+	select {
+	case <-m.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// evictIdle periodically closes the connection once it has been unused for
+// the idle timeout with no request waiting, until the connector is closed.
+func (m *muxConn) evictIdle() {
+	ticker := time.NewTicker(m.idleTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.closed:
+			return
+		case now := <-ticker.C:
+			m.mu.Lock()
+			if m.conn != nil && len(m.inflight) == 0 && now.Sub(m.lastUsed) >= m.idleTimeout {
+				connectorLog.Debugf("sink-connector: closing idle connection to broker %s", m.broker)
+				m.dropLocked()
+			}
+			m.mu.Unlock()
+		}
+	}
+}
+
+// close closes the connection. Requests in flight fail, and requests still
+// buffered for reconnection are lost.
+func (m *muxConn) close() {
+	m.closeOnce.Do(func() { close(m.closed) })
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.conn != nil {
+		m.failLocked(errSinkClosed)
+		m.opts.notify("", StateClosed, nil)
+	}
+	if len(m.buffer) > 0 {
+		connectorLog.Warnf("sink-connector: closed with %d undelivered requests", len(m.buffer))
+		m.buffer = nil
+		clear(m.buffered)
+	}
+}
@@ -0,0 +1,230 @@
+package fsbroker
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+// connCount returns the number of client connections open on the broker.
+func connCount(b *Broker) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return len(b.conns)
+}
+
+// muxOptions returns the default connector options with Multiplex set.
+func muxOptions() ConnectorOptions {
+	opts := DefaultConnectorOptions()
+	opts.Multiplex = true
+	return opts
+}
+
+func TestSinkConnector_MultiplexesTopicsOverOneConnection(t *testing.T) {
+	names := make([]string, 50)
+	for i := range names {
+		names[i] = "test." + uuid.New().String() + ".mux"
+	}
+	b := startTestBroker(t, DefaultSubscriberConfig())
+
+	sink := NewSinkConnectorWithOptions(b.Host(), muxOptions())
+	defer sink.Close()
+
+	var wg sync.WaitGroup
+	for _, topic := range names {
+		wg.Add(1)
+		go func(topic string) {
+			defer wg.Done()
+			assert.NoError(t, sink.Connect(topic))
+			for i := int64(0); i < 3; i++ {
+				offset, err := sink.Produce(topic, []byte(fmt.Sprintf("message-%d", i)))
+				assert.NoError(t, err)
+				assert.Equal(t, i, offset, topic)
+			}
+		}(topic)
+	}
+	wg.Wait()
+
+	assert.Equal(t, 1, connCount(b))
+	for _, topic := range names {
+		stored, err := os.ReadFile(b.topicPath(topic))
+		assert.NoError(t, err)
+		assert.Equal(t, "message-0\nmessage-1\nmessage-2\n", string(stored))
+	}
+}
+
+func TestSinkConnector_MultiplexedErrorsStayPerRequest(t *testing.T) {
+	topic := "test." + uuid.New().String() + ".mux-errors"
+	b := startTestBroker(t, DefaultSubscriberConfig())
+
+	sink := NewSinkConnectorWithOptions(b.Host(), muxOptions())
+	defer sink.Close()
+	assert.NoError(t, sink.Connect(topic))
+
+	_, err := sink.Produce("", []byte("nowhere"))
+	var brokerErr *BrokerError
+	assert.ErrorAs(t, err, &brokerErr)
+	assert.Equal(t, ErrCodeBadRequest, brokerErr.Code)
+
+	offset, err := sink.Produce(topic, []byte("one"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), offset)
+}
+
+func TestSinkConnector_MultiplexedWithoutAcks(t *testing.T) {
+	topic := "test." + uuid.New().String() + ".mux-none"
+	b := startTestBroker(t, DefaultSubscriberConfig())
+
+	opts := muxOptions()
+	opts.Durability = DurabilityNone
+	sink := NewSinkConnectorWithOptions(b.Host(), opts)
+	defer sink.Close()
+	assert.NoError(t, sink.Connect(topic))
+
+	for _, msg := range []string{"one", "two"} {
+		offset, err := sink.Produce(topic, []byte(msg))
+		assert.NoError(t, err)
+		assert.Equal(t, int64(-1), offset)
+	}
+
+	assert.Eventually(t, func() bool {
+		stored, _ := os.ReadFile(b.topicPath(topic))
+		return string(stored) == "one\ntwo\n"
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestSinkConnector_MultiplexedBuffersWhileReconnecting(t *testing.T) {
+	topic := "test." + uuid.New().String() + ".mux-buffered"
+	b := startTestBroker(t, DefaultSubscriberConfig())
+
+	opts := muxOptions()
+	opts.Reconnect = ReconnectPolicy{Enabled: true, InitialBackoff: 20 * time.Millisecond, MaxBackoff: 20 * time.Millisecond, BufferSize: 2}
+	sink := NewSinkConnectorWithOptions(b.Host(), opts)
+	defer sink.Close()
+	assert.NoError(t, sink.Connect(topic))
+	assert.NoError(t, sink.Write(topic, []byte("one")))
+
+	b.Stop()
+	assert.NoError(t, sink.Write(topic, []byte("two")))
+	assert.NoError(t, sink.Write(topic, []byte("three")))
+	assert.ErrorIs(t, sink.Write(topic, []byte("four")), ErrBufferFull)
+
+	restartTestBroker(t, b)
+
+	assert.Eventually(t, func() bool {
+		stored, _ := os.ReadFile(b.topicPath(topic))
+		return string(stored) == "one\ntwo\nthree\n"
+	}, 2*time.Second, 10*time.Millisecond)
+
+	offset, err := sink.Produce(topic, []byte("five"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), offset)
+}
+
+func TestSinkConnector_BlockedTopicDoesNotStallOthers(t *testing.T) {
+	blocked := "test." + uuid.New().String() + ".blocked"
+	other := "test." + uuid.New().String() + ".other"
+	b := startTestBroker(t, SubscriberConfig{QueueSize: 1, Overflow: OverflowBlock})
+
+	// A consumer that subscribes and never reads.
+	slow, err := net.Dial("tcp", b.Host())
+	assert.NoError(t, err)
+	defer slow.Close()
+	fmt.Fprintf(slow, "source-connector_%s\n", blocked)
+	assert.Eventually(t, func() bool {
+		return len(b.SubscriberStats(blocked)) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	sink := NewSinkConnector(b.Host())
+	defer sink.Close()
+	assert.NoError(t, sink.Connect(blocked))
+	assert.NoError(t, sink.Connect(other))
+
+	payload := []byte(strings.Repeat("x", 64*1024))
+	stalled := make(chan struct{})
+	go func() {
+		defer close(stalled)
+		for i := 0; i < 256; i++ {
+			if sink.Write(blocked, payload) != nil {
+				return
+			}
+		}
+	}()
+
+	select {
+	case <-stalled:
+		t.Fatal("expected writes to the blocked topic to wait for its subscriber")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	written := make(chan error)
+	go func() {
+		written <- sink.Write(other, []byte("hello"))
+	}()
+	select {
+	case err := <-written:
+		assert.NoError(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("write to another topic was stalled by the blocked topic")
+	}
+}
+
+// TestMuxConn_PipelinesWithFullSocketBuffers produces concurrently over a
+// connection with no buffering at all, as if both socket buffers were full:
+// the broker only reads the next request once its previous answer was read.
+// Writers must not keep the reader from reading answers meanwhile.
+func TestMuxConn_PipelinesWithFullSocketBuffers(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+
+	codec := &binaryCodec{reader: bufio.NewReader(server), conn: server, version: protocolVersion}
+	go func() {
+		for offset := int64(0); ; offset++ {
+			if _, _, err := codec.readProduceTo(); err != nil {
+				return
+			}
+			if err := codec.writeAck(offset); err != nil {
+				return
+			}
+		}
+	}()
+
+	m := newMuxConn("", ConnectorOptions{Protocol: ProtocolBinary, Durability: DurabilityWritten})
+	m.conn = client
+	go m.readAnswers(client, bufio.NewReader(client))
+	defer m.close()
+
+	const producers, requests = 16, 200
+	var wg sync.WaitGroup
+	for p := 0; p < producers; p++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < requests; i++ {
+				_, err := m.produce("test.mux-full", [][]byte{[]byte("pulse")})
+				assert.NoError(t, err)
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		server.Close()
+		t.Fatal("producers and the answer reader deadlocked")
+	}
+}
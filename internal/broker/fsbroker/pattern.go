@@ -0,0 +1,252 @@
+package fsbroker
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Topic patterns let a source connector subscribe to every topic matching
+// them, such as "tenants.*.aggregated.pulses.amount". A "*" segment matches
+// exactly one dot-separated segment of a topic name.
+const patternWildcard = "*"
+
+// isPattern reports whether topic is a pattern rather than a topic name.
+func isPattern(topic string) bool {
+	for _, segment := range strings.Split(topic, ".") {
+		if segment == patternWildcard {
+			return true
+		}
+	}
+	return false
+}
+
+// matchTopic reports whether topic matches pattern.
+func matchTopic(pattern, topic string) bool {
+	patternSegments := strings.Split(pattern, ".")
+	topicSegments := strings.Split(topic, ".")
+	if len(patternSegments) != len(topicSegments) {
+		return false
+	}
+
+	for i, segment := range patternSegments {
+		if segment != patternWildcard && segment != topicSegments[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// patternSubscription serves a source connector subscribed to a pattern. It
+// runs one subscriber per matching topic, all writing to the same connection,
+// and gains a subscriber whenever a matching topic is created.
+type patternSubscription struct {
+	pattern   string
+	conn      net.Conn
+	codec     *binaryCodec
+	cfg       SubscriberConfig
+	offsets   map[string]int64
+	group     string
+	principal string
+
+	// writeMu serializes the frames written by the subscribers.
+	writeMu sync.Mutex
+
+	mu     sync.Mutex
+	subs   map[string]*subscriber
+	closed bool
+	wg     sync.WaitGroup
+}
+
+func newPatternSubscription(conn net.Conn, codec *binaryCodec, pattern string, offsets map[string]int64, group, principal string, cfg SubscriberConfig) *patternSubscription {
+	return &patternSubscription{
+		pattern:   pattern,
+		conn:      conn,
+		codec:     codec,
+		cfg:       cfg,
+		offsets:   offsets,
+		group:     group,
+		principal: principal,
+		subs:      make(map[string]*subscriber),
+	}
+}
+
+// add creates the subscriber of a matching topic, starting at offset from,
+// unless it exists already or the subscription is closed. It returns nil in
+// that case.
+func (p *patternSubscription) add(topic string, log *topicLog, from int64) *subscriber {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, ok := p.subs[topic]; ok || p.closed {
+		return nil
+	}
+
+	sub := newSubscriber(p.conn, &topicCodec{topic: topic, subscription: p}, topic, log, log.config.subscriber(p.cfg))
+	sub.from = from
+	sub.group = p.group
+	sub.watched = true
+	p.subs[topic] = sub
+	p.wg.Add(1)
+	return sub
+}
+
+// close stops every subscriber and waits for them to return.
+func (p *patternSubscription) close() {
+	p.mu.Lock()
+	p.closed = true
+	for _, sub := range p.subs {
+		sub.close()
+	}
+	p.mu.Unlock()
+
+	p.wg.Wait()
+}
+
+// topicCodec writes the messages of one topic of a pattern subscription,
+// tagged with the topic name.
+type topicCodec struct {
+	topic        string
+	subscription *patternSubscription
+}
+
+func (c *topicCodec) readMessages() ([]string, error) {
+	return nil, errors.New("pattern subscriptions do not accept messages")
+}
+
+func (c *topicCodec) writeMessage(offset int64, message string) error {
+	c.subscription.writeMu.Lock()
+	defer c.subscription.writeMu.Unlock()
+
+	payload := encodeDeliverFrom(c.topic, offset, c.subscription.codec.deliverable(message))
+	return writeFrame(c.subscription.conn, frameDeliverFrom, payload)
+}
+
+func (c *topicCodec) writeHeartbeat() error {
+	c.subscription.writeMu.Lock()
+	defer c.subscription.writeMu.Unlock()
+
+	return c.subscription.codec.writeHeartbeat()
+}
+
+func (c *topicCodec) writeAck(int64) error {
+	return nil
+}
+
+func (c *topicCodec) writeError(ErrorCode, string) error {
+	return nil
+}
+
+// handlePatternSubscription serves every topic matching pattern, existing or
+// created later, to a source connector until it disconnects. Offsets holds
+// the position to resume from for topics the client has already read, unless
+// the client is a member of a consumer group. Topics the principal may not
+// consume are left out.
+func (b *Broker) handlePatternSubscription(conn net.Conn, codec *binaryCodec, pattern string, offsets map[string]int64, group, principal string) {
+	if err := b.ensureDataDir(); err != nil {
+		brokerLog.Errorf("broker: failed to create data dir %s: %v", b.dataDir, err)
+		codec.writeError(ErrCodeStorage, err.Error())
+		return
+	}
+
+	b.mu.Lock()
+	sub := newPatternSubscription(conn, codec, pattern, offsets, group, principal, b.subscriberCfg)
+	b.patterns[sub] = struct{}{}
+	b.mu.Unlock()
+
+	defer func() {
+		b.mu.Lock()
+		delete(b.patterns, sub)
+		b.mu.Unlock()
+		sub.close()
+	}()
+
+	// Registered first, so that a topic created during the scan is not missed.
+	topics, err := b.existingTopics()
+	if err != nil {
+		brokerLog.Errorf("broker: failed to list topics for pattern %s: %v", pattern, err)
+		return
+	}
+	for _, topic := range topics {
+		if !matchTopic(pattern, topic) {
+			continue
+		}
+		log, err := b.topicLog(topic)
+		if err != nil {
+			brokerLog.Errorf("broker: failed to open topic %s for pattern %s: %v", topic, pattern, err)
+			continue
+		}
+		b.subscribePattern(sub, topic, log)
+	}
+
+	// Subscribers never read from the shared connection, so it is watched
+	// here. A subscriber that fails closes the connection, which ends the
+	// whole subscription; the client resumes where it left off.
+	b.readCommits(codec.reader, group)
+}
+
+// subscribePattern adds a topic to a pattern subscription and serves it.
+func (b *Broker) subscribePattern(p *patternSubscription, topic string, log *topicLog) {
+	if !b.security.authorize(p.principal, topic, AccessConsume) {
+		return
+	}
+
+	from := p.offsets[topic]
+	if p.group != "" {
+		var err error
+		if from, err = b.groups.offset(p.group, topic); err != nil {
+			brokerLog.Errorf("broker: failed to read offset of group %s on topic %s: %v", p.group, topic, err)
+			p.conn.Close()
+			return
+		}
+	}
+
+	sub := p.add(topic, log, from)
+	if sub == nil {
+		return
+	}
+
+	b.mu.Lock()
+	b.sourceConnectors[topic] = append(b.sourceConnectors[topic], sub)
+	b.mu.Unlock()
+	log.subscribe(sub)
+
+	brokerLog.Debugf("broker: pattern %s subscribed to topic %s", p.pattern, topic)
+	go func() {
+		defer p.wg.Done()
+		defer b.unsubscribe(sub)
+
+		if err := sub.run(); err != nil {
+			brokerLog.Errorf("broker: error writing message to source-connector: %v", err)
+		}
+	}()
+}
+
+// existingTopics returns the topics stored on disk or open in the broker.
+func (b *Broker) existingTopics() ([]string, error) {
+	entries, err := os.ReadDir(b.dataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	var topics []string
+	for _, entry := range entries {
+		if entry.Type().IsRegular() {
+			seen[entry.Name()] = true
+			topics = append(topics, entry.Name())
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for topic := range b.topics {
+		if !seen[topic] {
+			topics = append(topics, topic)
+		}
+	}
+	return topics, nil
+}
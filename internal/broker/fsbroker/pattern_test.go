@@ -0,0 +1,143 @@
+package fsbroker
+
+import (
+	"goriok/pulses/internal/broker"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchTopic(t *testing.T) {
+	tests := []struct {
+		pattern string
+		topic   string
+		want    bool
+	}{
+		{"tenants.*.aggregated.pulses.amount", "tenants.a.aggregated.pulses.amount", true},
+		{"tenants.*.aggregated.pulses.amount", "tenants.a.grouped.pulses", false},
+		{"tenants.*.aggregated.pulses.amount", "tenants.a.b.aggregated.pulses.amount", false},
+		{"tenants.*.*", "tenants.a.grouped", true},
+		{"tenants.a.grouped", "tenants.a.grouped", true},
+		{"*", "source", true},
+		{"*", "tenants.a", false},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, matchTopic(tt.pattern, tt.topic), "%s ~ %s", tt.pattern, tt.topic)
+	}
+}
+
+func TestIsPattern(t *testing.T) {
+	assert.True(t, isPattern("tenants.*.grouped.pulses"))
+	assert.True(t, isPattern("*"))
+	assert.False(t, isPattern("tenants.a.grouped.pulses"))
+	assert.False(t, isPattern("tenants.a*.grouped.pulses"))
+}
+
+// patternMessage is a message received through a pattern subscription.
+type patternMessage struct {
+	topic   string
+	message string
+}
+
+func readPattern(t *testing.T, source *SourceConnector, pattern string) <-chan patternMessage {
+	received := make(chan patternMessage, 16)
+	go source.Read(pattern, broker.BytesHandler(func(topic string, msg []byte) {
+		received <- patternMessage{topic, string(msg)}
+	}))
+	t.Cleanup(source.Close)
+	return received
+}
+
+func receivePattern(t *testing.T, received <-chan patternMessage, n int) []patternMessage {
+	var messages []patternMessage
+	timeout := time.After(2 * time.Second)
+	for len(messages) < n {
+		select {
+		case msg := <-received:
+			messages = append(messages, msg)
+		case <-timeout:
+			t.Fatalf("timeout, got %v", messages)
+		}
+	}
+	return messages
+}
+
+func TestSourceConnector_ReadPattern(t *testing.T) {
+	prefix := "test" + strings.ReplaceAll(uuid.New().String(), "-", "")
+	existing := prefix + ".a.aggregated"
+	created := prefix + ".b.aggregated"
+	other := prefix + ".a.grouped"
+	b := startTestBroker(t, DefaultSubscriberConfig())
+
+	sink := NewSinkConnector(b.Host())
+	defer sink.Close()
+	assert.NoError(t, sink.Connect(existing))
+	assert.NoError(t, sink.Write(existing, []byte("one")))
+
+	received := readPattern(t, NewSourceConnector(b.Host()), prefix+".*.aggregated")
+	assert.Equal(t, []patternMessage{{existing, "one"}}, receivePattern(t, received, 1))
+
+	assert.NoError(t, sink.Connect(other))
+	assert.NoError(t, sink.Connect(created))
+	assert.NoError(t, sink.Write(other, []byte("ignored")))
+	assert.NoError(t, sink.Write(created, []byte("two")))
+	assert.NoError(t, sink.Write(existing, []byte("three")))
+
+	assert.ElementsMatch(t, []patternMessage{{created, "two"}, {existing, "three"}}, receivePattern(t, received, 2))
+	assert.Len(t, b.Subscribers()[created], 1)
+	assert.Empty(t, b.Subscribers()[other])
+}
+
+func TestSourceConnector_ReadPattern_ResumesAfterBrokerRestart(t *testing.T) {
+	prefix := "test" + strings.ReplaceAll(uuid.New().String(), "-", "")
+	first := prefix + ".a.aggregated"
+	second := prefix + ".b.aggregated"
+	b := startTestBroker(t, DefaultSubscriberConfig())
+
+	produce := func(host, topic, msg string) {
+		sink := NewSinkConnector(host)
+		defer sink.Close()
+		assert.NoError(t, sink.Connect(topic))
+		assert.NoError(t, sink.Write(topic, []byte(msg)))
+	}
+	produce(b.Host(), first, "one")
+	produce(b.Host(), second, "two")
+
+	opts := DefaultConnectorOptions()
+	opts.Reconnect = ReconnectPolicy{Enabled: true, InitialBackoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond}
+	received := readPattern(t, NewSourceConnectorWithOptions(b.Host(), opts), prefix+".*.aggregated")
+	assert.ElementsMatch(t, []patternMessage{{first, "one"}, {second, "two"}}, receivePattern(t, received, 2))
+
+	b = restartTestBroker(t, b)
+	produce(b.Host(), second, "three")
+
+	assert.Equal(t, []patternMessage{{second, "three"}}, receivePattern(t, received, 1))
+	select {
+	case msg := <-received:
+		t.Fatalf("unexpected redelivery of %v", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestSourceConnector_ReadPattern_RequiresBinaryProtocol(t *testing.T) {
+	source := NewSourceConnectorWithOptions("127.0.0.1:65534", ConnectorOptions{Protocol: ProtocolText})
+	assert.Error(t, source.Read("tenants.*.grouped.pulses", broker.BytesHandler(func(string, []byte) {})))
+}
+
+func TestSinkConnector_RejectsPatterns(t *testing.T) {
+	b := startTestBroker(t, DefaultSubscriberConfig())
+
+	sink := NewSinkConnectorWithOptions(b.Host(), ConnectorOptions{Durability: DurabilityWritten})
+	defer sink.Close()
+	var brokerErr *BrokerError
+	assert.ErrorAs(t, sink.Connect("tenants.*.grouped.pulses"), &brokerErr)
+
+	mux := NewSinkConnectorWithOptions(b.Host(), muxOptions())
+	defer mux.Close()
+	_, err := mux.Produce("tenants.*.grouped.pulses", []byte("one"))
+	assert.ErrorAs(t, err, &brokerErr)
+}
@@ -0,0 +1,563 @@
+package fsbroker
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strings"
+	"time"
+)
+
+// Protocol selects the wire protocol spoken between connectors and the broker.
+//
+// ProtocolBinary is a versioned, length-prefixed frame protocol negotiated at
+// connect time. ProtocolText is the original newline-delimited protocol,
+// kept for compatibility with older clients; it can not carry messages with
+// embedded newlines and has no way to report errors back to the client.
+type Protocol int
+
+const (
+	ProtocolBinary Protocol = iota
+	ProtocolText
+)
+
+func (p Protocol) String() string {
+	switch p {
+	case ProtocolBinary:
+		return "binary"
+	case ProtocolText:
+		return "text"
+	default:
+		return fmt.Sprintf("Protocol(%d)", int(p))
+	}
+}
+
+// ParseProtocol parses the name of a protocol, as returned by String.
+func ParseProtocol(name string) (Protocol, error) {
+	for _, p := range []Protocol{ProtocolBinary, ProtocolText} {
+		if p.String() == name {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown protocol %q", name)
+}
+
+func (p Protocol) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+func (p *Protocol) UnmarshalText(text []byte) error {
+	parsed, err := ParseProtocol(string(text))
+	if err != nil {
+		return err
+	}
+	*p = parsed
+	return nil
+}
+
+// Durability is the guarantee a sink connector waits for before a write
+// returns. It is only available with the binary protocol; text protocol
+// writes are never acknowledged.
+type Durability int
+
+const (
+	// DurabilityNone sends messages without waiting for the broker.
+	DurabilityNone Durability = iota
+	// DurabilityWritten waits until the message is written to the topic file.
+	DurabilityWritten
+	// DurabilityFsynced waits until the topic file is synced to disk.
+	DurabilityFsynced
+)
+
+func (d Durability) String() string {
+	switch d {
+	case DurabilityNone:
+		return "none"
+	case DurabilityWritten:
+		return "written"
+	case DurabilityFsynced:
+		return "fsynced"
+	default:
+		return fmt.Sprintf("Durability(%d)", int(d))
+	}
+}
+
+// ParseDurability parses the name of a durability, as returned by String.
+func ParseDurability(name string) (Durability, error) {
+	for _, d := range []Durability{DurabilityNone, DurabilityWritten, DurabilityFsynced} {
+		if d.String() == name {
+			return d, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown durability %q", name)
+}
+
+func (d Durability) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+func (d *Durability) UnmarshalText(text []byte) error {
+	parsed, err := ParseDurability(string(text))
+	if err != nil {
+		return err
+	}
+	*d = parsed
+	return nil
+}
+
+// ConnectorOptions configures source and sink connectors.
+//
+// A sink connector with a BatchSize above 1 collects writes per topic that
+// arrive while a previous request is in flight, and sends them as a single
+// produce request once that request completes, BatchSize messages are pending
+// or the oldest of them has waited for Linger. Batching requires the binary
+// protocol.
+//
+// With Multiplex, a binary protocol sink connector sends the requests for
+// every topic over a single connection instead of one connection per topic.
+// The broker answers them in order, so a request that waits for a slow
+// subscriber of its topic, as with OverflowBlock, holds up the requests for
+// every other topic. Multiplex suits brokers that do not block producers.
+//
+// Sink connectors close connections unused for IdleTimeout, 5 minutes if
+// not set.
+//
+// A source connector with a Group is a member of that consumer group: it
+// starts from the offset the group committed on the broker rather than from
+// the start of the topic, and commits its progress as it goes. Commits happen
+// whenever the connector has handled everything received so far, so a
+// consumer that stops may see the last few messages again on restart.
+// Consumer groups require the binary protocol.
+//
+// With TLS set, connectors connect over TLS, presenting the client
+// certificate of the config, if any, to brokers asking for one. Token
+// authenticates binary protocol connectors to brokers configured with
+// tokens.
+//
+// OnStateChange, if set, is called whenever the connection for a topic
+// changes state, with the error that caused a disconnection. It is called
+// synchronously and must not call back into the connector.
+type ConnectorOptions struct {
+	Protocol      Protocol
+	Durability    Durability
+	BatchSize     int
+	Linger        time.Duration
+	Multiplex     bool
+	IdleTimeout   time.Duration
+	Reconnect     ReconnectPolicy
+	Group         string
+	TLS           *tls.Config
+	Token         string
+	OnStateChange func(topic string, state ConnectionState, err error)
+}
+
+// DefaultConnectorOptions returns options using the binary protocol over one
+// connection per topic, with writes acknowledged once they reach the topic
+// file. Connections are not multiplexed by default, as the default
+// subscriber overflow policy blocks producers.
+func DefaultConnectorOptions() ConnectorOptions {
+	return ConnectorOptions{
+		Protocol:    ProtocolBinary,
+		Durability:  DurabilityWritten,
+		IdleTimeout: defaultIdleTimeout,
+	}
+}
+
+// A binary connection starts with protocolMagic followed by one byte holding
+// the highest protocol version the client speaks. Everything after that is a
+// sequence of frames: a one byte frame type, a big-endian uint32 payload
+// length and the payload itself. The broker answers the hello frame with the
+// highest version both sides speak.
+//
+// From version 2 on, the messages carried by produce and deliver frames are
+// topic log entries, which may hold the key, headers and timestamp of a
+// message as well as its value. Version 1 clients send and receive bare
+// values.
+const (
+	protocolMagic      = "PULS"
+	protocolVersion    = 2
+	minProtocolVersion = 1
+	maxFrameSize       = 16 << 20
+)
+
+type frameType byte
+
+const (
+	frameHello frameType = iota + 1
+	frameProduce
+	frameDeliver
+	frameAck
+	frameError
+	frameHeartbeat
+	frameProduceBatch
+	frameProduceTo
+	frameDeliverFrom
+	frameCommit
+	frameAdmin
+)
+
+func (t frameType) String() string {
+	switch t {
+	case frameHello:
+		return "hello"
+	case frameProduce:
+		return "produce"
+	case frameDeliver:
+		return "deliver"
+	case frameAck:
+		return "ack"
+	case frameError:
+		return "error"
+	case frameHeartbeat:
+		return "heartbeat"
+	case frameProduceBatch:
+		return "produce-batch"
+	case frameProduceTo:
+		return "produce-to"
+	case frameDeliverFrom:
+		return "deliver-from"
+	case frameCommit:
+		return "commit"
+	case frameAdmin:
+		return "admin"
+	default:
+		return fmt.Sprintf("frameType(%d)", byte(t))
+	}
+}
+
+func (o ConnectorOptions) notify(topic string, state ConnectionState, err error) {
+	if o.OnStateChange != nil {
+		o.OnStateChange(topic, state, err)
+	}
+}
+
+// Connector roles announced in the hello frame. A producer is a sink that is
+// not bound to a topic and names the topic in every produce-to frame, so that
+// one connection serves any number of topics. An admin client sends admin
+// frames, each answered with an admin or error frame.
+const (
+	roleSink     = "sink"
+	roleSource   = "source"
+	roleProducer = "producer"
+	roleAdmin    = "admin"
+)
+
+// Text protocol greetings, as in "sink-connector_<topic>\n".
+const (
+	textSinkGreeting   = "sink-connector"
+	textSourceGreeting = "source-connector"
+)
+
+// hello is the payload of the hello frame. The client sends its role, topic
+// and, for sinks, the durability it expects or, for sources, the offset of
+// the first message to deliver; the broker answers with the negotiated
+// version. Sources subscribing to a pattern send an offset per topic
+// instead, and sources in a consumer group send the group, whose committed
+// offsets take precedence. Clients authenticating with a token send it too.
+type hello struct {
+	Version    int              `json:"version"`
+	Role       string           `json:"role,omitempty"`
+	Topic      string           `json:"topic,omitempty"`
+	Durability Durability       `json:"durability,omitempty"`
+	Offset     int64            `json:"offset,omitempty"`
+	Offsets    map[string]int64 `json:"offsets,omitempty"`
+	Group      string           `json:"group,omitempty"`
+	Token      string           `json:"token,omitempty"`
+}
+
+// ErrorCode identifies the reason carried by an error frame.
+type ErrorCode uint16
+
+const (
+	ErrCodeUnknown ErrorCode = iota
+	ErrCodeUnsupportedVersion
+	ErrCodeBadRequest
+	ErrCodeInvalidMessage
+	ErrCodeStorage
+	ErrCodeNotFound
+	ErrCodeConflict
+	ErrCodeUnauthorized
+	ErrCodeForbidden
+)
+
+// BrokerError is returned by connectors when the broker answers with an
+// error frame.
+type BrokerError struct {
+	Code    ErrorCode
+	Message string
+}
+
+func (e *BrokerError) Error() string {
+	return fmt.Sprintf("broker error %d: %s", e.Code, e.Message)
+}
+
+type frame struct {
+	Type    frameType
+	Payload []byte
+}
+
+func writeFrame(w io.Writer, t frameType, payload []byte) error {
+	header := make([]byte, 5, 5+len(payload))
+	header[0] = byte(t)
+	binary.BigEndian.PutUint32(header[1:], uint32(len(payload)))
+	_, err := w.Write(append(header, payload...))
+	return err
+}
+
+func readFrame(r io.Reader) (frame, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return frame{}, err
+	}
+
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > maxFrameSize {
+		return frame{}, fmt.Errorf("frame of %d bytes exceeds limit", size)
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return frame{}, err
+	}
+	return frame{Type: frameType(header[0]), Payload: payload}, nil
+}
+
+func encodeDeliver(offset int64, message []byte) []byte {
+	payload := make([]byte, 8, 8+len(message))
+	binary.BigEndian.PutUint64(payload, uint64(offset))
+	return append(payload, message...)
+}
+
+func decodeDeliver(payload []byte) (int64, []byte, error) {
+	if len(payload) < 8 {
+		return 0, nil, errors.New("short deliver frame")
+	}
+	return int64(binary.BigEndian.Uint64(payload)), payload[8:], nil
+}
+
+// A deliver-from payload is the topic, prefixed with its length as a
+// big-endian uint16, followed by a deliver payload. It is used for pattern
+// subscriptions, which carry messages from several topics.
+func encodeDeliverFrom(topic string, offset int64, message []byte) []byte {
+	payload := binary.BigEndian.AppendUint16(nil, uint16(len(topic)))
+	payload = append(payload, topic...)
+	return append(payload, encodeDeliver(offset, message)...)
+}
+
+func decodeDeliverFrom(payload []byte) (string, int64, []byte, error) {
+	if len(payload) < 2 {
+		return "", 0, nil, errors.New("short deliver-from frame")
+	}
+	size := int(binary.BigEndian.Uint16(payload))
+	payload = payload[2:]
+	if len(payload) < size {
+		return "", 0, nil, errors.New("short deliver-from frame")
+	}
+
+	offset, message, err := decodeDeliver(payload[size:])
+	if err != nil {
+		return "", 0, nil, err
+	}
+	return string(payload[:size]), offset, message, nil
+}
+
+// A commit payload is the topic, prefixed with its length as a big-endian
+// uint16, followed by the offset of the next message to read as a big-endian
+// uint64.
+func encodeCommit(topic string, offset int64) []byte {
+	payload := binary.BigEndian.AppendUint16(nil, uint16(len(topic)))
+	payload = append(payload, topic...)
+	return binary.BigEndian.AppendUint64(payload, uint64(offset))
+}
+
+func decodeCommit(payload []byte) (string, int64, error) {
+	if len(payload) < 2 {
+		return "", 0, errors.New("malformed commit frame")
+	}
+	size := int(binary.BigEndian.Uint16(payload))
+	payload = payload[2:]
+	if len(payload) != size+8 {
+		return "", 0, errors.New("malformed commit frame")
+	}
+	return string(payload[:size]), int64(binary.BigEndian.Uint64(payload[size:])), nil
+}
+
+// A produce-batch payload is a sequence of messages, each prefixed with its
+// length as a big-endian uint32.
+func encodeBatch(messages [][]byte) []byte {
+	size := 0
+	for _, msg := range messages {
+		size += 4 + len(msg)
+	}
+
+	payload := make([]byte, 0, size)
+	for _, msg := range messages {
+		payload = binary.BigEndian.AppendUint32(payload, uint32(len(msg)))
+		payload = append(payload, msg...)
+	}
+	return payload
+}
+
+func decodeBatch(payload []byte) ([][]byte, error) {
+	var messages [][]byte
+	for len(payload) > 0 {
+		if len(payload) < 4 {
+			return nil, errors.New("malformed produce-batch frame")
+		}
+		size := binary.BigEndian.Uint32(payload)
+		payload = payload[4:]
+		if uint32(len(payload)) < size {
+			return nil, errors.New("malformed produce-batch frame")
+		}
+		messages = append(messages, payload[:size])
+		payload = payload[size:]
+	}
+	return messages, nil
+}
+
+// A produce-to payload is the topic, prefixed with its length as a
+// big-endian uint16, followed by the messages encoded as in a produce-batch
+// payload.
+func encodeProduceTo(topic string, messages [][]byte) ([]byte, error) {
+	if len(topic) > math.MaxUint16 {
+		return nil, fmt.Errorf("topic name of %d bytes exceeds limit", len(topic))
+	}
+
+	payload := binary.BigEndian.AppendUint16(nil, uint16(len(topic)))
+	payload = append(payload, topic...)
+	return append(payload, encodeBatch(messages)...), nil
+}
+
+func decodeProduceTo(payload []byte) (string, [][]byte, error) {
+	if len(payload) < 2 {
+		return "", nil, errors.New("malformed produce-to frame")
+	}
+	size := int(binary.BigEndian.Uint16(payload))
+	payload = payload[2:]
+	if len(payload) < size {
+		return "", nil, errors.New("malformed produce-to frame")
+	}
+
+	messages, err := decodeBatch(payload[size:])
+	if err != nil {
+		return "", nil, err
+	}
+	return string(payload[:size]), messages, nil
+}
+
+func encodeAck(offset int64) []byte {
+	payload := make([]byte, 8)
+	binary.BigEndian.PutUint64(payload, uint64(offset))
+	return payload
+}
+
+func decodeAck(payload []byte) (int64, error) {
+	if len(payload) != 8 {
+		return 0, errors.New("malformed ack frame")
+	}
+	return int64(binary.BigEndian.Uint64(payload)), nil
+}
+
+func encodeError(code ErrorCode, message string) []byte {
+	payload := make([]byte, 2, 2+len(message))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	return append(payload, message...)
+}
+
+func decodeError(payload []byte) *BrokerError {
+	if len(payload) < 2 {
+		return &BrokerError{Code: ErrCodeUnknown, Message: string(payload)}
+	}
+	return &BrokerError{
+		Code:    ErrorCode(binary.BigEndian.Uint16(payload)),
+		Message: string(payload[2:]),
+	}
+}
+
+// dial connects to the broker, over TLS if the options ask for it.
+func dial(broker string, opts ConnectorOptions) (net.Conn, error) {
+	if opts.TLS != nil {
+		return tls.Dial("tcp", broker, opts.TLS)
+	}
+	return net.Dial("tcp", broker)
+}
+
+// handshake opens a connection to the broker for the given role and topic
+// and returns a reader positioned after the greeting. Sources resume each
+// topic at its offset in offsets, which the text protocol can not express.
+func handshake(conn net.Conn, opts ConnectorOptions, role, topic string, offsets map[string]int64) (*bufio.Reader, error) {
+	reader := bufio.NewReader(conn)
+
+	if opts.Protocol == ProtocolText {
+		if opts.Token != "" {
+			return nil, errors.New("token authentication requires the binary protocol")
+		}
+		greeting := textSinkGreeting
+		if role == roleSource {
+			greeting = textSourceGreeting
+		}
+		_, err := fmt.Fprintf(conn, "%s_%s\n", greeting, topic)
+		return reader, err
+	}
+
+	if _, err := fmt.Fprintf(conn, "%s%c", protocolMagic, protocolVersion); err != nil {
+		return nil, err
+	}
+
+	req := hello{Version: protocolVersion, Role: role, Topic: topic, Token: opts.Token}
+	switch {
+	case role == roleSource && isPattern(topic):
+		req.Offsets = offsets
+		req.Group = opts.Group
+	case role == roleSource:
+		req.Offset = offsets[topic]
+		req.Group = opts.Group
+	default:
+		req.Durability = opts.Durability
+	}
+
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFrame(conn, frameHello, payload); err != nil {
+		return nil, err
+	}
+
+	reply, err := readFrame(reader)
+	if err != nil {
+		return nil, err
+	}
+	switch reply.Type {
+	case frameHello:
+		// Connectors always send topic log entries, which older brokers
+		// would store as they are.
+		var negotiated hello
+		if err := json.Unmarshal(reply.Payload, &negotiated); err != nil {
+			return nil, fmt.Errorf("malformed hello frame: %w", err)
+		}
+		if negotiated.Version < protocolVersion {
+			return nil, &BrokerError{
+				Code:    ErrCodeUnsupportedVersion,
+				Message: fmt.Sprintf("broker speaks protocol version %d, %d is required", negotiated.Version, protocolVersion),
+			}
+		}
+		return reader, nil
+	case frameError:
+		return nil, decodeError(reply.Payload)
+	default:
+		return nil, fmt.Errorf("unexpected %s frame during handshake", reply.Type)
+	}
+}
+
+// parseTextGreeting splits a text protocol greeting into its client type and
+// topic. Only the first "_" separates them, so topics may contain "_".
+func parseTextGreeting(greeting string) (string, string, bool) {
+	return strings.Cut(strings.TrimSuffix(greeting, "\n"), "_")
+}
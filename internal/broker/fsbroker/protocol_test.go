@@ -0,0 +1,164 @@
+package fsbroker
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFrame_RoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	assert.NoError(t, writeFrame(&buf, frameProduce, []byte("with\nnewline")))
+	assert.NoError(t, writeFrame(&buf, frameHeartbeat, nil))
+
+	f, err := readFrame(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, frameProduce, f.Type)
+	assert.Equal(t, "with\nnewline", string(f.Payload))
+
+	f, err = readFrame(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, frameHeartbeat, f.Type)
+	assert.Empty(t, f.Payload)
+}
+
+func TestFrame_TooLarge(t *testing.T) {
+	buf := bytes.NewBuffer([]byte{byte(frameProduce), 0xff, 0xff, 0xff, 0xff})
+	_, err := readFrame(buf)
+	assert.Error(t, err)
+}
+
+func TestDeliver_RoundTrip(t *testing.T) {
+	offset, message, err := decodeDeliver(encodeDeliver(42, []byte("payload")))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(42), offset)
+	assert.Equal(t, "payload", string(message))
+
+	_, _, err = decodeDeliver([]byte{1, 2})
+	assert.Error(t, err)
+}
+
+func TestCommit_RoundTrip(t *testing.T) {
+	topic, offset, err := decodeCommit(encodeCommit("tenants.a.grouped", 42))
+	assert.NoError(t, err)
+	assert.Equal(t, "tenants.a.grouped", topic)
+	assert.Equal(t, int64(42), offset)
+
+	_, _, err = decodeCommit([]byte{0, 5, 'a'})
+	assert.Error(t, err)
+}
+
+func TestAck_RoundTrip(t *testing.T) {
+	offset, err := decodeAck(encodeAck(1 << 40))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1<<40), offset)
+
+	_, err = decodeAck([]byte{1})
+	assert.Error(t, err)
+}
+
+func TestError_RoundTrip(t *testing.T) {
+	err := decodeError(encodeError(ErrCodeInvalidMessage, "bad"))
+	assert.Equal(t, ErrCodeInvalidMessage, err.Code)
+	assert.Equal(t, "bad", err.Message)
+}
+
+func TestParseTextGreeting(t *testing.T) {
+	clientType, topic, ok := parseTextGreeting("sink-connector_tenants.a_b.pulses\n")
+	assert.True(t, ok)
+	assert.Equal(t, textSinkGreeting, clientType)
+	assert.Equal(t, "tenants.a_b.pulses", topic)
+}
+
+func TestHandshake_BrokerError(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	go func() {
+		defer server.Close()
+		buf := make([]byte, len(protocolMagic)+1)
+		server.Read(buf)
+		f, _ := readFrame(server)
+
+		var req hello
+		json.Unmarshal(f.Payload, &req)
+		writeFrame(server, frameError, encodeError(ErrCodeBadRequest, "no "+req.Role+"s allowed"))
+	}()
+
+	_, err := handshake(client, DefaultConnectorOptions(), roleSink, "any.topic", nil)
+	var brokerErr *BrokerError
+	assert.ErrorAs(t, err, &brokerErr)
+	assert.Equal(t, ErrCodeBadRequest, brokerErr.Code)
+	assert.Equal(t, "no sinks allowed", brokerErr.Message)
+}
+
+func TestHandshake_RejectsOlderBroker(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	go func() {
+		defer server.Close()
+		buf := make([]byte, len(protocolMagic)+1)
+		server.Read(buf)
+		readFrame(server)
+		writeFrame(server, frameHello, []byte(`{"version":1}`))
+	}()
+
+	_, err := handshake(client, DefaultConnectorOptions(), roleSink, "any.topic", nil)
+	var brokerErr *BrokerError
+	assert.ErrorAs(t, err, &brokerErr)
+	assert.Equal(t, ErrCodeUnsupportedVersion, brokerErr.Code)
+}
+
+func TestProduceTo_RoundTrip(t *testing.T) {
+	payload, err := encodeProduceTo("tenants.a.grouped.pulses", [][]byte{[]byte("one"), []byte("two")})
+	assert.NoError(t, err)
+
+	topic, messages, err := decodeProduceTo(payload)
+	assert.NoError(t, err)
+	assert.Equal(t, "tenants.a.grouped.pulses", topic)
+	assert.Equal(t, [][]byte{[]byte("one"), []byte("two")}, messages)
+
+	_, _, err = decodeProduceTo([]byte{0, 9, 'a'})
+	assert.Error(t, err)
+
+	_, err = encodeProduceTo(strings.Repeat("a", 1<<16), nil)
+	assert.Error(t, err)
+}
+
+func TestDeliverFrom_RoundTrip(t *testing.T) {
+	topic, offset, message, err := decodeDeliverFrom(encodeDeliverFrom("tenants.a.grouped.pulses", 7, []byte("payload")))
+	assert.NoError(t, err)
+	assert.Equal(t, "tenants.a.grouped.pulses", topic)
+	assert.Equal(t, int64(7), offset)
+	assert.Equal(t, "payload", string(message))
+
+	_, _, _, err = decodeDeliverFrom([]byte{0, 3, 'a', 'b', 'c', 1})
+	assert.Error(t, err)
+}
+
+func TestProtocolAndDurability_Text(t *testing.T) {
+	for _, p := range []Protocol{ProtocolBinary, ProtocolText} {
+		text, err := p.MarshalText()
+		assert.NoError(t, err)
+		var parsed Protocol
+		assert.NoError(t, parsed.UnmarshalText(text))
+		assert.Equal(t, p, parsed)
+	}
+	for _, d := range []Durability{DurabilityNone, DurabilityWritten, DurabilityFsynced} {
+		text, err := d.MarshalText()
+		assert.NoError(t, err)
+		var parsed Durability
+		assert.NoError(t, parsed.UnmarshalText(text))
+		assert.Equal(t, d, parsed)
+	}
+
+	_, err := ParseProtocol("grpc")
+	assert.Error(t, err)
+	_, err = ParseDurability("replicated")
+	assert.Error(t, err)
+}
@@ -0,0 +1,124 @@
+package fsbroker
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"time"
+)
+
+// ConnectionState is the state of the connection between a connector and the
+// broker for one topic, as reported to ConnectorOptions.OnStateChange.
+type ConnectionState int
+
+const (
+	StateConnecting ConnectionState = iota
+	StateConnected
+	StateDisconnected
+	StateClosed
+)
+
+func (s ConnectionState) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateDisconnected:
+		return "disconnected"
+	case StateClosed:
+		return "closed"
+	default:
+		return fmt.Sprintf("ConnectionState(%d)", int(s))
+	}
+}
+
+// ReconnectPolicy controls how connectors recover from a lost connection to
+// the broker. Attempts are spaced by an exponential backoff, starting at
+// InitialBackoff and doubling up to MaxBackoff, with half of each delay
+// randomized so that clients do not all come back at once after a broker
+// restart.
+//
+// A source connector resumes after the last message it received. A sink
+// connector keeps up to BufferSize messages per topic while disconnected,
+// including those whose acknowledgement was lost, and sends them ahead of any
+// new write once reconnected; writes beyond that fail with ErrBufferFull.
+// Delivery is therefore at least once: a message may be stored twice if the
+// connection dropped after the broker stored it but before it answered.
+type ReconnectPolicy struct {
+	Enabled        bool
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// MaxAttempts is the number of consecutive failed attempts after which
+	// the connector gives up. Zero retries forever.
+	MaxAttempts int
+	BufferSize  int
+}
+
+// DefaultReconnectPolicy returns an enabled policy retrying forever, from
+// 100ms up to 10s apart, buffering up to 1024 messages per topic.
+func DefaultReconnectPolicy() ReconnectPolicy {
+	return ReconnectPolicy{
+		Enabled:        true,
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     10 * time.Second,
+		BufferSize:     1024,
+	}
+}
+
+// ErrBufferFull is returned by sink connectors when a message can not be
+// buffered while reconnecting.
+var ErrBufferFull = errors.New("sink-connector: reconnect buffer full")
+
+// backoff returns the delay before the given retry, counted from zero.
+func (r ReconnectPolicy) backoff(attempt int) time.Duration {
+	delay := r.InitialBackoff
+	if delay <= 0 {
+		delay = DefaultReconnectPolicy().InitialBackoff
+	}
+	limit := max(r.MaxBackoff, delay)
+
+	for i := 0; i < attempt && delay < limit; i++ {
+		delay *= 2
+	}
+	delay = min(delay, limit)
+
+	half := delay / 2
+	return half + rand.N(delay-half+1)
+}
+
+// sleep waits for the backoff of the given retry. It returns false if done
+// is closed first.
+func (r ReconnectPolicy) sleep(attempt int, done <-chan struct{}) bool {
+	timer := time.NewTimer(r.backoff(attempt))
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+// exhausted reports whether the given number of consecutive failed attempts
+// uses up MaxAttempts.
+func (r ReconnectPolicy) exhausted(attempts int) bool {
+	return r.MaxAttempts > 0 && attempts >= r.MaxAttempts
+}
+
+// retryable reports whether reconnecting may help after err. Errors the
+// broker reports about the request itself, or about the credentials of the
+// client, would only be repeated.
+func retryable(err error) bool {
+	var brokerErr *BrokerError
+	if errors.As(err, &brokerErr) {
+		switch brokerErr.Code {
+		case ErrCodeUnsupportedVersion, ErrCodeBadRequest, ErrCodeUnauthorized, ErrCodeForbidden:
+			return false
+		}
+	}
+	var certErr *tls.CertificateVerificationError
+	return !errors.As(err, &certErr)
+}
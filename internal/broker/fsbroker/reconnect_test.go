@@ -0,0 +1,49 @@
+package fsbroker
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReconnectPolicy_Backoff(t *testing.T) {
+	policy := ReconnectPolicy{InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+
+	for attempt, want := range []time.Duration{
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		400 * time.Millisecond,
+		800 * time.Millisecond,
+		time.Second,
+		time.Second,
+	} {
+		for i := 0; i < 20; i++ {
+			delay := policy.backoff(attempt)
+			assert.GreaterOrEqual(t, delay, want/2, "attempt %d", attempt)
+			assert.LessOrEqual(t, delay, want, "attempt %d", attempt)
+		}
+	}
+}
+
+func TestReconnectPolicy_Exhausted(t *testing.T) {
+	assert.False(t, ReconnectPolicy{}.exhausted(100))
+	assert.False(t, ReconnectPolicy{MaxAttempts: 3}.exhausted(2))
+	assert.True(t, ReconnectPolicy{MaxAttempts: 3}.exhausted(3))
+}
+
+func TestReconnectPolicy_SleepInterruptedByClose(t *testing.T) {
+	done := make(chan struct{})
+	close(done)
+
+	policy := ReconnectPolicy{InitialBackoff: time.Hour, MaxBackoff: time.Hour}
+	assert.False(t, policy.sleep(0, done))
+}
+
+func TestRetryable(t *testing.T) {
+	assert.True(t, retryable(errors.New("connection reset")))
+	assert.True(t, retryable(&BrokerError{Code: ErrCodeStorage}))
+	assert.False(t, retryable(&BrokerError{Code: ErrCodeBadRequest}))
+	assert.False(t, retryable(&BrokerError{Code: ErrCodeUnsupportedVersion}))
+}
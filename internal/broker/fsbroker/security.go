@@ -0,0 +1,205 @@
+package fsbroker
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// defaultHandshakeTimeout bounds the handshake of a new connection when the
+// SecurityConfig does not.
+const defaultHandshakeTimeout = 10 * time.Second
+
+// AnonymousPrincipal is the principal of clients that present neither a
+// client certificate nor a token.
+const AnonymousPrincipal = "anonymous"
+
+// aclWildcard, as the last segment of an ACL rule topic, matches one or more
+// remaining segments, so that "tenants.>" covers every tenant topic and ">"
+// every topic.
+const aclWildcard = ">"
+
+// Access is a set of operations on a topic.
+type Access int
+
+const (
+	// AccessProduce allows sink connectors to write to a topic.
+	AccessProduce Access = 1 << iota
+	// AccessConsume allows source connectors to read a topic.
+	AccessConsume
+	// AccessAdmin allows admin clients to describe, create, delete and
+	// truncate a topic, and to reset the offsets of consumer groups on it.
+	AccessAdmin
+)
+
+// ACLRule grants a principal access to the topics matching Topic. Principal
+// "*" stands for any principal, including AnonymousPrincipal. Topic is a
+// topic name, a pattern in which "*" stands for one segment, or either of
+// them ending with a ">" segment.
+type ACLRule struct {
+	Principal string
+	Topic     string
+	Access    Access
+}
+
+// SecurityConfig controls who may connect to the broker and what they may
+// do.
+//
+// With TLS set the broker only accepts TLS connections; a TLS config that
+// verifies client certificates enables mutual TLS, and the common name of
+// the certificate becomes the client's principal. Tokens maps the tokens
+// binary protocol clients may send in their hello to their principal. A
+// client presenting an unknown token is rejected, as are anonymous clients
+// with RequireAuth.
+//
+// Without ACL, every admitted client may do anything. Otherwise operations
+// are denied unless a rule grants them.
+//
+// A new connection that has not completed its TLS handshake and sent its
+// greeting or hello within HandshakeTimeout, 10 seconds if not set, is
+// closed.
+type SecurityConfig struct {
+	TLS              *tls.Config
+	Tokens           map[string]string
+	RequireAuth      bool
+	ACL              []ACLRule
+	HandshakeTimeout time.Duration
+}
+
+func (c SecurityConfig) handshakeTimeout() time.Duration {
+	if c.HandshakeTimeout > 0 {
+		return c.HandshakeTimeout
+	}
+	return defaultHandshakeTimeout
+}
+
+var (
+	errUnauthorized = errors.New("authentication failed")
+	errForbidden    = errors.New("access denied")
+)
+
+// authenticate returns the principal of a client, from its certificate or
+// else from the token it sent.
+func (c SecurityConfig) authenticate(conn net.Conn, token string) (string, error) {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if certs := tlsConn.ConnectionState().VerifiedChains; len(certs) > 0 {
+			return certs[0][0].Subject.CommonName, nil
+		}
+	}
+
+	if token != "" {
+		for known, principal := range c.Tokens {
+			if subtle.ConstantTimeCompare([]byte(known), []byte(token)) == 1 {
+				return principal, nil
+			}
+		}
+		return "", fmt.Errorf("%w: unknown token", errUnauthorized)
+	}
+
+	if c.RequireAuth {
+		return "", fmt.Errorf("%w: credentials required", errUnauthorized)
+	}
+	return AnonymousPrincipal, nil
+}
+
+// authorize reports whether principal has access to topic.
+func (c SecurityConfig) authorize(principal, topic string, access Access) bool {
+	if c.ACL == nil {
+		return true
+	}
+
+	for _, rule := range c.ACL {
+		if rule.Access&access != access {
+			continue
+		}
+		if rule.Principal != "*" && rule.Principal != principal {
+			continue
+		}
+		if matchACLTopic(rule.Topic, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchACLTopic reports whether topic matches the topic of an ACL rule.
+func matchACLTopic(rule, topic string) bool {
+	prefix, ok := strings.CutSuffix(rule, aclWildcard)
+	if !ok || (prefix != "" && !strings.HasSuffix(prefix, ".")) {
+		return matchTopic(rule, topic)
+	}
+	if prefix == "" {
+		return true
+	}
+
+	segments := strings.Count(prefix, ".")
+	topicSegments := strings.Split(topic, ".")
+	if len(topicSegments) <= segments {
+		return false
+	}
+	return matchTopic(strings.TrimSuffix(prefix, "."), strings.Join(topicSegments[:segments], "."))
+}
+
+// LoadServerTLS returns a TLS config serving the certificate in certFile
+// and keyFile. With a clientCAFile, clients must present a certificate
+// signed by one of the CAs it holds.
+func LoadServerTLS(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if clientCAFile != "" {
+		if cfg.ClientCAs, err = loadCertPool(clientCAFile); err != nil {
+			return nil, err
+		}
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// LoadClientTLS returns a TLS config trusting the CAs in caFile, or the
+// system roots if it is empty, and presenting the certificate in certFile
+// and keyFile, if given, for mutual TLS.
+func LoadClientTLS(caFile, certFile, keyFile string) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if caFile != "" {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", file)
+	}
+	return pool, nil
+}
@@ -0,0 +1,292 @@
+package fsbroker
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"goriok/pulses/internal/broker"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+// testPKI is a self-signed CA along with certificate files it issued,
+// written to a temporary directory.
+type testPKI struct {
+	t      *testing.T
+	dir    string
+	ca     *x509.Certificate
+	caKey  *ecdsa.PrivateKey
+	CAFile string
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "pulses test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	ca, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+
+	pki := &testPKI{t: t, dir: t.TempDir(), ca: ca, caKey: key}
+	pki.CAFile = pki.write("ca.pem", "CERTIFICATE", der)
+	return pki
+}
+
+// issue creates a certificate for name, valid for localhost when it is a
+// server certificate, and returns its certificate and key files.
+func (p *testPKI) issue(name string, server bool) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(p.t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if server {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		template.DNSNames = []string{"localhost"}
+		template.IPAddresses = []net.IP{net.IPv4(127, 0, 0, 1)}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, p.ca, &key.PublicKey, p.caKey)
+	assert.NoError(p.t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(p.t, err)
+
+	return p.write(name+".pem", "CERTIFICATE", der), p.write(name+"-key.pem", "EC PRIVATE KEY", keyDER)
+}
+
+func (p *testPKI) write(name, blockType string, der []byte) string {
+	path := filepath.Join(p.dir, name)
+	assert.NoError(p.t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600))
+	return path
+}
+
+// serverTLS returns the TLS config of a broker, verifying client
+// certificates when mutual is set.
+func (p *testPKI) serverTLS(mutual bool) *tls.Config {
+	cert, key := p.issue("localhost", true)
+	clientCA := ""
+	if mutual {
+		clientCA = p.CAFile
+	}
+	cfg, err := LoadServerTLS(cert, key, clientCA)
+	assert.NoError(p.t, err)
+	return cfg
+}
+
+// clientTLS returns the TLS config of a client presenting a certificate for
+// principal, or none if principal is empty.
+func (p *testPKI) clientTLS(principal string) *tls.Config {
+	var cert, key string
+	if principal != "" {
+		cert, key = p.issue(principal, false)
+	}
+	cfg, err := LoadClientTLS(p.CAFile, cert, key)
+	assert.NoError(p.t, err)
+	return cfg
+}
+
+func startSecureTestBroker(t *testing.T, cfg SecurityConfig) *Broker {
+	brokerCfg := testBrokerConfig(t)
+	brokerCfg.Security = cfg
+	return runTestBroker(t, NewBrokerWithConfig(brokerCfg))
+}
+
+func TestMatchACLTopic(t *testing.T) {
+	tests := []struct {
+		rule  string
+		topic string
+		want  bool
+	}{
+		{">", "source.pulses", true},
+		{"source.pulses", "source.pulses", true},
+		{"source.pulses", "source.other", false},
+		{"tenants.>", "tenants.a.grouped.pulses", true},
+		{"tenants.>", "tenants", false},
+		{"tenants.*.grouped.>", "tenants.a.grouped.pulses", true},
+		{"tenants.*.grouped.>", "tenants.a.aggregated.pulses", false},
+		{"tenants.*", "tenants.a", true},
+		{"tenants.*", "tenants.a.grouped", false},
+		{"tenants>", "tenants.a", false},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, matchACLTopic(tt.rule, tt.topic), "%s ~ %s", tt.rule, tt.topic)
+	}
+}
+
+func TestBroker_TLS(t *testing.T) {
+	topic := "test." + uuid.New().String() + ".tls"
+	pki := newTestPKI(t)
+	b := startSecureTestBroker(t, SecurityConfig{TLS: pki.serverTLS(false)})
+
+	opts := DefaultConnectorOptions()
+	opts.TLS = pki.clientTLS("")
+
+	received := readPattern(t, NewSourceConnectorWithOptions(b.Host(), opts), topic)
+	sink := NewSinkConnectorWithOptions(b.Host(), opts)
+	defer sink.Close()
+	assert.NoError(t, sink.Connect(topic))
+	assert.NoError(t, sink.Write(topic, []byte("encrypted")))
+	assert.Equal(t, []patternMessage{{topic, "encrypted"}}, receivePattern(t, received, 1))
+
+	plain := NewSinkConnector(b.Host())
+	defer plain.Close()
+	assert.Error(t, plain.Connect(topic), "plaintext clients must be rejected")
+}
+
+func TestBroker_MutualTLSWithACL(t *testing.T) {
+	prefix := "test" + strings.ReplaceAll(uuid.New().String(), "-", "")
+	billing, other := prefix+".billing", "test."+uuid.New().String()+".other"
+	pki := newTestPKI(t)
+	b := startSecureTestBroker(t, SecurityConfig{
+		TLS: pki.serverTLS(true),
+		ACL: []ACLRule{
+			{Principal: "ingestor", Topic: prefix + ".>", Access: AccessProduce},
+			{Principal: "reporting", Topic: billing, Access: AccessConsume},
+		},
+	})
+
+	ingestor := muxOptions()
+	ingestor.TLS = pki.clientTLS("ingestor")
+	reporting := DefaultConnectorOptions()
+	reporting.TLS = pki.clientTLS("reporting")
+
+	received := readPattern(t, NewSourceConnectorWithOptions(b.Host(), reporting), billing)
+
+	sink := NewSinkConnectorWithOptions(b.Host(), ingestor)
+	defer sink.Close()
+	assert.NoError(t, sink.Connect(billing))
+	_, err := sink.Produce(billing, []byte("allowed"))
+	assert.NoError(t, err)
+	assert.Equal(t, []patternMessage{{billing, "allowed"}}, receivePattern(t, received, 1))
+
+	_, err = sink.Produce(other, []byte("denied"))
+	assertBrokerError(t, err, ErrCodeForbidden)
+
+	err = NewSourceConnectorWithOptions(b.Host(), ingestor).Read(billing, broker.BytesHandler(func(string, []byte) {}))
+	assertBrokerError(t, err, ErrCodeForbidden)
+
+	anonymous := DefaultConnectorOptions()
+	anonymous.TLS = pki.clientTLS("")
+	noCert := NewSinkConnectorWithOptions(b.Host(), anonymous)
+	defer noCert.Close()
+	assert.Error(t, noCert.Connect(billing), "clients without a certificate must be rejected")
+}
+
+func TestBroker_TokenAuth(t *testing.T) {
+	prefix := "test" + strings.ReplaceAll(uuid.New().String(), "-", "")
+	allowed, hidden := prefix+".a.pulses", prefix+".b.pulses"
+	b := startSecureTestBroker(t, SecurityConfig{
+		Tokens:      map[string]string{"s3cret": "ingestor"},
+		RequireAuth: true,
+		ACL: []ACLRule{
+			{Principal: "ingestor", Topic: prefix + ".>", Access: AccessProduce},
+			{Principal: "ingestor", Topic: allowed, Access: AccessConsume | AccessAdmin},
+		},
+	})
+
+	opts := muxOptions()
+	opts.Token = "s3cret"
+
+	sink := NewSinkConnectorWithOptions(b.Host(), opts)
+	defer sink.Close()
+	assert.NoError(t, sink.Connect(allowed))
+	assert.NoError(t, sink.Write(hidden, []byte("hidden")))
+	assert.NoError(t, sink.Write(allowed, []byte("visible")))
+
+	// Pattern subscriptions leave out the topics the principal may not read.
+	received := readPattern(t, NewSourceConnectorWithOptions(b.Host(), opts), prefix+".*.pulses")
+	assert.Equal(t, []patternMessage{{allowed, "visible"}}, receivePattern(t, received, 1))
+	select {
+	case msg := <-received:
+		t.Fatalf("unexpected message %v", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	admin := NewAdminClientWithOptions(b.Host(), opts)
+	defer admin.Close()
+	topics, err := admin.Topics()
+	assert.NoError(t, err)
+	for _, info := range topics {
+		assert.Equal(t, allowed, info.Name)
+	}
+	assertBrokerError(t, admin.TruncateTopic(hidden), ErrCodeForbidden)
+
+	for _, token := range []string{"wrong", ""} {
+		opts.Token = token
+		rejected := NewSinkConnectorWithOptions(b.Host(), opts)
+		assertBrokerError(t, rejected.Connect(allowed), ErrCodeUnauthorized)
+		rejected.Close()
+	}
+
+	// Text protocol clients can not authenticate without a certificate, and
+	// are disconnected.
+	conn, err := net.Dial("tcp", b.Host())
+	assert.NoError(t, err)
+	defer conn.Close()
+	fmt.Fprintf(conn, "source-connector_%s\n", allowed)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = bufio.NewReader(conn).ReadString('\n')
+	assert.Error(t, err)
+}
+
+func TestBroker_ClosesConnectionsWithoutHandshake(t *testing.T) {
+	b := startSecureTestBroker(t, SecurityConfig{HandshakeTimeout: 50 * time.Millisecond})
+
+	for name, greeting := range map[string]string{
+		"nothing":  "",
+		"text":     "source-connector_",
+		"no hello": protocolMagic + string(rune(protocolVersion)),
+	} {
+		t.Run(name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", b.Host())
+			assert.NoError(t, err)
+			defer conn.Close()
+			_, err = conn.Write([]byte(greeting))
+			assert.NoError(t, err)
+
+			conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			_, err = conn.Read(make([]byte, 1))
+			assert.ErrorIs(t, err, io.EOF, "expected the broker to close the connection")
+		})
+	}
+
+	// Connections that completed their handshake are not bound by it.
+	sink := NewSinkConnector(b.Host())
+	defer sink.Close()
+	topic := "test." + uuid.New().String() + ".handshake"
+	assert.NoError(t, sink.Connect(topic))
+	time.Sleep(100 * time.Millisecond)
+	_, err := sink.Produce(topic, []byte("late"))
+	assert.NoError(t, err)
+}
@@ -2,83 +2,182 @@ package fsbroker
 
 import (
 	"fmt"
-	"net"
+	"goriok/pulses/internal/broker"
 	"strings"
 	"sync"
-	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
 // SinkConnector provides an interface for writing messages to a specific topic
-// on a filesystem-backed broker via TCP. It includes connection caching and expiration.
+// on a filesystem-backed broker via TCP. It is safe for concurrent use.
+//
+// With ConnectorOptions.Multiplex, writes to every topic share a single
+// connection and are pipelined over it. Otherwise the connector keeps a pool
+// of connections, one per topic: writes to a topic are serialized while
+// writes to different topics proceed in parallel.
+//
+// With the binary protocol, writes wait for the broker to acknowledge them
+// according to the configured Durability.
+//
+// Connections idle for ConnectorOptions.IdleTimeout, or found dead while
+// writing, are closed and dialed again on the next write. With reconnection
+// enabled, a dead connection is instead dialed again in the background and
+// writes are buffered until it is back.
 type SinkConnector struct {
-	broker     string
-	mu         sync.Mutex
-	cache      map[string]*net.Conn
-	expiration map[string]time.Time
+	conns    producer
+	opts     ConnectorOptions
+	mu       sync.Mutex
+	batchers map[string]*batcher
 }
 
 // SinkConnector manages outbound TCP connections to broker topics
 // and publishes messages by writing to a topic-specific stream.
 func NewSinkConnector(broker string) *SinkConnector {
+	return NewSinkConnectorWithOptions(broker, DefaultConnectorOptions())
+}
+
+// NewSinkConnectorWithOptions creates a sink connector using the given
+// protocol options.
+func NewSinkConnectorWithOptions(broker string, opts ConnectorOptions) *SinkConnector {
+	var conns producer = newConnPool(broker, opts)
+	if opts.Multiplex && opts.Protocol == ProtocolBinary {
+		conns = newMuxConn(broker, opts)
+	}
+
 	return &SinkConnector{
-		broker,
-		sync.Mutex{},
-		make(map[string]*net.Conn),
-		make(map[string]time.Time),
+		conns:    conns,
+		opts:     opts,
+		batchers: make(map[string]*batcher),
 	}
 }
 
-// Connect establishes or reuses a TCP connection to the specified topic.
+// Connect establishes or reuses a TCP connection to the specified topic. It
+// must be called once before writing to the topic.
 //
-// Connections are cached per topic and automatically expire after 5 minutes.
-// If a valid connection already exists, it is reused.
+// If a connection already exists, it is reused. With reconnection enabled, a
+// failed dial is retried in the background and Connect succeeds right away,
+// so that writes are buffered meanwhile.
 func (p *SinkConnector) Connect(topic string) error {
-	if _, ok := p.cache[topic]; ok {
-		if time.Now().Before(p.expiration[topic]) {
-			return nil
-		}
-		p.mu.Lock()
-		defer p.mu.Unlock()
-
-		(*p.cache[topic]).Close()
-		delete(p.cache, topic)
-		delete(p.expiration, topic)
-	}
+	return p.conns.connect(topic)
+}
 
+// Close sends pending batches and closes every connection. Messages still
+// buffered for reconnection are lost.
+func (p *SinkConnector) Close() {
 	p.mu.Lock()
-	defer p.mu.Unlock()
-	conn, err := net.Dial("tcp", p.broker)
-	if err != nil {
-		return err
+	batchers := p.batchers
+	p.batchers = make(map[string]*batcher)
+	p.mu.Unlock()
+
+	for _, b := range batchers {
+		if last := b.close(); last != nil {
+			<-last.done
+		}
 	}
-	p.cache[topic] = &conn
 
-	fmt.Fprintf(*p.cache[topic], "sink-connector_%s\n", topic)
-	logrus.Infof("sink-connector: connected to broker %s for topic %s", p.broker, topic)
+	p.conns.close()
+}
 
-	p.expiration[topic] = time.Now().Add(5 * time.Minute)
+// Write publishes a message to the topic. A trailing newline is ignored.
+// With the binary protocol, other newlines are escaped and the message is
+// delivered as written; the text protocol is line delimited and rejects
+// them.
+func (p *SinkConnector) Write(topic string, msg []byte) error {
+	_, err := p.Produce(topic, msg)
+	return err
+}
 
-	return nil
+// WriteMessage publishes msg to its topic like Write, along with its key,
+// headers and timestamp, which source connectors hand back to their
+// handler. The text protocol can not carry them and only sends the value.
+func (p *SinkConnector) WriteMessage(msg broker.Message) error {
+	_, err := p.ProduceMessage(msg)
+	return err
 }
 
-func (p *SinkConnector) Close() {
-	for _, conn := range p.cache {
-		if conn == nil {
-			continue
+// Produce publishes a message to the topic like Write and returns the offset
+// the broker assigned to it. The offset is -1 when the message is not
+// acknowledged, i.e. with DurabilityNone, the text protocol or while it is
+// buffered for reconnection.
+//
+// When batching is enabled the message joins the pending batch of the topic,
+// and Produce waits for the whole batch to be acknowledged.
+func (p *SinkConnector) Produce(topic string, msg []byte) (int64, error) {
+	return p.ProduceMessage(broker.Message{Topic: topic, Value: msg})
+}
+
+// ProduceMessage publishes msg like WriteMessage and returns its offset like
+// Produce.
+func (p *SinkConnector) ProduceMessage(msg broker.Message) (int64, error) {
+	msgCleaned := strings.TrimSuffix(string(msg.Value), "\n")
+	if p.opts.Protocol == ProtocolText {
+		if strings.Contains(msgCleaned, "\n") {
+			return -1, fmt.Errorf("sink-connector: message must not contain newlines with the text protocol")
 		}
+		return p.conns.produce(msg.Topic, [][]byte{[]byte(msgCleaned)})
+	}
 
-		(*conn).Close()
+	msg.Value = []byte(msgCleaned)
+	entry, err := encodeEntry(msg)
+	if err != nil {
+		return -1, fmt.Errorf("sink-connector: failed to encode message metadata: %w", err)
 	}
+	if p.opts.BatchSize > 1 {
+		return p.produceBatched(msg.Topic, entry)
+	}
+	return p.conns.produce(msg.Topic, [][]byte{entry})
 }
 
-func (p *SinkConnector) Write(topic string, msg []byte) error {
-	if p.cache[topic] == nil {
-		return fmt.Errorf("sink-connector: sink-connector not connected")
+// Flush sends every pending batch and waits until the broker answered them.
+func (p *SinkConnector) Flush() {
+	p.mu.Lock()
+	batchers := make([]*batcher, 0, len(p.batchers))
+	for _, b := range p.batchers {
+		batchers = append(batchers, b)
 	}
+	p.mu.Unlock()
 
-	msgCleaned := strings.TrimSuffix(string(msg), "\n")
-	fmt.Fprintf(*p.cache[topic], "%s\n", msgCleaned)
-	return nil
+	for _, b := range batchers {
+		if last := b.flush(); last != nil {
+			<-last.done
+		}
+	}
+}
+
+func (p *SinkConnector) produceBatched(topic string, msg []byte) (int64, error) {
+	p.mu.Lock()
+	b, ok := p.batchers[topic]
+	if !ok {
+		b = newBatcher(p.opts.BatchSize, p.opts.Linger, func(next *batch) {
+			p.sendBatch(topic, next)
+		})
+		p.batchers[topic] = b
+	}
+	p.mu.Unlock()
+
+	current, index := b.add(msg)
+	if current == nil {
+		return -1, errSinkClosed
+	}
+	if p.opts.Durability == DurabilityNone {
+		return -1, nil
+	}
+
+	<-current.done
+	if current.err != nil || current.offset < 0 {
+		return -1, current.err
+	}
+	return current.offset + int64(index), nil
+}
+
+// sendBatch writes a batch as one produce request and records the broker's
+// answer in it.
+func (p *SinkConnector) sendBatch(topic string, next *batch) {
+	defer close(next.done)
+
+	next.offset, next.err = p.conns.produce(topic, next.messages)
+	if next.err != nil {
+		connectorLog.Sampledf(logrus.ErrorLevel, "sink-connector: failed to produce batch of %d messages to %s: %v", len(next.messages), topic, next.err)
+	}
 }
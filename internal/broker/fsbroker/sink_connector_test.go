@@ -2,9 +2,15 @@ package fsbroker
 
 import (
 	"bufio"
+	"fmt"
+	"goriok/pulses/internal/broker"
 	"net"
+	"os"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -44,7 +50,7 @@ func TestSinkConnector_ConnectAndWrite(t *testing.T) {
 	addr, received, cleanup := startTestTCPServer(t)
 	defer cleanup()
 
-	sink := NewSinkConnector(addr)
+	sink := NewSinkConnectorWithOptions(addr, ConnectorOptions{Protocol: ProtocolText})
 	topic := "test.topic"
 
 	err := sink.Connect(topic)
@@ -62,3 +68,232 @@ func TestSinkConnector_ConnectAndWrite(t *testing.T) {
 	line2 := <-received
 	assert.Equal(t, msg, line2)
 }
+
+func TestSinkConnector_Write_EmbeddedNewlines(t *testing.T) {
+	topic := "test." + uuid.New().String() + ".newlines"
+	b := startTestBroker(t, DefaultSubscriberConfig())
+
+	text := NewSinkConnectorWithOptions(b.Host(), ConnectorOptions{Protocol: ProtocolText})
+	defer text.Close()
+	assert.NoError(t, text.Connect(topic))
+	assert.Error(t, text.Write(topic, []byte("first\nsecond")), "the text protocol is line delimited")
+
+	sink := NewSinkConnector(b.Host())
+	defer sink.Close()
+	assert.NoError(t, sink.Connect(topic))
+	assert.NoError(t, sink.Write(topic, []byte("first\nsecond")))
+	assert.NoError(t, sink.Write(topic, []byte("trailing\n")))
+
+	source := NewSourceConnector(b.Host())
+	defer source.Close()
+	received := make(chan string, 2)
+	go source.Read(topic, func(msg broker.Message) {
+		received <- string(msg.Value)
+	})
+
+	for _, want := range []string{"first\nsecond", "trailing"} {
+		select {
+		case got := <-received:
+			assert.Equal(t, want, got)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for %q", want)
+		}
+	}
+}
+
+func TestSinkConnector_Produce_ReturnsOffsets(t *testing.T) {
+	topic := "test." + uuid.New().String() + ".acks"
+	b := startTestBroker(t, DefaultSubscriberConfig())
+
+	for _, durability := range []Durability{DurabilityWritten, DurabilityFsynced} {
+		sink := NewSinkConnectorWithOptions(b.Host(), ConnectorOptions{Durability: durability})
+		assert.NoError(t, sink.Connect(topic))
+
+		first, err := sink.Produce(topic, []byte("one"))
+		assert.NoError(t, err)
+		second, err := sink.Produce(topic, []byte("two"))
+		assert.NoError(t, err)
+		assert.Equal(t, first+1, second, durability.String())
+		sink.Close()
+	}
+
+	sink := NewSinkConnectorWithOptions(b.Host(), ConnectorOptions{Durability: DurabilityNone})
+	defer sink.Close()
+	assert.NoError(t, sink.Connect(topic))
+	offset, err := sink.Produce(topic, []byte("three"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(-1), offset)
+}
+
+func TestSinkConnector_Produce_BrokerError(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer ln.Close()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		reader := bufio.NewReader(conn)
+		reader.Discard(len(protocolMagic) + 1)
+		readFrame(reader)
+		writeFrame(conn, frameHello, []byte(fmt.Sprintf(`{"version":%d}`, protocolVersion)))
+
+		readFrame(reader)
+		writeFrame(conn, frameError, encodeError(ErrCodeStorage, "disk full"))
+	}()
+
+	sink := NewSinkConnector(ln.Addr().String())
+	defer sink.Close()
+	assert.NoError(t, sink.Connect("full.topic"))
+
+	_, err = sink.Produce("full.topic", []byte("one"))
+	var brokerErr *BrokerError
+	assert.ErrorAs(t, err, &brokerErr)
+	assert.Equal(t, ErrCodeStorage, brokerErr.Code)
+}
+
+func TestSinkConnector_Produce_Batched(t *testing.T) {
+	topic := "test." + uuid.New().String() + ".batched"
+	b := startTestBroker(t, DefaultSubscriberConfig())
+
+	sink := NewSinkConnectorWithOptions(b.Host(), ConnectorOptions{
+		Durability: DurabilityFsynced,
+		BatchSize:  8,
+		Linger:     5 * time.Millisecond,
+	})
+	defer sink.Close()
+	assert.NoError(t, sink.Connect(topic))
+
+	const writers = 32
+	offsets := make(chan int64, writers)
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			offset, err := sink.Produce(topic, []byte(fmt.Sprintf("message-%d", i)))
+			assert.NoError(t, err)
+			offsets <- offset
+		}(i)
+	}
+	wg.Wait()
+	close(offsets)
+
+	seen := make(map[int64]bool)
+	for offset := range offsets {
+		assert.False(t, seen[offset], "duplicate offset %d", offset)
+		seen[offset] = true
+	}
+	for i := int64(0); i < writers; i++ {
+		assert.True(t, seen[i], "missing offset %d", i)
+	}
+}
+
+func TestSinkConnector_Flush(t *testing.T) {
+	topic := "test." + uuid.New().String() + ".flush"
+	b := startTestBroker(t, DefaultSubscriberConfig())
+
+	sink := NewSinkConnectorWithOptions(b.Host(), ConnectorOptions{
+		Durability: DurabilityNone,
+		BatchSize:  100,
+		Linger:     time.Hour,
+	})
+	defer sink.Close()
+	assert.NoError(t, sink.Connect(topic))
+
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, sink.Write(topic, []byte(fmt.Sprintf("message-%d", i))))
+	}
+	sink.Flush()
+
+	assert.Eventually(t, func() bool {
+		stored, _ := os.ReadFile(b.topicPath(topic))
+		return string(stored) == "message-0\nmessage-1\nmessage-2\n"
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestSinkConnector_DropsDeadConnection(t *testing.T) {
+	topic := "test." + uuid.New().String() + ".dead"
+	b := startTestBroker(t, DefaultSubscriberConfig())
+
+	sink := NewSinkConnectorWithOptions(b.Host(), ConnectorOptions{Durability: DurabilityWritten})
+	defer sink.Close()
+	assert.NoError(t, sink.Connect(topic))
+	assert.NoError(t, sink.Write(topic, []byte("one")))
+
+	b = restartTestBroker(t, b)
+	assert.Error(t, sink.Write(topic, []byte("lost")))
+
+	assert.NoError(t, sink.Connect(topic))
+	assert.NoError(t, sink.Write(topic, []byte("two")))
+
+	stored, err := os.ReadFile(b.topicPath(topic))
+	assert.NoError(t, err)
+	assert.Equal(t, "one\ntwo\n", string(stored))
+}
+
+func TestSinkConnector_BuffersWhileReconnecting(t *testing.T) {
+	topic := "test." + uuid.New().String() + ".buffered"
+	b := startTestBroker(t, DefaultSubscriberConfig())
+
+	var mu sync.Mutex
+	var states []ConnectionState
+	sink := NewSinkConnectorWithOptions(b.Host(), ConnectorOptions{
+		Durability: DurabilityWritten,
+		Reconnect:  ReconnectPolicy{Enabled: true, InitialBackoff: 50 * time.Millisecond, MaxBackoff: 50 * time.Millisecond, BufferSize: 2},
+		OnStateChange: func(_ string, state ConnectionState, _ error) {
+			mu.Lock()
+			defer mu.Unlock()
+			states = append(states, state)
+		},
+	})
+	defer sink.Close()
+	assert.NoError(t, sink.Connect(topic))
+	assert.NoError(t, sink.Write(topic, []byte("one")))
+
+	b.Stop()
+	offset, err := sink.Produce(topic, []byte("two"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(-1), offset)
+	assert.NoError(t, sink.Connect(topic))
+	assert.NoError(t, sink.Write(topic, []byte("three")))
+	assert.ErrorIs(t, sink.Write(topic, []byte("four")), ErrBufferFull)
+
+	restartTestBroker(t, b)
+
+	assert.Eventually(t, func() bool {
+		stored, _ := os.ReadFile(b.topicPath(topic))
+		return string(stored) == "one\ntwo\nthree\n"
+	}, 2*time.Second, 10*time.Millisecond)
+
+	offset, err = sink.Produce(topic, []byte("five"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), offset)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []ConnectionState{
+		StateConnecting, StateConnected,
+		StateDisconnected,
+		StateConnecting, StateConnected,
+	}, compactStates(states))
+}
+
+// compactStates drops the failed attempts from a sequence of states, which
+// depend on timing.
+func compactStates(states []ConnectionState) []ConnectionState {
+	var compact []ConnectionState
+	for i, state := range states {
+		failedAttempt := state == StateConnecting && i+1 < len(states) && states[i+1] == StateDisconnected
+		repeated := state == StateDisconnected && len(compact) > 0 && compact[len(compact)-1] == StateDisconnected
+		if failedAttempt || repeated {
+			continue
+		}
+		compact = append(compact, state)
+	}
+	return compact
+}
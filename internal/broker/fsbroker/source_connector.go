@@ -3,51 +3,255 @@ package fsbroker
 import (
 	"bufio"
 	"fmt"
+	"goriok/pulses/internal/broker"
+	"goriok/pulses/internal/logging"
 	"net"
+	"sync"
 
 	"github.com/sirupsen/logrus"
 )
 
+// connectorLog is the logger of the source and sink connectors.
+var connectorLog = logging.For("connector")
+
+// SourceConnector subscribes to a topic, or to a topic pattern, on the
+// broker.
+//
+// With reconnection enabled, a lost connection is dialed again with backoff
+// and the subscription resumes after the last message received, so handlers
+// see every message once as long as the broker does not drop any.
+//
+// Connectors sharing a ConnectorOptions.Group resume from the offsets
+// committed by the group instead, across restarts of the consumer.
 type SourceConnector struct {
-	broker string
-	conn   *net.Conn
+	broker    string
+	opts      ConnectorOptions
+	mu        sync.Mutex
+	conn      *net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+	next      map[string]int64
 }
 
 func NewSourceConnector(broker string) *SourceConnector {
+	return NewSourceConnectorWithOptions(broker, DefaultConnectorOptions())
+}
+
+// NewSourceConnectorWithOptions creates a source connector using the given
+// protocol options.
+func NewSourceConnectorWithOptions(broker string, opts ConnectorOptions) *SourceConnector {
 	return &SourceConnector{
-		broker,
-		nil,
+		broker: broker,
+		opts:   opts,
+		closed: make(chan struct{}),
+		next:   make(map[string]int64),
 	}
 }
 
 // Read connects to the broker and subscribes to the given topic.
 //
-// It invokes the provided handler for every message received from the broker.
-// This function blocks indefinitely unless an error occurs.
-func (c *SourceConnector) Read(topic string, handler func(topic string, msg []byte)) error {
-	conn, err := net.Dial("tcp", c.broker)
+// The topic may be a pattern in which "*" stands for any one dot-separated
+// segment, such as "tenants.*.aggregated.pulses.amount". The broker then
+// delivers the messages of every matching topic, including topics created
+// after Read was called, and the handler receives the concrete topic of each
+// message. Patterns require the binary protocol.
+//
+// It invokes the provided handler for every message received from the broker,
+// with the offset and the key, headers and timestamp it was written with.
+// The text protocol only carries values. Handlers taking the topic and value
+// alone can be adapted with broker.BytesHandler.
+//
+// This function blocks indefinitely unless an error occurs. With reconnection
+// enabled it only returns once the connector is closed, the broker rejects
+// the subscription or MaxAttempts consecutive attempts failed.
+func (c *SourceConnector) Read(topic string, handler broker.Handler) error {
+	if isPattern(topic) && c.opts.Protocol == ProtocolText {
+		return fmt.Errorf("source-connector: topic patterns require the binary protocol")
+	}
+	if c.opts.Group != "" && c.opts.Protocol == ProtocolText {
+		return fmt.Errorf("source-connector: consumer groups require the binary protocol")
+	}
+
+	attempts := 0
+	for {
+		connected, err := c.subscribe(topic, handler)
+		if c.isClosed() {
+			c.opts.notify(topic, StateClosed, nil)
+			if c.opts.Reconnect.Enabled {
+				return nil
+			}
+			return err
+		}
+		c.opts.notify(topic, StateDisconnected, err)
+
+		if connected {
+			attempts = 0
+		}
+		attempts++
+		if !c.opts.Reconnect.Enabled || !retryable(err) || c.opts.Reconnect.exhausted(attempts) {
+			return err
+		}
+
+		connectorLog.Warnf("source-connector: reconnecting to broker %s for topic %s: %v", c.broker, topic, err)
+		if !c.opts.Reconnect.sleep(attempts-1, c.closed) {
+			c.opts.notify(topic, StateClosed, nil)
+			return nil
+		}
+	}
+}
+
+// subscribe runs a single connection to the broker and reports whether the
+// handshake went through before it ended.
+func (c *SourceConnector) subscribe(topic string, handler broker.Handler) (bool, error) {
+	c.opts.notify(topic, StateConnecting, nil)
+
+	conn, err := dial(c.broker, c.opts)
 	if err != nil {
-		logrus.Errorf("source-connector: error connecting to broker: %v", err)
-		return err
+		connectorLog.Errorf("source-connector: error connecting to broker: %v", err)
+		return false, err
 	}
-	c.conn = &conn
 	defer conn.Close()
 
-	fmt.Fprintf(conn, "source-connector_%s\n", topic)
-	logrus.Infof("source-connector: connected to broker %s for topic %s", c.broker, topic)
+	if !c.setConn(&conn) {
+		return false, net.ErrClosed
+	}
+
+	reader, err := handshake(conn, c.opts, roleSource, topic, c.next)
+	if err != nil {
+		connectorLog.Errorf("source-connector: handshake with broker failed: %v", err)
+		return false, err
+	}
+	connectorLog.Infof("source-connector: connected to broker %s for topic %s", c.broker, topic)
+	c.opts.notify(topic, StateConnected, nil)
+
+	if c.opts.Protocol == ProtocolText {
+		return true, c.readText(reader, topic, handler)
+	}
+	return true, c.readFrames(conn, reader, topic, handler)
+}
+
+// readText reads newline-delimited messages. The text protocol always replays
+// the topic from its start, so messages received on earlier connections are
+// skipped by count.
+func (c *SourceConnector) readText(reader *bufio.Reader, topic string, handler broker.Handler) error {
+	seen := c.next[topic]
+	c.next[topic] = 0
 
-	reader := bufio.NewReader(conn)
 	for {
 		message, err := reader.ReadString('\n')
 		if err != nil {
-			logrus.Errorf("source-connector: error reading message: %v", err)
+			connectorLog.Errorf("source-connector: error reading message: %v", err)
 			return err
 		}
-		handler(topic, []byte(message))
-		logrus.Debugf("source-connector: received message on topic %s: %s", topic, message)
+		if message == heartbeat {
+			continue
+		}
+
+		c.next[topic]++
+		if c.next[topic] <= seen {
+			continue
+		}
+		handler(broker.Message{Topic: topic, Value: []byte(message), Offset: c.next[topic] - 1})
+		connectorLog.Sampledf(logrus.DebugLevel, "source-connector: received message on topic %s: %s", topic, logging.Payload([]byte(message)))
+	}
+}
+
+// readFrames reads frames until the connection fails. In a consumer group,
+// the offsets reached are committed whenever every message received so far
+// has been handled.
+func (c *SourceConnector) readFrames(conn net.Conn, reader *bufio.Reader, topic string, handler broker.Handler) error {
+	uncommitted := make(map[string]bool)
+	for {
+		f, err := readFrame(reader)
+		if err != nil {
+			connectorLog.Errorf("source-connector: error reading message: %v", err)
+			return err
+		}
+
+		switch f.Type {
+		case frameDeliver:
+			offset, message, err := decodeDeliver(f.Payload)
+			if err != nil {
+				return err
+			}
+			c.deliver(topic, offset, message, handler)
+			uncommitted[topic] = true
+		case frameDeliverFrom:
+			from, offset, message, err := decodeDeliverFrom(f.Payload)
+			if err != nil {
+				return err
+			}
+			c.deliver(from, offset, message, handler)
+			uncommitted[from] = true
+		case frameHeartbeat:
+		case frameError:
+			err := decodeError(f.Payload)
+			connectorLog.Errorf("source-connector: %v", err)
+			return err
+		default:
+			return fmt.Errorf("source-connector: unexpected %s frame", f.Type)
+		}
+
+		if c.opts.Group != "" && reader.Buffered() == 0 {
+			for committed := range uncommitted {
+				if err := writeFrame(conn, frameCommit, encodeCommit(committed, c.next[committed])); err != nil {
+					return err
+				}
+				delete(uncommitted, committed)
+			}
+		}
 	}
 }
 
+// deliver hands a topic log entry to the handler, unless it was already
+// received on an earlier connection.
+func (c *SourceConnector) deliver(topic string, offset int64, entry []byte, handler broker.Handler) {
+	if offset < c.next[topic] {
+		return
+	}
+	c.next[topic] = offset + 1
+
+	msg, err := decodeEntry(entry)
+	if err != nil {
+		connectorLog.Sampledf(logrus.WarnLevel, "source-connector: message %d of topic %s has %v", offset, topic, err)
+		msg = broker.Message{Value: entry}
+	}
+	msg.Topic, msg.Offset = topic, offset
+	handler(msg)
+	connectorLog.Sampledf(logrus.DebugLevel, "source-connector: received message on topic %s: %s", topic, logging.Payload(msg.Value))
+}
+
+// setConn records the current connection so that Close can interrupt it. It
+// returns false if the connector was closed in the meantime.
+func (c *SourceConnector) setConn(conn *net.Conn) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.isClosed() {
+		return false
+	}
+	c.conn = conn
+	return true
+}
+
+func (c *SourceConnector) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close stops Read, interrupting the current connection or a pending
+// reconnection.
 func (c *SourceConnector) Close() {
-	(*c.conn).Close()
+	c.closeOnce.Do(func() { close(c.closed) })
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn != nil {
+		(*c.conn).Close()
+	}
 }
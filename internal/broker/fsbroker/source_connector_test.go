@@ -2,10 +2,13 @@ package fsbroker
 
 import (
 	"fmt"
+	"goriok/pulses/internal/broker"
 	"net"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -45,7 +48,7 @@ func TestSourceConnector_Read_ConnectionRefused(t *testing.T) {
 	// Use an unused port to trigger a connection error
 	source := NewSourceConnector("127.0.0.1:65534") // unlikely to be open
 
-	err := source.Read("any.topic", func(_ string, _ []byte) {})
+	err := source.Read("any.topic", broker.BytesHandler(func(_ string, _ []byte) {}))
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "connect")
 }
@@ -63,7 +66,7 @@ func TestSourceConnector_Read_ReadError(t *testing.T) {
 	}()
 
 	source := NewSourceConnector(addr)
-	err = source.Read("drop.topic", func(_ string, _ []byte) {})
+	err = source.Read("drop.topic", broker.BytesHandler(func(_ string, _ []byte) {}))
 	assert.Error(t, err)
 }
 
@@ -71,18 +74,160 @@ func TestSourceConnector_Close(t *testing.T) {
 	addr, _, cleanup := startTestSourceServer(t, []string{"one"})
 	defer cleanup()
 
-	source := NewSourceConnector(addr)
+	source := NewSourceConnectorWithOptions(addr, ConnectorOptions{Protocol: ProtocolText})
 
 	go func() {
-		_ = source.Read("close.topic", func(_ string, _ []byte) {
+		_ = source.Read("close.topic", broker.BytesHandler(func(_ string, _ []byte) {
 			source.Close()
-		})
+		}))
 	}()
 
 	time.Sleep(200 * time.Millisecond)
 
+	source.mu.Lock()
+	defer source.mu.Unlock()
 	if source.conn != nil {
 		assert.NotNil(t, source.conn)
 		assert.NotNil(t, *source.conn)
 	}
 }
+
+func TestSourceConnector_Read_SkipsHeartbeats(t *testing.T) {
+	hb := string(entryMarker)
+	addr, _, cleanup := startTestSourceServer(t, []string{hb, "one", hb, "", "two"})
+	defer cleanup()
+
+	source := NewSourceConnectorWithOptions(addr, ConnectorOptions{Protocol: ProtocolText})
+	received := make(chan string, 4)
+	go source.Read("hb.topic", broker.BytesHandler(func(_ string, msg []byte) {
+		received <- string(msg)
+	}))
+
+	assert.Equal(t, "one\n", <-received)
+	assert.Equal(t, "\n", <-received, "an empty message is not a heartbeat")
+	assert.Equal(t, "two\n", <-received)
+}
+
+func TestSourceConnector_Read_EmptyMessage(t *testing.T) {
+	for _, protocol := range []Protocol{ProtocolBinary, ProtocolText} {
+		t.Run(protocol.String(), func(t *testing.T) {
+			topic := "test." + uuid.New().String() + ".empty"
+			b := startTestBroker(t, SubscriberConfig{QueueSize: 10, HeartbeatInterval: 10 * time.Millisecond})
+
+			sink := NewSinkConnectorWithOptions(b.Host(), ConnectorOptions{Protocol: protocol})
+			defer sink.Close()
+			assert.NoError(t, sink.Connect(topic))
+			assert.NoError(t, sink.Write(topic, []byte("")))
+			assert.NoError(t, sink.Write(topic, []byte("last")))
+
+			source := NewSourceConnectorWithOptions(b.Host(), ConnectorOptions{Protocol: protocol})
+			defer source.Close()
+			received := make(chan string, 4)
+			go source.Read(topic, broker.BytesHandler(func(_ string, msg []byte) {
+				received <- strings.TrimSuffix(string(msg), "\n")
+			}))
+
+			for _, want := range []string{"", "last"} {
+				select {
+				case got := <-received:
+					assert.Equal(t, want, got)
+				case <-time.After(2 * time.Second):
+					t.Fatalf("timed out waiting for %q", want)
+				}
+			}
+		})
+	}
+}
+
+func TestSourceConnector_Read_ResumesAfterBrokerRestart(t *testing.T) {
+	for _, protocol := range []Protocol{ProtocolBinary, ProtocolText} {
+		t.Run(protocol.String(), func(t *testing.T) {
+			topic := "test." + uuid.New().String() + ".resume"
+			b := startTestBroker(t, DefaultSubscriberConfig())
+
+			produce := func(host, msg string) {
+				sink := NewSinkConnector(host)
+				defer sink.Close()
+				assert.NoError(t, sink.Connect(topic))
+				assert.NoError(t, sink.Write(topic, []byte(msg)))
+			}
+			produce(b.Host(), "one")
+
+			states := make(chan ConnectionState, 16)
+			opts := ConnectorOptions{
+				Protocol:  protocol,
+				Reconnect: ReconnectPolicy{Enabled: true, InitialBackoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond},
+				OnStateChange: func(_ string, state ConnectionState, _ error) {
+					states <- state
+				},
+			}
+			source := NewSourceConnectorWithOptions(b.Host(), opts)
+			received := make(chan string, 4)
+			stopped := make(chan error)
+			go func() {
+				stopped <- source.Read(topic, broker.BytesHandler(func(_ string, msg []byte) {
+					received <- strings.TrimSuffix(string(msg), "\n")
+				}))
+			}()
+			assert.Equal(t, "one", <-received)
+
+			b = restartTestBroker(t, b)
+			produce(b.Host(), "two")
+
+			select {
+			case msg := <-received:
+				assert.Equal(t, "two", msg)
+			case <-time.After(2 * time.Second):
+				t.Fatal("expected message after broker restart")
+			}
+
+			source.Close()
+			assert.NoError(t, <-stopped)
+
+			close(states)
+			var seen []ConnectionState
+			for state := range states {
+				seen = append(seen, state)
+			}
+			assert.Contains(t, seen, StateDisconnected)
+			assert.Equal(t, StateClosed, seen[len(seen)-1])
+		})
+	}
+}
+
+func TestSourceConnector_Read_GivesUpAfterMaxAttempts(t *testing.T) {
+	source := NewSourceConnectorWithOptions("127.0.0.1:65534", ConnectorOptions{
+		Reconnect: ReconnectPolicy{Enabled: true, InitialBackoff: time.Millisecond, MaxAttempts: 3},
+	})
+
+	attempts := 0
+	source.opts.OnStateChange = func(_ string, state ConnectionState, _ error) {
+		if state == StateConnecting {
+			attempts++
+		}
+	}
+
+	assert.Error(t, source.Read("any.topic", broker.BytesHandler(func(_ string, _ []byte) {})))
+	assert.Equal(t, 3, attempts)
+}
+
+func TestSourceConnector_Close_InterruptsReconnect(t *testing.T) {
+	source := NewSourceConnectorWithOptions("127.0.0.1:65534", ConnectorOptions{
+		Reconnect: ReconnectPolicy{Enabled: true, InitialBackoff: time.Hour, MaxBackoff: time.Hour},
+	})
+
+	stopped := make(chan error)
+	go func() {
+		stopped <- source.Read("any.topic", broker.BytesHandler(func(_ string, _ []byte) {}))
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	source.Close()
+
+	select {
+	case err := <-stopped:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("expected Read to return after Close")
+	}
+}
@@ -0,0 +1,379 @@
+package fsbroker
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// OverflowPolicy decides what happens when a live subscriber falls more than
+// its queue size behind the head of the topic.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock makes producers of the topic wait until the subscriber
+	// has room in its queue again.
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropOldest skips the oldest undelivered messages so that the
+	// subscriber stays within its queue size.
+	OverflowDropOldest
+	// OverflowDisconnect closes the subscriber connection.
+	OverflowDisconnect
+)
+
+func (p OverflowPolicy) String() string {
+	switch p {
+	case OverflowBlock:
+		return "block"
+	case OverflowDropOldest:
+		return "drop-oldest"
+	case OverflowDisconnect:
+		return "disconnect"
+	default:
+		return fmt.Sprintf("OverflowPolicy(%d)", int(p))
+	}
+}
+
+// ParseOverflowPolicy parses the name of a policy, as returned by String.
+func ParseOverflowPolicy(name string) (OverflowPolicy, error) {
+	for _, p := range []OverflowPolicy{OverflowBlock, OverflowDropOldest, OverflowDisconnect} {
+		if p.String() == name {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown overflow policy %q", name)
+}
+
+func (p OverflowPolicy) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+func (p *OverflowPolicy) UnmarshalText(text []byte) error {
+	parsed, err := ParseOverflowPolicy(string(text))
+	if err != nil {
+		return err
+	}
+	*p = parsed
+	return nil
+}
+
+// heartbeat is written to idle text protocol subscribers to detect dead
+// connections. It is a line holding only the entry marker, a value the text
+// codec never delivers, so source connectors can tell it from any message,
+// empty ones included, and never hand it to a handler.
+const heartbeat = string(entryMarker) + "\n"
+
+// SubscriberConfig controls the per-subscriber send queue of the broker and
+// how dead subscribers are detected.
+//
+// QueueSize bounds how many messages a subscriber that has caught up with the
+// topic may fall behind its head before Overflow applies. An idle subscriber
+// receives a heartbeat every HeartbeatInterval, and any write that does not
+// complete within WriteTimeout closes the subscriber. Zero values disable the
+// respective check.
+type SubscriberConfig struct {
+	QueueSize         int
+	Overflow          OverflowPolicy
+	HeartbeatInterval time.Duration
+	WriteTimeout      time.Duration
+}
+
+// DefaultSubscriberConfig returns a bounded queue of 1024 messages that blocks
+// producers when full, with a 5s heartbeat and a 10s write timeout.
+func DefaultSubscriberConfig() SubscriberConfig {
+	return SubscriberConfig{
+		QueueSize:         1024,
+		Overflow:          OverflowBlock,
+		HeartbeatInterval: 5 * time.Second,
+		WriteTimeout:      10 * time.Second,
+	}
+}
+
+// SubscriberStats is a point-in-time view of a subscriber's delivery state.
+// Lag is the number of messages appended to the topic but not yet written to
+// the connection. Skipped counts the messages the protocol of the subscriber
+// can not carry.
+type SubscriberStats struct {
+	ID        string `json:"id"`
+	Topic     string `json:"topic"`
+	Group     string `json:"group,omitempty"`
+	Lag       int64  `json:"lag"`
+	Delivered uint64 `json:"delivered"`
+	Dropped   uint64 `json:"dropped"`
+	Skipped   uint64 `json:"skipped,omitempty"`
+}
+
+// subscriber serves a source connector from a single cursor over the topic
+// log. The cursor first replays the history and then keeps tailing the log,
+// so there is no handoff between replay and live delivery that could
+// duplicate, reorder or lose messages. Each subscriber runs in its own
+// goroutine, so a slow consumer never holds up other consumers or topics.
+type subscriber struct {
+	id        string
+	topic     string
+	conn      net.Conn
+	codec     codec
+	log       *topicLog
+	overflow  OverflowPolicy
+	maxLag    int
+	heartbeat time.Duration
+	timeout   time.Duration
+	done      chan struct{}
+	closeOnce sync.Once
+	start     int64
+	from      int64
+	group     string
+	// watched is set when the owner of the connection reads from it, and so
+	// notices the client hanging up, instead of the subscriber.
+	watched  bool
+	resumed  atomic.Int64
+	position atomic.Int64
+	dropped  atomic.Uint64
+	skipped  atomic.Uint64
+}
+
+func newSubscriber(conn net.Conn, codec codec, topic string, log *topicLog, cfg SubscriberConfig) *subscriber {
+	maxLag := cfg.QueueSize
+	if maxLag <= 0 {
+		maxLag = DefaultSubscriberConfig().QueueSize
+	}
+
+	return &subscriber{
+		id:        conn.RemoteAddr().String(),
+		topic:     topic,
+		conn:      conn,
+		codec:     codec,
+		log:       log,
+		overflow:  cfg.Overflow,
+		maxLag:    maxLag,
+		heartbeat: cfg.HeartbeatInterval,
+		timeout:   cfg.WriteTimeout,
+		done:      make(chan struct{}),
+	}
+}
+
+// run delivers the topic log, from offset s.from onwards, until the
+// subscriber is closed, the client hangs up or a write fails. Idle periods
+// are filled with heartbeats so that a vanished client is noticed even on a
+// quiet topic.
+func (s *subscriber) run() error {
+	defer s.close()
+	if !s.watched {
+		go s.watch()
+	}
+
+	file, err := os.Open(s.log.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var ticks <-chan time.Time
+	if s.heartbeat > 0 {
+		ticker := time.NewTicker(s.heartbeat)
+		defer ticker.Stop()
+		ticks = ticker.C
+	}
+
+	offset, err := s.seek(file)
+	if err != nil {
+		return err
+	}
+
+	idle := true
+	for {
+		size, count, changed := s.log.head()
+
+		if s.backlog(count) > int64(s.maxLag) {
+			switch s.overflow {
+			case OverflowDropOldest:
+				skipped, err := s.skip(file, offset, size, count-s.position.Load()-int64(s.maxLag))
+				if err != nil {
+					return err
+				}
+				offset += skipped
+			case OverflowDisconnect:
+				brokerLog.Warnf("broker: subscriber %s on topic %s is too slow, disconnecting", s.id, s.topic)
+				return nil
+			}
+		}
+
+		if offset < size {
+			delivered, err := s.deliver(file, offset, size)
+			offset += delivered
+			if err != nil {
+				return err
+			}
+			idle = false
+			continue
+		}
+
+		select {
+		case <-s.done:
+			return nil
+		case <-changed:
+		case <-ticks:
+			if idle {
+				if err := s.write(s.codec.writeHeartbeat); err != nil {
+					brokerLog.Debugf("broker: subscriber %s on topic %s missed heartbeat: %v", s.id, s.topic, err)
+					return nil
+				}
+			}
+			idle = true
+		}
+	}
+}
+
+// deliver writes the committed messages between offset and size to the
+// connection and returns the number of bytes consumed. It stops early when
+// the subscriber overflows, so that the policy is applied without waiting
+// for the whole range to be written.
+func (s *subscriber) deliver(file *os.File, offset, size int64) (int64, error) {
+	reader := bufio.NewReader(io.NewSectionReader(file, offset, size-offset))
+
+	var read int64
+	for {
+		select {
+		case <-s.done:
+			return read, net.ErrClosed
+		default:
+		}
+
+		line, err := reader.ReadString('\n')
+		if err == io.EOF {
+			return read, nil
+		}
+		if err != nil {
+			return read, err
+		}
+
+		offset := s.position.Load()
+		err = s.write(func() error { return s.codec.writeMessage(offset, line) })
+		if errors.Is(err, errUndeliverable) {
+			brokerLog.Sampledf(logrus.WarnLevel, "broker: skipping message %d of topic %s for subscriber %s: %v", offset, s.topic, s.id, err)
+			s.skipped.Add(1)
+		} else if err != nil {
+			brokerLog.Errorf("broker: Error writing message to consumer: %v", err)
+			return read, err
+		}
+		read += int64(len(line))
+		s.position.Add(1)
+
+		if s.overflow == OverflowBlock {
+			s.log.advanced()
+			continue
+		}
+		if _, count, _ := s.log.head(); s.backlog(count) > int64(s.maxLag) {
+			return read, nil
+		}
+	}
+}
+
+// backlog returns how many of the messages appended since the subscriber
+// joined are still undelivered. History that existed at subscription time is
+// replayed at the subscriber's own pace and never triggers the overflow policy.
+func (s *subscriber) backlog(count int64) int64 {
+	return count - max(s.position.Load(), s.start)
+}
+
+// seek moves the cursor past the messages before from, which the client
+// received on an earlier connection, and returns the number of bytes
+// consumed. A position beyond the end of the log resumes at its end, and one
+// before its start, after a truncation, at its start.
+func (s *subscriber) seek(file *os.File) (int64, error) {
+	first := s.log.first()
+	s.position.Store(first)
+	s.resumed.Store(first)
+
+	size, _, _ := s.log.head()
+	reader := bufio.NewReader(io.NewSectionReader(file, 0, size))
+
+	var read int64
+	for n := s.from - first; n > 0; n-- {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return read, err
+		}
+		read += int64(len(line))
+		s.position.Add(1)
+		s.resumed.Add(1)
+	}
+	return read, nil
+}
+
+// skip moves the cursor past n messages without delivering them and returns
+// the number of bytes consumed.
+func (s *subscriber) skip(file *os.File, offset, size, n int64) (int64, error) {
+	reader := bufio.NewReader(io.NewSectionReader(file, offset, size-offset))
+
+	var read int64
+	for ; n > 0; n-- {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return read, err
+		}
+		read += int64(len(line))
+		s.position.Add(1)
+		s.dropped.Add(1)
+	}
+	return read, nil
+}
+
+// watch closes the subscriber as soon as the client side of the connection
+// is closed. Source connectors never send anything after their greeting.
+func (s *subscriber) watch() {
+	io.Copy(io.Discard, s.conn)
+	s.close()
+}
+
+// write runs fn, which writes to the connection, under the write timeout.
+func (s *subscriber) write(fn func() error) error {
+	if s.timeout > 0 {
+		s.conn.SetWriteDeadline(time.Now().Add(s.timeout))
+	}
+	return fn()
+}
+
+func (s *subscriber) close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		s.conn.Close()
+	})
+}
+
+// stats reports the delivery state of the subscriber. With
+// OverflowDropOldest, messages beyond the queue count as dropped as soon as
+// they are appended, even while the subscriber is stuck writing and has yet
+// to move its cursor past them.
+func (s *subscriber) stats() SubscriberStats {
+	_, count, _ := s.log.head()
+	position := s.position.Load()
+	dropped := s.dropped.Load()
+	delivered := uint64(position-s.resumed.Load()) - dropped - s.skipped.Load()
+
+	var pending int64
+	if s.overflow == OverflowDropOldest {
+		pending = max(s.backlog(count)-int64(s.maxLag), 0)
+	}
+
+	return SubscriberStats{
+		ID:        s.id,
+		Topic:     s.topic,
+		Group:     s.group,
+		Lag:       count - position,
+		Delivered: delivered,
+		Dropped:   dropped + uint64(pending),
+		Skipped:   s.skipped.Load(),
+	}
+}
@@ -0,0 +1,228 @@
+package fsbroker
+
+import (
+	"bufio"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestLog opens a topic log in a temporary directory and appends the
+// given messages to it.
+func newTestLog(t *testing.T, messages ...string) *topicLog {
+	log, err := openTopicLog(filepath.Join(t.TempDir(), "test.topic"), 0)
+	assert.NoError(t, err)
+	t.Cleanup(func() { log.close() })
+
+	for _, msg := range messages {
+		appendMessage(t, log, msg)
+	}
+	return log
+}
+
+// newTestSubscriber subscribes to the log through an in-memory connection
+// and returns the client side of it.
+func newTestSubscriber(t *testing.T, log *topicLog, cfg SubscriberConfig) (*subscriber, net.Conn) {
+	server, client := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+
+	sub := newSubscriber(server, &textCodec{conn: server}, "test.topic", log, cfg)
+	log.subscribe(sub)
+	t.Cleanup(func() {
+		sub.close()
+		log.unsubscribe(sub)
+	})
+	return sub, client
+}
+
+func appendMessage(t *testing.T, log *topicLog, message string) {
+	_, err := log.append(message)
+	assert.NoError(t, err)
+}
+
+func readLines(t *testing.T, reader *bufio.Reader, n int) []string {
+	lines := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		line, err := reader.ReadString('\n')
+		assert.NoError(t, err)
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func TestSubscriber_ReplayThenTail(t *testing.T) {
+	log := newTestLog(t, "one\n", "two\n")
+	sub, client := newTestSubscriber(t, log, SubscriberConfig{QueueSize: 10})
+	go sub.run()
+
+	reader := bufio.NewReader(client)
+	assert.Equal(t, []string{"one\n", "two\n"}, readLines(t, reader, 2))
+
+	appendMessage(t, log, "three\n")
+	assert.Equal(t, []string{"three\n"}, readLines(t, reader, 1))
+
+	assert.Eventually(t, func() bool {
+		stats := sub.stats()
+		return stats.Delivered == 3 && stats.Lag == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestSubscriber_ResumeFromOffset(t *testing.T) {
+	log := newTestLog(t, "one\n", "two\n", "three\n")
+	sub, client := newTestSubscriber(t, log, SubscriberConfig{QueueSize: 10})
+	sub.from = 2
+	go sub.run()
+
+	reader := bufio.NewReader(client)
+	assert.Equal(t, []string{"three\n"}, readLines(t, reader, 1))
+
+	assert.Eventually(t, func() bool {
+		stats := sub.stats()
+		return stats.Delivered == 1 && stats.Lag == 0 && stats.Dropped == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestSubscriber_DropOldest(t *testing.T) {
+	log := newTestLog(t)
+	sub, client := newTestSubscriber(t, log, SubscriberConfig{QueueSize: 2, Overflow: OverflowDropOldest})
+
+	for _, msg := range []string{"one\n", "two\n", "three\n"} {
+		appendMessage(t, log, msg)
+	}
+	assert.Equal(t, int64(3), sub.stats().Lag)
+
+	go sub.run()
+
+	reader := bufio.NewReader(client)
+	assert.Equal(t, []string{"two\n", "three\n"}, readLines(t, reader, 2))
+	assert.Equal(t, uint64(1), sub.stats().Dropped)
+}
+
+func TestSubscriber_HistoryDoesNotOverflow(t *testing.T) {
+	log := newTestLog(t, "one\n", "two\n", "three\n")
+	sub, client := newTestSubscriber(t, log, SubscriberConfig{QueueSize: 1, Overflow: OverflowDisconnect})
+	go sub.run()
+
+	reader := bufio.NewReader(client)
+	assert.Equal(t, []string{"one\n", "two\n", "three\n"}, readLines(t, reader, 3))
+}
+
+func TestSubscriber_Disconnect(t *testing.T) {
+	log := newTestLog(t)
+	sub, _ := newTestSubscriber(t, log, SubscriberConfig{QueueSize: 1, Overflow: OverflowDisconnect})
+
+	appendMessage(t, log, "one\n")
+	appendMessage(t, log, "two\n")
+
+	assert.NoError(t, sub.run())
+	select {
+	case <-sub.done:
+	default:
+		t.Fatal("expected subscriber to be closed")
+	}
+}
+
+func TestSubscriber_BlockUntilDrained(t *testing.T) {
+	log := newTestLog(t)
+	sub, client := newTestSubscriber(t, log, SubscriberConfig{QueueSize: 1, Overflow: OverflowBlock})
+
+	appendMessage(t, log, "one\n")
+
+	appended := make(chan error)
+	go func() {
+		_, err := log.append("two\n")
+		appended <- err
+	}()
+
+	select {
+	case <-appended:
+		t.Fatal("expected append to block on a full queue")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	go sub.run()
+	reader := bufio.NewReader(client)
+	assert.Equal(t, []string{"one\n"}, readLines(t, reader, 1))
+
+	assert.NoError(t, <-appended)
+	assert.Equal(t, []string{"two\n"}, readLines(t, reader, 1))
+}
+
+func TestSubscriber_BlockReleasedOnUnsubscribe(t *testing.T) {
+	log := newTestLog(t)
+	sub, _ := newTestSubscriber(t, log, SubscriberConfig{QueueSize: 1, Overflow: OverflowBlock})
+	appendMessage(t, log, "one\n")
+
+	appended := make(chan error)
+	go func() {
+		_, err := log.append("two\n")
+		appended <- err
+	}()
+
+	sub.close()
+	log.unsubscribe(sub)
+	assert.NoError(t, <-appended)
+}
+
+func TestSubscriber_HeartbeatWhenIdle(t *testing.T) {
+	log := newTestLog(t)
+	sub, client := newTestSubscriber(t, log, SubscriberConfig{QueueSize: 1, HeartbeatInterval: 20 * time.Millisecond})
+	go sub.run()
+
+	line, err := bufio.NewReader(client).ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, heartbeat, line)
+}
+
+func TestSubscriber_SkipsUndeliverableMessages(t *testing.T) {
+	log := newTestLog(t, escapeEntry(string(entryMarker))+"\n", "\n", "two\n")
+	sub, client := newTestSubscriber(t, log, SubscriberConfig{QueueSize: 10})
+	go sub.run()
+
+	reader := bufio.NewReader(client)
+	assert.Equal(t, []string{"\n", "two\n"}, readLines(t, reader, 2), "a value reading as a heartbeat is skipped")
+	assert.Eventually(t, func() bool {
+		stats := sub.stats()
+		return stats.Skipped == 1 && stats.Delivered == 2
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestSubscriber_ClosedWhenClientHangsUp(t *testing.T) {
+	log := newTestLog(t)
+	sub, client := newTestSubscriber(t, log, SubscriberConfig{QueueSize: 1})
+
+	stopped := make(chan struct{})
+	go func() {
+		sub.run()
+		close(stopped)
+	}()
+
+	client.Close()
+
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("expected subscriber to stop after client hang up")
+	}
+}
+
+func TestSubscriber_ClosedOnWriteTimeout(t *testing.T) {
+	// The client never reads, so the write can not complete.
+	log := newTestLog(t, "one\n")
+	sub, _ := newTestSubscriber(t, log, SubscriberConfig{QueueSize: 1, WriteTimeout: 20 * time.Millisecond})
+
+	errs := make(chan error)
+	go func() {
+		errs <- sub.run()
+	}()
+
+	select {
+	case err := <-errs:
+		assert.Error(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("expected subscriber to be closed after write timeout")
+	}
+}
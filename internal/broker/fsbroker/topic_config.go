@@ -0,0 +1,110 @@
+package fsbroker
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// metaDir holds, inside the data directory, the metadata of topics that were created
+// with a config or truncated. Topics without a metadata file use the broker
+// defaults and start at offset 0.
+const metaDir = ".meta"
+
+// TopicConfig overrides broker settings for a single topic. Unset fields
+// inherit the matching BrokerConfig.Topics entry, then the broker's
+// StorageConfig and SubscriberConfig.
+type TopicConfig struct {
+	Fsync     *FsyncPolicy    `json:"fsync,omitempty"`
+	QueueSize int             `json:"queue_size,omitempty"`
+	Overflow  *OverflowPolicy `json:"overflow,omitempty"`
+}
+
+// inherit fills the fields of c left unset from defaults.
+func (c TopicConfig) inherit(defaults TopicConfig) TopicConfig {
+	if c.Fsync == nil {
+		c.Fsync = defaults.Fsync
+	}
+	if c.QueueSize <= 0 {
+		c.QueueSize = defaults.QueueSize
+	}
+	if c.Overflow == nil {
+		c.Overflow = defaults.Overflow
+	}
+	return c
+}
+
+// fsync returns the fsync policy of the topic.
+func (c TopicConfig) fsync(defaults StorageConfig) FsyncPolicy {
+	if c.Fsync != nil {
+		return *c.Fsync
+	}
+	return defaults.Fsync
+}
+
+// subscriber returns the config of subscribers to the topic.
+func (c TopicConfig) subscriber(defaults SubscriberConfig) SubscriberConfig {
+	if c.QueueSize > 0 {
+		defaults.QueueSize = c.QueueSize
+	}
+	if c.Overflow != nil {
+		defaults.Overflow = *c.Overflow
+	}
+	return defaults
+}
+
+// topicMeta is what the broker persists about a topic besides its messages.
+type topicMeta struct {
+	Config TopicConfig `json:"config"`
+	Start  int64       `json:"start,omitempty"`
+}
+
+func topicMetaPath(dir, topic string) string {
+	return filepath.Join(dir, metaDir, topic+".json")
+}
+
+// loadTopicMeta reads the metadata of a topic, which is empty if the topic
+// has none.
+func loadTopicMeta(dir, topic string) (topicMeta, error) {
+	var meta topicMeta
+
+	data, err := os.ReadFile(topicMetaPath(dir, topic))
+	if errors.Is(err, os.ErrNotExist) {
+		return meta, nil
+	}
+	if err != nil {
+		return meta, err
+	}
+	return meta, json.Unmarshal(data, &meta)
+}
+
+func saveTopicMeta(dir, topic string, meta topicMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(topicMetaPath(dir, topic), data)
+}
+
+func removeTopicMeta(dir, topic string) error {
+	err := os.Remove(topicMetaPath(dir, topic))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// writeFileAtomic replaces the file at path with data, so that readers never
+// see it half written, creating its directory if needed.
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,294 @@
+package fsbroker
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// FsyncPolicy decides when the broker syncs topic files to disk on its own,
+// regardless of the durability requested by sink connectors.
+type FsyncPolicy int
+
+const (
+	// FsyncNever leaves syncing to the operating system, except for writes
+	// from connectors asking for DurabilityFsynced.
+	FsyncNever FsyncPolicy = iota
+	// FsyncAlways syncs after every produce request.
+	FsyncAlways
+	// FsyncInterval syncs every topic with unsynced writes periodically.
+	FsyncInterval
+)
+
+func (p FsyncPolicy) String() string {
+	switch p {
+	case FsyncNever:
+		return "never"
+	case FsyncAlways:
+		return "always"
+	case FsyncInterval:
+		return "interval"
+	default:
+		return fmt.Sprintf("FsyncPolicy(%d)", int(p))
+	}
+}
+
+// ParseFsyncPolicy parses the name of a policy, as returned by String.
+func ParseFsyncPolicy(name string) (FsyncPolicy, error) {
+	for _, p := range []FsyncPolicy{FsyncNever, FsyncAlways, FsyncInterval} {
+		if p.String() == name {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown fsync policy %q", name)
+}
+
+func (p FsyncPolicy) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+func (p *FsyncPolicy) UnmarshalText(text []byte) error {
+	parsed, err := ParseFsyncPolicy(string(text))
+	if err != nil {
+		return err
+	}
+	*p = parsed
+	return nil
+}
+
+// StorageConfig controls how the broker persists topic files.
+type StorageConfig struct {
+	Fsync         FsyncPolicy
+	FsyncInterval time.Duration
+}
+
+// DefaultStorageConfig returns a config that only syncs on request.
+func DefaultStorageConfig() StorageConfig {
+	return StorageConfig{
+		Fsync:         FsyncNever,
+		FsyncInterval: time.Second,
+	}
+}
+
+// topicLog is the append-only file backing a topic. It tracks how much of the
+// file is committed, so that subscribers reading it concurrently never see a
+// partially written message, and wakes them up whenever it grows.
+//
+// Syncs are group committed: concurrent callers of syncTo share one fsync
+// covering everything appended up to that point.
+//
+// Offsets keep growing when the log is truncated: the file then only holds
+// the messages from offset start onwards.
+type topicLog struct {
+	path   string
+	file   *os.File
+	config TopicConfig
+
+	syncMu sync.Mutex
+	synced atomic.Int64
+
+	mu          sync.Mutex
+	cond        *sync.Cond
+	size        int64
+	start       int64
+	count       int64
+	changed     chan struct{}
+	subscribers map[*subscriber]struct{}
+}
+
+// openTopicLog opens (or creates) the log at path, whose first message has
+// offset start, and counts the messages already stored in it.
+func openTopicLog(path string, start int64) (*topicLog, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	size, count := int64(0), start
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		size += int64(len(line))
+		count++
+	}
+
+	l := &topicLog{
+		path:        path,
+		file:        file,
+		size:        size,
+		start:       start,
+		count:       count,
+		changed:     make(chan struct{}),
+		subscribers: make(map[*subscriber]struct{}),
+	}
+	l.cond = sync.NewCond(&l.mu)
+	l.synced.Store(size)
+	return l, nil
+}
+
+// append writes a newline terminated message to the end of the log and
+// returns its offset, the zero-based index of the message in the topic.
+func (l *topicLog) append(message string) (int64, error) {
+	offset, _, err := l.appendBatch([]string{message})
+	return offset, err
+}
+
+// appendBatch writes newline terminated messages to the end of the log with a
+// single write. It returns the offset of the first message, with the rest
+// following contiguously, and the size of the log after the write.
+// It waits while a subscriber with OverflowBlock is too far behind.
+func (l *topicLog) appendBatch(messages []string) (int64, int64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for l.blocked() {
+		l.cond.Wait()
+	}
+
+	offset := l.count
+	if len(messages) == 0 {
+		return offset, l.size, nil
+	}
+
+	n, err := l.file.WriteString(strings.Join(messages, ""))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	l.size += int64(n)
+	l.count += int64(len(messages))
+	close(l.changed)
+	l.changed = make(chan struct{})
+	return offset, l.size, nil
+}
+
+// syncTo makes sure the first size bytes of the log are on stable storage.
+// Whoever gets to sync first covers every write committed so far, so
+// producers waiting behind it usually find their data already synced.
+func (l *topicLog) syncTo(size int64) error {
+	if l.synced.Load() >= size {
+		return nil
+	}
+
+	l.syncMu.Lock()
+	defer l.syncMu.Unlock()
+
+	if l.synced.Load() >= size {
+		return nil
+	}
+
+	committed, _, _ := l.head()
+	if err := l.file.Sync(); err != nil {
+		return err
+	}
+	l.synced.Store(committed)
+	return nil
+}
+
+// sync flushes everything committed to the log to stable storage.
+func (l *topicLog) sync() error {
+	size, _, _ := l.head()
+	return l.syncTo(size)
+}
+
+// blocked reports whether a subscriber with OverflowBlock has reached its
+// maximum backlog.
+func (l *topicLog) blocked() bool {
+	for sub := range l.subscribers {
+		if sub.overflow == OverflowBlock && sub.backlog(l.count) >= int64(sub.maxLag) {
+			return true
+		}
+	}
+	return false
+}
+
+// head returns the committed size and message count of the log, along with a
+// channel that is closed on the next append.
+func (l *topicLog) head() (size, count int64, changed <-chan struct{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.size, l.count, l.changed
+}
+
+// first returns the offset of the first message still stored in the log.
+func (l *topicLog) first() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.start
+}
+
+func (l *topicLog) subscribe(sub *subscriber) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	sub.start = l.count
+	l.subscribers[sub] = struct{}{}
+}
+
+func (l *topicLog) unsubscribe(sub *subscriber) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.subscribers, sub)
+	l.cond.Broadcast()
+}
+
+// advanced wakes up producers waiting on a blocking subscriber.
+func (l *topicLog) advanced() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.cond.Broadcast()
+}
+
+// truncate drops every message stored in the log and returns the offset the
+// next one will get. Subscribers are closed, since their cursors point into
+// the old contents; clients resume from the new start.
+func (l *topicLog) truncate() (int64, error) {
+	l.syncMu.Lock()
+	defer l.syncMu.Unlock()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.closeSubscribersLocked()
+	if err := l.file.Truncate(0); err != nil {
+		return 0, err
+	}
+
+	l.size = 0
+	l.start = l.count
+	l.synced.Store(0)
+	close(l.changed)
+	l.changed = make(chan struct{})
+	return l.start, nil
+}
+
+// close closes the subscribers and the file of the log.
+func (l *topicLog) close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.closeSubscribersLocked()
+	return l.file.Close()
+}
+
+func (l *topicLog) closeSubscribersLocked() {
+	for sub := range l.subscribers {
+		sub.close()
+	}
+	l.cond.Broadcast()
+}
@@ -0,0 +1,101 @@
+package fsbroker
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTopicLog_ReopenCountsMessages(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "reopen.topic")
+
+	log, err := openTopicLog(path, 0)
+	assert.NoError(t, err)
+	offset, err := log.append("one\n")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), offset)
+	offset, err = log.append("two\n")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), offset)
+	assert.NoError(t, log.close())
+
+	log, err = openTopicLog(path, 0)
+	assert.NoError(t, err)
+	defer log.close()
+
+	size, count, _ := log.head()
+	assert.Equal(t, int64(8), size)
+	assert.Equal(t, int64(2), count)
+}
+
+func TestTopicLog_AppendSignalsChange(t *testing.T) {
+	log := newTestLog(t)
+	_, _, changed := log.head()
+
+	select {
+	case <-changed:
+		t.Fatal("expected no change before append")
+	default:
+	}
+
+	appendMessage(t, log, "one\n")
+
+	select {
+	case <-changed:
+	default:
+		t.Fatal("expected append to signal change")
+	}
+}
+
+func TestTopicLog_AppendBatchIsContiguous(t *testing.T) {
+	log := newTestLog(t, "zero\n")
+
+	offset, size, err := log.appendBatch([]string{"one\n", "two\n"})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), offset)
+	assert.Equal(t, int64(13), size)
+
+	_, count, _ := log.head()
+	assert.Equal(t, int64(3), count)
+}
+
+func TestTopicLog_SyncToCoversCommittedWrites(t *testing.T) {
+	log := newTestLog(t)
+
+	_, first, err := log.appendBatch([]string{"one\n"})
+	assert.NoError(t, err)
+	_, second, err := log.appendBatch([]string{"two\n"})
+	assert.NoError(t, err)
+
+	assert.NoError(t, log.syncTo(first))
+	assert.Equal(t, second, log.synced.Load())
+	assert.NoError(t, log.syncTo(second))
+}
+
+func TestTopicLog_TruncateKeepsOffsets(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "truncate.topic")
+
+	log, err := openTopicLog(path, 0)
+	assert.NoError(t, err)
+	appendMessage(t, log, "one\n")
+	appendMessage(t, log, "two\n")
+
+	start, err := log.truncate()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), start)
+
+	offset, err := log.append("three\n")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), offset)
+	assert.NoError(t, log.close())
+
+	log, err = openTopicLog(path, start)
+	assert.NoError(t, err)
+	defer log.close()
+
+	size, count, _ := log.head()
+	assert.Equal(t, int64(6), size)
+	assert.Equal(t, int64(3), count)
+	assert.Equal(t, int64(2), log.first())
+}
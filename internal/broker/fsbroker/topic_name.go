@@ -0,0 +1,64 @@
+package fsbroker
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// maxTopicLength bounds the length of topic names, which are used as file
+// names in the data directory, suffixed for their metadata.
+const maxTopicLength = 240
+
+// errInvalidRequest is wrapped by the errors of requests the broker rejects
+// without trying, such as those naming an invalid topic.
+var errInvalidRequest = errors.New("invalid request")
+
+// validateTopicName rejects topic names and patterns that could escape the
+// data directory or clash with the files the broker keeps in it: names with
+// path separators, "..", whitespace or control characters, and names
+// starting with a dot.
+func validateTopicName(topic string) error {
+	switch {
+	case topic == "":
+		return fmt.Errorf("%w: missing topic", errInvalidRequest)
+	case len(topic) > maxTopicLength:
+		return fmt.Errorf("%w: topic longer than %d bytes", errInvalidRequest, maxTopicLength)
+	case strings.ContainsAny(topic, `/\`):
+		return fmt.Errorf("%w: topic %q contains a path separator", errInvalidRequest, topic)
+	case strings.Contains(topic, ".."):
+		return fmt.Errorf("%w: topic %q contains \"..\"", errInvalidRequest, topic)
+	case strings.HasPrefix(topic, "."):
+		return fmt.Errorf("%w: topic %q starts with a dot", errInvalidRequest, topic)
+	case strings.ContainsFunc(topic, func(r rune) bool { return unicode.IsSpace(r) || unicode.IsControl(r) }):
+		return fmt.Errorf("%w: topic %q contains whitespace or control characters", errInvalidRequest, topic)
+	}
+	return nil
+}
+
+// validateTopic rejects invalid topic names and topic patterns.
+func validateTopic(topic string) error {
+	if err := validateTopicName(topic); err != nil {
+		return err
+	}
+	if isPattern(topic) {
+		return fmt.Errorf("%w: %q is a topic pattern", errInvalidRequest, topic)
+	}
+	return nil
+}
+
+// ValidateTopic returns an error if topic can not be produced to or
+// subscribed to, such as a name that could escape the data directory or a
+// topic pattern.
+func ValidateTopic(topic string) error {
+	return validateTopic(topic)
+}
+
+// validateGroup rejects group names that can not be used as file names.
+func validateGroup(group string) error {
+	if group == "" || strings.ContainsAny(group, `/\`) || strings.HasPrefix(group, ".") {
+		return fmt.Errorf("%w: invalid consumer group %q", errInvalidRequest, group)
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package fsbroker
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"goriok/pulses/internal/broker"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+var hostileTopics = []string{
+	"../../etc/passwd",
+	"..",
+	"a/b",
+	`a\b`,
+	".meta",
+	"tenants..pulses",
+	"with space",
+	"line\nbreak",
+	strings.Repeat("a", maxTopicLength+1),
+}
+
+func TestValidateTopicName(t *testing.T) {
+	for _, topic := range []string{"source.pulses", "tenants.a-b_c.grouped.pulses", "tenants.*.grouped.pulses"} {
+		assert.NoError(t, validateTopicName(topic), topic)
+	}
+	for _, topic := range append(hostileTopics, "") {
+		err := validateTopicName(topic)
+		assert.True(t, errors.Is(err, errInvalidRequest), "%q: %v", topic, err)
+	}
+
+	assert.NoError(t, validateTopic("source.pulses"))
+	assert.Error(t, validateTopic("tenants.*.grouped.pulses"))
+}
+
+func TestBroker_RejectsHostileTopics(t *testing.T) {
+	b := startTestBroker(t, DefaultSubscriberConfig())
+	admin := newTestAdmin(t, b)
+
+	single := DefaultConnectorOptions()
+	shared := NewSinkConnectorWithOptions(b.Host(), muxOptions())
+	defer shared.Close()
+
+	for _, topic := range hostileTopics {
+		sink := NewSinkConnectorWithOptions(b.Host(), single)
+		assertBrokerError(t, sink.Connect(topic), ErrCodeBadRequest)
+		sink.Close()
+
+		_, err := shared.Produce(topic, []byte("escaped"))
+		assertBrokerError(t, err, ErrCodeBadRequest)
+
+		err = NewSourceConnectorWithOptions(b.Host(), single).Read(topic, broker.BytesHandler(func(string, []byte) {}))
+		assertBrokerError(t, err, ErrCodeBadRequest)
+
+		assertBrokerError(t, admin.CreateTopic(topic, TopicConfig{}), ErrCodeBadRequest)
+		assertBrokerError(t, admin.DeleteTopic(topic), ErrCodeBadRequest)
+	}
+
+	err := NewSourceConnectorWithOptions(b.Host(), single).Read("../*", broker.BytesHandler(func(string, []byte) {}))
+	assertBrokerError(t, err, ErrCodeBadRequest)
+
+	// Text protocol clients are disconnected.
+	conn, err := net.Dial("tcp", b.Host())
+	assert.NoError(t, err)
+	defer conn.Close()
+	fmt.Fprintf(conn, "sink-connector_../escaped\nescaped\n")
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = bufio.NewReader(conn).ReadString('\n')
+	assert.Error(t, err)
+
+	_, err = os.Stat(filepath.Join(b.DataDir(), "..", "escaped"))
+	assert.True(t, os.IsNotExist(err), "nothing must be written outside the data dir")
+
+	// The broker keeps serving everyone else.
+	topic := "test." + uuid.New().String() + ".valid"
+	_, err = shared.Produce(topic, []byte("stored"))
+	assert.NoError(t, err)
+	_, err = admin.DescribeTopic(topic)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,178 @@
+// Package membroker implements an in-process broker that keeps topics in
+// memory. Its connectors have the same methods as those of fsbroker, so
+// tests and single-binary deployments can run the pipeline without a TCP
+// broker or topic files.
+//
+// Every message is kept until the broker is closed, so it suits tests and
+// short-lived runs rather than long-running deployments.
+package membroker
+
+import (
+	"errors"
+	"goriok/pulses/internal/broker"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// patternWildcard, as a segment of the topic given to SourceConnector.Read,
+// matches exactly one dot-separated segment of a topic name.
+const patternWildcard = "*"
+
+// ErrClosed is returned when using a closed broker or connector.
+var ErrClosed = errors.New("membroker: closed")
+
+// Broker stores the messages written to each topic and serves them to
+// source connectors. It is safe for concurrent use.
+type Broker struct {
+	mu      sync.Mutex
+	topics  map[string][]broker.Message
+	changed chan struct{}
+	closed  bool
+}
+
+func NewBroker() *Broker {
+	return &Broker{
+		topics:  make(map[string][]broker.Message),
+		changed: make(chan struct{}),
+	}
+}
+
+// NewSinkConnector creates a connector writing to the broker.
+func (b *Broker) NewSinkConnector() *SinkConnector {
+	return &SinkConnector{broker: b}
+}
+
+// NewSourceConnector creates a connector reading from the broker.
+func (b *Broker) NewSourceConnector() *SourceConnector {
+	return &SourceConnector{broker: b, closed: make(chan struct{})}
+}
+
+// Topics returns the topics written to so far, sorted by name.
+func (b *Broker) Topics() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	topics := make([]string, 0, len(b.topics))
+	for topic := range b.topics {
+		topics = append(topics, topic)
+	}
+	slices.Sort(topics)
+	return topics
+}
+
+// Messages returns a copy of the values of the messages written to the
+// topic.
+func (b *Broker) Messages(topic string) [][]byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	messages := make([][]byte, 0, len(b.topics[topic]))
+	for _, msg := range b.topics[topic] {
+		messages = append(messages, msg.Value)
+	}
+	return messages
+}
+
+// EndOffset returns the offset the next message written to the topic gets,
+// 0 for a topic not written to yet.
+func (b *Broker) EndOffset(topic string) (int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return 0, ErrClosed
+	}
+	return int64(len(b.topics[topic])), nil
+}
+
+// Close drops every topic. Pending reads return and further writes fail.
+func (b *Broker) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return
+	}
+	b.closed = true
+	b.topics = nil
+	close(b.changed)
+}
+
+// create makes sure the topic exists, so that readers of a pattern see it.
+func (b *Broker) create(topic string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return ErrClosed
+	}
+	if _, ok := b.topics[topic]; !ok {
+		b.topics[topic] = nil
+		b.notifyLocked()
+	}
+	return nil
+}
+
+// append stores a copy of msg at the end of its topic.
+func (b *Broker) append(msg broker.Message) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return ErrClosed
+	}
+	msg.Key = slices.Clone(msg.Key)
+	msg.Value = slices.Clone(msg.Value)
+	msg.Headers = maps.Clone(msg.Headers)
+	msg.Offset = int64(len(b.topics[msg.Topic]))
+	b.topics[msg.Topic] = append(b.topics[msg.Topic], msg)
+	b.notifyLocked()
+	return nil
+}
+
+// notifyLocked wakes up the readers waiting for new messages.
+func (b *Broker) notifyLocked() {
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// poll returns the messages of the topics matching topic past the offsets
+// already read, advancing them, or a channel closed on the next write if
+// there are none.
+func (b *Broker) poll(topic string, offsets map[string]int) (map[string][]broker.Message, <-chan struct{}, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return nil, nil, ErrClosed
+	}
+
+	pending := make(map[string][]broker.Message)
+	for name, messages := range b.topics {
+		if !matchTopic(topic, name) || offsets[name] >= len(messages) {
+			continue
+		}
+		pending[name] = messages[offsets[name]:]
+		offsets[name] = len(messages)
+	}
+	return pending, b.changed, nil
+}
+
+// matchTopic reports whether topic matches pattern, a topic name in which
+// "*" segments stand for any one segment.
+func matchTopic(pattern, topic string) bool {
+	patternSegments := strings.Split(pattern, ".")
+	topicSegments := strings.Split(topic, ".")
+	if len(patternSegments) != len(topicSegments) {
+		return false
+	}
+
+	for i, segment := range patternSegments {
+		if segment != patternWildcard && segment != topicSegments[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,49 @@
+package membroker
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBroker_TopicsAndMessages(t *testing.T) {
+	b := NewBroker()
+	sink := b.NewSinkConnector()
+
+	assert.NoError(t, sink.Connect("source.pulses"))
+	message := []byte("one")
+	assert.NoError(t, sink.Write("tenants.a.grouped.pulses", message))
+	message[0] = 'x'
+
+	assert.Equal(t, []string{"source.pulses", "tenants.a.grouped.pulses"}, b.Topics())
+	assert.Equal(t, [][]byte{[]byte("one")}, b.Messages("tenants.a.grouped.pulses"), "messages must be copied")
+	assert.Empty(t, b.Messages("source.pulses"))
+
+	end, err := b.EndOffset("tenants.a.grouped.pulses")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), end)
+	end, err = b.EndOffset("catalog.skus")
+	assert.NoError(t, err)
+	assert.Zero(t, end)
+}
+
+func TestBroker_Close(t *testing.T) {
+	b := NewBroker()
+	sink := b.NewSinkConnector()
+	assert.NoError(t, sink.Write("source.pulses", []byte("one")))
+
+	b.Close()
+	b.Close()
+	assert.ErrorIs(t, sink.Write("source.pulses", []byte("two")), ErrClosed)
+	assert.ErrorIs(t, sink.Connect("source.pulses"), ErrClosed)
+	assert.Empty(t, b.Topics())
+	_, err := b.EndOffset("source.pulses")
+	assert.ErrorIs(t, err, ErrClosed)
+}
+
+func TestMatchTopic(t *testing.T) {
+	assert.True(t, matchTopic("source.pulses", "source.pulses"))
+	assert.True(t, matchTopic("tenants.*.grouped.pulses", "tenants.a.grouped.pulses"))
+	assert.False(t, matchTopic("tenants.*.grouped.pulses", "tenants.a.aggregated.pulses"))
+	assert.False(t, matchTopic("tenants.*", "tenants.a.grouped"))
+}
@@ -0,0 +1,122 @@
+package membroker
+
+import (
+	"errors"
+	"fmt"
+	"goriok/pulses/internal/broker"
+	"sort"
+	"sync"
+)
+
+// SinkConnector writes messages to the topics of a Broker.
+type SinkConnector struct {
+	broker *Broker
+	mu     sync.Mutex
+	closed bool
+}
+
+// Connect creates the topic if needed. Writing to a topic does as well, so
+// it is only required by callers that expect it.
+func (p *SinkConnector) Connect(topic string) error {
+	if err := p.check(topic); err != nil {
+		return err
+	}
+	return p.broker.create(topic)
+}
+
+// Write appends a copy of message to the topic.
+func (p *SinkConnector) Write(topic string, message []byte) error {
+	return p.WriteMessage(broker.Message{Topic: topic, Value: message})
+}
+
+// WriteMessage appends a copy of msg, metadata included, to its topic.
+func (p *SinkConnector) WriteMessage(msg broker.Message) error {
+	if err := p.check(msg.Topic); err != nil {
+		return err
+	}
+	return p.broker.append(msg)
+}
+
+// Close makes further writes fail. Messages already written stay.
+func (p *SinkConnector) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+}
+
+func (p *SinkConnector) check(topic string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return ErrClosed
+	}
+	if topic == "" {
+		return fmt.Errorf("membroker: missing topic")
+	}
+	return nil
+}
+
+// SourceConnector reads the topics of a Broker.
+type SourceConnector struct {
+	broker    *Broker
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// Read invokes the handler for every message of the topic, from the first
+// one on, and then for every message written to it, until the connector or
+// the broker is closed. Messages come with their offset and the metadata
+// they were written with.
+//
+// The topic may be a pattern in which "*" stands for any one dot-separated
+// segment, in which case the handler gets the messages of every matching
+// topic, including topics created after Read was called, in order within
+// each topic.
+func (c *SourceConnector) Read(topic string, handler broker.Handler) error {
+	offsets := make(map[string]int)
+	for {
+		pending, changed, err := c.broker.poll(topic, offsets)
+		if errors.Is(err, ErrClosed) {
+			return nil
+		}
+
+		topics := make([]string, 0, len(pending))
+		for name := range pending {
+			topics = append(topics, name)
+		}
+		sort.Strings(topics)
+		for _, name := range topics {
+			for _, msg := range pending[name] {
+				if c.isClosed() {
+					return nil
+				}
+				handler(msg)
+			}
+		}
+		if len(pending) > 0 {
+			continue
+		}
+
+		select {
+		case <-changed:
+		case <-c.closed:
+			return nil
+		}
+	}
+}
+
+// Close stops Read.
+func (c *SourceConnector) Close() {
+	c.closeOnce.Do(func() { close(c.closed) })
+}
+
+func (c *SourceConnector) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
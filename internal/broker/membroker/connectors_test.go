@@ -0,0 +1,142 @@
+package membroker
+
+import (
+	"goriok/pulses/internal/broker"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type message struct {
+	topic string
+	body  string
+}
+
+// read runs Read on a new source connector, sending what it gets on the
+// returned channel, and closes the connector once the test finishes.
+func read(t *testing.T, b *Broker, topic string) <-chan message {
+	received := make(chan message, 16)
+	source := b.NewSourceConnector()
+	done := make(chan error, 1)
+	go func() {
+		done <- source.Read(topic, broker.BytesHandler(func(topic string, msg []byte) {
+			received <- message{topic, string(msg)}
+		}))
+	}()
+
+	t.Cleanup(func() {
+		source.Close()
+		select {
+		case err := <-done:
+			assert.NoError(t, err)
+		case <-time.After(time.Second):
+			t.Error("Read did not return after Close")
+		}
+	})
+	return received
+}
+
+func receive(t *testing.T, received <-chan message, n int) []message {
+	var messages []message
+	for len(messages) < n {
+		select {
+		case msg := <-received:
+			messages = append(messages, msg)
+		case <-time.After(time.Second):
+			t.Fatalf("timeout, got %v", messages)
+		}
+	}
+	return messages
+}
+
+func TestSourceConnector_ReadsFromTheStart(t *testing.T) {
+	b := NewBroker()
+	sink := b.NewSinkConnector()
+	assert.NoError(t, sink.Write("source.pulses", []byte("before")))
+
+	received := read(t, b, "source.pulses")
+	assert.Equal(t, []message{{"source.pulses", "before"}}, receive(t, received, 1))
+
+	assert.NoError(t, sink.Write("source.pulses", []byte("after")))
+	assert.NoError(t, sink.Write("other.pulses", []byte("ignored")))
+	assert.Equal(t, []message{{"source.pulses", "after"}}, receive(t, received, 1))
+}
+
+func TestSourceConnector_Pattern(t *testing.T) {
+	b := NewBroker()
+	sink := b.NewSinkConnector()
+	assert.NoError(t, sink.Write("tenants.a.grouped.pulses", []byte("a1")))
+
+	received := read(t, b, "tenants.*.grouped.pulses")
+	assert.Equal(t, []message{{"tenants.a.grouped.pulses", "a1"}}, receive(t, received, 1))
+
+	assert.NoError(t, sink.Write("tenants.b.grouped.pulses", []byte("b1")))
+	assert.NoError(t, sink.Write("tenants.a.aggregated.pulses", []byte("ignored")))
+	assert.NoError(t, sink.Write("tenants.a.grouped.pulses", []byte("a2")))
+	assert.ElementsMatch(t, []message{
+		{"tenants.b.grouped.pulses", "b1"},
+		{"tenants.a.grouped.pulses", "a2"},
+	}, receive(t, received, 2))
+}
+
+func TestSourceConnector_ReturnsWhenBrokerCloses(t *testing.T) {
+	b := NewBroker()
+	done := make(chan error, 1)
+	go func() {
+		done <- b.NewSourceConnector().Read("source.pulses", broker.BytesHandler(func(string, []byte) {}))
+	}()
+
+	b.Close()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Read did not return after the broker closed")
+	}
+}
+
+func TestSinkConnector_Close(t *testing.T) {
+	b := NewBroker()
+	sink := b.NewSinkConnector()
+	sink.Close()
+
+	assert.ErrorIs(t, sink.Write("source.pulses", []byte("one")), ErrClosed)
+	assert.Error(t, b.NewSinkConnector().Write("", []byte("one")))
+}
+
+func TestSourceConnector_ReadMessages(t *testing.T) {
+	b := NewBroker()
+	sink := b.NewSinkConnector()
+	written := broker.Message{
+		Topic:     "source.pulses",
+		Key:       []byte("tenant-a"),
+		Value:     []byte("traced"),
+		Headers:   map[string]string{"traceparent": "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"},
+		Timestamp: time.Unix(1700000000, 0),
+	}
+	assert.NoError(t, sink.WriteMessage(written))
+	written.Headers["traceparent"] = "changed"
+	assert.NoError(t, sink.Write("source.pulses", []byte("bare")))
+
+	var got []broker.Message
+	source := b.NewSourceConnector()
+	go source.Read("source.pulses", func(msg broker.Message) {
+		got = append(got, msg)
+		if len(got) == 2 {
+			source.Close()
+		}
+	})
+
+	assert.Eventually(t, func() bool { return source.isClosed() }, time.Second, 5*time.Millisecond)
+	assert.Equal(t, []broker.Message{
+		{
+			Topic:     "source.pulses",
+			Key:       []byte("tenant-a"),
+			Value:     []byte("traced"),
+			Headers:   map[string]string{"traceparent": "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"},
+			Timestamp: time.Unix(1700000000, 0),
+		},
+		{Topic: "source.pulses", Value: []byte("bare"), Offset: 1},
+	}, got, "messages are copied on write")
+}
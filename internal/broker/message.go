@@ -0,0 +1,37 @@
+// Package broker defines what the broker implementations have in common:
+// the messages their connectors carry.
+package broker
+
+import "time"
+
+// Message is a message of a topic, along with its metadata.
+//
+// Writers set Topic, Value and, optionally, Key, Headers and Timestamp.
+// Readers get all of them back, and the Offset the broker stored the message
+// at.
+type Message struct {
+	Topic string
+	// Key identifies what the message is about, such as a tenant, for
+	// consumers that partition or compact by it.
+	Key   []byte
+	Value []byte
+	// Headers carry metadata such as trace context or content type.
+	Headers map[string]string
+	// Offset is the position of the message in its topic, -1 when unknown,
+	// such as for messages not read from a broker.
+	Offset int64
+	// Timestamp is when the producer created the message, the zero time if
+	// it did not say.
+	Timestamp time.Time
+}
+
+// Handler receives the messages read from a topic.
+type Handler func(msg Message)
+
+// BytesHandler adapts a handler taking the topic and value of each message,
+// as read handlers did before messages had metadata, to a Handler.
+func BytesHandler(handler func(topic string, value []byte)) Handler {
+	return func(msg Message) {
+		handler(msg.Topic, msg.Value)
+	}
+}
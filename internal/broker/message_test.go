@@ -0,0 +1,18 @@
+package broker
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBytesHandler(t *testing.T) {
+	var topic, value string
+	handler := BytesHandler(func(t string, v []byte) {
+		topic, value = t, string(v)
+	})
+
+	handler(Message{Topic: "source.pulses", Key: []byte("ignored"), Value: []byte("pulse"), Offset: 3})
+	assert.Equal(t, "source.pulses", topic)
+	assert.Equal(t, "pulse", value)
+}
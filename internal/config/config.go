@@ -0,0 +1,330 @@
+// Package config loads the configuration of the ingestor command. Settings
+// are layered, each layer overriding the previous ones: built-in defaults, a
+// YAML file, PULSES_* environment variables and command line flags.
+//
+// The YAML file mirrors Config, with one mapping per section:
+//
+//	broker:
+//	  port: 9000
+//	  data_dir: /var/lib/pulses
+//	topics:
+//	  grouped: "{{.Region}}.tenants.{{.TenantID}}.usage"
+//	  labels:
+//	    Region: eu-west-1
+//	aggregation:
+//	  window: 10s
+//	log:
+//	  format: json
+//	  levels:
+//	    broker: warn
+//
+// Every setting can be set from the environment, under the name of its YAML
+// key path in upper case with the sections joined by underscores and a
+// PULSES_ prefix, such as PULSES_BROKER_DATA_DIR or PULSES_LOG_LEVEL. Maps
+// are written as key=value pairs separated by commas, as in
+// PULSES_LOG_LEVELS=broker=warn,stream=debug.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"goriok/pulses/internal/app/ingestor"
+	"goriok/pulses/internal/broker/fsbroker"
+	"goriok/pulses/internal/logging"
+	"goriok/pulses/internal/stream"
+	"goriok/pulses/internal/stream/aggregators/engines"
+	"goriok/pulses/internal/stream/catalog"
+	"goriok/pulses/internal/stream/enrichers"
+	"goriok/pulses/internal/stream/topics"
+	"goriok/pulses/internal/tracing"
+	"io"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// EnvFile names the YAML file to load when the -config flag is not given.
+const EnvFile = "PULSES_CONFIG"
+
+// Config is the configuration of the ingestor command.
+type Config struct {
+	Broker      Broker                `yaml:"broker"`
+	Connector   Connector             `yaml:"connector"`
+	Topics      Topics                `yaml:"topics"`
+	Outputs     Outputs               `yaml:"outputs"`
+	Catalog     Catalog               `yaml:"catalog"`
+	Aggregation Aggregation           `yaml:"aggregation"`
+	Log         logging.Config        `yaml:"log"`
+	HTTP        HTTP                  `yaml:"http"`
+	Health      ingestor.HealthConfig `yaml:"health"`
+	Tracing     tracing.Config        `yaml:"tracing"`
+	Stubs       Stubs                 `yaml:"stubs"`
+}
+
+// Broker configures the broker run by the ingestor.
+type Broker struct {
+	// Embedded runs an in-memory broker in process instead of the TCP
+	// broker. Nothing is written to disk and the other settings are unused.
+	Embedded bool `yaml:"embedded"`
+	// Port is the port of the TCP broker, 0 for any free port.
+	Port int `yaml:"port"`
+	// Listen is the address the broker listens on, localhost:<port> if
+	// empty.
+	Listen        string               `yaml:"listen"`
+	DataDir       string               `yaml:"data_dir"`
+	Fsync         fsbroker.FsyncPolicy `yaml:"fsync"`
+	FsyncInterval time.Duration        `yaml:"fsync_interval"`
+}
+
+// Connector configures the connectors of the ingestor to the TCP broker, as
+// fsbroker.ConnectorOptions do. Token is only read from the file and the
+// environment, never from flags, and is redacted when printed.
+type Connector struct {
+	Protocol    fsbroker.Protocol   `yaml:"protocol"`
+	Durability  fsbroker.Durability `yaml:"durability"`
+	BatchSize   int                 `yaml:"batch_size"`
+	Linger      time.Duration       `yaml:"linger"`
+	Multiplex   bool                `yaml:"multiplex"`
+	IdleTimeout time.Duration       `yaml:"idle_timeout"`
+	// Reconnect dials the broker again, with the default backoff, when the
+	// connection is lost.
+	Reconnect bool   `yaml:"reconnect"`
+	Group     string `yaml:"group"`
+	Token     string `yaml:"token"`
+}
+
+// Topics names the topics the ingestor reads from and writes to.
+type Topics struct {
+	Source string `yaml:"source"`
+	// Grouped and Aggregated are the templates of the topics grouped pulses
+	// and aggregates are written to, as described by package topics. They
+	// may name the same topic.
+	Grouped    string `yaml:"grouped"`
+	Aggregated string `yaml:"aggregated"`
+	// Labels are the labels the templates refer to besides the fields of
+	// pulses, such as the Region of the deployment.
+	Labels map[string]string `yaml:"labels,omitempty"`
+}
+
+// Outputs configures the records the ingestor writes: whether pulses are
+// passed through to the grouped topics, and the enrichers adding reference
+// data to them and to aggregates, named as registered in package enrichers.
+type Outputs struct {
+	Grouped    GroupedOutput    `yaml:"grouped"`
+	Aggregated AggregatedOutput `yaml:"aggregated"`
+	// LookupFile is the YAML or JSON file of the reference data of the
+	// built-in enrichers.
+	LookupFile string `yaml:"lookup_file"`
+}
+
+// GroupedOutput configures the grouped copies of pulses.
+type GroupedOutput struct {
+	// Enabled writes every pulse to its grouped topic. Deployments that only
+	// need aggregates disable it, halving what they store.
+	Enabled bool     `yaml:"enabled"`
+	Enrich  []string `yaml:"enrich,omitempty"`
+}
+
+// AggregatedOutput configures the aggregates.
+type AggregatedOutput struct {
+	Enrich []string `yaml:"enrich,omitempty"`
+}
+
+// Catalog configures the SKU catalog pulses are looked up in, to annotate
+// them with the product family and canonical unit of their SKU. It is
+// disabled unless File or Topic is set. Pulses of SKUs missing from it are
+// written to QuarantineTopic instead of being grouped and aggregated.
+type Catalog struct {
+	// File is the CSV or JSON file of the catalog.
+	File string `yaml:"file"`
+	// Refresh is how often File is checked for changes, 0 to load it once.
+	Refresh time.Duration `yaml:"refresh"`
+	// Topic is a catalog topic to follow, holding the entries of SKUs keyed
+	// by SKU. Its entries override those of File.
+	Topic           string `yaml:"topic"`
+	QuarantineTopic string `yaml:"quarantine_topic"`
+}
+
+// Aggregation configures the aggregator.
+type Aggregation struct {
+	// Window is how often aggregates are flushed.
+	Window time.Duration `yaml:"window"`
+}
+
+// HTTP configures the server of the metrics and health endpoints.
+type HTTP struct {
+	// Addr serves /metrics, /healthz and /readyz. The server is disabled
+	// when empty.
+	Addr string `yaml:"addr"`
+}
+
+// Stubs configures the generator of random pulses, for local runs.
+type Stubs struct {
+	Enabled bool `yaml:"enabled"`
+	Tenants int  `yaml:"tenants"`
+	SKUs    int  `yaml:"skus"`
+	// Clean deletes every topic before generating pulses.
+	Clean bool `yaml:"clean"`
+}
+
+// Default returns the built-in defaults, those of the packages configured.
+func Default() Config {
+	storage := fsbroker.DefaultStorageConfig()
+	connector := fsbroker.DefaultConnectorOptions()
+
+	return Config{
+		Broker: Broker{
+			Port:          9000,
+			DataDir:       fsbroker.DATA_DIR,
+			Fsync:         storage.Fsync,
+			FsyncInterval: storage.FsyncInterval,
+		},
+		Connector: Connector{
+			Protocol:    connector.Protocol,
+			Durability:  connector.Durability,
+			BatchSize:   connector.BatchSize,
+			Linger:      connector.Linger,
+			Multiplex:   connector.Multiplex,
+			IdleTimeout: connector.IdleTimeout,
+			Reconnect:   true,
+		},
+		Topics: Topics{
+			Source:     "source.pulses",
+			Grouped:    topics.DefaultGrouped,
+			Aggregated: topics.DefaultAggregated,
+		},
+		Outputs: Outputs{Grouped: GroupedOutput{Enabled: true}},
+		Catalog: Catalog{
+			Refresh:         30 * time.Second,
+			QuarantineTopic: stream.DefaultQuarantineTopic,
+		},
+		Aggregation: Aggregation{Window: engines.DefaultWindow},
+		Log:         logging.DefaultConfig(),
+		HTTP:        HTTP{Addr: "localhost:9100"},
+		Health:      ingestor.DefaultHealthConfig(),
+		Tracing:     tracing.DefaultConfig(),
+		Stubs:       Stubs{Tenants: 10, SKUs: 50},
+	}
+}
+
+// LoadFile overrides cfg with the settings of a YAML file. Unknown keys are
+// errors, so that typos do not go unnoticed.
+func LoadFile(cfg *Config, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+	defer f.Close()
+
+	decoder := yaml.NewDecoder(f)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("config: %s: %w", path, err)
+	}
+	return nil
+}
+
+// Write prints cfg as YAML, in the format LoadFile reads, with the connector
+// token redacted.
+func (c Config) Write(w io.Writer) error {
+	if c.Connector.Token != "" {
+		c.Connector.Token = "<redacted>"
+	}
+
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(c); err != nil {
+		return err
+	}
+	return encoder.Close()
+}
+
+// BrokerConfig returns the config of the TCP broker.
+func (c Config) BrokerConfig() fsbroker.BrokerConfig {
+	cfg := fsbroker.DefaultBrokerConfig()
+	cfg.ListenAddr = c.Broker.Listen
+	if cfg.ListenAddr == "" {
+		cfg.ListenAddr = fmt.Sprintf("localhost:%d", c.Broker.Port)
+	}
+	cfg.DataDir = c.Broker.DataDir
+	cfg.Storage.Fsync = c.Broker.Fsync
+	cfg.Storage.FsyncInterval = c.Broker.FsyncInterval
+	return cfg
+}
+
+// ConnectorOptions returns the options of the connectors to the TCP broker.
+func (c Config) ConnectorOptions() fsbroker.ConnectorOptions {
+	opts := fsbroker.ConnectorOptions{
+		Protocol:    c.Connector.Protocol,
+		Durability:  c.Connector.Durability,
+		BatchSize:   c.Connector.BatchSize,
+		Linger:      c.Connector.Linger,
+		Multiplex:   c.Connector.Multiplex,
+		IdleTimeout: c.Connector.IdleTimeout,
+		Group:       c.Connector.Group,
+		Token:       c.Connector.Token,
+	}
+	if c.Connector.Reconnect {
+		opts.Reconnect = fsbroker.DefaultReconnectPolicy()
+	}
+	return opts
+}
+
+// Routes returns the routes of the grouped and aggregated topics.
+func (c Config) Routes() (*topics.Routes, error) {
+	return topics.NewRoutes(c.Topics.Grouped, c.Topics.Aggregated, c.Topics.Labels)
+}
+
+// Ingestor returns the config of the ingestor app. It fails if the topic
+// templates are invalid, or if the enrichers or the catalog can not be
+// created, such as when their files can not be read.
+func (c Config) Ingestor() (ingestor.Config, error) {
+	routes, err := c.Routes()
+	if err != nil {
+		return ingestor.Config{}, fmt.Errorf("config: %w", err)
+	}
+	lookup, err := enrichers.LoadLookup(c.Outputs.LookupFile)
+	if err != nil {
+		return ingestor.Config{}, fmt.Errorf("config: %w", err)
+	}
+	grouped, err := enrichers.New(c.Outputs.Grouped.Enrich, lookup)
+	if err != nil {
+		return ingestor.Config{}, fmt.Errorf("config: outputs.grouped: %w", err)
+	}
+	aggregated, err := enrichers.New(c.Outputs.Aggregated.Enrich, lookup)
+	if err != nil {
+		return ingestor.Config{}, fmt.Errorf("config: outputs.aggregated: %w", err)
+	}
+
+	var skus *catalog.Catalog
+	if c.Catalog.File != "" || c.Catalog.Topic != "" {
+		skus = catalog.New()
+		if c.Catalog.File != "" {
+			if err := skus.ReloadFile(c.Catalog.File); err != nil {
+				return ingestor.Config{}, fmt.Errorf("config: %w", err)
+			}
+		}
+	}
+
+	return ingestor.Config{
+		BrokerHost:          c.BrokerConfig().ListenAddr,
+		DataDir:             c.Broker.DataDir,
+		SourceTopic:         c.Topics.Source,
+		Window:              c.Aggregation.Window,
+		Routes:              routes,
+		DisableGrouped:      !c.Outputs.Grouped.Enabled,
+		GroupedEnrichers:    grouped,
+		AggregatedEnrichers: aggregated,
+		Catalog:             skus,
+		CatalogFile:         c.Catalog.File,
+		CatalogRefresh:      c.Catalog.Refresh,
+		CatalogTopic:        c.Catalog.Topic,
+		QuarantineTopic:     c.Catalog.QuarantineTopic,
+		EnableStubs:         c.Stubs.Enabled,
+		StubTenants:         c.Stubs.Tenants,
+		StubSKUs:            c.Stubs.SKUs,
+		StubClean:           c.Stubs.Clean,
+		Health:              c.Health,
+	}, nil
+}
@@ -0,0 +1,164 @@
+package config
+
+import (
+	"bytes"
+	"goriok/pulses/internal/broker/fsbroker"
+	"goriok/pulses/internal/models"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// writeFile writes a config file in a temporary directory and returns its
+// path.
+func writeFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "pulses.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+	return path
+}
+
+func TestDefault(t *testing.T) {
+	cfg := Default()
+	assert.NoError(t, cfg.Validate())
+	assert.Equal(t, "localhost:9000", cfg.BrokerConfig().ListenAddr)
+	assert.Equal(t, fsbroker.DefaultConnectorOptions().Protocol, cfg.ConnectorOptions().Protocol)
+	assert.True(t, cfg.ConnectorOptions().Reconnect.Enabled)
+
+	ingestorCfg, err := cfg.Ingestor()
+	assert.NoError(t, err)
+	assert.Equal(t, "source.pulses", ingestorCfg.SourceTopic)
+	assert.Equal(t, "localhost:9000", ingestorCfg.BrokerHost)
+	grouped, err := ingestorCfg.Routes.Grouped(&models.Pulse{TenantID: "acme"})
+	assert.NoError(t, err)
+	assert.Equal(t, "tenants.acme.grouped.pulses", grouped)
+
+	cfg.Broker.Listen = "10.0.0.5:7777"
+	ingestorCfg, err = cfg.Ingestor()
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.5:7777", ingestorCfg.BrokerHost, "the broker is dialed where it listens")
+
+	cfg.Topics.Grouped = "{{.Region}}.pulses"
+	_, err = cfg.Ingestor()
+	assert.ErrorContains(t, err, "grouped topic")
+}
+
+func TestConfig_IngestorOutputs(t *testing.T) {
+	cfg := Default()
+	cfg.Outputs.Grouped.Enabled = false
+	cfg.Outputs.Aggregated.Enrich = []string{"tenant", "price_tier"}
+	cfg.Outputs.LookupFile = writeFile(t, "skus:\n  vm-small:\n    price_tier: standard\n")
+
+	ingestorCfg, err := cfg.Ingestor()
+	assert.NoError(t, err)
+	assert.True(t, ingestorCfg.DisableGrouped)
+	assert.Empty(t, ingestorCfg.GroupedEnrichers)
+	if assert.Len(t, ingestorCfg.AggregatedEnrichers, 2) {
+		payload := map[string]any{}
+		ingestorCfg.AggregatedEnrichers[1].Enrich(&models.Pulse{ProductSKU: "vm-small"}, payload)
+		assert.Equal(t, "standard", payload["price_tier"])
+	}
+
+	cfg.Outputs.LookupFile = filepath.Join(t.TempDir(), "missing.yaml")
+	_, err = cfg.Ingestor()
+	assert.Error(t, err)
+
+	cfg.Outputs.LookupFile = ""
+	cfg.Outputs.Grouped.Enrich = []string{"geo"}
+	_, err = cfg.Ingestor()
+	assert.ErrorContains(t, err, "outputs.grouped")
+}
+
+func TestLoadFile(t *testing.T) {
+	cfg := Default()
+	path := writeFile(t, `
+broker:
+  port: 9500
+  fsync: interval
+connector:
+  durability: fsynced
+  reconnect: false
+topics:
+  aggregated: "{{.Region}}.usage"
+  labels:
+    Region: eu-west-1
+aggregation:
+  window: 1m
+log:
+  format: json
+  levels:
+    broker: warn
+`)
+	assert.NoError(t, LoadFile(&cfg, path))
+
+	assert.Equal(t, 9500, cfg.Broker.Port)
+	assert.Equal(t, fsbroker.DATA_DIR, cfg.Broker.DataDir, "unset keys keep their value")
+	assert.Equal(t, fsbroker.FsyncInterval, cfg.BrokerConfig().Storage.Fsync)
+	assert.Equal(t, fsbroker.DurabilityFsynced, cfg.ConnectorOptions().Durability)
+	assert.False(t, cfg.ConnectorOptions().Reconnect.Enabled)
+	ingestorCfg, err := cfg.Ingestor()
+	assert.NoError(t, err)
+	assert.Equal(t, time.Minute, ingestorCfg.Window)
+	aggregated, err := ingestorCfg.Routes.Aggregated(&models.Pulse{TenantID: "acme"})
+	assert.NoError(t, err)
+	assert.Equal(t, "eu-west-1.usage", aggregated)
+	assert.Equal(t, "json", cfg.Log.Format)
+	assert.Equal(t, map[string]logrus.Level{"broker": logrus.WarnLevel}, cfg.Log.Levels)
+
+	assert.NoError(t, LoadFile(&cfg, writeFile(t, "")), "empty file")
+	assert.ErrorContains(t, LoadFile(&cfg, writeFile(t, "brokers:\n  port: 1\n")), "field brokers not found")
+	assert.ErrorContains(t, LoadFile(&cfg, writeFile(t, "connector:\n  protocol: grpc\n")), "unknown protocol")
+	assert.Error(t, LoadFile(&cfg, filepath.Join(t.TempDir(), "missing.yaml")))
+}
+
+func TestConfig_Write(t *testing.T) {
+	cfg := Default()
+	cfg.Broker.Listen = "0.0.0.0:9000"
+	cfg.Connector.Token = "s3cret"
+	cfg.Log.Levels = map[string]logrus.Level{"stream": logrus.DebugLevel}
+
+	var out bytes.Buffer
+	assert.NoError(t, cfg.Write(&out))
+	assert.Contains(t, out.String(), "window: 5s")
+	assert.NotContains(t, out.String(), "s3cret")
+	assert.Equal(t, "s3cret", cfg.Connector.Token, "redacted in the output only")
+
+	printed := Default()
+	assert.NoError(t, LoadFile(&printed, writeFile(t, out.String())))
+	cfg.Connector.Token = "<redacted>"
+	assert.Equal(t, cfg, printed, "printed configs load back")
+}
+
+func TestConfig_IngestorCatalog(t *testing.T) {
+	cfg := Default()
+	ingestorCfg, err := cfg.Ingestor()
+	assert.NoError(t, err)
+	assert.Nil(t, ingestorCfg.Catalog, "disabled by default")
+
+	cfg.Catalog.File = filepath.Join(t.TempDir(), "catalog.csv")
+	assert.NoError(t, os.WriteFile(cfg.Catalog.File, []byte("sku,family,unit\nvm-small,compute,hours\n"), 0o644))
+	cfg.Catalog.Topic = "catalog.skus"
+	ingestorCfg, err = cfg.Ingestor()
+	assert.NoError(t, err)
+	if assert.NotNil(t, ingestorCfg.Catalog) {
+		entry, ok := ingestorCfg.Catalog.Lookup("vm-small")
+		assert.True(t, ok)
+		assert.Equal(t, "hours", entry.Unit)
+	}
+	assert.Equal(t, "catalog.skus", ingestorCfg.CatalogTopic)
+	assert.Equal(t, 30*time.Second, ingestorCfg.CatalogRefresh)
+	assert.Equal(t, "quarantine.pulses", ingestorCfg.QuarantineTopic)
+
+	cfg.Catalog.File = filepath.Join(t.TempDir(), "missing.csv")
+	_, err = cfg.Ingestor()
+	assert.Error(t, err)
+
+	cfg.Catalog.File = ""
+	ingestorCfg, err = cfg.Ingestor()
+	assert.NoError(t, err)
+	assert.Zero(t, ingestorCfg.Catalog.Len(), "filled by the topic only")
+}
@@ -0,0 +1,154 @@
+package config
+
+import (
+	"encoding"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// envPrefix starts the names of the environment variables read by LoadEnv.
+const envPrefix = "PULSES"
+
+var (
+	durationType        = reflect.TypeFor[time.Duration]()
+	textUnmarshalerType = reflect.TypeFor[encoding.TextUnmarshaler]()
+)
+
+// LoadEnv overrides cfg with the PULSES_* environment variables that are
+// set, each named after the YAML key path of its setting.
+func LoadEnv(cfg *Config) error {
+	return loadEnv(reflect.ValueOf(cfg).Elem(), envPrefix)
+}
+
+// loadEnv sets the fields of a struct from the variables named after prefix
+// and their YAML keys, recursing into nested sections.
+func loadEnv(v reflect.Value, prefix string) error {
+	t := v.Type()
+	for i := range t.NumField() {
+		key := yamlKey(t.Field(i))
+		if key == "" {
+			continue
+		}
+		name := prefix + "_" + strings.ToUpper(key)
+		field := v.Field(i)
+
+		if field.Kind() == reflect.Struct && !reflect.PointerTo(field.Type()).Implements(textUnmarshalerType) {
+			if err := loadEnv(field, name); err != nil {
+				return err
+			}
+			continue
+		}
+
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		if err := setString(field, value); err != nil {
+			return fmt.Errorf("config: %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// yamlKey returns the YAML key of a struct field, empty if it has none.
+func yamlKey(field reflect.StructField) string {
+	key, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+	if key == "-" || !field.IsExported() {
+		return ""
+	}
+	return key
+}
+
+// setString parses s into v according to its type.
+func setString(v reflect.Value, s string) error {
+	if v.CanAddr() && v.Addr().Type().Implements(textUnmarshalerType) {
+		return v.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(s))
+	}
+	if v.Type() == durationType {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case reflect.Map:
+		return setMap(v, s)
+	case reflect.Slice:
+		return setSlice(v, s)
+	default:
+		return fmt.Errorf("unsupported setting type %s", v.Type())
+	}
+	return nil
+}
+
+// setMap replaces a map with string keys by the key=value pairs of s,
+// separated by commas.
+func setMap(v reflect.Value, s string) error {
+	if v.Type().Key().Kind() != reflect.String {
+		return fmt.Errorf("unsupported setting type %s", v.Type())
+	}
+
+	m := reflect.MakeMap(v.Type())
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok || key == "" {
+			return fmt.Errorf("invalid entry %q, expected key=value", pair)
+		}
+		elem := reflect.New(v.Type().Elem()).Elem()
+		if err := setString(elem, value); err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+		m.SetMapIndex(reflect.ValueOf(key).Convert(v.Type().Key()), elem)
+	}
+	v.Set(m)
+	return nil
+}
+
+// setSlice replaces a slice by the values of s, separated by commas.
+func setSlice(v reflect.Value, s string) error {
+	slice := reflect.MakeSlice(v.Type(), 0, 0)
+	for _, value := range strings.Split(s, ",") {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		elem := reflect.New(v.Type().Elem()).Elem()
+		if err := setString(elem, value); err != nil {
+			return err
+		}
+		slice = reflect.Append(slice, elem)
+	}
+	v.Set(slice)
+	return nil
+}
@@ -0,0 +1,54 @@
+package config
+
+import (
+	"goriok/pulses/internal/broker/fsbroker"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadEnv(t *testing.T) {
+	cfg := Default()
+	assert.NoError(t, LoadEnv(&cfg))
+	assert.Equal(t, Default(), cfg, "nothing set")
+
+	t.Setenv("PULSES_BROKER_DATA_DIR", "/var/lib/pulses")
+	t.Setenv("PULSES_BROKER_EMBEDDED", "true")
+	t.Setenv("PULSES_CONNECTOR_PROTOCOL", "text")
+	t.Setenv("PULSES_CONNECTOR_BATCH_SIZE", "64")
+	t.Setenv("PULSES_AGGREGATION_WINDOW", "30s")
+	t.Setenv("PULSES_LOG_LEVEL", "warn")
+	t.Setenv("PULSES_LOG_LEVELS", "broker=debug, stream=error")
+	t.Setenv("PULSES_HEALTH_MAX_FLUSH_AGE", "2m")
+	t.Setenv("PULSES_TRACING_SAMPLE_RATIO", "0.25")
+	assert.NoError(t, LoadEnv(&cfg))
+
+	assert.Equal(t, "/var/lib/pulses", cfg.Broker.DataDir)
+	assert.True(t, cfg.Broker.Embedded)
+	assert.Equal(t, fsbroker.ProtocolText, cfg.Connector.Protocol)
+	assert.Equal(t, 64, cfg.Connector.BatchSize)
+	assert.Equal(t, 30*time.Second, cfg.Aggregation.Window)
+	assert.Equal(t, logrus.WarnLevel, cfg.Log.Level)
+	assert.Equal(t, map[string]logrus.Level{"broker": logrus.DebugLevel, "stream": logrus.ErrorLevel}, cfg.Log.Levels)
+	assert.Equal(t, 2*time.Minute, cfg.Health.MaxFlushAge)
+	assert.Equal(t, 0.25, cfg.Tracing.SampleRatio)
+}
+
+func TestLoadEnv_Invalid(t *testing.T) {
+	for name, value := range map[string]string{
+		"PULSES_BROKER_PORT":          "ninety",
+		"PULSES_BROKER_FSYNC":         "sometimes",
+		"PULSES_LOG_SAMPLE_INTERVAL":  "often",
+		"PULSES_LOG_LEVELS":           "broker",
+		"PULSES_STUBS_ENABLED":        "maybe",
+		"PULSES_TRACING_SAMPLE_RATIO": "half",
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv(name, value)
+			cfg := Default()
+			assert.ErrorContains(t, LoadEnv(&cfg), name)
+		})
+	}
+}
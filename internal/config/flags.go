@@ -0,0 +1,161 @@
+package config
+
+import (
+	"flag"
+	"goriok/pulses/internal/logging"
+	"io"
+	"os"
+	"reflect"
+)
+
+// RegisterFlags defines on fs the flags of the ingestor command, each
+// setting a field of c and defaulting to its current value. The -config flag
+// is defined too, for Parse to accept it, but the file is read by Load.
+func (c *Config) RegisterFlags(fs *flag.FlagSet) {
+	fs.String("config", "", "YAML configuration file ($"+EnvFile+")")
+
+	fs.BoolVar(&c.Broker.Embedded, "embedded", c.Broker.Embedded, "Run an in-memory broker in process instead of the TCP broker")
+	fs.IntVar(&c.Broker.Port, "port", c.Broker.Port, "Broker port, 0 for any free port")
+	fs.StringVar(&c.Broker.Listen, "listen", c.Broker.Listen, "Broker listen address (default localhost:<port>)")
+	fs.StringVar(&c.Broker.DataDir, "data-dir", c.Broker.DataDir, "Broker data directory")
+	fs.TextVar(&c.Broker.Fsync, "fsync", c.Broker.Fsync, "Broker fsync policy: never, always or interval")
+	fs.DurationVar(&c.Broker.FsyncInterval, "fsync-interval", c.Broker.FsyncInterval, "Time between syncs of the interval fsync policy")
+
+	fs.TextVar(&c.Connector.Protocol, "connector-protocol", c.Connector.Protocol, "Connector protocol: binary or text")
+	fs.TextVar(&c.Connector.Durability, "connector-durability", c.Connector.Durability, "Guarantee sink connector writes wait for: none, written or fsynced")
+	fs.IntVar(&c.Connector.BatchSize, "connector-batch-size", c.Connector.BatchSize, "Messages sent per produce request, 0 or 1 to disable batching")
+	fs.DurationVar(&c.Connector.Linger, "connector-linger", c.Connector.Linger, "Longest wait of a message for its batch to fill")
+	fs.BoolVar(&c.Connector.Multiplex, "connector-multiplex", c.Connector.Multiplex, "Write to every topic over a single connection")
+	fs.DurationVar(&c.Connector.IdleTimeout, "connector-idle-timeout", c.Connector.IdleTimeout, "Close sink connections unused for this long")
+	fs.BoolVar(&c.Connector.Reconnect, "connector-reconnect", c.Connector.Reconnect, "Reconnect to the broker when the connection is lost")
+	fs.StringVar(&c.Connector.Group, "connector-group", c.Connector.Group, "Consumer group of the source connector, empty to read the whole topic")
+
+	fs.StringVar(&c.Topics.Source, "source-topic", c.Topics.Source, "Source Topic")
+	fs.StringVar(&c.Topics.Grouped, "grouped-topic", c.Topics.Grouped, "Template of the topics of grouped pulses, referring to {{.TenantID}}, {{.ProductSKU}}, {{.UseUnit}} and labels")
+	fs.StringVar(&c.Topics.Aggregated, "aggregated-topic", c.Topics.Aggregated, "Template of the topics of aggregates, referring to {{.TenantID}}, {{.ProductSKU}}, {{.UseUnit}} and labels")
+	fs.Func("topic-labels", "Labels the topic templates refer to, as Region=eu-west-1,Env=prod", func(s string) error {
+		labels, err := parseLabels(s)
+		c.Topics.Labels = labels
+		return err
+	})
+	fs.BoolVar(&c.Outputs.Grouped.Enabled, "grouped", c.Outputs.Grouped.Enabled, "Write every pulse to its grouped topic, besides aggregating it")
+	fs.Func("grouped-enrich", "Enrichers of grouped pulses, in order, as tenant,sku_category,price_tier", func(s string) error {
+		return setSlice(reflect.ValueOf(&c.Outputs.Grouped.Enrich).Elem(), s)
+	})
+	fs.Func("aggregated-enrich", "Enrichers of aggregates, in order, as tenant,sku_category,price_tier", func(s string) error {
+		return setSlice(reflect.ValueOf(&c.Outputs.Aggregated.Enrich).Elem(), s)
+	})
+	fs.StringVar(&c.Outputs.LookupFile, "lookup-file", c.Outputs.LookupFile, "YAML or JSON file of the reference data of the built-in enrichers")
+	fs.StringVar(&c.Catalog.File, "catalog-file", c.Catalog.File, "CSV or JSON SKU catalog pulses are looked up in")
+	fs.DurationVar(&c.Catalog.Refresh, "catalog-refresh", c.Catalog.Refresh, "How often the catalog file is checked for changes, 0 to load it once")
+	fs.StringVar(&c.Catalog.Topic, "catalog-topic", c.Catalog.Topic, "Catalog topic to follow, holding SKU entries keyed by SKU")
+	fs.StringVar(&c.Catalog.QuarantineTopic, "quarantine-topic", c.Catalog.QuarantineTopic, "Topic receiving the pulses of SKUs missing from the catalog")
+	fs.DurationVar(&c.Aggregation.Window, "window", c.Aggregation.Window, "Aggregation window, how often aggregates are flushed")
+
+	fs.StringVar(&c.Log.Format, "log-format", c.Log.Format, "Log format, text or json")
+	fs.TextVar(&c.Log.Level, "log-level", c.Log.Level, "Log level of the components without one in -log-levels")
+	fs.Func("log-levels", "Log levels per component, as broker=warn,connector=info,stream=debug,aggregator=error", func(s string) error {
+		levels, err := logging.ParseLevels(s)
+		c.Log.Levels = levels
+		return err
+	})
+	fs.DurationVar(&c.Log.SampleInterval, "log-sample-interval", c.Log.SampleInterval, "Shortest time between two per-message log lines of the same kind, 0 to log them all")
+	fs.BoolVar(&c.Log.Payloads, "log-payloads", c.Log.Payloads, "Log message payloads instead of redacting them")
+
+	fs.StringVar(&c.HTTP.Addr, "http-addr", c.HTTP.Addr, "Address serving /metrics, /healthz and /readyz, empty to disable")
+	fs.DurationVar(&c.Health.MaxFlushAge, "health-max-flush-age", c.Health.MaxFlushAge, "Unhealthy after this long without a successful aggregator flush, 0 to disable")
+	fs.DurationVar(&c.Health.MaxMessageAge, "health-max-message-age", c.Health.MaxMessageAge, "Not ready after this long without a pulse, 0 to disable")
+
+	fs.StringVar(&c.Tracing.Endpoint, "otlp-endpoint", c.Tracing.Endpoint, "OTLP/HTTP collector (host:port) receiving traces, empty to disable tracing")
+	fs.BoolVar(&c.Tracing.Insecure, "otlp-insecure", c.Tracing.Insecure, "Export traces over plain HTTP")
+	fs.StringVar(&c.Tracing.ServiceName, "trace-service-name", c.Tracing.ServiceName, "Service name of the exported spans")
+	fs.Float64Var(&c.Tracing.SampleRatio, "trace-sample-ratio", c.Tracing.SampleRatio, "Fraction of new traces recorded")
+
+	fs.BoolVar(&c.Stubs.Enabled, "stub", c.Stubs.Enabled, "Enable stubs")
+	fs.IntVar(&c.Stubs.Tenants, "stub-tenants", c.Stubs.Tenants, "Number of tenants")
+	fs.IntVar(&c.Stubs.SKUs, "stub-skus", c.Stubs.SKUs, "Number of SKUs")
+	fs.BoolVar(&c.Stubs.Clean, "stub-clean", c.Stubs.Clean, "Clean all topics")
+}
+
+// parseLabels parses labels written as key=value pairs separated by commas.
+func parseLabels(s string) (map[string]string, error) {
+	var labels map[string]string
+	err := setMap(reflect.ValueOf(&labels).Elem(), s)
+	return labels, err
+}
+
+// Load returns the configuration of the command line arguments args, the
+// program name excluded: the defaults, overridden by the YAML file named by
+// the -config flag or $PULSES_CONFIG, by the environment and by the flags,
+// which are defined on fs and parsed from args.
+//
+// The configuration is validated last. It is returned along with the
+// validation errors, so that it can be shown to explain them.
+func Load(fs *flag.FlagSet, args []string) (Config, error) {
+	cfg := Default()
+
+	if path := filePath(fs, args); path != "" {
+		if err := LoadFile(&cfg, path); err != nil {
+			return cfg, err
+		}
+	}
+	if err := LoadEnv(&cfg); err != nil {
+		return cfg, err
+	}
+
+	cfg.RegisterFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return cfg, err
+	}
+	return cfg, cfg.Validate()
+}
+
+// filePath returns the file named by the -config flag in args, or else by
+// $PULSES_CONFIG.
+//
+// The flag has to be known before the others are defined, as the file sets
+// their defaults. The flags are parsed once more for it, along with
+// placeholders for the others defined on fs, their errors left for Load to
+// report.
+func filePath(fs *flag.FlagSet, args []string) string {
+	probe := foreignFlags(fs)
+	scratch := Default()
+	scratch.RegisterFlags(probe)
+	probe.Parse(args)
+
+	path := os.Getenv(EnvFile)
+	probe.Visit(func(f *flag.Flag) {
+		if f.Name == "config" {
+			path = f.Value.String()
+		}
+	})
+	return path
+}
+
+// foreignFlags returns a silent flag set with placeholders for the flags of
+// fs that RegisterFlags does not define, such as those of the command.
+func foreignFlags(fs *flag.FlagSet) *flag.FlagSet {
+	own := flag.NewFlagSet("", flag.ContinueOnError)
+	scratch := Default()
+	scratch.RegisterFlags(own)
+
+	set := flag.NewFlagSet(fs.Name(), flag.ContinueOnError)
+	set.SetOutput(io.Discard)
+	fs.VisitAll(func(f *flag.Flag) {
+		if own.Lookup(f.Name) != nil {
+			return
+		}
+		bf, ok := f.Value.(interface{ IsBoolFlag() bool })
+		set.Var(placeholder{isBool: ok && bf.IsBoolFlag()}, f.Name, "")
+	})
+	return set
+}
+
+// placeholder accepts and ignores the values of a flag.
+type placeholder struct {
+	isBool bool
+}
+
+func (placeholder) String() string     { return "" }
+func (placeholder) Set(string) error   { return nil }
+func (p placeholder) IsBoolFlag() bool { return p.isBool }
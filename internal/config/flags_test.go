@@ -0,0 +1,107 @@
+package config
+
+import (
+	"flag"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newFlagSet returns a flag set that reports errors instead of exiting.
+func newFlagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet("ingestor", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	return fs
+}
+
+func TestLoad_Precedence(t *testing.T) {
+	path := writeFile(t, `
+broker:
+  port: 9100
+  data_dir: from-file
+aggregation:
+  window: 10s
+topics:
+  source: file.pulses
+`)
+	t.Setenv("PULSES_BROKER_PORT", "9200")
+	t.Setenv("PULSES_AGGREGATION_WINDOW", "20s")
+
+	fs := newFlagSet()
+	printConfig := fs.Bool("print-config", false, "")
+	cfg, err := Load(fs, []string{"-print-config", "-window", "25s", "-config", path, "-stub"})
+	assert.NoError(t, err)
+
+	assert.True(t, *printConfig)
+	assert.Equal(t, "from-file", cfg.Broker.DataDir, "file over defaults")
+	assert.Equal(t, "file.pulses", cfg.Topics.Source)
+	assert.Equal(t, 9200, cfg.Broker.Port, "environment over file")
+	assert.Equal(t, 25*time.Second, cfg.Aggregation.Window, "flags over environment")
+	assert.True(t, cfg.Stubs.Enabled)
+	assert.Equal(t, "9200", fs.Lookup("port").DefValue, "flags default to the layers below")
+}
+
+func TestLoad_FileFromEnv(t *testing.T) {
+	t.Setenv(EnvFile, writeFile(t, "topics:\n  source: env.pulses\n"))
+
+	cfg, err := Load(newFlagSet(), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "env.pulses", cfg.Topics.Source)
+
+	cfg, err = Load(newFlagSet(), []string{"--config=" + writeFile(t, "topics:\n  source: flag.pulses\n")})
+	assert.NoError(t, err)
+	assert.Equal(t, "flag.pulses", cfg.Topics.Source, "the flag names the file")
+}
+
+func TestLoad_TopicFlags(t *testing.T) {
+	cfg, err := Load(newFlagSet(), []string{
+		"-grouped-topic", "{{.Region}}.{{.Env}}.tenants.{{.TenantID}}",
+		"-aggregated-topic", "pulses.usage",
+		"-topic-labels", "Region=eu-west-1,Env=prod",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"Region": "eu-west-1", "Env": "prod"}, cfg.Topics.Labels)
+	assert.Equal(t, "pulses.usage", cfg.Topics.Aggregated)
+
+	_, err = Load(newFlagSet(), []string{"-topic-labels", "Region"})
+	assert.ErrorContains(t, err, "expected key=value")
+}
+
+func TestLoad_OutputFlags(t *testing.T) {
+	t.Setenv("PULSES_OUTPUTS_AGGREGATED_ENRICH", "tenant, price_tier")
+
+	cfg, err := Load(newFlagSet(), []string{"-grouped=false", "-grouped-enrich", "sku_category", "-lookup-file", "lookup.yaml"})
+	assert.NoError(t, err)
+	assert.False(t, cfg.Outputs.Grouped.Enabled)
+	assert.Equal(t, []string{"sku_category"}, cfg.Outputs.Grouped.Enrich)
+	assert.Equal(t, []string{"tenant", "price_tier"}, cfg.Outputs.Aggregated.Enrich, "lists from the environment")
+	assert.Equal(t, "lookup.yaml", cfg.Outputs.LookupFile)
+
+	_, err = Load(newFlagSet(), []string{"-aggregated-enrich", "geo"})
+	assert.ErrorContains(t, err, `outputs.aggregated.enrich: unknown enricher "geo"`)
+}
+
+func TestLoad_CatalogFlags(t *testing.T) {
+	cfg, err := Load(newFlagSet(), []string{
+		"-catalog-file", "skus.json",
+		"-catalog-refresh", "0s",
+		"-catalog-topic", "catalog.skus",
+		"-quarantine-topic", "pulses.unknown",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, Catalog{File: "skus.json", Topic: "catalog.skus", QuarantineTopic: "pulses.unknown"}, cfg.Catalog)
+}
+
+func TestLoad_Errors(t *testing.T) {
+	_, err := Load(newFlagSet(), []string{"-config", writeFile(t, "broker: [1]\n")})
+	assert.Error(t, err)
+
+	_, err = Load(newFlagSet(), []string{"-no-such-flag"})
+	assert.Error(t, err)
+
+	cfg, err := Load(newFlagSet(), []string{"-window", "0s"})
+	assert.ErrorContains(t, err, "aggregation.window")
+	assert.Zero(t, cfg.Aggregation.Window, "returned along with its errors")
+}
@@ -0,0 +1,21 @@
+package config
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	reloads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "pulses",
+		Subsystem: "config",
+		Name:      "reloads_total",
+		Help:      "Configuration reloads, by result: applied, unchanged, rejected or failed.",
+	}, []string{"result"})
+	lastReload = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "pulses",
+		Subsystem: "config",
+		Name:      "last_reload_timestamp_seconds",
+		Help:      "Unix time of the last configuration reload that was applied.",
+	})
+)
@@ -0,0 +1,177 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"goriok/pulses/internal/logging"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+var configLog = logging.For("config")
+
+// reloadable are the settings a running ingestor applies live, by key path
+// or section. The others require a restart: they are bound to connections,
+// listeners and files opened at startup or, like the source topic, to the
+// state of the windows being aggregated.
+var reloadable = []string{"log", "aggregation.window", "topics.grouped", "topics.aggregated", "topics.labels"}
+
+// Outcomes of a reload, as counted by pulses_config_reloads_total.
+const (
+	ReloadApplied   = "applied"
+	ReloadUnchanged = "unchanged"
+	ReloadRejected  = "rejected"
+	ReloadFailed    = "failed"
+)
+
+// ErrRestartRequired is returned by Reload when settings that are not
+// reloadable changed.
+var ErrRestartRequired = errors.New("config: restart required")
+
+// Reloader loads the configuration again, on request or when its file
+// changes, and applies it to the running ingestor if only reloadable
+// settings changed. A reload is all or nothing: when any other setting
+// changed, none is applied.
+type Reloader struct {
+	fs    *flag.FlagSet
+	args  []string
+	apply func(Config) error
+
+	mu      sync.Mutex
+	current Config
+}
+
+// NewReloader returns a reloader of the configuration current, loaded by
+// Load from fs and args. apply is called with the configurations to apply.
+func NewReloader(fs *flag.FlagSet, args []string, current Config, apply func(Config) error) *Reloader {
+	return &Reloader{fs: fs, args: args, apply: apply, current: current}
+}
+
+// Current returns the configuration last applied.
+func (r *Reloader) Current() Config {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.current
+}
+
+// Reload loads the configuration again, from the same file, environment and
+// command line, and applies it if every changed setting is reloadable. It
+// returns the key paths of the changed settings, along with
+// ErrRestartRequired if some of them are not reloadable, or with the error
+// that prevented loading or applying the configuration. The outcome is
+// logged and counted.
+func (r *Reloader) Reload() ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	next, err := Load(foreignFlags(r.fs), r.args)
+	if err != nil {
+		reloads.WithLabelValues(ReloadFailed).Inc()
+		configLog.Errorf("config: reload failed: %v", err)
+		return nil, err
+	}
+
+	changed := changedKeys(reflect.ValueOf(r.current), reflect.ValueOf(next), "")
+	if len(changed) == 0 {
+		reloads.WithLabelValues(ReloadUnchanged).Inc()
+		configLog.Infof("config: reloaded, nothing changed")
+		return nil, nil
+	}
+
+	var restart []string
+	for _, key := range changed {
+		if !isReloadable(key) {
+			restart = append(restart, key)
+		}
+	}
+	if len(restart) > 0 {
+		reloads.WithLabelValues(ReloadRejected).Inc()
+		configLog.Warnf("config: reload rejected, restart to change %s", strings.Join(restart, ", "))
+		return changed, fmt.Errorf("%w to change %s", ErrRestartRequired, strings.Join(restart, ", "))
+	}
+
+	if err := r.apply(next); err != nil {
+		reloads.WithLabelValues(ReloadFailed).Inc()
+		configLog.Errorf("config: failed to apply %s: %v", strings.Join(changed, ", "), err)
+		return changed, err
+	}
+
+	r.current = next
+	reloads.WithLabelValues(ReloadApplied).Inc()
+	lastReload.SetToCurrentTime()
+	configLog.Infof("config: reloaded %s", strings.Join(changed, ", "))
+	return changed, nil
+}
+
+// Watch reloads the configuration whenever its file changes, as seen by
+// polling it every interval, until stop is closed. It returns at once when
+// the configuration has no file.
+func (r *Reloader) Watch(interval time.Duration, stop <-chan struct{}) {
+	path := filePath(r.fs, r.args)
+	if path == "" {
+		return
+	}
+	last, _ := os.Stat(path)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			configLog.Debugf("config: failed to stat %s: %v", path, err)
+			continue
+		}
+		if last != nil && info.ModTime().Equal(last.ModTime()) && info.Size() == last.Size() {
+			continue
+		}
+		last = info
+		r.Reload()
+	}
+}
+
+// isReloadable tells whether the setting of a key path is applied live.
+func isReloadable(key string) bool {
+	for _, prefix := range reloadable {
+		if key == prefix || strings.HasPrefix(key, prefix+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// changedKeys returns the key paths of the settings that differ between two
+// values of the same struct type, recursing into nested sections.
+func changedKeys(a, b reflect.Value, prefix string) []string {
+	var changed []string
+	t := a.Type()
+	for i := range t.NumField() {
+		key := yamlKey(t.Field(i))
+		if key == "" {
+			continue
+		}
+		if prefix != "" {
+			key = prefix + "." + key
+		}
+
+		fa, fb := a.Field(i), b.Field(i)
+		if fa.Kind() == reflect.Struct && !reflect.PointerTo(fa.Type()).Implements(textUnmarshalerType) {
+			changed = append(changed, changedKeys(fa, fb, key)...)
+			continue
+		}
+		if !reflect.DeepEqual(fa.Interface(), fb.Interface()) {
+			changed = append(changed, key)
+		}
+	}
+	return changed
+}
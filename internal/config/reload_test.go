@@ -0,0 +1,158 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// newReloader loads the config of args, which name a config file, and
+// returns a reloader recording what it applies.
+func newReloader(t *testing.T, args []string) (*Reloader, *[]Config) {
+	t.Helper()
+	fs := newFlagSet()
+	fs.Bool("print-config", false, "")
+	cfg, err := Load(fs, args)
+	assert.NoError(t, err)
+
+	var applied []Config
+	return NewReloader(fs, args, cfg, func(next Config) error {
+		applied = append(applied, next)
+		return nil
+	}), &applied
+}
+
+// reloadCount returns the number of reloads with the given result.
+func reloadCount(result string) float64 {
+	return testutil.ToFloat64(reloads.WithLabelValues(result))
+}
+
+func TestReloader_Reload(t *testing.T) {
+	path := writeFile(t, "aggregation:\n  window: 5s\n")
+	reloader, applied := newReloader(t, []string{"-print-config", "-config", path})
+
+	unchanged := reloadCount(ReloadUnchanged)
+	changed, err := reloader.Reload()
+	assert.NoError(t, err)
+	assert.Empty(t, changed)
+	assert.Empty(t, *applied)
+	assert.Equal(t, unchanged+1, reloadCount(ReloadUnchanged))
+
+	assert.NoError(t, os.WriteFile(path, []byte("aggregation:\n  window: 10s\nlog:\n  level: debug\n"), 0o644))
+	applies := reloadCount(ReloadApplied)
+	changed, err = reloader.Reload()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"aggregation.window", "log.level"}, changed)
+	assert.Len(t, *applied, 1)
+	assert.Equal(t, 10*time.Second, reloader.Current().Aggregation.Window)
+	assert.Equal(t, logrus.DebugLevel, reloader.Current().Log.Level)
+	assert.Equal(t, applies+1, reloadCount(ReloadApplied))
+}
+
+func TestReloader_ReloadsTopics(t *testing.T) {
+	path := writeFile(t, "aggregation:\n  window: 5s\n")
+	reloader, applied := newReloader(t, []string{"-config", path})
+
+	assert.NoError(t, os.WriteFile(path, []byte("topics:\n  grouped: \"{{.Region}}.pulses\"\n  aggregated: \"{{.Region}}.pulses\"\n  labels:\n    Region: eu\n"), 0o644))
+	changed, err := reloader.Reload()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"topics.grouped", "topics.aggregated", "topics.labels"}, changed)
+	assert.Len(t, *applied, 1)
+	assert.Equal(t, "{{.Region}}.pulses", reloader.Current().Topics.Grouped)
+}
+
+func TestReloader_RejectsRestartSettings(t *testing.T) {
+	path := writeFile(t, "aggregation:\n  window: 5s\n")
+	reloader, applied := newReloader(t, []string{"-config", path})
+
+	assert.NoError(t, os.WriteFile(path, []byte("aggregation:\n  window: 10s\ntopics:\n  source: other.pulses\nbroker:\n  port: 9001\n"), 0o644))
+	rejected := reloadCount(ReloadRejected)
+	changed, err := reloader.Reload()
+	assert.ErrorIs(t, err, ErrRestartRequired)
+	assert.ErrorContains(t, err, "broker.port, topics.source")
+	assert.Equal(t, []string{"broker.port", "topics.source", "aggregation.window"}, changed)
+	assert.Empty(t, *applied, "all or nothing")
+	assert.Equal(t, 5*time.Second, reloader.Current().Aggregation.Window)
+	assert.Equal(t, rejected+1, reloadCount(ReloadRejected))
+}
+
+func TestReloader_Failures(t *testing.T) {
+	path := writeFile(t, "aggregation:\n  window: 5s\n")
+	reloader, applied := newReloader(t, []string{"-config", path})
+	failed := reloadCount(ReloadFailed)
+
+	assert.NoError(t, os.WriteFile(path, []byte("aggregation:\n  window: -1s\n"), 0o644))
+	_, err := reloader.Reload()
+	assert.ErrorContains(t, err, "aggregation.window")
+
+	assert.NoError(t, os.WriteFile(path, []byte("aggregation: [\n"), 0o644))
+	_, err = reloader.Reload()
+	assert.Error(t, err)
+
+	assert.NoError(t, os.WriteFile(path, []byte("aggregation:\n  window: 10s\n"), 0o644))
+	reloader.apply = func(Config) error { return errors.New("pipeline not started") }
+	_, err = reloader.Reload()
+	assert.EqualError(t, err, "pipeline not started")
+
+	assert.Empty(t, *applied)
+	assert.Equal(t, 5*time.Second, reloader.Current().Aggregation.Window)
+	assert.Equal(t, failed+3, reloadCount(ReloadFailed))
+}
+
+func TestReloader_FlagsKeepPrecedence(t *testing.T) {
+	path := writeFile(t, "aggregation:\n  window: 5s\n")
+	reloader, applied := newReloader(t, []string{"-config", path, "-window", "8s"})
+
+	assert.NoError(t, os.WriteFile(path, []byte("aggregation:\n  window: 10s\n"), 0o644))
+	changed, err := reloader.Reload()
+	assert.NoError(t, err)
+	assert.Empty(t, changed)
+	assert.Empty(t, *applied)
+	assert.Equal(t, 8*time.Second, reloader.Current().Aggregation.Window)
+}
+
+func TestReloader_Watch(t *testing.T) {
+	path := writeFile(t, "aggregation:\n  window: 5s\n")
+	fs := newFlagSet()
+	args := []string{"-config", path}
+	cfg, err := Load(fs, args)
+	assert.NoError(t, err)
+
+	applied := make(chan Config, 1)
+	reloader := NewReloader(fs, args, cfg, func(next Config) error {
+		applied <- next
+		return nil
+	})
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		reloader.Watch(10*time.Millisecond, stop)
+		close(done)
+	}()
+
+	time.Sleep(30 * time.Millisecond)
+	assert.NoError(t, os.WriteFile(path, []byte("aggregation:\n  window: 15s\n"), 0o644))
+	select {
+	case next := <-applied:
+		assert.Equal(t, 15*time.Second, next.Aggregation.Window)
+	case <-time.After(2 * time.Second):
+		t.Fatal("file change not reloaded")
+	}
+
+	close(stop)
+	<-done
+}
+
+func TestReloader_WatchWithoutFile(t *testing.T) {
+	fs := newFlagSet()
+	cfg, err := Load(fs, nil)
+	assert.NoError(t, err)
+
+	// Returns at once, with nothing to watch.
+	NewReloader(fs, nil, cfg, nil).Watch(time.Millisecond, nil)
+}
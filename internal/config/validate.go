@@ -0,0 +1,144 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"goriok/pulses/internal/broker/fsbroker"
+	"goriok/pulses/internal/logging"
+	"goriok/pulses/internal/models"
+	"goriok/pulses/internal/stream/enrichers"
+	"net"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Validate returns every invalid setting of c, each reported under its YAML
+// key path.
+func (c Config) Validate() error {
+	var errs []error
+	invalid := func(key, format string, args ...any) {
+		errs = append(errs, fmt.Errorf("%s: %s", key, fmt.Sprintf(format, args...)))
+	}
+	negative := func(key string, d time.Duration) {
+		if d < 0 {
+			invalid(key, "%v is negative", d)
+		}
+	}
+
+	if !c.Broker.Embedded {
+		if c.Broker.Port < 0 || c.Broker.Port > 65535 {
+			invalid("broker.port", "%d is not a port", c.Broker.Port)
+		}
+		if c.Broker.Listen != "" {
+			if _, _, err := net.SplitHostPort(c.Broker.Listen); err != nil {
+				invalid("broker.listen", "%v", err)
+			}
+		}
+		if c.Broker.DataDir == "" {
+			invalid("broker.data_dir", "missing")
+		}
+		if c.Broker.Fsync == fsbroker.FsyncInterval && c.Broker.FsyncInterval <= 0 {
+			invalid("broker.fsync_interval", "must be positive with the interval fsync policy")
+		}
+
+		if c.Connector.BatchSize < 0 {
+			invalid("connector.batch_size", "%d is negative", c.Connector.BatchSize)
+		}
+		negative("connector.linger", c.Connector.Linger)
+		negative("connector.idle_timeout", c.Connector.IdleTimeout)
+		if c.Connector.Protocol == fsbroker.ProtocolText {
+			if c.Connector.BatchSize > 1 {
+				invalid("connector.batch_size", "batching requires the binary protocol")
+			}
+			if c.Connector.Group != "" {
+				invalid("connector.group", "consumer groups require the binary protocol")
+			}
+		}
+	}
+
+	if err := fsbroker.ValidateTopic(c.Topics.Source); err != nil {
+		invalid("topics.source", "%v", err)
+	}
+	if routes, err := c.Routes(); err != nil {
+		invalid("topics", "%v", err)
+	} else {
+		sample := &models.Pulse{TenantID: "tenant", ProductSKU: "sku", UseUnity: "unit"}
+		grouped, _ := routes.Grouped(sample)
+		if err := fsbroker.ValidateTopic(grouped); err != nil {
+			invalid("topics.grouped", "%v", err)
+		}
+		aggregated, _ := routes.Aggregated(sample)
+		if err := fsbroker.ValidateTopic(aggregated); err != nil {
+			invalid("topics.aggregated", "%v", err)
+		}
+		if grouped == c.Topics.Source || aggregated == c.Topics.Source {
+			invalid("topics", "the grouped and aggregated topics may not be the source topic")
+		}
+	}
+	known := enrichers.Names()
+	unknownEnrichers := func(key string, names []string) {
+		for _, name := range names {
+			if !slices.Contains(known, name) {
+				invalid(key, "unknown enricher %q, expected one of %s", name, strings.Join(known, ", "))
+			}
+		}
+	}
+	unknownEnrichers("outputs.grouped.enrich", c.Outputs.Grouped.Enrich)
+	unknownEnrichers("outputs.aggregated.enrich", c.Outputs.Aggregated.Enrich)
+
+	if c.Catalog.File != "" {
+		if ext := strings.ToLower(filepath.Ext(c.Catalog.File)); ext != ".csv" && ext != ".json" {
+			invalid("catalog.file", "%q is neither a .csv nor a .json file", c.Catalog.File)
+		}
+	}
+	negative("catalog.refresh", c.Catalog.Refresh)
+	if c.Catalog.Topic != "" {
+		if err := fsbroker.ValidateTopic(c.Catalog.Topic); err != nil {
+			invalid("catalog.topic", "%v", err)
+		}
+	}
+	if err := fsbroker.ValidateTopic(c.Catalog.QuarantineTopic); err != nil {
+		invalid("catalog.quarantine_topic", "%v", err)
+	}
+	for _, topic := range []string{c.Catalog.Topic, c.Catalog.QuarantineTopic} {
+		if topic != "" && topic == c.Topics.Source {
+			invalid("catalog", "the catalog and quarantine topics may not be the source topic")
+			break
+		}
+	}
+
+	if c.Aggregation.Window <= 0 {
+		invalid("aggregation.window", "must be positive")
+	}
+
+	if c.Log.Format != logging.FormatText && c.Log.Format != logging.FormatJSON {
+		invalid("log.format", "%q is neither %s nor %s", c.Log.Format, logging.FormatText, logging.FormatJSON)
+	}
+	negative("log.sample_interval", c.Log.SampleInterval)
+
+	negative("health.max_flush_age", c.Health.MaxFlushAge)
+	negative("health.max_message_age", c.Health.MaxMessageAge)
+	if c.Health.MaxFlushAge > 0 && c.Health.MaxFlushAge <= c.Aggregation.Window {
+		invalid("health.max_flush_age", "%v does not exceed the aggregation window of %v", c.Health.MaxFlushAge, c.Aggregation.Window)
+	}
+
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		invalid("tracing.sample_ratio", "%v is not between 0 and 1", c.Tracing.SampleRatio)
+	}
+
+	if c.Stubs.Enabled {
+		if c.Stubs.Tenants <= 0 {
+			invalid("stubs.tenants", "must be positive")
+		}
+		if c.Stubs.SKUs <= 0 {
+			invalid("stubs.skus", "must be positive")
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("config: invalid settings:\n%w", errors.Join(errs...))
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package config
+
+import (
+	"goriok/pulses/internal/broker/fsbroker"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfig_Validate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(cfg *Config)
+		key    string
+	}{
+		{"port", func(cfg *Config) { cfg.Broker.Port = 70000 }, "broker.port"},
+		{"listen", func(cfg *Config) { cfg.Broker.Listen = "localhost" }, "broker.listen"},
+		{"data dir", func(cfg *Config) { cfg.Broker.DataDir = "" }, "broker.data_dir"},
+		{"fsync interval", func(cfg *Config) {
+			cfg.Broker.Fsync = fsbroker.FsyncInterval
+			cfg.Broker.FsyncInterval = 0
+		}, "broker.fsync_interval"},
+		{"text batching", func(cfg *Config) {
+			cfg.Connector.Protocol = fsbroker.ProtocolText
+			cfg.Connector.BatchSize = 10
+		}, "connector.batch_size"},
+		{"text group", func(cfg *Config) {
+			cfg.Connector.Protocol = fsbroker.ProtocolText
+			cfg.Connector.Group = "ingestors"
+		}, "connector.group"},
+		{"linger", func(cfg *Config) { cfg.Connector.Linger = -time.Second }, "connector.linger"},
+		{"source topic", func(cfg *Config) { cfg.Topics.Source = "tenants.*" }, "topics.source"},
+		{"topic template", func(cfg *Config) { cfg.Topics.Grouped = "{{.Region}}.pulses" }, "topics"},
+		{"grouped topic", func(cfg *Config) { cfg.Topics.Grouped = "tenants/{{.TenantID}}" }, "topics.grouped"},
+		{"aggregated topic", func(cfg *Config) { cfg.Topics.Aggregated = "tenants.*" }, "topics.aggregated"},
+		{"output to source", func(cfg *Config) { cfg.Topics.Aggregated = cfg.Topics.Source }, "topics"},
+		{"grouped enricher", func(cfg *Config) { cfg.Outputs.Grouped.Enrich = []string{"tenant", "geo"} }, "outputs.grouped.enrich"},
+		{"aggregated enricher", func(cfg *Config) { cfg.Outputs.Aggregated.Enrich = []string{"geo"} }, "outputs.aggregated.enrich"},
+		{"catalog file", func(cfg *Config) { cfg.Catalog.File = "catalog.yaml" }, "catalog.file"},
+		{"catalog refresh", func(cfg *Config) { cfg.Catalog.Refresh = -time.Second }, "catalog.refresh"},
+		{"catalog topic", func(cfg *Config) { cfg.Catalog.Topic = "catalog/skus" }, "catalog.topic"},
+		{"quarantine topic", func(cfg *Config) { cfg.Catalog.QuarantineTopic = "" }, "catalog.quarantine_topic"},
+		{"quarantine to source", func(cfg *Config) { cfg.Catalog.QuarantineTopic = cfg.Topics.Source }, "catalog"},
+		{"window", func(cfg *Config) { cfg.Aggregation.Window = 0 }, "aggregation.window"},
+		{"log format", func(cfg *Config) { cfg.Log.Format = "xml" }, "log.format"},
+		{"sample interval", func(cfg *Config) { cfg.Log.SampleInterval = -time.Second }, "log.sample_interval"},
+		{"flush age", func(cfg *Config) { cfg.Aggregation.Window = time.Minute }, "health.max_flush_age"},
+		{"sample ratio", func(cfg *Config) { cfg.Tracing.SampleRatio = 1.5 }, "tracing.sample_ratio"},
+		{"stub skus", func(cfg *Config) {
+			cfg.Stubs.Enabled = true
+			cfg.Stubs.SKUs = 0
+		}, "stubs.skus"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := Default()
+			tt.modify(&cfg)
+			assert.ErrorContains(t, cfg.Validate(), tt.key+":")
+		})
+	}
+}
+
+func TestConfig_ValidateReportsEverySetting(t *testing.T) {
+	cfg := Default()
+	cfg.Broker.Port = -1
+	cfg.Aggregation.Window = 0
+	cfg.Tracing.SampleRatio = -1
+
+	err := cfg.Validate()
+	assert.ErrorContains(t, err, "broker.port")
+	assert.ErrorContains(t, err, "aggregation.window")
+	assert.ErrorContains(t, err, "tracing.sample_ratio")
+}
+
+func TestConfig_ValidateEmbedded(t *testing.T) {
+	cfg := Default()
+	cfg.Broker.Embedded = true
+	cfg.Broker.DataDir = ""
+	cfg.Connector.Protocol = fsbroker.ProtocolText
+	cfg.Connector.Group = "ingestors"
+	assert.NoError(t, cfg.Validate(), "TCP broker settings are unused")
+}
@@ -0,0 +1,243 @@
+// Package logging configures the logs of the broker, the stream and the
+// aggregators: their format, a level per component, sampling of the lines
+// logged on hot paths and redaction of message payloads.
+//
+// Each component logs through its own logger, obtained with For, so that it
+// can be made more or less verbose than the others. Configure applies to the
+// loggers already handed out as well as to later ones, and to the standard
+// logrus logger used by the commands.
+package logging
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Formats of the log lines.
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// Config is the logging configuration.
+type Config struct {
+	// Format is FormatText or FormatJSON.
+	Format string `yaml:"format"`
+	// Level is the level of the components without one in Levels.
+	Level logrus.Level `yaml:"level"`
+	// Levels overrides Level per component, such as "broker" or "stream".
+	Levels map[string]logrus.Level `yaml:"levels"`
+	// SampleInterval is the shortest time between two lines logged by the
+	// same statement on a hot path, such as one per message. Lines dropped
+	// in between are counted by the next one. Zero logs every line.
+	SampleInterval time.Duration `yaml:"sample_interval"`
+	// Payloads logs message payloads as is. They are redacted otherwise, as
+	// they may hold tenant data.
+	Payloads bool `yaml:"payloads"`
+	// Output receives the log lines, os.Stderr when nil.
+	Output io.Writer `yaml:"-"`
+}
+
+// DefaultConfig logs text at Info, at most one hot-path line per statement
+// and second, with redacted payloads.
+func DefaultConfig() Config {
+	return Config{
+		Format:         FormatText,
+		Level:          logrus.InfoLevel,
+		SampleInterval: time.Second,
+	}
+}
+
+// ParseLevels parses component levels written as "broker=warn,stream=debug".
+func ParseLevels(s string) (map[string]logrus.Level, error) {
+	levels := make(map[string]logrus.Level)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		component, value, ok := strings.Cut(part, "=")
+		if !ok || component == "" {
+			return nil, fmt.Errorf("invalid component level %q, expected component=level", part)
+		}
+		level, err := logrus.ParseLevel(value)
+		if err != nil {
+			return nil, fmt.Errorf("component %s: %w", component, err)
+		}
+		levels[component] = level
+	}
+	return levels, nil
+}
+
+// FormatLevels is the inverse of ParseLevels, with components sorted.
+func FormatLevels(levels map[string]logrus.Level) string {
+	parts := make([]string, 0, len(levels))
+	for component, level := range levels {
+		parts = append(parts, component+"="+level.String())
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
+
+var (
+	mu      sync.Mutex
+	current = DefaultConfig()
+	loggers = make(map[string]*Logger)
+
+	sampleInterval atomic.Int64
+	payloads       atomic.Bool
+)
+
+func init() {
+	current.Output = os.Stderr
+	sampleInterval.Store(int64(current.SampleInterval))
+}
+
+// Validate reports whether Configure would accept cfg, without applying it.
+func Validate(cfg Config) error {
+	_, err := newFormatter(cfg.Format)
+	return err
+}
+
+// Configure applies cfg to every component logger and to the standard logrus
+// logger.
+func Configure(cfg Config) error {
+	formatter, err := newFormatter(cfg.Format)
+	if err != nil {
+		return err
+	}
+	if cfg.Output == nil {
+		cfg.Output = os.Stderr
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	current = cfg
+	sampleInterval.Store(int64(cfg.SampleInterval))
+	payloads.Store(cfg.Payloads)
+
+	std := logrus.StandardLogger()
+	std.SetFormatter(formatter)
+	std.SetOutput(cfg.Output)
+	std.SetLevel(cfg.Level)
+	for _, l := range loggers {
+		apply(l, formatter)
+	}
+	return nil
+}
+
+func newFormatter(format string) (logrus.Formatter, error) {
+	switch format {
+	case "", FormatText:
+		return &logrus.TextFormatter{}, nil
+	case FormatJSON:
+		return &logrus.JSONFormatter{}, nil
+	default:
+		return nil, fmt.Errorf("logging: unknown format %q, expected %s or %s", format, FormatText, FormatJSON)
+	}
+}
+
+// apply sets the current configuration on a component logger. mu must be
+// held.
+func apply(l *Logger, formatter logrus.Formatter) {
+	level, ok := current.Levels[l.component]
+	if !ok {
+		level = current.Level
+	}
+	l.logger.SetFormatter(formatter)
+	l.logger.SetOutput(current.Output)
+	l.logger.SetLevel(level)
+}
+
+// Logger is the logger of a component. Its lines carry a component field.
+type Logger struct {
+	*logrus.Entry
+	logger    *logrus.Logger
+	component string
+	samples   sync.Map // format string => *sample
+}
+
+// For returns the logger of a component, creating it on first use.
+func For(component string) *Logger {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if l, ok := loggers[component]; ok {
+		return l
+	}
+
+	logger := logrus.New()
+	l := &Logger{
+		Entry:     logger.WithField("component", component),
+		logger:    logger,
+		component: component,
+	}
+	formatter, _ := newFormatter(current.Format)
+	apply(l, formatter)
+	loggers[component] = l
+	return l
+}
+
+// sample tracks the lines of a hot-path log statement.
+type sample struct {
+	next       atomic.Int64 // Unix nanoseconds before which lines are dropped
+	suppressed atomic.Int64
+}
+
+// Sampledf logs like Logf from a hot path: a given format is logged at most
+// once per sample interval, with the number of lines dropped since the last
+// one in a suppressed field.
+func (l *Logger) Sampledf(level logrus.Level, format string, args ...any) {
+	if !l.logger.IsLevelEnabled(level) {
+		return
+	}
+
+	interval := sampleInterval.Load()
+	if interval <= 0 {
+		l.Logf(level, format, args...)
+		return
+	}
+
+	s, ok := l.samples.Load(format)
+	if !ok {
+		s, _ = l.samples.LoadOrStore(format, &sample{})
+	}
+	smp := s.(*sample)
+
+	now := time.Now().UnixNano()
+	next := smp.next.Load()
+	if now < next || !smp.next.CompareAndSwap(next, now+interval) {
+		smp.suppressed.Add(1)
+		return
+	}
+
+	entry := l.Entry
+	if suppressed := smp.suppressed.Swap(0); suppressed > 0 {
+		entry = entry.WithField("suppressed", suppressed)
+	}
+	entry.Logf(level, format, args...)
+}
+
+// Payload returns a message payload as it should appear in logs, with the
+// %s or %v verbs: as is when payloads are logged, its size otherwise. It is
+// only formatted if the line is logged.
+func Payload(value []byte) fmt.Stringer {
+	return payload(value)
+}
+
+type payload []byte
+
+func (p payload) String() string {
+	if payloads.Load() {
+		return string(p)
+	}
+	return fmt.Sprintf("<redacted %d bytes>", len(p))
+}
@@ -0,0 +1,126 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// configure applies cfg with its output captured, until the end of the test.
+func configure(t *testing.T, cfg Config) *bytes.Buffer {
+	t.Helper()
+	var out bytes.Buffer
+	cfg.Output = &out
+	assert.NoError(t, Configure(cfg))
+	t.Cleanup(func() { Configure(DefaultConfig()) })
+	return &out
+}
+
+// lines decodes the JSON log lines written to out.
+func lines(t *testing.T, out *bytes.Buffer) []map[string]any {
+	t.Helper()
+	var decoded []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var fields map[string]any
+		assert.NoError(t, json.Unmarshal([]byte(line), &fields), line)
+		decoded = append(decoded, fields)
+	}
+	return decoded
+}
+
+func TestParseLevels(t *testing.T) {
+	levels, err := ParseLevels(" broker=warn, stream=debug,,")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]logrus.Level{"broker": logrus.WarnLevel, "stream": logrus.DebugLevel}, levels)
+	assert.Equal(t, "broker=warning,stream=debug", FormatLevels(levels))
+
+	for _, invalid := range []string{"broker", "=warn", "broker=loud"} {
+		_, err := ParseLevels(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	assert.NoError(t, Validate(DefaultConfig()))
+	assert.NoError(t, Validate(Config{Format: FormatJSON}))
+	assert.Error(t, Validate(Config{Format: "xml"}))
+}
+
+func TestConfigure(t *testing.T) {
+	assert.Error(t, Configure(Config{Format: "xml"}))
+
+	before := For("test.configure.before")
+	cfg := DefaultConfig()
+	cfg.Format = FormatJSON
+	cfg.Level = logrus.WarnLevel
+	cfg.Levels = map[string]logrus.Level{"test.configure.after": logrus.DebugLevel}
+	out := configure(t, cfg)
+	after := For("test.configure.after")
+	assert.Same(t, after, For("test.configure.after"))
+
+	before.Infof("hidden")
+	before.Warnf("warned")
+	after.Debugf("debugged")
+	logrus.Infof("hidden")
+	logrus.Errorf("standard")
+
+	logged := lines(t, out)
+	assert.Len(t, logged, 3)
+	assert.Equal(t, "warned", logged[0]["msg"])
+	assert.Equal(t, "test.configure.before", logged[0]["component"])
+	assert.Equal(t, "debugged", logged[1]["msg"])
+	assert.Equal(t, "test.configure.after", logged[1]["component"])
+	assert.Equal(t, "standard", logged[2]["msg"])
+}
+
+func TestLogger_Sampledf(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Format = FormatJSON
+	cfg.SampleInterval = 50 * time.Millisecond
+	out := configure(t, cfg)
+	l := For("test.sampled")
+
+	for i := range 3 {
+		l.Sampledf(logrus.WarnLevel, "message %d", i)
+		l.Sampledf(logrus.WarnLevel, "other %d", i)
+		l.Sampledf(logrus.DebugLevel, "disabled %d", i)
+	}
+	time.Sleep(60 * time.Millisecond)
+	l.Sampledf(logrus.WarnLevel, "message %d", 3)
+
+	logged := lines(t, out)
+	assert.Len(t, logged, 3)
+	assert.Equal(t, "message 0", logged[0]["msg"])
+	assert.NotContains(t, logged[0], "suppressed")
+	assert.Equal(t, "other 0", logged[1]["msg"])
+	assert.Equal(t, "message 3", logged[2]["msg"])
+	assert.Equal(t, float64(2), logged[2]["suppressed"])
+
+	out.Reset()
+	cfg.SampleInterval = 0
+	cfg.Output = out
+	assert.NoError(t, Configure(cfg))
+	for i := range 3 {
+		l.Sampledf(logrus.WarnLevel, "message %d", i)
+	}
+	assert.Len(t, lines(t, out), 3, "not sampled")
+}
+
+func TestPayload(t *testing.T) {
+	cfg := DefaultConfig()
+	configure(t, cfg)
+	assert.Equal(t, "<redacted 11 bytes>", fmt.Sprintf("%s", Payload([]byte(`{"sku":"a"}`))))
+
+	cfg.Payloads = true
+	configure(t, cfg)
+	assert.Equal(t, `{"sku":"a"}`, fmt.Sprintf("%v", Payload([]byte(`{"sku":"a"}`))))
+}
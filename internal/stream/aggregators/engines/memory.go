@@ -6,23 +6,41 @@
 package engines
 
 import (
+	"context"
 	"encoding/json"
+	"goriok/pulses/internal/broker"
+	"goriok/pulses/internal/logging"
+	"goriok/pulses/internal/tracing"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
+const tracerName = "goriok/pulses/internal/stream/aggregators/engines"
+
+var aggregatorLog = logging.For("aggregator")
+
+// maxLinks bounds the traces of the events added to an aggregate that its
+// write span links to, so that busy keys do not grow unbounded spans.
+const maxLinks = 32
+
 type AggregationEntry struct {
 	Total     float64
 	FirstSeen string
 	LastSeen  string
 	ObjectID  string
+	links     []trace.Link
 }
 
 // Sink defines an output destination for aggregated results (e.g. a stream topic).
 type Sink interface {
-	Write(topic string, data []byte) error
+	WriteMessage(msg broker.Message) error
 }
 
 // KeyFunc defines a function that generates a string key from a generic event.
@@ -34,6 +52,20 @@ type SinkDataFunc func(key, window string, total float64) (map[string]any, strin
 // AmountFunc defines a function that extracts the amount from a generic event.
 type AmountFunc func(event any) float64
 
+// MessageKeyFunc defines a function that derives the key of the message
+// carrying an aggregate from its aggregation key, such as the tenant it
+// belongs to, for consumers partitioning by key.
+type MessageKeyFunc func(key string) string
+
+// MemoryAggregatorOptions configure a MemoryAggregator.
+type MemoryAggregatorOptions struct {
+	// Window is how often aggregates are flushed, DefaultWindow if zero.
+	Window time.Duration
+	// MessageKey derives the keys of the messages carrying aggregates. They
+	// are keyed by their aggregation key if nil.
+	MessageKey MessageKeyFunc
+}
+
 // MemoryAggregator aggregates generic events in memory by a dynamic key.
 // It flushes the results every flushEvery arg seconds to the provided Sink.
 type MemoryAggregator struct {
@@ -44,27 +76,60 @@ type MemoryAggregator struct {
 	sink       Sink
 	mu         sync.Mutex
 	sincDataFn SinkDataFunc
+	msgKeyFn   MessageKeyFunc
+	lastFlush  atomic.Int64
+	// nextWindow is the window to switch to after the next flush, zero if
+	// it does not change.
+	nextWindow atomic.Int64
 }
 
+// DefaultWindow is how often aggregators created with NewMemoryAggregator
+// flush.
+const DefaultWindow = 5 * time.Second
+
 // NewMemoryAggregator creates a new in-memory aggregator
-// that emits aggregates grouped by a caller-defined key every 30s.
+// that emits aggregates grouped by a caller-defined key every DefaultWindow.
 func NewMemoryAggregator(keyFn KeyFunc, amountFn AmountFunc, sinkDataFn SinkDataFunc, sink Sink) *MemoryAggregator {
+	return NewMemoryAggregatorWithWindow(keyFn, amountFn, sinkDataFn, sink, DefaultWindow)
+}
+
+// NewMemoryAggregatorWithWindow creates a new in-memory aggregator that
+// emits aggregates grouped by a caller-defined key every window.
+func NewMemoryAggregatorWithWindow(keyFn KeyFunc, amountFn AmountFunc, sinkDataFn SinkDataFunc, sink Sink, window time.Duration) *MemoryAggregator {
+	return NewMemoryAggregatorWithOptions(keyFn, amountFn, sinkDataFn, sink, MemoryAggregatorOptions{Window: window})
+}
+
+// NewMemoryAggregatorWithOptions creates a new in-memory aggregator
+// configured by opts.
+func NewMemoryAggregatorWithOptions(keyFn KeyFunc, amountFn AmountFunc, sinkDataFn SinkDataFunc, sink Sink, opts MemoryAggregatorOptions) *MemoryAggregator {
+	if opts.Window <= 0 {
+		opts.Window = DefaultWindow
+	}
 	a := &MemoryAggregator{
 		keyFn:      keyFn,
 		amountFn:   amountFn,
 		buffer:     make(map[string]*AggregationEntry),
-		flushEvery: 5 * time.Second,
+		flushEvery: opts.Window,
 		sink:       sink,
 		sincDataFn: sinkDataFn,
+		msgKeyFn:   opts.MessageKey,
 	}
+	a.lastFlush.Store(time.Now().UnixNano())
 	go a.run()
 	return a
 }
 
 // Add processes a new event and updates the in-memory buffer.
 func (a *MemoryAggregator) Add(event any) {
+	a.AddContext(context.Background(), event)
+}
+
+// AddContext adds an event like Add. If ctx holds a span, the span writing
+// the aggregate the event goes to links to it, for up to maxLinks events.
+func (a *MemoryAggregator) AddContext(ctx context.Context, event any) {
 	key := a.keyFn(event)
 	amount := a.amountFn(event)
+	spanContext := trace.SpanContextFromContext(ctx)
 
 	a.mu.Lock()
 
@@ -73,10 +138,23 @@ func (a *MemoryAggregator) Add(event any) {
 	}
 	entry := a.buffer[key]
 	entry.Total += amount
+	if spanContext.IsValid() && len(entry.links) < maxLinks {
+		entry.links = append(entry.links, trace.Link{SpanContext: spanContext})
+	}
 	a.buffer[key] = entry
+	bufferSize.Set(float64(len(a.buffer)))
 	a.mu.Unlock()
 }
 
+// SetWindow changes how often aggregates are flushed. The current window
+// keeps its length, so that the aggregates it holds cover the time they
+// claim to; the new one starts once it is flushed.
+func (a *MemoryAggregator) SetWindow(window time.Duration) {
+	if window > 0 {
+		a.nextWindow.Store(int64(window))
+	}
+}
+
 // run executes the aggregation flushing loop.
 // It periodically drains the current buffer and sends the results to the sink.
 func (a *MemoryAggregator) run() {
@@ -84,25 +162,100 @@ func (a *MemoryAggregator) run() {
 	defer ticker.Stop()
 
 	for range ticker.C {
-		a.mu.Lock()
-		bufferCopy := a.buffer
-		a.buffer = make(map[string]*AggregationEntry)
-		a.mu.Unlock()
-
-		for key, entry := range bufferCopy {
-			sinkData, topic, err := a.sincDataFn(key, a.flushEvery.String(), entry.Total)
-			if err != nil {
-				logrus.Errorf("aggregator.memory: failed to generate sink data: %v", err)
-			}
-
-			data, err := json.Marshal(sinkData)
-			if err != nil {
-				logrus.Errorf("aggregator.memory: failed to marshal sink data: %v", err)
-			}
-
-			if err := a.sink.Write(topic, data); err != nil {
-				logrus.Errorf("aggregator.memory: failed to write: %v", err)
-			}
+		a.flush()
+		if window := time.Duration(a.nextWindow.Swap(0)); window > 0 && window != a.flushEvery {
+			a.flushEvery = window
+			ticker.Reset(window)
+		}
+	}
+}
+
+// LastFlush returns when the aggregator last wrote every aggregate of a
+// window to the sink, or when it was created if it has not yet.
+func (a *MemoryAggregator) LastFlush() time.Time {
+	return time.Unix(0, a.lastFlush.Load())
+}
+
+// flush drains the current buffer and sends the results to the sink.
+//
+// Each flush is traced as an aggregator.flush span, with an aggregator.write
+// child span per aggregate that links to the traces of the events it sums.
+// Aggregates are keyed by their aggregation key, unless a MessageKeyFunc
+// derives another, and carry the trace context of their write span in their
+// headers.
+func (a *MemoryAggregator) flush() {
+	start := time.Now()
+	defer func() { flushDuration.Observe(time.Since(start).Seconds()) }()
+
+	a.mu.Lock()
+	bufferCopy := a.buffer
+	a.buffer = make(map[string]*AggregationEntry)
+	bufferSize.Set(0)
+	a.mu.Unlock()
+
+	tracer := otel.Tracer(tracerName)
+	ctx, span := tracer.Start(context.Background(), "aggregator.flush",
+		trace.WithAttributes(attribute.Int("pulses.aggregator.keys", len(bufferCopy))))
+	defer span.End()
+
+	failed := false
+
+	for key, entry := range bufferCopy {
+		if err := a.write(ctx, tracer, key, entry); err != nil {
+			failed = true
+			sinkWriteErrors.Inc()
+			aggregatorLog.Sampledf(logrus.ErrorLevel, "aggregator.memory: failed to write: %v", err)
 		}
 	}
+	if failed {
+		span.SetStatus(codes.Error, "failed to write aggregates")
+		return
+	}
+	a.lastFlush.Store(time.Now().UnixNano())
+}
+
+// write sends the aggregate of key to the sink, in a span of its own. An
+// aggregate whose sink data can not be built is logged and skipped, as it
+// would never be written.
+func (a *MemoryAggregator) write(ctx context.Context, tracer trace.Tracer, key string, entry *AggregationEntry) error {
+	ctx, span := tracer.Start(ctx, "aggregator.write",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithLinks(entry.links...),
+		trace.WithAttributes(attribute.String("pulses.aggregator.key", key)))
+	defer span.End()
+
+	sinkData, topic, err := a.sincDataFn(key, a.flushEvery.String(), entry.Total)
+	if err != nil {
+		aggregatorLog.Sampledf(logrus.ErrorLevel, "aggregator.memory: skipping aggregate %s, failed to generate sink data: %v", key, err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to generate sink data")
+		return nil
+	}
+	span.SetAttributes(attribute.String("messaging.destination.name", topic))
+
+	data, err := json.Marshal(sinkData)
+	if err != nil {
+		aggregatorLog.Sampledf(logrus.ErrorLevel, "aggregator.memory: skipping aggregate %s, failed to marshal sink data: %v", key, err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to marshal sink data")
+		return nil
+	}
+
+	msgKey := key
+	if a.msgKeyFn != nil {
+		msgKey = a.msgKeyFn(key)
+	}
+
+	err = a.sink.WriteMessage(broker.Message{
+		Topic:     topic,
+		Key:       []byte(msgKey),
+		Value:     data,
+		Headers:   tracing.Inject(ctx, nil),
+		Timestamp: time.Now(),
+	})
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to write aggregate")
+	}
+	return err
 }
@@ -1,21 +1,37 @@
 package engines
 
 import (
+	"context"
+	"errors"
+	"goriok/pulses/internal/broker"
+	"goriok/pulses/internal/tracing"
+	"strings"
 	"sync"
+	"testing"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // --- Mocks ---
 
+// MockSink expects WriteMessage calls with the topic and value of each message,
+// and keeps the last message written to each topic.
 type MockSink struct {
 	mock.Mock
-	calledData sync.Map
+	written sync.Map
 }
 
-func (m *MockSink) Write(topic string, data []byte) error {
-	m.calledData.Store(topic, data)
-	args := m.Called(topic, data)
+func (m *MockSink) WriteMessage(msg broker.Message) error {
+	m.written.Store(msg.Topic, msg)
+	args := m.Called(msg.Topic, msg.Value)
 	return args.Error(0)
 }
 
@@ -35,3 +51,207 @@ func testSinkDataFunc(key, window string, total float64) (map[string]any, string
 		"total": total,
 	}, "test.topic." + key, nil
 }
+
+// flushCount returns the number of flushes observed by flushDuration.
+func flushCount(t *testing.T) uint64 {
+	var metric dto.Metric
+	assert.NoError(t, flushDuration.Write(&metric))
+	return metric.GetHistogram().GetSampleCount()
+}
+
+// --- Tests ---
+
+func TestMemoryAggregator_FlushMetrics(t *testing.T) {
+	sink := new(MockSink)
+	sink.On("WriteMessage", "test.topic.a", mock.Anything).Return(nil)
+	sink.On("WriteMessage", "test.topic.b", mock.Anything).Return(errors.New("sink error"))
+
+	a := &MemoryAggregator{
+		keyFn:      testKeyFunc,
+		amountFn:   testAmountFunc,
+		buffer:     make(map[string]*AggregationEntry),
+		flushEvery: time.Second,
+		sink:       sink,
+		sincDataFn: testSinkDataFunc,
+	}
+	writeErrors := testutil.ToFloat64(sinkWriteErrors)
+	flushes := flushCount(t)
+
+	a.Add("a")
+	a.Add("a")
+	a.Add("b")
+	assert.Equal(t, 2.0, testutil.ToFloat64(bufferSize))
+
+	a.flush()
+	assert.Equal(t, 0.0, testutil.ToFloat64(bufferSize))
+	assert.Equal(t, writeErrors+1, testutil.ToFloat64(sinkWriteErrors))
+	assert.Equal(t, flushes+1, flushCount(t))
+	sink.AssertExpectations(t)
+}
+
+func TestMemoryAggregator_SkipsAggregatesWithoutSinkData(t *testing.T) {
+	sink := new(MockSink)
+	sink.On("WriteMessage", "test.topic.good", mock.Anything).Return(nil)
+
+	a := &MemoryAggregator{
+		keyFn:      testKeyFunc,
+		amountFn:   testAmountFunc,
+		buffer:     make(map[string]*AggregationEntry),
+		flushEvery: time.Second,
+		sink:       sink,
+		sincDataFn: func(key, window string, total float64) (map[string]any, string, error) {
+			if key == "bad" {
+				return nil, "", errors.New("no tenant")
+			}
+			return testSinkDataFunc(key, window, total)
+		},
+	}
+	writeErrors := testutil.ToFloat64(sinkWriteErrors)
+
+	a.Add("good")
+	a.Add("bad")
+	a.flush()
+
+	sink.AssertExpectations(t)
+	sink.AssertNotCalled(t, "WriteMessage", "", mock.Anything)
+	assert.Equal(t, writeErrors, testutil.ToFloat64(sinkWriteErrors))
+	assert.False(t, a.LastFlush().IsZero(), "a skipped aggregate does not fail the flush")
+}
+
+func TestNewMemoryAggregatorWithWindow(t *testing.T) {
+	sink := new(MockSink)
+	sink.On("WriteMessage", "test.topic.window", mock.Anything).Return(nil)
+	windows := make(chan string, 1)
+	sinkDataFn := func(key, window string, total float64) (map[string]any, string, error) {
+		select {
+		case windows <- window:
+		default:
+		}
+		return testSinkDataFunc(key, window, total)
+	}
+
+	a := NewMemoryAggregatorWithWindow(testKeyFunc, testAmountFunc, sinkDataFn, sink, 20*time.Millisecond)
+	a.Add("window")
+
+	select {
+	case window := <-windows:
+		assert.Equal(t, "20ms", window)
+	case <-time.After(time.Second):
+		t.Fatal("aggregates not flushed within the window")
+	}
+}
+
+func TestMemoryAggregator_MessageKey(t *testing.T) {
+	sink := new(MockSink)
+	sink.On("WriteMessage", "test.topic.tenant.sku", mock.Anything).Return(nil)
+
+	a := &MemoryAggregator{
+		keyFn:      testKeyFunc,
+		amountFn:   testAmountFunc,
+		buffer:     make(map[string]*AggregationEntry),
+		flushEvery: time.Second,
+		sink:       sink,
+		sincDataFn: testSinkDataFunc,
+		msgKeyFn: func(key string) string {
+			tenant, _, _ := strings.Cut(key, ".")
+			return tenant
+		},
+	}
+
+	a.Add("tenant.sku")
+	a.flush()
+
+	sink.AssertExpectations(t)
+	msg, ok := sink.written.Load("test.topic.tenant.sku")
+	assert.True(t, ok)
+	assert.Equal(t, "tenant", string(msg.(broker.Message).Key))
+}
+
+func TestMemoryAggregator_SetWindow(t *testing.T) {
+	sink := new(MockSink)
+	sink.On("WriteMessage", "test.topic.window", mock.Anything).Return(nil)
+	windows := make(chan string, 1)
+	sinkDataFn := func(key, window string, total float64) (map[string]any, string, error) {
+		windows <- window
+		return testSinkDataFunc(key, window, total)
+	}
+
+	a := NewMemoryAggregatorWithWindow(testKeyFunc, testAmountFunc, sinkDataFn, sink, 30*time.Millisecond)
+	a.SetWindow(60 * time.Millisecond)
+
+	for _, want := range []string{"30ms", "60ms"} {
+		a.Add("window")
+		select {
+		case window := <-windows:
+			assert.Equal(t, want, window, "the current window keeps its length")
+		case <-time.After(time.Second):
+			t.Fatal("aggregates not flushed")
+		}
+	}
+}
+
+func TestMemoryAggregator_LastFlush(t *testing.T) {
+	sink := new(MockSink)
+	sink.On("WriteMessage", "test.topic.a", mock.Anything).Return(nil).Once()
+	sink.On("WriteMessage", "test.topic.a", mock.Anything).Return(errors.New("sink error")).Once()
+
+	a := &MemoryAggregator{
+		keyFn:      testKeyFunc,
+		amountFn:   testAmountFunc,
+		buffer:     make(map[string]*AggregationEntry),
+		flushEvery: time.Second,
+		sink:       sink,
+		sincDataFn: testSinkDataFunc,
+	}
+	assert.Equal(t, time.Unix(0, 0), a.LastFlush())
+
+	a.Add("a")
+	a.flush()
+	flushed := a.LastFlush()
+	assert.WithinDuration(t, time.Now(), flushed, time.Second)
+
+	a.Add("a")
+	a.flush()
+	assert.Equal(t, flushed, a.LastFlush(), "failed flushes must not count")
+
+	a.flush()
+	assert.True(t, a.LastFlush().After(flushed), "empty flushes succeed")
+}
+
+func TestMemoryAggregator_FlushSpans(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	otel.SetTracerProvider(provider)
+	t.Cleanup(func() { provider.Shutdown(context.Background()) })
+
+	sink := new(MockSink)
+	sink.On("WriteMessage", "test.topic.a", mock.Anything).Return(nil)
+
+	a := &MemoryAggregator{
+		keyFn:      testKeyFunc,
+		amountFn:   testAmountFunc,
+		buffer:     make(map[string]*AggregationEntry),
+		flushEvery: time.Second,
+		sink:       sink,
+		sincDataFn: testSinkDataFunc,
+	}
+
+	ctx, pulse := provider.Tracer("test").Start(context.Background(), "pulse")
+	pulse.End()
+	a.AddContext(ctx, "a")
+	a.Add("a")
+	a.flush()
+
+	spans := exporter.GetSpans()
+	assert.Len(t, spans, 3)
+	write, flush := spans[1], spans[2]
+	assert.Equal(t, "aggregator.write", write.Name)
+	assert.Equal(t, "aggregator.flush", flush.Name)
+	assert.Equal(t, flush.SpanContext.SpanID(), write.Parent.SpanID())
+	assert.Len(t, write.Links, 1, "only traced events are linked")
+	assert.Equal(t, pulse.SpanContext().TraceID(), write.Links[0].SpanContext.TraceID())
+
+	written, _ := sink.written.Load("test.topic.a")
+	propagated := tracing.Extract(context.Background(), written.(broker.Message).Headers)
+	assert.Equal(t, write.SpanContext.SpanID(), trace.SpanContextFromContext(propagated).SpanID())
+}
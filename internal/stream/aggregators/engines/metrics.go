@@ -0,0 +1,28 @@
+package engines
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	bufferSize = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "pulses",
+		Subsystem: "aggregator",
+		Name:      "buffer_keys",
+		Help:      "Keys aggregated in memory, waiting for the next flush.",
+	})
+	flushDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "pulses",
+		Subsystem: "aggregator",
+		Name:      "flush_duration_seconds",
+		Help:      "Time taken to write the aggregates of a flush window to the sink.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 4, 8),
+	})
+	sinkWriteErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "pulses",
+		Subsystem: "aggregator",
+		Name:      "sink_write_errors_total",
+		Help:      "Aggregates that could not be written to the sink.",
+	})
+)
@@ -3,17 +3,55 @@ package aggregators
 import (
 	"fmt"
 	"goriok/pulses/internal/models"
+	"goriok/pulses/internal/stream/enrichers"
+	"goriok/pulses/internal/stream/topics"
 	"strings"
 	"time"
 )
 
+// TopicFunc names the topic of the aggregates of a tenant, SKU and unit,
+// given as the fields of a pulse.
+type TopicFunc func(pulse *models.Pulse) (string, error)
+
+// defaultInfo writes aggregates to the topics of topics.DefaultAggregated.
+var defaultInfo = TenantSKUInfoTo(topics.DefaultRoutes().Aggregated)
+
+// TenantSKUInfo returns the payload of the aggregate of a tenant, SKU and
+// unit, written to the tenant's aggregated topic of topics.DefaultAggregated.
 func TenantSKUInfo(key, window string, total float64) (map[string]any, string, error) {
+	return defaultInfo(key, window, total)
+}
+
+// TenantSKUInfoTo returns a function like TenantSKUInfo writing aggregates
+// to the topics named by topic, their payloads enriched by enrich.
+func TenantSKUInfoTo(topic TopicFunc, enrich ...enrichers.Enricher) func(key, window string, total float64) (map[string]any, string, error) {
+	return func(key, window string, total float64) (map[string]any, string, error) {
+		pulse, err := parseTenantSKUKey(key)
+		if err != nil {
+			return nil, "", err
+		}
+		name, err := topic(pulse)
+		if err != nil {
+			return nil, "", err
+		}
+		payload := tenantSKUPayload(pulse, window, total)
+		enrichers.Apply(enrich, pulse, payload)
+		return payload, name, nil
+	}
+}
+
+// TenantSKUTenant returns the tenant of an aggregation key of TenantSKUKey,
+// the key itself if it is not one.
+func TenantSKUTenant(key string) string {
 	pulse, err := parseTenantSKUKey(key)
 	if err != nil {
-		return nil, "", err
+		return key
 	}
+	return pulse.TenantID
+}
 
-	payload := map[string]any{
+func tenantSKUPayload(pulse *models.Pulse, window string, total float64) map[string]any {
+	return map[string]any{
 		"tenant_id":    pulse.TenantID,
 		"product_sku":  pulse.ProductSKU,
 		"use_unit":     pulse.UseUnity,
@@ -21,9 +59,6 @@ func TenantSKUInfo(key, window string, total float64) (map[string]any, string, e
 		"window":       window,
 		"timestamp":    time.Now().Unix(),
 	}
-
-	topic := fmt.Sprintf("tenants.%s.aggregated.pulses.amount", pulse.TenantID)
-	return payload, topic, nil
 }
 
 func TenantSKUKey(event any) string {
@@ -1,7 +1,10 @@
 package aggregators
 
 import (
+	"errors"
 	"goriok/pulses/internal/models"
+	"goriok/pulses/internal/stream/enrichers"
+	"goriok/pulses/internal/stream/topics"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -84,3 +87,34 @@ func TestTenantSKUInfo_InvalidKey(t *testing.T) {
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "invalid key format")
 }
+
+func TestTenantSKUInfoTo(t *testing.T) {
+	routes, err := topics.NewRoutes(topics.DefaultGrouped, "{{.Region}}.usage.{{.ProductSKU}}", map[string]string{"Region": "eu"})
+	assert.NoError(t, err)
+
+	payload, topic, err := TenantSKUInfoTo(routes.Aggregated)("tenantX.skuY.unitZ", "5s", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, "tenantX", payload["tenant_id"])
+	assert.Equal(t, "eu.usage.skuY", topic)
+
+	_, _, err = TenantSKUInfoTo(func(*models.Pulse) (string, error) {
+		return "", errors.New("no topic")
+	})("tenantX.skuY.unitZ", "5s", 1)
+	assert.EqualError(t, err, "no topic")
+}
+
+func TestTenantSKUInfoTo_Enrichers(t *testing.T) {
+	category := enrichers.Func(func(pulse *models.Pulse, payload map[string]any) {
+		payload["sku_category"] = "category of " + pulse.ProductSKU
+	})
+
+	payload, _, err := TenantSKUInfoTo(topics.DefaultRoutes().Aggregated, category)("tenantX.skuY.unitZ", "5s", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, "category of skuY", payload["sku_category"])
+	assert.Equal(t, 1.0, payload["total_amount"])
+}
+
+func TestTenantSKUTenant(t *testing.T) {
+	assert.Equal(t, "tenantX", TenantSKUTenant("tenantX.skuY.unitZ"))
+	assert.Equal(t, "invalid", TenantSKUTenant("invalid"))
+}
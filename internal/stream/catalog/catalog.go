@@ -0,0 +1,111 @@
+// Package catalog holds the SKU catalog the pipeline looks pulses up in, to
+// annotate them with the product family and canonical unit of their SKU and
+// to tell the SKUs it does not know.
+//
+// The catalog is loaded from a CSV or JSON file, reloaded when it changes,
+// and may follow a catalog topic too. The topic is read from its start and
+// holds the latest entry of each SKU, keyed by SKU: it is compacted as it is
+// read. Entries from the topic override those of the file.
+package catalog
+
+import (
+	"goriok/pulses/internal/logging"
+	"goriok/pulses/internal/models"
+	"goriok/pulses/internal/stream/enrichers"
+	"sync"
+)
+
+var catalogLog = logging.For("catalog")
+
+// Entry is the catalog entry of a SKU.
+type Entry struct {
+	SKU    string `json:"sku"`
+	Family string `json:"family"`
+	// Unit is the canonical unit of the SKU's usage.
+	Unit string `json:"unit"`
+}
+
+// Catalog is a SKU catalog, safe for concurrent use.
+type Catalog struct {
+	mu    sync.RWMutex
+	file  map[string]Entry
+	topic map[string]Entry
+}
+
+// New returns a catalog of entries, as if loaded from a file.
+func New(entries ...Entry) *Catalog {
+	c := &Catalog{topic: make(map[string]Entry)}
+	c.Replace(entries)
+	return c
+}
+
+// Lookup returns the entry of a SKU, and whether the catalog knows it.
+func (c *Catalog) Lookup(sku string) (Entry, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if entry, ok := c.topic[sku]; ok {
+		return entry, true
+	}
+	entry, ok := c.file[sku]
+	return entry, ok
+}
+
+// Len returns the number of SKUs the catalog knows.
+func (c *Catalog) Len() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	n := len(c.topic)
+	for sku := range c.file {
+		if _, ok := c.topic[sku]; !ok {
+			n++
+		}
+	}
+	return n
+}
+
+// Replace replaces the entries loaded from the file by entries.
+func (c *Catalog) Replace(entries []Entry) {
+	file := make(map[string]Entry, len(entries))
+	for _, entry := range entries {
+		file[entry.SKU] = entry
+	}
+
+	c.mu.Lock()
+	c.file = file
+	c.mu.Unlock()
+	catalogEntries.Set(float64(c.Len()))
+}
+
+// Put adds or replaces the entry of a SKU, as read from the catalog topic.
+func (c *Catalog) Put(entry Entry) {
+	c.mu.Lock()
+	c.topic[entry.SKU] = entry
+	c.mu.Unlock()
+	catalogEntries.Set(float64(c.Len()))
+}
+
+// Delete removes the entry of a SKU read from the catalog topic. The entry
+// of the file, if any, applies again.
+func (c *Catalog) Delete(sku string) {
+	c.mu.Lock()
+	delete(c.topic, sku)
+	c.mu.Unlock()
+	catalogEntries.Set(float64(c.Len()))
+}
+
+// Enricher returns an enricher adding the "product_family" and
+// "canonical_unit" of the pulse's SKU, if the catalog knows it.
+func (c *Catalog) Enricher() enrichers.Enricher {
+	return enrichers.Func(func(pulse *models.Pulse, payload map[string]any) {
+		entry, ok := c.Lookup(pulse.ProductSKU)
+		if !ok {
+			return
+		}
+		if entry.Family != "" {
+			payload["product_family"] = entry.Family
+		}
+		if entry.Unit != "" {
+			payload["canonical_unit"] = entry.Unit
+		}
+	})
+}
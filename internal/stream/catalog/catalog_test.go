@@ -0,0 +1,61 @@
+package catalog
+
+import (
+	"goriok/pulses/internal/models"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCatalog_Lookup(t *testing.T) {
+	c := New(Entry{SKU: "vm-small", Family: "compute", Unit: "hours"})
+
+	entry, ok := c.Lookup("vm-small")
+	assert.True(t, ok)
+	assert.Equal(t, "compute", entry.Family)
+	_, ok = c.Lookup("db-large")
+	assert.False(t, ok)
+	assert.Equal(t, 1, c.Len())
+	assert.Equal(t, 1.0, testutil.ToFloat64(catalogEntries))
+}
+
+func TestCatalog_TopicOverridesFile(t *testing.T) {
+	c := New(Entry{SKU: "vm-small", Family: "compute", Unit: "hours"})
+
+	c.Put(Entry{SKU: "vm-small", Family: "compute", Unit: "seconds"})
+	c.Put(Entry{SKU: "db-large", Family: "database", Unit: "hours"})
+	entry, _ := c.Lookup("vm-small")
+	assert.Equal(t, "seconds", entry.Unit)
+	assert.Equal(t, 2, c.Len())
+
+	c.Replace([]Entry{{SKU: "vm-small", Family: "compute", Unit: "minutes"}})
+	entry, _ = c.Lookup("vm-small")
+	assert.Equal(t, "seconds", entry.Unit, "reloading the file keeps the topic entries")
+
+	c.Delete("vm-small")
+	entry, _ = c.Lookup("vm-small")
+	assert.Equal(t, "minutes", entry.Unit, "the file entry applies again")
+
+	c.Delete("db-large")
+	_, ok := c.Lookup("db-large")
+	assert.False(t, ok)
+	assert.Equal(t, 1, c.Len())
+}
+
+func TestCatalog_Enricher(t *testing.T) {
+	c := New(Entry{SKU: "vm-small", Family: "compute", Unit: "hours"}, Entry{SKU: "ip", Family: "network"})
+	enricher := c.Enricher()
+
+	payload := map[string]any{}
+	enricher.Enrich(&models.Pulse{ProductSKU: "vm-small", UseUnity: "h"}, payload)
+	assert.Equal(t, map[string]any{"product_family": "compute", "canonical_unit": "hours"}, payload)
+
+	payload = map[string]any{}
+	enricher.Enrich(&models.Pulse{ProductSKU: "ip"}, payload)
+	assert.Equal(t, map[string]any{"product_family": "network"}, payload)
+
+	payload = map[string]any{}
+	enricher.Enrich(&models.Pulse{ProductSKU: "unknown"}, payload)
+	assert.Empty(t, payload)
+}
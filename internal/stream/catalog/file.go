@@ -0,0 +1,146 @@
+package catalog
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// LoadFile reads the entries of a catalog file, CSV or JSON according to its
+// extension.
+//
+// A CSV file starts with a header naming its columns, sku and optionally
+// family and unit, in any order. Other columns are ignored:
+//
+//	sku,family,unit
+//	vm-small,compute,hours
+//
+// A JSON file holds an array of entries:
+//
+//	[{"sku": "vm-small", "family": "compute", "unit": "hours"}]
+func LoadFile(path string) ([]Entry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("catalog: %w", err)
+	}
+	defer f.Close()
+
+	var entries []Entry
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".csv":
+		entries, err = readCSV(f)
+	case ".json":
+		err = json.NewDecoder(f).Decode(&entries)
+	default:
+		err = fmt.Errorf("unsupported file type %q, expected .csv or .json", ext)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("catalog: %s: %w", path, err)
+	}
+
+	for i, entry := range entries {
+		if entry.SKU == "" {
+			return nil, fmt.Errorf("catalog: %s: entry %d has no SKU", path, i+1)
+		}
+	}
+	return entries, nil
+}
+
+// readCSV reads the entries of a CSV file with a header.
+func readCSV(r io.Reader) ([]Entry, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if errors.Is(err, io.EOF) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for i := range header {
+		header[i] = strings.ToLower(strings.TrimSpace(header[i]))
+	}
+	sku, family, unit := slices.Index(header, "sku"), slices.Index(header, "family"), slices.Index(header, "unit")
+	if sku < 0 {
+		return nil, errors.New("header has no sku column")
+	}
+
+	column := func(record []string, i int) string {
+		if i < 0 || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+
+	var entries []Entry
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, Entry{
+			SKU:    column(record, sku),
+			Family: column(record, family),
+			Unit:   column(record, unit),
+		})
+	}
+}
+
+// ReloadFile replaces the entries of the file of c by those of the file at
+// path.
+func (c *Catalog) ReloadFile(path string) error {
+	entries, err := LoadFile(path)
+	if err != nil {
+		catalogUpdates.WithLabelValues("file", "failed").Inc()
+		return err
+	}
+	c.Replace(entries)
+	catalogUpdates.WithLabelValues("file", "applied").Inc()
+	return nil
+}
+
+// WatchFile loads the file at path again whenever it changes, as seen by
+// polling it every interval, until stop is closed. A file that fails to
+// load is logged, and the entries loaded last are kept.
+func (c *Catalog) WatchFile(path string, interval time.Duration, stop <-chan struct{}) {
+	last, _ := os.Stat(path)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			catalogLog.Debugf("catalog: failed to stat %s: %v", path, err)
+			continue
+		}
+		if last != nil && info.ModTime().Equal(last.ModTime()) && info.Size() == last.Size() {
+			continue
+		}
+		last = info
+
+		if err := c.ReloadFile(path); err != nil {
+			catalogLog.Errorf("catalog: failed to reload, keeping %d SKUs: %v", c.Len(), err)
+			continue
+		}
+		catalogLog.Infof("catalog: reloaded %s, %d SKUs", path, c.Len())
+	}
+}
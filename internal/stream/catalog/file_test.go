@@ -0,0 +1,81 @@
+package catalog
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeFile writes a catalog file in a temporary directory and returns its
+// path.
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	assert.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+	return path
+}
+
+func TestLoadFile_CSV(t *testing.T) {
+	entries, err := LoadFile(writeFile(t, "catalog.csv", "unit, SKU, family, owner\nhours, vm-small, compute, infra\nGB,storage\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, []Entry{
+		{SKU: "vm-small", Family: "compute", Unit: "hours"},
+		{SKU: "storage", Unit: "GB"},
+	}, entries)
+
+	entries, err = LoadFile(writeFile(t, "empty.csv", ""))
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+
+	_, err = LoadFile(writeFile(t, "catalog.csv", "family,unit\ncompute,hours\n"))
+	assert.ErrorContains(t, err, "no sku column")
+	_, err = LoadFile(writeFile(t, "catalog.csv", "sku,family\n,compute\n"))
+	assert.ErrorContains(t, err, "entry 1 has no SKU")
+}
+
+func TestLoadFile_JSON(t *testing.T) {
+	entries, err := LoadFile(writeFile(t, "catalog.json", `[{"sku": "vm-small", "family": "compute", "unit": "hours"}]`))
+	assert.NoError(t, err)
+	assert.Equal(t, []Entry{{SKU: "vm-small", Family: "compute", Unit: "hours"}}, entries)
+
+	_, err = LoadFile(writeFile(t, "catalog.json", `{"sku": "vm-small"}`))
+	assert.Error(t, err)
+}
+
+func TestLoadFile_Errors(t *testing.T) {
+	_, err := LoadFile(writeFile(t, "catalog.yaml", "skus: []\n"))
+	assert.ErrorContains(t, err, `unsupported file type ".yaml"`)
+	_, err = LoadFile(filepath.Join(t.TempDir(), "missing.csv"))
+	assert.Error(t, err)
+}
+
+func TestCatalog_WatchFile(t *testing.T) {
+	path := writeFile(t, "catalog.csv", "sku,family,unit\nvm-small,compute,hours\n")
+	c := New()
+	assert.NoError(t, c.ReloadFile(path))
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		c.WatchFile(path, 5*time.Millisecond, stop)
+		close(done)
+	}()
+
+	time.Sleep(30 * time.Millisecond)
+	assert.NoError(t, os.WriteFile(path, []byte("sku,family,unit\nvm-small,compute,hours\ndb-large,database,hours\n"), 0o644))
+	assert.Eventually(t, func() bool { return c.Len() == 2 }, time.Second, 5*time.Millisecond)
+
+	assert.NoError(t, os.WriteFile(path, []byte("family\ncompute\n"), 0o644))
+	time.Sleep(30 * time.Millisecond)
+	assert.Equal(t, 2, c.Len(), "invalid files keep the entries loaded last")
+
+	close(stop)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("WatchFile did not return")
+	}
+}
@@ -0,0 +1,21 @@
+package catalog
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	catalogEntries = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "pulses",
+		Subsystem: "catalog",
+		Name:      "entries",
+		Help:      "SKUs the catalog knows.",
+	})
+	catalogUpdates = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "pulses",
+		Subsystem: "catalog",
+		Name:      "updates_total",
+		Help:      "Catalog updates, by source (file or topic) and result (applied or failed).",
+	}, []string{"source", "result"})
+)
@@ -0,0 +1,76 @@
+package catalog
+
+import (
+	"encoding/json"
+	"errors"
+	"goriok/pulses/internal/broker"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// SourceConnector reads the messages of a topic.
+type SourceConnector interface {
+	Read(topic string, handler broker.Handler) error
+}
+
+var (
+	errEmptyMessage = errors.New("message has neither key nor value")
+	errNoSKU        = errors.New("entry has no SKU")
+)
+
+// Follow applies the messages of the catalog topic to c, from the start of
+// the topic, until the connector is closed. Each message holds the JSON
+// entry of the SKU it is keyed by, or nothing to delete it. Invalid
+// messages are logged and skipped.
+//
+// caughtUp, if not nil, is called once the messages before offset end, such
+// as the end of the topic when following starts, have been applied, or
+// right away if end is not positive.
+func (c *Catalog) Follow(source SourceConnector, topic string, end int64, caughtUp func()) error {
+	var once sync.Once
+	done := func() {
+		if caughtUp != nil {
+			once.Do(caughtUp)
+		}
+	}
+	if end <= 0 {
+		done()
+	}
+
+	return source.Read(topic, func(msg broker.Message) {
+		if msg.Offset+1 >= end {
+			defer done()
+		}
+		if err := c.apply(msg); err != nil {
+			catalogUpdates.WithLabelValues("topic", "failed").Inc()
+			catalogLog.Sampledf(logrus.WarnLevel, "catalog: skipping invalid entry of %s: %v", topic, err)
+			return
+		}
+		catalogUpdates.WithLabelValues("topic", "applied").Inc()
+	})
+}
+
+// apply applies a message of the catalog topic.
+func (c *Catalog) apply(msg broker.Message) error {
+	if len(msg.Value) == 0 {
+		if len(msg.Key) == 0 {
+			return errEmptyMessage
+		}
+		c.Delete(string(msg.Key))
+		return nil
+	}
+
+	var entry Entry
+	if err := json.Unmarshal(msg.Value, &entry); err != nil {
+		return err
+	}
+	if entry.SKU == "" {
+		entry.SKU = string(msg.Key)
+	}
+	if entry.SKU == "" {
+		return errNoSKU
+	}
+	c.Put(entry)
+	return nil
+}
@@ -0,0 +1,62 @@
+package catalog
+
+import (
+	"goriok/pulses/internal/broker"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// stubSource reads the messages it holds.
+type stubSource []broker.Message
+
+func (s stubSource) Read(topic string, handler broker.Handler) error {
+	for _, msg := range s {
+		handler(msg)
+	}
+	return nil
+}
+
+func TestCatalog_Follow(t *testing.T) {
+	c := New(Entry{SKU: "ip", Family: "network"})
+
+	err := c.Follow(stubSource{
+		{Key: []byte("vm-small"), Value: []byte(`{"family": "compute", "unit": "seconds"}`)},
+		{Key: []byte("db-large"), Value: []byte(`{"sku": "db-large", "family": "database"}`)},
+		{Key: []byte("vm-small"), Value: []byte(`{"family": "compute", "unit": "hours"}`)},
+		{Key: []byte("db-large")},
+		{Value: []byte(`not json`)},
+		{Value: []byte(`{"family": "orphan"}`)},
+		{},
+	}, "catalog.skus", 0, nil)
+	assert.NoError(t, err)
+
+	entry, ok := c.Lookup("vm-small")
+	assert.True(t, ok)
+	assert.Equal(t, Entry{SKU: "vm-small", Family: "compute", Unit: "hours"}, entry, "the latest entry of a SKU wins")
+	_, ok = c.Lookup("db-large")
+	assert.False(t, ok, "deleted by its tombstone")
+	assert.Equal(t, 2, c.Len())
+}
+
+func TestCatalog_Follow_CaughtUp(t *testing.T) {
+	c := New()
+	var known []bool
+	caughtUp := func() {
+		_, ok := c.Lookup("db-large")
+		known = append(known, ok)
+	}
+
+	err := c.Follow(stubSource{
+		{Key: []byte("vm-small"), Value: []byte(`{"family": "compute"}`), Offset: 0},
+		{Value: []byte(`not json`), Offset: 1},
+		{Key: []byte("db-large"), Value: []byte(`{"family": "database"}`), Offset: 2},
+		{Key: []byte("ip"), Value: []byte(`{"family": "network"}`), Offset: 3},
+	}, "catalog.skus", 3, caughtUp)
+	assert.NoError(t, err)
+	assert.Equal(t, []bool{true}, known, "called once, after the last message before the end")
+
+	calls := 0
+	assert.NoError(t, New().Follow(stubSource{}, "catalog.skus", 0, func() { calls++ }))
+	assert.Equal(t, 1, calls, "called right away for an empty topic")
+}
@@ -0,0 +1,119 @@
+// Package enrichers adds reference data, such as tenant metadata or SKU
+// attributes, to the records the pipeline writes before they leave the
+// ingestor.
+//
+// Enrichers are plug-ins, created by name from the factories registered
+// with Register. The built-in ones read a local lookup file:
+//
+//	tenant        adds "tenant", the metadata of the pulse's tenant
+//	sku_category  adds "sku_category", the category of the pulse's SKU
+//	price_tier    adds "price_tier", the price tier of the pulse's SKU
+//
+// Fields without reference data are left out.
+package enrichers
+
+import (
+	"fmt"
+	"goriok/pulses/internal/models"
+	"maps"
+	"slices"
+	"sync"
+)
+
+// Enricher adds fields to the payload of a record about a pulse. The pulse
+// of an aggregate holds its tenant, SKU and unit only.
+type Enricher interface {
+	Enrich(pulse *models.Pulse, payload map[string]any)
+}
+
+// Func adapts a function to the Enricher interface.
+type Func func(pulse *models.Pulse, payload map[string]any)
+
+// Enrich calls f.
+func (f Func) Enrich(pulse *models.Pulse, payload map[string]any) {
+	f(pulse, payload)
+}
+
+// Factory creates an enricher reading the reference data of lookup.
+type Factory func(lookup *Lookup) (Enricher, error)
+
+var (
+	mu        sync.RWMutex
+	factories = make(map[string]Factory)
+)
+
+func init() {
+	Register("tenant", tenantEnricher)
+	Register("sku_category", skuCategoryEnricher)
+	Register("price_tier", priceTierEnricher)
+}
+
+// Register makes an enricher available by name. It panics if the name is
+// already registered, as registrations happen at init.
+func Register(name string, factory Factory) {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := factories[name]; ok {
+		panic(fmt.Sprintf("enrichers: %s registered twice", name))
+	}
+	factories[name] = factory
+}
+
+// Names returns the names of the registered enrichers, sorted.
+func Names() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	return slices.Sorted(maps.Keys(factories))
+}
+
+// New creates the enrichers of names, in order, reading the reference data
+// of lookup.
+func New(names []string, lookup *Lookup) ([]Enricher, error) {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	enrichers := make([]Enricher, 0, len(names))
+	for _, name := range names {
+		factory, ok := factories[name]
+		if !ok {
+			return nil, fmt.Errorf("enrichers: unknown enricher %q", name)
+		}
+		enricher, err := factory(lookup)
+		if err != nil {
+			return nil, fmt.Errorf("enrichers: %s: %w", name, err)
+		}
+		enrichers = append(enrichers, enricher)
+	}
+	return enrichers, nil
+}
+
+// Apply enriches payload with each of enrichers, in order.
+func Apply(enrichers []Enricher, pulse *models.Pulse, payload map[string]any) {
+	for _, enricher := range enrichers {
+		enricher.Enrich(pulse, payload)
+	}
+}
+
+func tenantEnricher(lookup *Lookup) (Enricher, error) {
+	return Func(func(pulse *models.Pulse, payload map[string]any) {
+		if tenant, ok := lookup.Tenants[pulse.TenantID]; ok {
+			payload["tenant"] = tenant
+		}
+	}), nil
+}
+
+func skuCategoryEnricher(lookup *Lookup) (Enricher, error) {
+	return Func(func(pulse *models.Pulse, payload map[string]any) {
+		if sku, ok := lookup.SKUs[pulse.ProductSKU]; ok && sku.Category != "" {
+			payload["sku_category"] = sku.Category
+		}
+	}), nil
+}
+
+func priceTierEnricher(lookup *Lookup) (Enricher, error) {
+	return Func(func(pulse *models.Pulse, payload map[string]any) {
+		if sku, ok := lookup.SKUs[pulse.ProductSKU]; ok && sku.PriceTier != "" {
+			payload["price_tier"] = sku.PriceTier
+		}
+	}), nil
+}
@@ -0,0 +1,50 @@
+package enrichers
+
+import (
+	"goriok/pulses/internal/models"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var lookup = &Lookup{
+	Tenants: map[string]map[string]any{"acme": {"name": "Acme Corp", "segment": "enterprise"}},
+	SKUs:    map[string]SKU{"vm-small": {Category: "compute", PriceTier: "standard"}},
+}
+
+func TestNew_BuiltIns(t *testing.T) {
+	enrichers, err := New([]string{"tenant", "sku_category", "price_tier"}, lookup)
+	assert.NoError(t, err)
+
+	payload := map[string]any{"total_amount": 1.0}
+	Apply(enrichers, &models.Pulse{TenantID: "acme", ProductSKU: "vm-small"}, payload)
+	assert.Equal(t, map[string]any{
+		"total_amount": 1.0,
+		"tenant":       map[string]any{"name": "Acme Corp", "segment": "enterprise"},
+		"sku_category": "compute",
+		"price_tier":   "standard",
+	}, payload)
+
+	payload = map[string]any{}
+	Apply(enrichers, &models.Pulse{TenantID: "globex", ProductSKU: "db-large"}, payload)
+	assert.Empty(t, payload, "fields without reference data are left out")
+}
+
+func TestNew_Unknown(t *testing.T) {
+	_, err := New([]string{"tenant", "geo"}, lookup)
+	assert.EqualError(t, err, `enrichers: unknown enricher "geo"`)
+}
+
+func TestRegister(t *testing.T) {
+	Register("test_constant", func(*Lookup) (Enricher, error) {
+		return Func(func(_ *models.Pulse, payload map[string]any) { payload["constant"] = true }), nil
+	})
+	assert.Contains(t, Names(), "test_constant")
+	assert.Panics(t, func() { Register("test_constant", nil) })
+
+	enrichers, err := New([]string{"test_constant"}, lookup)
+	assert.NoError(t, err)
+	payload := map[string]any{}
+	Apply(enrichers, &models.Pulse{}, payload)
+	assert.Equal(t, true, payload["constant"])
+}
@@ -0,0 +1,56 @@
+package enrichers
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Lookup is the reference data of the built-in enrichers, read from a YAML
+// or JSON file:
+//
+//	tenants:
+//	  acme:
+//	    name: Acme Corp
+//	    segment: enterprise
+//	skus:
+//	  vm-small:
+//	    category: compute
+//	    price_tier: standard
+//
+// Tenant metadata is free-form, and added to records as is.
+type Lookup struct {
+	Tenants map[string]map[string]any `yaml:"tenants"`
+	SKUs    map[string]SKU            `yaml:"skus"`
+}
+
+// SKU holds the attributes of a SKU.
+type SKU struct {
+	Category  string `yaml:"category"`
+	PriceTier string `yaml:"price_tier"`
+}
+
+// LoadLookup reads the lookup file at path. An empty path gives an empty
+// lookup. Unknown keys are errors, so that typos do not go unnoticed.
+func LoadLookup(path string) (*Lookup, error) {
+	lookup := &Lookup{}
+	if path == "" {
+		return lookup, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("enrichers: %w", err)
+	}
+	defer f.Close()
+
+	decoder := yaml.NewDecoder(f)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(lookup); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("enrichers: %s: %w", path, err)
+	}
+	return lookup, nil
+}
@@ -0,0 +1,44 @@
+package enrichers
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadLookup(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "lookup.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte(`
+tenants:
+  acme:
+    name: Acme Corp
+skus:
+  vm-small:
+    category: compute
+    price_tier: standard
+`), 0o644))
+
+	loaded, err := LoadLookup(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "Acme Corp", loaded.Tenants["acme"]["name"])
+	assert.Equal(t, SKU{Category: "compute", PriceTier: "standard"}, loaded.SKUs["vm-small"])
+
+	jsonPath := filepath.Join(dir, "lookup.json")
+	assert.NoError(t, os.WriteFile(jsonPath, []byte(`{"skus": {"vm-small": {"category": "compute"}}}`), 0o644))
+	loaded, err = LoadLookup(jsonPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "compute", loaded.SKUs["vm-small"].Category)
+
+	empty, err := LoadLookup("")
+	assert.NoError(t, err)
+	assert.Empty(t, empty.SKUs)
+
+	assert.NoError(t, os.WriteFile(path, []byte("sku:\n  vm-small: {}\n"), 0o644))
+	_, err = LoadLookup(path)
+	assert.ErrorContains(t, err, "field sku not found")
+	_, err = LoadLookup(filepath.Join(dir, "missing.yaml"))
+	assert.Error(t, err)
+}
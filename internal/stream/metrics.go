@@ -0,0 +1,39 @@
+package stream
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	pulsesReceived = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "pulses",
+		Subsystem: "stream",
+		Name:      "pulses_received_total",
+		Help:      "Pulses read from the source topic.",
+	})
+	decodeFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "pulses",
+		Subsystem: "stream",
+		Name:      "decode_failures_total",
+		Help:      "Messages of the source topic that are not valid pulses.",
+	})
+	groupedWrites = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "pulses",
+		Subsystem: "stream",
+		Name:      "grouped_writes_total",
+		Help:      "Pulses written to their tenant's grouped topic.",
+	})
+	quarantined = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "pulses",
+		Subsystem: "stream",
+		Name:      "quarantined_total",
+		Help:      "Pulses of SKUs missing from the catalog, written to the quarantine topic.",
+	})
+	sinkWriteErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "pulses",
+		Subsystem: "stream",
+		Name:      "sink_write_errors_total",
+		Help:      "Grouped pulses that could not be written.",
+	})
+)
@@ -6,45 +6,154 @@
 package stream
 
 import (
+	"context"
 	"encoding/json"
-	"fmt"
+	"errors"
+	"goriok/pulses/internal/broker"
+	"goriok/pulses/internal/logging"
 	"goriok/pulses/internal/models"
 	"goriok/pulses/internal/stream/aggregators"
 	"goriok/pulses/internal/stream/aggregators/engines"
+	"goriok/pulses/internal/stream/catalog"
+	"goriok/pulses/internal/stream/enrichers"
 	"goriok/pulses/internal/stream/sinks"
+	"goriok/pulses/internal/stream/topics"
+	"goriok/pulses/internal/tracing"
+	"maps"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
+const tracerName = "goriok/pulses/internal/stream"
+
+// DefaultQuarantineTopic receives the pulses of SKUs missing from the
+// catalog, when Options.QuarantineTopic is empty.
+const DefaultQuarantineTopic = "quarantine.pulses"
+
+// QuarantineReasonHeader tells why a pulse of the quarantine topic was
+// quarantined.
+const QuarantineReasonHeader = "pulses-quarantine-reason"
+
+var streamLog = logging.For("stream")
+
 type SourceConnector interface {
-	Read(topic string, handler func(topic string, message []byte)) error
+	Read(topic string, handler broker.Handler) error
 }
 
 type SinkConnector interface {
 	Connect(topic string) error
-	Write(topic string, message []byte) error
+	WriteMessage(msg broker.Message) error
 }
 
 type Options struct {
 	SourceTopic     string
 	SourceConnector SourceConnector
 	SinkConnector   SinkConnector
+	// Window is how often aggregates are flushed, engines.DefaultWindow if
+	// zero.
+	Window time.Duration
+	// Routes names the grouped and aggregated topics,
+	// topics.DefaultRoutes if nil.
+	Routes *topics.Routes
+	// DisableGrouped only writes aggregates, for consumers that do not need
+	// every pulse.
+	DisableGrouped bool
+	// GroupedEnrichers and AggregatedEnrichers add reference data to grouped
+	// pulses and aggregates, in order, before they are written.
+	GroupedEnrichers    []enrichers.Enricher
+	AggregatedEnrichers []enrichers.Enricher
+	// Catalog, if set, annotates grouped pulses and aggregates with the
+	// product family and canonical unit of their SKU. Pulses of SKUs it does
+	// not know are written as read to QuarantineTopic, or
+	// DefaultQuarantineTopic, instead of being grouped and aggregated.
+	Catalog         *catalog.Catalog
+	QuarantineTopic string
 }
 
-type Pipeline struct{}
+// Pipeline reads pulses from the source topic and writes them, grouped and
+// aggregated, to the sink. It records when it last read a message and when
+// its aggregator last flushed, for health checks.
+type Pipeline struct {
+	lastMessage atomic.Int64
+	aggregator  atomic.Pointer[engines.MemoryAggregator]
+	routes      atomic.Pointer[topics.Routes]
+	ready       chan struct{}
+	readyOnce   sync.Once
+}
 
 func NewPipeline() *Pipeline {
-	return &Pipeline{}
+	return &Pipeline{ready: make(chan struct{})}
+}
+
+// Ready returns a channel closed once the pipeline has started, as Start
+// goes on to read the source topic until it fails. SetWindow succeeds from
+// then on.
+func (p *Pipeline) Ready() <-chan struct{} {
+	return p.ready
+}
+
+// LastMessage returns when the pipeline last read a message from the source
+// topic, the zero time if it has not yet.
+func (p *Pipeline) LastMessage() time.Time {
+	if nanos := p.lastMessage.Load(); nanos != 0 {
+		return time.Unix(0, nanos)
+	}
+	return time.Time{}
+}
+
+// LastFlush returns when the aggregator last flushed successfully, the zero
+// time if the pipeline has not started.
+func (p *Pipeline) LastFlush() time.Time {
+	if aggregator := p.aggregator.Load(); aggregator != nil {
+		return aggregator.LastFlush()
+	}
+	return time.Time{}
+}
+
+// SetWindow changes the aggregation window from the next window on. It
+// fails if the pipeline has not started.
+func (p *Pipeline) SetWindow(window time.Duration) error {
+	aggregator := p.aggregator.Load()
+	if aggregator == nil {
+		return errors.New("stream: pipeline not started")
+	}
+	aggregator.SetWindow(window)
+	return nil
+}
+
+// SetRoutes changes the topics grouped pulses and aggregates are written
+// to, from the next ones on. Aggregates of the current window are written
+// to the new topics. Nil routes are ignored.
+func (p *Pipeline) SetRoutes(routes *topics.Routes) {
+	if routes != nil {
+		p.routes.Store(routes)
+	}
 }
 
 // Start launches the pipeline with the provided options.
-// It reads from the source topic, emits grouped events per tenant,
-// and applies a memory-based aggregation for each (tenant_id, product_sku) pair.
+// It reads from the source topic, emits grouped events per tenant unless
+// disabled, and applies a memory-based aggregation for each
+// (tenant_id, product_sku) pair.
 //
 // Grouped messages are enriched with object IDs and timestamps, and both
-// grouped and aggregated results are written to the appropriate sinks.
+// grouped and aggregated results with the reference data of their
+// enrichers. They are written to the topics named by the routes, keyed by
+// tenant.
+// Pulses read, decode failures and grouped writes are counted in the
+// pulses_stream_* Prometheus metrics.
+//
+// Each pulse is traced as a stream.process span, continuing the trace found
+// in its headers, with stream.decode, stream.group and stream.aggregate
+// child spans. Grouped pulses carry the trace context on, and the aggregates
+// link back to it.
 func (p *Pipeline) Start(opts *Options) error {
 	sourceConnector := opts.SourceConnector
 	sinkConnector := opts.SinkConnector
@@ -53,40 +162,158 @@ func (p *Pipeline) Start(opts *Options) error {
 
 	aggregatedSink := sinks.NewStreamSink(sinkConnector)
 
-	aggregator := engines.NewMemoryAggregator(
+	routes := opts.Routes
+	if routes == nil {
+		routes = topics.DefaultRoutes()
+	}
+	p.routes.Store(routes)
+
+	groupedEnrichers, aggregatedEnrichers := opts.GroupedEnrichers, opts.AggregatedEnrichers
+	quarantineTopic := opts.QuarantineTopic
+	if opts.Catalog != nil {
+		groupedEnrichers = append([]enrichers.Enricher{opts.Catalog.Enricher()}, groupedEnrichers...)
+		aggregatedEnrichers = append([]enrichers.Enricher{opts.Catalog.Enricher()}, aggregatedEnrichers...)
+		if quarantineTopic == "" {
+			quarantineTopic = DefaultQuarantineTopic
+		}
+	}
+
+	aggregator := engines.NewMemoryAggregatorWithOptions(
 		aggregators.TenantSKUKey,
 		aggregators.TenantSKUAmount,
-		aggregators.TenantSKUInfo,
+		aggregators.TenantSKUInfoTo(func(pulse *models.Pulse) (string, error) {
+			return p.routes.Load().Aggregated(pulse)
+		}, aggregatedEnrichers...),
 		aggregatedSink,
+		engines.MemoryAggregatorOptions{
+			Window:     opts.Window,
+			MessageKey: aggregators.TenantSKUTenant,
+		},
 	)
+	p.aggregator.Store(aggregator)
+	p.readyOnce.Do(func() { close(p.ready) })
+
+	return sourceConnector.Read(opts.SourceTopic, func(msg broker.Message) {
+		pulsesReceived.Inc()
+		p.lastMessage.Store(time.Now().UnixNano())
 
-	return sourceConnector.Read(opts.SourceTopic, func(topic string, message []byte) {
+		tracer := otel.Tracer(tracerName)
+		ctx, span := tracer.Start(tracing.Extract(context.Background(), msg.Headers), "stream.process",
+			trace.WithSpanKind(trace.SpanKindConsumer),
+			trace.WithAttributes(
+				attribute.String("messaging.source.name", msg.Topic),
+				attribute.Int64("messaging.message.offset", msg.Offset),
+			))
+		defer span.End()
+
+		_, decodeSpan := tracer.Start(ctx, "stream.decode")
 		var pulse models.Pulse
-		if err := json.Unmarshal(message, &pulse); err != nil {
-			logrus.Errorf("stream: failed to unmarshal: %v", err)
+		if err := json.Unmarshal(msg.Value, &pulse); err != nil {
+			decodeFailures.Inc()
+			streamLog.Sampledf(logrus.ErrorLevel, "stream: failed to unmarshal: %v", err)
+			decodeSpan.RecordError(err)
+			decodeSpan.SetStatus(codes.Error, "invalid pulse")
+			decodeSpan.End()
+			span.SetStatus(codes.Error, "invalid pulse")
 			return
 		}
+		decodeSpan.End()
+		span.SetAttributes(
+			attribute.String("pulses.tenant_id", pulse.TenantID),
+			attribute.String("pulses.product_sku", pulse.ProductSKU),
+		)
 
-		groupedTopic := fmt.Sprintf("tenants.%s.grouped.pulses", pulse.TenantID)
-
-		newMsg := map[string]any{
-			"object_id":   uuid.New().String(),
-			"tenant_id":   pulse.TenantID,
-			"product_sku": pulse.ProductSKU,
-			"use_unit":    pulse.UseUnity,
-			"used_amount": pulse.UsedAmmount,
-			"timestamp":   time.Now().Unix(),
+		if opts.Catalog != nil {
+			if _, ok := opts.Catalog.Lookup(pulse.ProductSKU); !ok {
+				span.SetAttributes(attribute.Bool("pulses.quarantined", true))
+				p.quarantine(ctx, tracer, groupedSink, msg, &pulse, quarantineTopic)
+				return
+			}
 		}
 
-		newMsgData, err := json.Marshal(newMsg)
-		if err != nil {
-			logrus.Errorf("stream: failed to marshal grouped pulse: %v", err)
+		if !opts.DisableGrouped {
+			p.group(ctx, tracer, groupedSink, &pulse, groupedEnrichers)
 		}
 
-		if err := groupedSink.Write(groupedTopic, newMsgData); err != nil {
-			logrus.Errorf("stream: failed to sink raw grouped pulse: %v", err)
-		}
+		aggregateCtx, aggregateSpan := tracer.Start(ctx, "stream.aggregate")
+		aggregator.AddContext(aggregateCtx, &pulse)
+		aggregateSpan.End()
+	})
+}
+
+// group writes the pulse, enriched by enrich, to its grouped topic, keyed by
+// the tenant and with the trace context of a stream.group span.
+func (p *Pipeline) group(ctx context.Context, tracer trace.Tracer, groupedSink *sinks.StreamSink, pulse *models.Pulse, enrich []enrichers.Enricher) {
+	groupedTopic, err := p.routes.Load().Grouped(pulse)
+	if err != nil {
+		sinkWriteErrors.Inc()
+		streamLog.Sampledf(logrus.ErrorLevel, "stream: failed to route grouped pulse: %v", err)
+		return
+	}
+
+	ctx, span := tracer.Start(ctx, "stream.group",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(attribute.String("messaging.destination.name", groupedTopic)))
+	defer span.End()
+
+	newMsg := map[string]any{
+		"object_id":   uuid.New().String(),
+		"tenant_id":   pulse.TenantID,
+		"product_sku": pulse.ProductSKU,
+		"use_unit":    pulse.UseUnity,
+		"used_amount": pulse.UsedAmmount,
+		"timestamp":   time.Now().Unix(),
+	}
+	enrichers.Apply(enrich, pulse, newMsg)
+
+	newMsgData, err := json.Marshal(newMsg)
+	if err != nil {
+		streamLog.Sampledf(logrus.ErrorLevel, "stream: failed to marshal grouped pulse: %v", err)
+	}
+
+	err = groupedSink.WriteMessage(broker.Message{
+		Topic:     groupedTopic,
+		Key:       []byte(pulse.TenantID),
+		Value:     newMsgData,
+		Headers:   tracing.Inject(ctx, nil),
+		Timestamp: time.Now(),
+	})
+	if err != nil {
+		sinkWriteErrors.Inc()
+		streamLog.Sampledf(logrus.ErrorLevel, "stream: failed to sink raw grouped pulse: %v", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to write grouped pulse")
+	} else {
+		groupedWrites.Inc()
+	}
+}
+
+// quarantine writes a message of the source topic, as read, to the
+// quarantine topic with the reason in its headers, keyed by the tenant of
+// its pulse and with the trace context of a stream.quarantine span.
+func (p *Pipeline) quarantine(ctx context.Context, tracer trace.Tracer, sink *sinks.StreamSink, msg broker.Message, pulse *models.Pulse, topic string) {
+	ctx, span := tracer.Start(ctx, "stream.quarantine",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(attribute.String("messaging.destination.name", topic)))
+	defer span.End()
+
+	headers := tracing.Inject(ctx, maps.Clone(msg.Headers))
+	headers[QuarantineReasonHeader] = "unknown sku"
 
-		aggregator.Add(&pulse)
+	err := sink.WriteMessage(broker.Message{
+		Topic:     topic,
+		Key:       []byte(pulse.TenantID),
+		Value:     msg.Value,
+		Headers:   headers,
+		Timestamp: time.Now(),
 	})
+	if err != nil {
+		sinkWriteErrors.Inc()
+		streamLog.Sampledf(logrus.ErrorLevel, "stream: failed to quarantine pulse: %v", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to quarantine pulse")
+		return
+	}
+	quarantined.Inc()
+	streamLog.Sampledf(logrus.WarnLevel, "stream: quarantined pulse of unknown SKU %q", pulse.ProductSKU)
 }
@@ -1,13 +1,27 @@
 package stream
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"goriok/pulses/internal/broker"
 	"goriok/pulses/internal/models"
+	"goriok/pulses/internal/stream/catalog"
+	"goriok/pulses/internal/stream/enrichers"
+	"goriok/pulses/internal/stream/topics"
+	"goriok/pulses/internal/tracing"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // --- Mocks ---
@@ -16,7 +30,7 @@ type MockSourceConnector struct {
 	mock.Mock
 }
 
-func (m *MockSourceConnector) Read(topic string, handler func(string, []byte)) error {
+func (m *MockSourceConnector) Read(topic string, handler broker.Handler) error {
 	args := m.Called(topic, handler)
 	if handler != nil {
 		// Simulate sending a message
@@ -27,13 +41,17 @@ func (m *MockSourceConnector) Read(topic string, handler func(string, []byte)) e
 			UsedAmmount: 42.0,
 		}
 		payload, _ := json.Marshal(pulse)
-		handler(topic, payload)
+		handler(broker.Message{Topic: topic, Value: payload})
 	}
 	return args.Error(0)
 }
 
+// MockSinkConnector expects WriteMessage calls with the topic and value of
+// each message, and keeps the messages written.
 type MockSinkConnector struct {
 	mock.Mock
+	mu      sync.Mutex
+	written []broker.Message
 }
 
 func (m *MockSinkConnector) Connect(topic string) error {
@@ -41,8 +59,12 @@ func (m *MockSinkConnector) Connect(topic string) error {
 	return args.Error(0)
 }
 
-func (m *MockSinkConnector) Write(topic string, message []byte) error {
-	args := m.Called(topic, message)
+func (m *MockSinkConnector) WriteMessage(msg broker.Message) error {
+	m.mu.Lock()
+	m.written = append(m.written, msg)
+	m.mu.Unlock()
+
+	args := m.Called(msg.Topic, msg.Value)
 	return args.Error(0)
 }
 
@@ -61,7 +83,7 @@ func TestPipeline_Start_Success(t *testing.T) {
 
 	expectedGroupedTopic := "tenants.tenant123.grouped.pulses"
 	sink.On("Connect", expectedGroupedTopic).Return(nil)
-	sink.On("Write", mock.MatchedBy(func(topic string) bool {
+	sink.On("WriteMessage", mock.MatchedBy(func(topic string) bool {
 		return topic == expectedGroupedTopic
 	}), mock.MatchedBy(func(data []byte) bool {
 		var out map[string]any
@@ -100,14 +122,329 @@ func TestPipeline_Start_MarshalError(t *testing.T) {
 	// but here we’ll simulate failure through sink returning an error instead
 
 	sink.On("Connect", mock.Anything).Return(nil)
-	sink.On("Write", mock.Anything, mock.Anything).Return(errors.New("sink error"))
+	sink.On("WriteMessage", mock.Anything, mock.Anything).Return(errors.New("sink error"))
 	source.On("Read", "pulses.incoming", mock.Anything).Return(nil).Run(func(args mock.Arguments) {
-		handler := args.Get(1).(func(string, []byte))
+		handler := args.Get(1).(broker.Handler)
 		p := models.Pulse{TenantID: "X", ProductSKU: "Y", UseUnity: "Z", UsedAmmount: 1}
 		raw, _ := json.Marshal(p)
-		handler("pulses.incoming", raw)
+		handler(broker.Message{Topic: "pulses.incoming", Value: raw})
 	})
 
 	err := pipeline.Start(opts)
 	assert.NoError(t, err)
 }
+
+func TestPipeline_Metrics(t *testing.T) {
+	source := new(MockSourceConnector)
+	sink := new(MockSinkConnector)
+
+	received := testutil.ToFloat64(pulsesReceived)
+	failures := testutil.ToFloat64(decodeFailures)
+	writes := testutil.ToFloat64(groupedWrites)
+	writeErrors := testutil.ToFloat64(sinkWriteErrors)
+
+	sink.On("Connect", mock.Anything).Return(nil)
+	sink.On("WriteMessage", "tenants.tenant123.grouped.pulses", mock.Anything).Return(nil)
+	sink.On("WriteMessage", "tenants.X.grouped.pulses", mock.Anything).Return(errors.New("sink error"))
+	source.On("Read", "pulses.incoming", mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+		handler := args.Get(1).(broker.Handler)
+		handler(broker.Message{Topic: "pulses.incoming", Value: []byte("not a pulse")})
+		raw, _ := json.Marshal(models.Pulse{TenantID: "X", ProductSKU: "Y", UseUnity: "Z", UsedAmmount: 1})
+		handler(broker.Message{Topic: "pulses.incoming", Value: raw})
+	})
+
+	err := NewPipeline().Start(&Options{
+		SourceTopic:     "pulses.incoming",
+		SourceConnector: source,
+		SinkConnector:   sink,
+	})
+	assert.NoError(t, err)
+
+	assert.Equal(t, received+3, testutil.ToFloat64(pulsesReceived))
+	assert.Equal(t, failures+1, testutil.ToFloat64(decodeFailures))
+	assert.Equal(t, writes+1, testutil.ToFloat64(groupedWrites))
+	assert.Equal(t, writeErrors+1, testutil.ToFloat64(sinkWriteErrors))
+}
+
+func TestPipeline_LastMessageAndFlush(t *testing.T) {
+	source := new(MockSourceConnector)
+	sink := new(MockSinkConnector)
+	pipeline := NewPipeline()
+	assert.True(t, pipeline.LastMessage().IsZero())
+	assert.True(t, pipeline.LastFlush().IsZero())
+
+	sink.On("Connect", mock.Anything).Return(nil)
+	sink.On("WriteMessage", mock.Anything, mock.Anything).Return(nil)
+	source.On("Read", "pulses.incoming", mock.Anything).Return(nil)
+
+	before := time.Now()
+	err := pipeline.Start(&Options{
+		SourceTopic:     "pulses.incoming",
+		SourceConnector: source,
+		SinkConnector:   sink,
+	})
+	assert.NoError(t, err)
+	assert.False(t, pipeline.LastMessage().Before(before))
+	assert.False(t, pipeline.LastFlush().Before(before), "a new aggregator counts as flushed")
+}
+
+func TestPipeline_SetWindow(t *testing.T) {
+	source := new(MockSourceConnector)
+	sink := new(MockSinkConnector)
+	pipeline := NewPipeline()
+	assert.Error(t, pipeline.SetWindow(time.Minute), "not started")
+	select {
+	case <-pipeline.Ready():
+		t.Fatal("ready before Start")
+	default:
+	}
+
+	sink.On("Connect", mock.Anything).Return(nil)
+	sink.On("WriteMessage", mock.Anything, mock.Anything).Return(nil)
+	source.On("Read", "pulses.incoming", mock.Anything).Return(nil).Run(func(mock.Arguments) {
+		// Read blocks for as long as the pipeline runs.
+		select {
+		case <-pipeline.Ready():
+		default:
+			t.Error("not ready while reading")
+		}
+		assert.NoError(t, pipeline.SetWindow(time.Minute))
+	})
+	assert.NoError(t, pipeline.Start(&Options{
+		SourceTopic:     "pulses.incoming",
+		SourceConnector: source,
+		SinkConnector:   sink,
+	}))
+	assert.NoError(t, pipeline.SetWindow(time.Minute))
+}
+
+func TestPipeline_Routes(t *testing.T) {
+	source := new(MockSourceConnector)
+	sink := new(MockSinkConnector)
+	pipeline := NewPipeline()
+
+	routes, err := topics.NewRoutes("{{.Region}}.tenants.{{.TenantID}}.usage", "pulses.aggregates", map[string]string{"Region": "eu"})
+	assert.NoError(t, err)
+
+	sink.On("Connect", mock.Anything).Return(nil)
+	sink.On("WriteMessage", mock.Anything, mock.Anything).Return(nil)
+	var handler broker.Handler
+	source.On("Read", "pulses.incoming", mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+		handler = args.Get(1).(broker.Handler)
+	})
+	assert.NoError(t, pipeline.Start(&Options{
+		SourceTopic:     "pulses.incoming",
+		SourceConnector: source,
+		SinkConnector:   sink,
+		Window:          20 * time.Millisecond,
+		Routes:          routes,
+	}))
+
+	written := func(topic string) *broker.Message {
+		sink.mu.Lock()
+		defer sink.mu.Unlock()
+		for _, msg := range sink.written {
+			if msg.Topic == topic {
+				return &msg
+			}
+		}
+		return nil
+	}
+	if grouped := written("eu.tenants.tenant123.usage"); assert.NotNil(t, grouped) {
+		assert.Equal(t, "tenant123", string(grouped.Key))
+	}
+	assert.Eventually(t, func() bool { return written("pulses.aggregates") != nil }, time.Second, 5*time.Millisecond)
+	assert.Equal(t, "tenant123", string(written("pulses.aggregates").Key), "aggregates of a shared topic are keyed by tenant")
+
+	shared, err := topics.NewRoutes("pulses.usage", "pulses.usage", nil)
+	assert.NoError(t, err)
+	pipeline.SetRoutes(shared)
+	raw, _ := json.Marshal(models.Pulse{TenantID: "tenant123", ProductSKU: "sku456", UseUnity: "unit789", UsedAmmount: 1})
+	handler(broker.Message{Topic: "pulses.incoming", Value: raw})
+	assert.NotNil(t, written("pulses.usage"), "grouped pulses go to the new topic at once")
+	assert.Eventually(t, func() bool {
+		sink.mu.Lock()
+		defer sink.mu.Unlock()
+		for _, msg := range sink.written {
+			if msg.Topic == "pulses.usage" && strings.Contains(string(msg.Value), "total_amount") {
+				return true
+			}
+		}
+		return false
+	}, time.Second, 5*time.Millisecond, "aggregates go to the new topic from the next flush on")
+}
+
+func TestPipeline_DisableGrouped(t *testing.T) {
+	source := new(MockSourceConnector)
+	sink := new(MockSinkConnector)
+
+	sink.On("Connect", mock.Anything).Return(nil)
+	sink.On("WriteMessage", "tenants.tenant123.aggregated.pulses.amount", mock.Anything).Return(nil)
+	source.On("Read", "pulses.incoming", mock.Anything).Return(nil)
+	writes := testutil.ToFloat64(groupedWrites)
+
+	assert.NoError(t, NewPipeline().Start(&Options{
+		SourceTopic:     "pulses.incoming",
+		SourceConnector: source,
+		SinkConnector:   sink,
+		Window:          20 * time.Millisecond,
+		DisableGrouped:  true,
+	}))
+
+	assert.Eventually(t, func() bool {
+		sink.mu.Lock()
+		defer sink.mu.Unlock()
+		return len(sink.written) > 0
+	}, time.Second, 5*time.Millisecond)
+	assert.Equal(t, writes, testutil.ToFloat64(groupedWrites))
+	sink.AssertNotCalled(t, "WriteMessage", "tenants.tenant123.grouped.pulses", mock.Anything)
+}
+
+func TestPipeline_Enrichers(t *testing.T) {
+	source := new(MockSourceConnector)
+	sink := new(MockSinkConnector)
+	aggregated := make(chan struct{})
+	tier := func(tier string) enrichers.Enricher {
+		return enrichers.Func(func(pulse *models.Pulse, payload map[string]any) {
+			payload["price_tier"] = tier
+		})
+	}
+
+	sink.On("Connect", mock.Anything).Return(nil)
+	sink.On("WriteMessage", "tenants.tenant123.grouped.pulses", mock.MatchedBy(func(data []byte) bool {
+		var out map[string]any
+		return json.Unmarshal(data, &out) == nil && out["price_tier"] == "grouped" && out["used_amount"] == 42.0
+	})).Return(nil)
+	sink.On("WriteMessage", "tenants.tenant123.aggregated.pulses.amount", mock.MatchedBy(func(data []byte) bool {
+		var out map[string]any
+		return json.Unmarshal(data, &out) == nil && out["price_tier"] == "aggregated" && out["total_amount"] == 42.0
+	})).Return(nil).Once().Run(func(mock.Arguments) { close(aggregated) })
+	source.On("Read", "pulses.incoming", mock.Anything).Return(nil)
+
+	assert.NoError(t, NewPipeline().Start(&Options{
+		SourceTopic:         "pulses.incoming",
+		SourceConnector:     source,
+		SinkConnector:       sink,
+		Window:              20 * time.Millisecond,
+		GroupedEnrichers:    []enrichers.Enricher{tier("grouped")},
+		AggregatedEnrichers: []enrichers.Enricher{tier("aggregated")},
+	}))
+
+	select {
+	case <-aggregated:
+	case <-time.After(time.Second):
+		t.Fatal("aggregate not written")
+	}
+	sink.AssertExpectations(t)
+}
+
+func TestPipeline_Catalog(t *testing.T) {
+	source := new(MockSourceConnector)
+	sink := new(MockSinkConnector)
+	aggregated := make(chan struct{})
+
+	sink.On("Connect", mock.Anything).Return(nil)
+	sink.On("WriteMessage", "tenants.tenant123.grouped.pulses", mock.MatchedBy(func(data []byte) bool {
+		var out map[string]any
+		return json.Unmarshal(data, &out) == nil && out["product_family"] == "compute" && out["canonical_unit"] == "hours"
+	})).Return(nil)
+	sink.On("WriteMessage", "tenants.tenant123.aggregated.pulses.amount", mock.MatchedBy(func(data []byte) bool {
+		var out map[string]any
+		return json.Unmarshal(data, &out) == nil && out["product_family"] == "compute" && out["total_amount"] == 42.0
+	})).Return(nil).Once().Run(func(mock.Arguments) { close(aggregated) })
+	sink.On("WriteMessage", "pulses.unknown", mock.Anything).Return(nil)
+
+	unknown, _ := json.Marshal(models.Pulse{TenantID: "tenant123", ProductSKU: "db-large", UseUnity: "hours", UsedAmmount: 7})
+	source.On("Read", "pulses.incoming", mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+		handler := args.Get(1).(broker.Handler)
+		handler(broker.Message{Topic: "pulses.incoming", Value: unknown, Headers: map[string]string{"origin": "test"}})
+	})
+	quarantinedBefore := testutil.ToFloat64(quarantined)
+
+	assert.NoError(t, NewPipeline().Start(&Options{
+		SourceTopic:     "pulses.incoming",
+		SourceConnector: source,
+		SinkConnector:   sink,
+		Window:          20 * time.Millisecond,
+		Catalog:         catalog.New(catalog.Entry{SKU: "sku456", Family: "compute", Unit: "hours"}),
+		QuarantineTopic: "pulses.unknown",
+	}))
+
+	select {
+	case <-aggregated:
+	case <-time.After(time.Second):
+		t.Fatal("aggregate not written")
+	}
+	sink.AssertExpectations(t)
+	assert.Equal(t, quarantinedBefore+1, testutil.ToFloat64(quarantined))
+
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	var quarantine *broker.Message
+	for _, msg := range sink.written {
+		if msg.Topic == "pulses.unknown" {
+			quarantine = &msg
+			continue
+		}
+		assert.NotContains(t, string(msg.Value), "db-large", "quarantined pulses are neither grouped nor aggregated")
+	}
+	if assert.NotNil(t, quarantine) {
+		assert.Equal(t, unknown, quarantine.Value, "quarantined as read")
+		assert.Equal(t, "tenant123", string(quarantine.Key))
+		assert.Equal(t, "unknown sku", quarantine.Headers[QuarantineReasonHeader])
+		assert.Equal(t, "test", quarantine.Headers["origin"])
+	}
+}
+
+func TestPipeline_Tracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	otel.SetTracerProvider(provider)
+	t.Cleanup(func() { provider.Shutdown(context.Background()) })
+
+	producerCtx, producer := provider.Tracer("test").Start(context.Background(), "produce")
+	producer.End()
+
+	source := new(MockSourceConnector)
+	sink := new(MockSinkConnector)
+	sink.On("Connect", mock.Anything).Return(nil)
+	sink.On("WriteMessage", mock.Anything, mock.Anything).Return(nil)
+	source.On("Read", "pulses.incoming", mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+		handler := args.Get(1).(broker.Handler)
+		raw, _ := json.Marshal(models.Pulse{TenantID: "X", ProductSKU: "Y", UseUnity: "Z", UsedAmmount: 1})
+		handler(broker.Message{Topic: "pulses.incoming", Value: raw, Headers: tracing.Inject(producerCtx, nil)})
+	})
+
+	err := NewPipeline().Start(&Options{
+		SourceTopic:     "pulses.incoming",
+		SourceConnector: source,
+		SinkConnector:   sink,
+	})
+	assert.NoError(t, err)
+
+	// Only the spans of the pulse sent with trace context belong to the
+	// producer's trace.
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range exporter.GetSpans().Snapshots() {
+		if span.SpanContext().TraceID() == producer.SpanContext().TraceID() {
+			spans[span.Name()] = span
+		}
+	}
+	process := spans["stream.process"]
+	if !assert.NotNil(t, process) {
+		return
+	}
+	assert.Equal(t, producer.SpanContext().SpanID(), process.Parent().SpanID())
+	for _, name := range []string{"stream.decode", "stream.group", "stream.aggregate"} {
+		if assert.Contains(t, spans, name) {
+			assert.Equal(t, process.SpanContext().SpanID(), spans[name].Parent().SpanID(), name)
+		}
+	}
+
+	grouped := sink.written[0]
+	assert.Equal(t, "tenants.X.grouped.pulses", grouped.Topic)
+	assert.Equal(t, "X", string(grouped.Key))
+	assert.False(t, grouped.Timestamp.IsZero())
+	propagated := trace.SpanContextFromContext(tracing.Extract(context.Background(), grouped.Headers))
+	assert.Equal(t, spans["stream.group"].SpanContext().SpanID(), propagated.SpanID())
+}
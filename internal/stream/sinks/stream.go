@@ -1,8 +1,10 @@
 package sinks
 
+import "goriok/pulses/internal/broker"
+
 type SinkConnector interface {
 	Connect(topic string) error
-	Write(topic string, message []byte) error
+	WriteMessage(msg broker.Message) error
 }
 
 type StreamSink struct {
@@ -14,9 +16,14 @@ func NewStreamSink(p SinkConnector) *StreamSink {
 }
 
 func (s *StreamSink) Write(topic string, data []byte) error {
-	err := s.SinkConnector.Connect(topic)
+	return s.WriteMessage(broker.Message{Topic: topic, Value: data})
+}
+
+// WriteMessage connects to the topic of msg and writes msg to it.
+func (s *StreamSink) WriteMessage(msg broker.Message) error {
+	err := s.SinkConnector.Connect(msg.Topic)
 	if err != nil {
 		return err
 	}
-	return s.SinkConnector.Write(topic, data)
+	return s.SinkConnector.WriteMessage(msg)
 }
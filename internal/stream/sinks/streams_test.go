@@ -2,6 +2,7 @@ package sinks
 
 import (
 	"errors"
+	"goriok/pulses/internal/broker"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -19,8 +20,8 @@ func (m *MockSinkConnector) Connect(topic string) error {
 	return args.Error(0)
 }
 
-func (m *MockSinkConnector) Write(topic string, message []byte) error {
-	args := m.Called(topic, message)
+func (m *MockSinkConnector) WriteMessage(msg broker.Message) error {
+	args := m.Called(msg)
 	return args.Error(0)
 }
 
@@ -34,7 +35,7 @@ func TestStreamSink_Write_Success(t *testing.T) {
 	data := []byte("hello world")
 
 	mockConnector.On("Connect", topic).Return(nil)
-	mockConnector.On("Write", topic, data).Return(nil)
+	mockConnector.On("WriteMessage", broker.Message{Topic: topic, Value: data}).Return(nil)
 
 	err := sink.Write(topic, data)
 
@@ -55,7 +56,7 @@ func TestStreamSink_Write_ConnectError(t *testing.T) {
 
 	assert.EqualError(t, err, "connection failed")
 	mockConnector.AssertCalled(t, "Connect", topic)
-	mockConnector.AssertNotCalled(t, "Write", mock.Anything, mock.Anything)
+	mockConnector.AssertNotCalled(t, "WriteMessage", mock.Anything)
 }
 
 func TestStreamSink_Write_WriteError(t *testing.T) {
@@ -66,10 +67,26 @@ func TestStreamSink_Write_WriteError(t *testing.T) {
 	data := []byte("test payload")
 
 	mockConnector.On("Connect", topic).Return(nil)
-	mockConnector.On("Write", topic, data).Return(errors.New("write failed"))
+	mockConnector.On("WriteMessage", broker.Message{Topic: topic, Value: data}).Return(errors.New("write failed"))
 
 	err := sink.Write(topic, data)
 
 	assert.EqualError(t, err, "write failed")
 	mockConnector.AssertExpectations(t)
 }
+
+func TestStreamSink_WriteMessage(t *testing.T) {
+	msg := broker.Message{
+		Topic:   "some.topic",
+		Key:     []byte("tenant-a"),
+		Value:   []byte("hello world"),
+		Headers: map[string]string{"traceparent": "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"},
+	}
+
+	mockConnector := new(MockSinkConnector)
+	mockConnector.On("Connect", "some.topic").Return(nil)
+	mockConnector.On("WriteMessage", msg).Return(nil)
+
+	assert.NoError(t, NewStreamSink(mockConnector).WriteMessage(msg))
+	mockConnector.AssertExpectations(t)
+}
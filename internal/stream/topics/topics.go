@@ -0,0 +1,129 @@
+// Package topics names the output topics of the pipeline from templates,
+// such as "{{.Region}}.tenants.{{.TenantID}}.usage".
+//
+// Templates use the text/template syntax. They refer to the fields of the
+// pulse being routed, TenantID, ProductSKU and UseUnit, and to labels set by
+// configuration, such as the Region of the deployment. Referring to anything
+// else is an error, so that typos do not route pulses to topics named
+// "<no value>".
+//
+// A template that refers to nothing, such as "pulses.usage", writes every
+// pulse to a single shared topic. Messages are keyed by tenant either way,
+// for consumers that partition by key.
+package topics
+
+import (
+	"errors"
+	"fmt"
+	"goriok/pulses/internal/models"
+	"maps"
+	"strings"
+	"text/template"
+)
+
+// Default templates, those of the topics the pipeline always wrote to.
+const (
+	DefaultGrouped    = "tenants.{{.TenantID}}.grouped.pulses"
+	DefaultAggregated = "tenants.{{.TenantID}}.aggregated.pulses.amount"
+)
+
+// Fields of a pulse that templates refer to. Labels may not use these names.
+var pulseFields = []string{"TenantID", "ProductSKU", "UseUnit"}
+
+// Template names a topic.
+type Template struct {
+	text string
+	tmpl *template.Template
+}
+
+// Parse parses a topic template.
+func Parse(text string) (*Template, error) {
+	if strings.TrimSpace(text) == "" {
+		return nil, errors.New("empty topic template")
+	}
+	tmpl, err := template.New("topic").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	return &Template{text: text, tmpl: tmpl}, nil
+}
+
+// String returns the text of the template.
+func (t *Template) String() string {
+	return t.text
+}
+
+// Execute returns the topic of a pulse.
+func (t *Template) Execute(pulse *models.Pulse, labels map[string]string) (string, error) {
+	fields := make(map[string]string, len(labels)+len(pulseFields))
+	maps.Copy(fields, labels)
+	fields["TenantID"] = pulse.TenantID
+	fields["ProductSKU"] = pulse.ProductSKU
+	fields["UseUnit"] = pulse.UseUnity
+
+	var topic strings.Builder
+	if err := t.tmpl.Execute(&topic, fields); err != nil {
+		return "", fmt.Errorf("topic template %q: %w", t.text, err)
+	}
+	if topic.Len() == 0 {
+		return "", fmt.Errorf("topic template %q: empty topic", t.text)
+	}
+	return topic.String(), nil
+}
+
+// Routes names the topics the pipeline writes grouped pulses and aggregates
+// to. Both may be the same topic.
+type Routes struct {
+	grouped    *Template
+	aggregated *Template
+	labels     map[string]string
+}
+
+// NewRoutes parses the templates of the grouped and aggregated topics. They
+// are checked against a sample pulse, so that templates referring to
+// unknown fields or labels are rejected up front.
+func NewRoutes(grouped, aggregated string, labels map[string]string) (*Routes, error) {
+	for _, field := range pulseFields {
+		if _, ok := labels[field]; ok {
+			return nil, fmt.Errorf("label %s shadows the pulse field of the same name", field)
+		}
+	}
+
+	r := &Routes{labels: maps.Clone(labels)}
+	var err error
+	if r.grouped, err = Parse(grouped); err != nil {
+		return nil, fmt.Errorf("grouped topic: %w", err)
+	}
+	if r.aggregated, err = Parse(aggregated); err != nil {
+		return nil, fmt.Errorf("aggregated topic: %w", err)
+	}
+
+	sample := &models.Pulse{TenantID: "tenant", ProductSKU: "sku", UseUnity: "unit"}
+	if _, err := r.Grouped(sample); err != nil {
+		return nil, fmt.Errorf("grouped topic: %w", err)
+	}
+	if _, err := r.Aggregated(sample); err != nil {
+		return nil, fmt.Errorf("aggregated topic: %w", err)
+	}
+	return r, nil
+}
+
+// DefaultRoutes returns the routes of the default templates, without labels.
+func DefaultRoutes() *Routes {
+	r, err := NewRoutes(DefaultGrouped, DefaultAggregated, nil)
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+// Grouped returns the topic of the grouped copy of a pulse.
+func (r *Routes) Grouped(pulse *models.Pulse) (string, error) {
+	return r.grouped.Execute(pulse, r.labels)
+}
+
+// Aggregated returns the topic of the aggregates of a pulse's tenant, SKU
+// and unit.
+func (r *Routes) Aggregated(pulse *models.Pulse) (string, error) {
+	return r.aggregated.Execute(pulse, r.labels)
+}
@@ -0,0 +1,77 @@
+package topics
+
+import (
+	"goriok/pulses/internal/models"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var pulse = &models.Pulse{TenantID: "acme", ProductSKU: "vm-small", UseUnity: "hours"}
+
+func TestDefaultRoutes(t *testing.T) {
+	routes := DefaultRoutes()
+
+	grouped, err := routes.Grouped(pulse)
+	assert.NoError(t, err)
+	assert.Equal(t, "tenants.acme.grouped.pulses", grouped)
+
+	aggregated, err := routes.Aggregated(pulse)
+	assert.NoError(t, err)
+	assert.Equal(t, "tenants.acme.aggregated.pulses.amount", aggregated)
+}
+
+func TestNewRoutes_Labels(t *testing.T) {
+	labels := map[string]string{"Region": "eu-west-1"}
+	routes, err := NewRoutes("{{.Region}}.tenants.{{.TenantID}}.usage", "{{.Region}}.{{.ProductSKU}}.{{.UseUnit}}", labels)
+	assert.NoError(t, err)
+
+	labels["Region"] = "us-east-1"
+	grouped, err := routes.Grouped(pulse)
+	assert.NoError(t, err)
+	assert.Equal(t, "eu-west-1.tenants.acme.usage", grouped, "labels are copied")
+
+	aggregated, err := routes.Aggregated(pulse)
+	assert.NoError(t, err)
+	assert.Equal(t, "eu-west-1.vm-small.hours", aggregated)
+}
+
+func TestNewRoutes_Shared(t *testing.T) {
+	routes, err := NewRoutes("pulses.usage", "pulses.usage", nil)
+	assert.NoError(t, err)
+
+	grouped, _ := routes.Grouped(pulse)
+	aggregated, _ := routes.Aggregated(pulse)
+	assert.Equal(t, "pulses.usage", grouped)
+	assert.Equal(t, "pulses.usage", aggregated)
+}
+
+func TestNewRoutes_Invalid(t *testing.T) {
+	tests := []struct {
+		name       string
+		grouped    string
+		aggregated string
+		labels     map[string]string
+		err        string
+	}{
+		{"empty", "", DefaultAggregated, nil, "grouped topic: empty topic template"},
+		{"syntax", DefaultGrouped, "tenants.{{.TenantID", nil, "aggregated topic: template: topic:1: unclosed action"},
+		{"unknown label", "{{.Region}}.pulses", DefaultAggregated, nil, `grouped topic: topic template "{{.Region}}.pulses"`},
+		{"empty topic", `{{if false}}x{{end}}`, DefaultAggregated, nil, "empty topic"},
+		{"shadowing label", DefaultGrouped, DefaultAggregated, map[string]string{"TenantID": "x"}, "label TenantID shadows the pulse field of the same name"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewRoutes(tt.grouped, tt.aggregated, tt.labels)
+			if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), tt.err)
+			}
+		})
+	}
+}
+
+func TestTemplate_String(t *testing.T) {
+	tmpl, err := Parse(DefaultGrouped)
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultGrouped, tmpl.String())
+}
@@ -0,0 +1,93 @@
+// Package tracing sets up OpenTelemetry tracing for the ingestor and carries
+// W3C trace context from message to message, in the headers of the broker.
+//
+// Spans are created from the global tracer provider, which is a no-op until
+// Setup installs an exporting one. Trace context is propagated either way, so
+// that traces started by producers survive an ingestor that does not export.
+package tracing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// propagator reads and writes the traceparent and tracestate headers.
+var propagator = propagation.TraceContext{}
+
+// Inject adds the trace context of ctx to headers, allocating them if nil,
+// and returns them. Headers are left untouched when ctx holds no span.
+func Inject(ctx context.Context, headers map[string]string) map[string]string {
+	if headers == nil {
+		headers = make(map[string]string)
+	}
+	propagator.Inject(ctx, propagation.MapCarrier(headers))
+	return headers
+}
+
+// Extract returns ctx with the trace context found in headers, if any, as
+// the remote parent of the next span.
+func Extract(ctx context.Context, headers map[string]string) context.Context {
+	return propagator.Extract(ctx, propagation.MapCarrier(headers))
+}
+
+// Config selects where spans are exported to.
+type Config struct {
+	// Endpoint is the host:port of an OTLP/HTTP collector. Tracing is
+	// disabled when empty.
+	Endpoint string `yaml:"endpoint"`
+	// Insecure exports over plain HTTP instead of HTTPS.
+	Insecure bool `yaml:"insecure"`
+	// ServiceName identifies the process in the exported spans.
+	ServiceName string `yaml:"service_name"`
+	// SampleRatio is the fraction of new traces that are recorded. Traces
+	// started upstream follow the sampling decision of their producer.
+	SampleRatio float64 `yaml:"sample_ratio"`
+}
+
+// DefaultConfig samples every trace and leaves tracing disabled.
+func DefaultConfig() Config {
+	return Config{ServiceName: "pulses-ingestor", SampleRatio: 1}
+}
+
+// Setup installs a global tracer provider exporting to cfg.Endpoint over
+// OTLP/HTTP, along with the W3C trace context propagator. The returned
+// function flushes pending spans and stops the exporter; it is a no-op when
+// tracing is disabled.
+func Setup(ctx context.Context, cfg Config) (func(context.Context) error, error) {
+	noop := func(context.Context) error { return nil }
+	if cfg.Endpoint == "" {
+		return noop, nil
+	}
+	if cfg.SampleRatio < 0 || cfg.SampleRatio > 1 {
+		return noop, fmt.Errorf("tracing: sample ratio %v is not between 0 and 1", cfg.SampleRatio)
+	}
+
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(cfg.Endpoint)}
+	if cfg.Insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		return noop, fmt.Errorf("tracing: failed to create exporter: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", cfg.ServiceName))),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagator)
+
+	return func(ctx context.Context) error {
+		return errors.Join(provider.ForceFlush(ctx), provider.Shutdown(ctx))
+	}, nil
+}
@@ -0,0 +1,52 @@
+package tracing
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestInjectExtract(t *testing.T) {
+	assert.Empty(t, Inject(context.Background(), nil), "no span, no headers")
+
+	provider := sdktrace.NewTracerProvider()
+	ctx, span := provider.Tracer("test").Start(context.Background(), "produce")
+	defer span.End()
+
+	headers := Inject(ctx, map[string]string{"content-type": "application/json"})
+	assert.Contains(t, headers, "traceparent")
+	assert.Equal(t, "application/json", headers["content-type"])
+
+	remote := trace.SpanContextFromContext(Extract(context.Background(), headers))
+	assert.True(t, remote.IsRemote())
+	assert.Equal(t, span.SpanContext().TraceID(), remote.TraceID())
+	assert.Equal(t, span.SpanContext().SpanID(), remote.SpanID())
+
+	assert.False(t, trace.SpanContextFromContext(Extract(context.Background(), nil)).IsValid())
+}
+
+func TestSetup(t *testing.T) {
+	before := otel.GetTracerProvider()
+
+	shutdown, err := Setup(context.Background(), DefaultConfig())
+	assert.NoError(t, err)
+	assert.NoError(t, shutdown(context.Background()))
+	assert.Equal(t, before, otel.GetTracerProvider(), "disabled without an endpoint")
+
+	cfg := DefaultConfig()
+	cfg.Endpoint = "localhost:4318"
+	cfg.SampleRatio = 2
+	_, err = Setup(context.Background(), cfg)
+	assert.Error(t, err)
+
+	cfg.SampleRatio = 0.5
+	cfg.Insecure = true
+	shutdown, err = Setup(context.Background(), cfg)
+	assert.NoError(t, err)
+	assert.IsType(t, &sdktrace.TracerProvider{}, otel.GetTracerProvider())
+	assert.NoError(t, shutdown(context.Background()), "nothing to export")
+}
@@ -3,10 +3,15 @@ package integration_test
 import (
 	"encoding/json"
 	"fmt"
+	"goriok/pulses/cmd/stubs"
 	"goriok/pulses/internal/app/ingestor"
+	"goriok/pulses/internal/broker"
 	"goriok/pulses/internal/broker/fsbroker"
+	"goriok/pulses/internal/broker/membroker"
 	"goriok/pulses/internal/models"
+	"goriok/pulses/internal/stream/catalog"
 	"os"
+	"path/filepath"
 	"sync"
 	"testing"
 	"time"
@@ -15,29 +20,38 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-const (
-	BROKER_PORT = 9999
-)
-
 var (
-	broker     *fsbroker.Broker
+	testBroker *fsbroker.Broker
 	brokerOnce sync.Once
-	brokerHost = fmt.Sprintf("localhost:%d", BROKER_PORT)
+	brokerHost string
+	dataDir    string
 )
 
+type sinkConnector interface {
+	Connect(topic string) error
+	Write(topic string, message []byte) error
+}
+
 func TestMain(m *testing.M) {
-	err := os.RemoveAll(".data")
+	dir, err := os.MkdirTemp("", "pulses-integration-")
 	if err != nil {
-		logrus.Fatalf("failed to clean .data folder: %v", err)
+		logrus.Fatalf("failed to create data dir: %v", err)
 		return
 	}
-	logrus.Infof(".data folder cleaned successfully")
+	dataDir = filepath.Join(dir, "data")
 
 	startBroker()
-	m.Run()
+	code := m.Run()
+
+	testBroker.Stop()
+	if err := stubs.CleanTopics(dir); err != nil {
+		logrus.Errorf("%v", err)
+	}
+	os.Exit(code)
 }
 
 func Test_integration_ingestor_grouping(t *testing.T) {
+	t.Parallel()
 	sinkChan := make(chan []byte, 3)
 	tenantID := uuid.New().String()
 	productSKU := uuid.New().String()
@@ -45,7 +59,8 @@ func Test_integration_ingestor_grouping(t *testing.T) {
 	sourceTopic := fmt.Sprintf("test.%s.source.pulses", uuid.New().String())
 
 	ingestor := ingestor.New(ingestor.Config{
-		BrokerPort:  BROKER_PORT,
+		BrokerHost:  brokerHost,
+		DataDir:     dataDir,
 		SourceTopic: sourceTopic,
 		EnableStubs: false,
 	})
@@ -54,16 +69,16 @@ func Test_integration_ingestor_grouping(t *testing.T) {
 
 	sinkTopic := fmt.Sprintf("tenants.%s.grouped.pulses", tenantID)
 	testSinkConnector := fsbroker.NewSourceConnector(brokerHost)
-	go testSinkConnector.Read(sinkTopic, func(topic string, message []byte) {
+	go testSinkConnector.Read(sinkTopic, broker.BytesHandler(func(topic string, message []byte) {
 		sinkChan <- message
-	})
+	}))
 
 	pulses := []*models.Pulse{
 		{TenantID: tenantID, ProductSKU: productSKU, UsedAmmount: 10.5, UseUnity: useUnit},
 		{TenantID: tenantID, ProductSKU: productSKU, UsedAmmount: 20.0, UseUnity: useUnit},
 		{TenantID: tenantID, ProductSKU: productSKU, UsedAmmount: 20.0, UseUnity: useUnit},
 	}
-	err := publish(sourceTopic, pulses)
+	err := publish(fsbroker.NewSinkConnector(brokerHost), sourceTopic, pulses)
 	if err != nil {
 		t.Fatalf("Test failed: Unable to publish message: %v", err)
 	}
@@ -85,6 +100,7 @@ func Test_integration_ingestor_grouping(t *testing.T) {
 }
 
 func Test_integration_ingestor_aggregation_output(t *testing.T) {
+	t.Parallel()
 	sinkChan := make(chan []byte, 1)
 	tenantID := uuid.New().String()
 	productSKU := uuid.New().String()
@@ -92,7 +108,8 @@ func Test_integration_ingestor_aggregation_output(t *testing.T) {
 	sourceTopic := fmt.Sprintf("test.%s.source.pulses", uuid.New().String())
 
 	ingestor := ingestor.New(ingestor.Config{
-		BrokerPort:  BROKER_PORT,
+		BrokerHost:  brokerHost,
+		DataDir:     dataDir,
 		SourceTopic: sourceTopic,
 		EnableStubs: false,
 	})
@@ -101,15 +118,15 @@ func Test_integration_ingestor_aggregation_output(t *testing.T) {
 
 	sinkTopic := fmt.Sprintf("tenants.%s.aggregated.pulses.amount", tenantID)
 	testOutboundConsumer := fsbroker.NewSourceConnector(brokerHost)
-	go testOutboundConsumer.Read(sinkTopic, func(topic string, message []byte) {
+	go testOutboundConsumer.Read(sinkTopic, broker.BytesHandler(func(topic string, message []byte) {
 		sinkChan <- message
-	})
+	}))
 
 	pulses := []*models.Pulse{
 		{TenantID: tenantID, ProductSKU: productSKU, UsedAmmount: 10.5, UseUnity: useUnit},
 		{TenantID: tenantID, ProductSKU: productSKU, UsedAmmount: 20.0, UseUnity: useUnit},
 	}
-	err := publish(sourceTopic, pulses)
+	err := publish(fsbroker.NewSinkConnector(brokerHost), sourceTopic, pulses)
 	if err != nil {
 		t.Fatalf("Test failed: Unable to publish message: %v", err)
 	}
@@ -134,21 +151,109 @@ func Test_integration_ingestor_aggregation_output(t *testing.T) {
 	}
 }
 
+func Test_integration_ingestor_without_catalog_topic(t *testing.T) {
+	t.Parallel()
+	quarantined := make(chan []byte, 1)
+	sourceTopic := fmt.Sprintf("test.%s.source.pulses", uuid.New().String())
+	quarantineTopic := fmt.Sprintf("test.%s.quarantine.pulses", uuid.New().String())
+
+	ingestor := ingestor.New(ingestor.Config{
+		BrokerHost:      brokerHost,
+		DataDir:         dataDir,
+		SourceTopic:     sourceTopic,
+		Catalog:         catalog.New(),
+		CatalogTopic:    fmt.Sprintf("test.%s.catalog.skus", uuid.New().String()),
+		QuarantineTopic: quarantineTopic,
+	})
+	defer ingestor.Stop()
+
+	started := make(chan error, 1)
+	go func() { started <- ingestor.Start() }()
+
+	select {
+	case <-ingestor.Ready():
+	case err := <-started:
+		t.Fatalf("Test failed: ingestor stopped before it was ready: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Test failed: ingestor not ready without a catalog topic")
+	}
+
+	testOutboundConsumer := fsbroker.NewSourceConnector(brokerHost)
+	go testOutboundConsumer.Read(quarantineTopic, broker.BytesHandler(func(topic string, message []byte) {
+		quarantined <- message
+	}))
+
+	// With an empty catalog, every SKU is unknown.
+	pulses := []*models.Pulse{{TenantID: uuid.New().String(), ProductSKU: uuid.New().String(), UsedAmmount: 1, UseUnity: "kWh"}}
+	if err := publish(fsbroker.NewSinkConnector(brokerHost), sourceTopic, pulses); err != nil {
+		t.Fatalf("Test failed: Unable to publish message: %v", err)
+	}
+
+	select {
+	case <-quarantined:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Test failed: Timeout waiting for the quarantined pulse")
+	}
+}
+
+func Test_integration_embedded_ingestor_grouping(t *testing.T) {
+	t.Parallel()
+	sinkChan := make(chan []byte, 2)
+	tenantID := uuid.New().String()
+	sourceTopic := fmt.Sprintf("test.%s.source.pulses", uuid.New().String())
+
+	embedded := membroker.NewBroker()
+	defer embedded.Close()
+
+	ingestor := ingestor.NewWithConnectors(ingestor.Config{
+		SourceTopic: sourceTopic,
+	}, embedded.NewSourceConnector(), embedded.NewSinkConnector())
+	defer ingestor.Stop()
+	go ingestor.Start()
+
+	sinkTopic := fmt.Sprintf("tenants.%s.grouped.pulses", tenantID)
+	consumer := embedded.NewSourceConnector()
+	defer consumer.Close()
+	go consumer.Read(sinkTopic, broker.BytesHandler(func(topic string, message []byte) {
+		sinkChan <- message
+	}))
+
+	pulses := []*models.Pulse{
+		{TenantID: tenantID, ProductSKU: "sku", UsedAmmount: 1, UseUnity: "kWh"},
+		{TenantID: tenantID, ProductSKU: "sku", UsedAmmount: 2, UseUnity: "kWh"},
+	}
+	if err := publish(embedded.NewSinkConnector(), sourceTopic, pulses); err != nil {
+		t.Fatalf("Test failed: Unable to publish message: %v", err)
+	}
+
+	for received := 0; received < len(pulses); received++ {
+		select {
+		case <-sinkChan:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Test failed: Timeout — only received %d messages", received)
+		}
+	}
+}
+
 func startBroker() {
 	brokerOnce.Do(func() {
-		broker = fsbroker.NewBroker(BROKER_PORT)
+		cfg := fsbroker.DefaultBrokerConfig()
+		cfg.ListenAddr = "localhost:0"
+		cfg.DataDir = dataDir
+		testBroker = fsbroker.NewBrokerWithConfig(cfg)
 		go func() {
-			err := broker.Start()
+			err := testBroker.Start()
 			if err != nil {
 				logrus.Fatalf("Failed to start broker: %v", err)
 			}
 		}()
-		time.Sleep(1 * time.Second)
+		<-testBroker.Ready()
+
+		brokerHost = testBroker.Host()
 	})
 }
 
-func publish(topic string, msgs []*models.Pulse) error {
-	sinkConnector := fsbroker.NewSinkConnector(brokerHost)
+func publish(sinkConnector sinkConnector, topic string, msgs []*models.Pulse) error {
 	err := sinkConnector.Connect(topic)
 	if err != nil {
 		return err